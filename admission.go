@@ -0,0 +1,152 @@
+package sharedhttpcache
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//MetricCacheNotAdmitted is counted every time a cacheable response is not stored because the AdmissionPolicy refused it
+const MetricCacheNotAdmitted = "cache.not_admitted"
+
+//An AdmissionPolicy decides if a cacheable response is stored. It is consulted after all other checks passed, just before storing.
+// A policy can for example only admit responses which have been requested before, so responses which are requested once
+// don't push responses which are requested often out of a small cache layer
+type AdmissionPolicy interface {
+
+	//Admit is called with the full cache key of every response which would be stored, if false is returned the response
+	// is served without being stored. It is called concurrently by multiple goroutines
+	Admit(cacheKey string, response *http.Response) bool
+}
+
+//The AdmissionPolicyFunc type is an adapter to allow the use of ordinary functions as AdmissionPolicy
+type AdmissionPolicyFunc func(cacheKey string, response *http.Response) bool
+
+//Admit calls the underlying function to decide if the response is stored
+func (policy AdmissionPolicyFunc) Admit(cacheKey string, response *http.Response) bool {
+	return policy(cacheKey, response)
+}
+
+const (
+	//DefaultBloomAdmissionKeys is the amount of keys a BloomAdmission remembers per window if Keys is zero
+	DefaultBloomAdmissionKeys = 100000
+
+	//DefaultBloomAdmissionWindow is the duration of a window of a BloomAdmission if Window is zero
+	DefaultBloomAdmissionWindow = time.Hour
+)
+
+//bloomBitsPerKey and bloomHashes give a false positive rate of about 1% when a filter contains the expected amount of keys
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+//The BloomAdmission is a AdmissionPolicy which only admits responses of which the cache key was seen before,
+// so responses which are only requested once don't pollute the cache. It remembers keys in two bloom filters,
+// the current and the previous window. Once the window passes or the current filter holds Keys keys the filters rotate,
+// so a key is remembered for at least one and at most two windows. A small fraction of keys is admitted on first sight
+// because of false positives of the filters
+type BloomAdmission struct {
+	//Keys is the amount of keys a filter is sized for, if zero DefaultBloomAdmissionKeys is used
+	Keys int
+
+	//Window is the time after which the filters rotate, if zero DefaultBloomAdmissionWindow is used
+	Window time.Duration
+
+	current  *bloomFilter
+	previous *bloomFilter
+	rotated  time.Time
+	mutex    sync.Mutex
+}
+
+//NewBloomAdmission creates a BloomAdmission which remembers the given amount of keys per window
+func NewBloomAdmission(keys int, window time.Duration) *BloomAdmission {
+	return &BloomAdmission{
+		Keys:   keys,
+		Window: window,
+	}
+}
+
+//Admit admits the response if the cache key was seen in the current or previous window, the key is remembered either way
+func (admission *BloomAdmission) Admit(cacheKey string, response *http.Response) bool {
+	admission.mutex.Lock()
+	defer admission.mutex.Unlock()
+
+	keys := admission.Keys
+	if keys <= 0 {
+		keys = DefaultBloomAdmissionKeys
+	}
+
+	window := admission.Window
+	if window <= 0 {
+		window = DefaultBloomAdmissionWindow
+	}
+
+	if admission.current == nil {
+		admission.current = newBloomFilter(keys)
+		admission.rotated = time.Now()
+	}
+
+	//The previous window is dropped and the current window becomes the previous one
+	if time.Since(admission.rotated) >= window || admission.current.count >= keys {
+		admission.previous = admission.current
+		admission.current = newBloomFilter(keys)
+		admission.rotated = time.Now()
+	}
+
+	seen := admission.current.contains(cacheKey) || (admission.previous != nil && admission.previous.contains(cacheKey))
+	if !admission.current.contains(cacheKey) {
+		admission.current.add(cacheKey)
+	}
+
+	return seen
+}
+
+//bloomFilter is a fixed size bloom filter of strings
+type bloomFilter struct {
+	bits []uint64
+
+	//count is the amount of keys which were added
+	count int
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	return &bloomFilter{
+		bits: make([]uint64, (keys*bloomBitsPerKey+63)/64),
+	}
+}
+
+//positions calls fn with the bit positions of the key, they are derived from two halves of a 64 bit FNV-1a hash
+// using double hashing, which is as good as independent hash functions for a bloom filter
+func (filter *bloomFilter) positions(key string, fn func(position uint64)) {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key))
+	sum := hash.Sum64()
+
+	first := sum & 0xffffffff
+	second := sum >> 32
+
+	size := uint64(len(filter.bits) * 64)
+	for i := uint64(0); i < bloomHashes; i++ {
+		fn((first + i*second) % size)
+	}
+}
+
+func (filter *bloomFilter) add(key string) {
+	filter.positions(key, func(position uint64) {
+		filter.bits[position/64] |= 1 << (position % 64)
+	})
+	filter.count++
+}
+
+func (filter *bloomFilter) contains(key string) bool {
+	found := true
+	filter.positions(key, func(position uint64) {
+		if filter.bits[position/64]&(1<<(position%64)) == 0 {
+			found = false
+		}
+	})
+
+	return found
+}
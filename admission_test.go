@@ -0,0 +1,80 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdmissionPolicy(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	//Only admit responses which would be stored for the second time
+	seen := map[string]bool{}
+	seenMutex := sync.Mutex{}
+	controller.DefaultCacheConfig.AdmissionPolicy = AdmissionPolicyFunc(func(cacheKey string, response *http.Response) bool {
+		seenMutex.Lock()
+		defer seenMutex.Unlock()
+
+		admit := seen[cacheKey]
+		seen[cacheKey] = true
+		return admit
+	})
+
+	for i := 0; i < 4; i++ {
+		_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if body != "content" {
+			t.Fatalf("expected body: content, got: %s", body)
+		}
+	}
+
+	if originRequests != 2 {
+		t.Errorf("expected the response to be stored after the second request, got %d origin requests", originRequests)
+	}
+}
+
+func TestBloomAdmission(t *testing.T) {
+	admission := NewBloomAdmission(1000, time.Hour)
+
+	if admission.Admit("a", nil) {
+		t.Error("expected a key which wasn't seen before not to be admitted")
+	}
+
+	if !admission.Admit("a", nil) {
+		t.Error("expected a key which was seen before to be admitted")
+	}
+
+	//After one rotation the key is still known from the previous window, after two it is forgotten
+	admission.rotated = admission.rotated.Add(-time.Hour)
+	admission.Admit("b", nil)
+	if !admission.previous.contains("a") {
+		t.Error("expected the key to be remembered in the previous window")
+	}
+
+	admission.rotated = admission.rotated.Add(-time.Hour)
+	admission.Admit("c", nil)
+	if admission.Admit("a", nil) {
+		t.Error("expected the key to be forgotten after two windows")
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if admission.Admit("unique-"+strconv.Itoa(i), nil) {
+			falsePositives++
+		}
+	}
+
+	if falsePositives > 50 {
+		t.Errorf("expected few false positives, got %d of 1000", falsePositives)
+	}
+}
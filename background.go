@@ -0,0 +1,143 @@
+package sharedhttpcache
+
+import (
+	"sync"
+)
+
+//Priorities of background tasks, when the queue is full tasks with the lowest priority are dropped first
+const (
+	//BackgroundPriorityLayerWrite is the priority of copying a entry to a slower layer
+	// dropping it only means the entry has to be fetched from the origin once it is evicted from the faster layers
+	BackgroundPriorityLayerWrite = 10
+
+	//BackgroundPriorityRevalidation is the priority of revalidating a stale entry in the background
+	// dropping it means a client may receive a stale response for longer
+	BackgroundPriorityRevalidation = 20
+)
+
+const (
+	//DefaultBackgroundWorkers is the amount of background workers used if BackgroundWorkers is zero
+	DefaultBackgroundWorkers = 8
+
+	//DefaultBackgroundQueueSize is the queue size used if BackgroundQueueSize is zero
+	DefaultBackgroundQueueSize = 1024
+)
+
+//MetricBackgroundDropped is counted every time a background task is dropped because the queue is full
+const MetricBackgroundDropped = "background.dropped"
+
+type backgroundTask struct {
+	priority int
+	run      func()
+}
+
+//backgroundPool runs tasks with a bounded amount of goroutines and a bounded queue
+// Workers are only started when there are tasks, so a idle pool has no goroutines
+type backgroundPool struct {
+	maxWorkers   int
+	maxQueueSize int
+
+	//onDrop is called with the priority of every task which is dropped
+	onDrop func(priority int)
+
+	lock    sync.Mutex
+	queue   []backgroundTask
+	workers int
+}
+
+func newBackgroundPool(maxWorkers, maxQueueSize int, onDrop func(priority int)) *backgroundPool {
+	if maxWorkers <= 0 {
+		maxWorkers = DefaultBackgroundWorkers
+	}
+
+	if maxQueueSize <= 0 {
+		maxQueueSize = DefaultBackgroundQueueSize
+	}
+
+	return &backgroundPool{
+		maxWorkers:   maxWorkers,
+		maxQueueSize: maxQueueSize,
+		onDrop:       onDrop,
+	}
+}
+
+//submit queues a task. If the queue is full the task with the lowest priority is dropped,
+// which is the submitted task itself if no queued task has a lower priority.
+// It returns false if the submitted task was dropped
+func (pool *backgroundPool) submit(priority int, run func()) bool {
+	pool.lock.Lock()
+
+	if len(pool.queue) >= pool.maxQueueSize {
+		lowest := 0
+		for i, task := range pool.queue {
+			if task.priority < pool.queue[lowest].priority {
+				lowest = i
+			}
+		}
+
+		if pool.queue[lowest].priority >= priority {
+			pool.lock.Unlock()
+			pool.drop(priority)
+			return false
+		}
+
+		droppedPriority := pool.queue[lowest].priority
+		pool.queue = append(pool.queue[:lowest], pool.queue[lowest+1:]...)
+		defer pool.drop(droppedPriority)
+	}
+
+	pool.queue = append(pool.queue, backgroundTask{priority: priority, run: run})
+
+	if pool.workers < pool.maxWorkers {
+		pool.workers++
+		go pool.work()
+	}
+
+	pool.lock.Unlock()
+
+	return true
+}
+
+func (pool *backgroundPool) drop(priority int) {
+	if pool.onDrop != nil {
+		pool.onDrop(priority)
+	}
+}
+
+//work runs tasks, highest priority first, until the queue is empty
+func (pool *backgroundPool) work() {
+	for {
+		pool.lock.Lock()
+
+		if len(pool.queue) == 0 {
+			pool.workers--
+			pool.lock.Unlock()
+			return
+		}
+
+		highest := 0
+		for i, task := range pool.queue {
+			if task.priority > pool.queue[highest].priority {
+				highest = i
+			}
+		}
+
+		task := pool.queue[highest]
+		pool.queue = append(pool.queue[:highest], pool.queue[highest+1:]...)
+
+		pool.lock.Unlock()
+
+		task.run()
+	}
+}
+
+//getBackgroundPool returns the background pool of the controller, it is created on first use
+func (controller *CacheController) getBackgroundPool() *backgroundPool {
+	controller.backgroundPoolOnce.Do(func() {
+		controller.backgroundPool = newBackgroundPool(controller.BackgroundWorkers, controller.BackgroundQueueSize, func(priority int) {
+			controller.incrMetric(MetricBackgroundDropped, 1, nil)
+		})
+	})
+
+	return controller.backgroundPool
+}
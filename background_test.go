@@ -0,0 +1,138 @@
+package sharedhttpcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dylandreimerink/sharedhttpcache/layer"
+)
+
+func TestBackgroundPoolDropsLowestPriority(t *testing.T) {
+	dropped := []int{}
+	pool := newBackgroundPool(1, 2, func(priority int) {
+		dropped = append(dropped, priority)
+	})
+
+	//Block the only worker so tasks stay in the queue
+	block := make(chan struct{})
+	started := make(chan struct{})
+	pool.submit(BackgroundPriorityRevalidation, func() {
+		close(started)
+		<-block
+	})
+	<-started
+
+	ran := make(chan int, 3)
+	task := func(priority int) func() {
+		return func() { ran <- priority }
+	}
+
+	pool.submit(BackgroundPriorityLayerWrite, task(BackgroundPriorityLayerWrite))
+	pool.submit(BackgroundPriorityRevalidation, task(BackgroundPriorityRevalidation))
+
+	//The queue is full, a layer write has no higher priority than any queued task so it is dropped
+	if pool.submit(BackgroundPriorityLayerWrite, task(BackgroundPriorityLayerWrite)) {
+		t.Error("expected low priority task to be dropped when the queue is full")
+	}
+
+	//A revalidation replaces the queued layer write
+	if !pool.submit(BackgroundPriorityRevalidation, task(BackgroundPriorityRevalidation)) {
+		t.Error("expected high priority task to replace a lower priority task")
+	}
+
+	close(block)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case priority := <-ran:
+			if priority != BackgroundPriorityRevalidation {
+				t.Errorf("expected only revalidations to run, got priority %d", priority)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for queued tasks")
+		}
+	}
+
+	if len(dropped) != 2 || dropped[0] != BackgroundPriorityLayerWrite || dropped[1] != BackgroundPriorityLayerWrite {
+		t.Errorf("expected two dropped layer writes, got: %v", dropped)
+	}
+}
+
+func TestBackgroundPoolBoundsWorkers(t *testing.T) {
+	pool := newBackgroundPool(3, 100, nil)
+
+	lock := sync.Mutex{}
+	running, maxRunning := 0, 0
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		pool.submit(BackgroundPriorityLayerWrite, func() {
+			defer wg.Done()
+
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			lock.Lock()
+			running--
+			lock.Unlock()
+		})
+	}
+
+	wg.Wait()
+
+	if maxRunning > 3 {
+		t.Errorf("expected at most 3 concurrent tasks, got %d", maxRunning)
+	}
+}
+
+func TestAsynchronousLayerWrites(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	slowLayer := layer.NewInMemoryCacheLayer(1024 * 1024)
+	controller.Layers = append(controller.Layers, slowLayer)
+	controller.AsynchronousLayerWrites = true
+
+	_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if body != "content" {
+		t.Fatalf("expected body 'content', got: %s", body)
+	}
+
+	bodyKey := bodyCacheKeyPrefix + "GET" + "http://" + host + "/"
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		entry, _, err := slowLayer.Get(bodyKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if entry != nil {
+			stored, _ := ioutil.ReadAll(entry)
+			if string(stored) != "content" {
+				t.Errorf("expected body to be copied to the second layer, got: %s", stored)
+			}
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("entry was never copied to the second layer")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,213 @@
+package sharedhttpcache
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//MetricResponseThrottled is observed for every response which was slowed down by ResponseRateLimit or ClientRateLimit,
+// with the total time the response waited for bandwidth
+const MetricResponseThrottled = "response.throttled"
+
+//maxShapedWrite is the maximum amount of bytes written at once by a rate limited response, so large writes are spread evenly
+const maxShapedWrite = 16 * 1024
+
+//clientBucketSweepInterval is the minimum time between removals of the buckets of idle clients
+const clientBucketSweepInterval = time.Minute
+
+//tokenBucket allows rate bytes per second with bursts of at most burst bytes
+type tokenBucket struct {
+	mutex sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	//users is the amount of responses which use the bucket of a client.
+	// The bucket is kept when it drops to zero, so a client can't reset its bucket by sending requests one after another
+	users int
+}
+
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+//full checks if the bucket has refilled to its burst, it then allows the same as a new bucket
+func (bucket *tokenBucket) full(now time.Time) bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	return bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate >= bucket.burst
+}
+
+//take reserves n bytes and returns how long the caller must wait before sending them
+func (bucket *tokenBucket) take(n int) time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	now := time.Now()
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+
+	//The tokens can become negative, the following responses then wait until the debt is paid
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+//shapedResponseWriter writes the body at the rate allowed by all of its buckets
+type shapedResponseWriter struct {
+	http.ResponseWriter
+
+	req     *http.Request
+	buckets []*tokenBucket
+
+	throttled time.Duration
+}
+
+func (writer *shapedResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > maxShapedWrite {
+			chunk = chunk[:maxShapedWrite]
+		}
+
+		wait := time.Duration(0)
+		for _, bucket := range writer.buckets {
+			if bucketWait := bucket.take(len(chunk)); bucketWait > wait {
+				wait = bucketWait
+			}
+		}
+
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+
+			select {
+			case <-timer.C:
+			case <-writer.req.Context().Done():
+				timer.Stop()
+				return written, writer.req.Context().Err()
+			}
+
+			writer.throttled += wait
+		}
+
+		n, err := writer.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+func (writer *shapedResponseWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//shapeResponseWriter limits the rate at which the response is sent to ResponseRateLimit and the rate of all responses
+// to the client to ClientRateLimit, so a few clients downloading large files can't use all bandwidth of the cache.
+// The returned function must be called once the response is written
+func (controller *CacheController) shapeResponseWriter(cacheConfig *CacheConfig, resp http.ResponseWriter, req *http.Request) (http.ResponseWriter, func()) {
+	if cacheConfig.ResponseRateLimit <= 0 && cacheConfig.ClientRateLimit <= 0 {
+		return resp, func() {}
+	}
+
+	writer := &shapedResponseWriter{ResponseWriter: resp, req: req}
+
+	if cacheConfig.ResponseRateLimit > 0 {
+		writer.buckets = append(writer.buckets, newTokenBucket(cacheConfig.ResponseRateLimit, cacheConfig.RateLimitBurst))
+	}
+
+	client := ""
+	if cacheConfig.ClientRateLimit > 0 {
+		client = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			client = host
+		}
+
+		writer.buckets = append(writer.buckets, controller.acquireClientBucket(client, cacheConfig))
+	}
+
+	return writer, func() {
+		if client != "" {
+			controller.releaseClientBucket(client)
+		}
+
+		if writer.throttled > 0 && controller.Metrics != nil {
+			controller.Metrics.ObserveDuration(MetricResponseThrottled, writer.throttled, nil)
+		}
+	}
+}
+
+//acquireClientBucket returns the bucket shared by all responses to the client
+func (controller *CacheController) acquireClientBucket(client string, cacheConfig *CacheConfig) *tokenBucket {
+	controller.clientBucketsMutex.Lock()
+	defer controller.clientBucketsMutex.Unlock()
+
+	if controller.clientBuckets == nil {
+		controller.clientBuckets = make(map[string]*tokenBucket)
+	}
+
+	now := time.Now()
+	if now.Sub(controller.clientBucketsSwept) >= clientBucketSweepInterval {
+		controller.clientBucketsSwept = now
+		controller.sweepClientBuckets(now)
+	}
+
+	bucket := controller.clientBuckets[client]
+	if bucket == nil {
+		bucket = newTokenBucket(cacheConfig.ClientRateLimit, cacheConfig.RateLimitBurst)
+		controller.clientBuckets[client] = bucket
+	}
+
+	bucket.users++
+
+	return bucket
+}
+
+//releaseClientBucket marks that a response no longer uses the bucket of the client.
+// The bucket is kept until it is idle and refilled, see sweepClientBuckets
+func (controller *CacheController) releaseClientBucket(client string) {
+	controller.clientBucketsMutex.Lock()
+	defer controller.clientBucketsMutex.Unlock()
+
+	if bucket := controller.clientBuckets[client]; bucket != nil {
+		bucket.users--
+	}
+}
+
+//sweepClientBuckets removes the buckets which no response uses and which are refilled, so idle clients use no memory.
+// A refilled bucket is the same as a new bucket, so removing it doesn't change the rate of the client.
+// The clientBucketsMutex must be held
+func (controller *CacheController) sweepClientBuckets(now time.Time) {
+	for client, bucket := range controller.clientBuckets {
+		if bucket.users <= 0 && bucket.full(now) {
+			delete(controller.clientBuckets, client)
+		}
+	}
+}
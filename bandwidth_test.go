@@ -0,0 +1,97 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseRateLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 16*1024)
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write(content)
+	}))
+	defer closeOrigin()
+
+	sink := newRecordingSink()
+	controller.Metrics = sink
+
+	controller.DefaultCacheConfig.ResponseRateLimit = 64 * 1024
+	controller.DefaultCacheConfig.ClientRateLimit = 1024 * 1024
+	controller.DefaultCacheConfig.RateLimitBurst = 1024
+
+	start := time.Now()
+	_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/file.css", nil))
+	elapsed := time.Since(start)
+
+	if body != string(content) {
+		t.Fatal("expected the complete body")
+	}
+
+	//15KB above the burst at 64KB per second takes about 234ms
+	if elapsed < 200*time.Millisecond {
+		t.Errorf("expected the response to be throttled, it took %s", elapsed)
+	}
+
+	if sink.timings[MetricResponseThrottled] != 1 {
+		t.Errorf("expected 1 throttled response, got: %d", sink.timings[MetricResponseThrottled])
+	}
+
+	if len(controller.clientBuckets) != 1 {
+		t.Errorf("expected the bucket of the client to be kept, got %d buckets", len(controller.clientBuckets))
+	}
+}
+
+func TestClientBucketKeptBetweenRequests(t *testing.T) {
+	controller := &CacheController{}
+	config := NewCacheConfig()
+	config.ClientRateLimit = 1000
+
+	//Sequential requests of a client use the same bucket, so the client can't get a new burst with every request
+	first := controller.acquireClientBucket("192.0.2.1", config)
+	first.take(1000)
+	controller.releaseClientBucket("192.0.2.1")
+
+	second := controller.acquireClientBucket("192.0.2.1", config)
+	if second != first {
+		t.Fatal("expected the bucket to be kept after the response")
+	}
+
+	if wait := second.take(500); wait < 400*time.Millisecond {
+		t.Errorf("expected the next request to wait for the used burst, got %s", wait)
+	}
+	controller.releaseClientBucket("192.0.2.1")
+
+	//A idle client of which the bucket refilled is removed by the next sweep, a client with a response in progress is kept
+	busy := controller.acquireClientBucket("192.0.2.2", config)
+	busy.last = time.Now().Add(-time.Hour)
+	second.last = time.Now().Add(-time.Hour)
+
+	controller.clientBucketsSwept = time.Now().Add(-clientBucketSweepInterval)
+	controller.acquireClientBucket("192.0.2.3", config)
+
+	if _, found := controller.clientBuckets["192.0.2.1"]; found {
+		t.Error("expected the bucket of the idle client to be removed")
+	}
+
+	if _, found := controller.clientBuckets["192.0.2.2"]; !found {
+		t.Error("expected the bucket of the busy client to be kept")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(1000, 0)
+
+	if wait := bucket.take(1000); wait != 0 {
+		t.Errorf("expected the burst to be sent without waiting, got %s", wait)
+	}
+
+	//The burst is used, so 500 bytes take half a second
+	if wait := bucket.take(500); wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("expected to wait about 500ms, got %s", wait)
+	}
+}
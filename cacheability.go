@@ -2,8 +2,6 @@ package sharedhttpcache
 
 import (
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -22,140 +20,141 @@ const (
 	MaxAgeDirective          = "max-age"
 	PublicDirective          = "public"
 	PrivateDirective         = "private"
+
+	//Extensions which allow stale responses to be served, RFC 5861
+	StaleWhileRevalidateDirective = "stale-while-revalidate"
+	StaleIfErrorDirective         = "stale-if-error"
 )
 
 //shouldStoreResponse determines based on the cache config if this request should be stored
 // It determines this based on section 3 of RFC7234
-//
-// TODO restructure this function so common reasons for no storing a response are checked first
-//	this can improve performance a lot
 func shouldStoreResponse(config *CacheConfig, resp *http.Response) bool {
+	return evaluateStoreRules(config, resp, nil)
+}
+
+//evaluateStoreRules implements shouldStoreResponse, every evaluated rule is recorded in the decision if it isn't nil
+//
+// The checks are ordered so the cheapest checks and the most common reasons for not storing a response come first.
+// Headers are read without canonicalizing their names and every Cache-Control header is parsed at most once
+func evaluateStoreRules(config *CacheConfig, resp *http.Response, decision *Decision) bool {
 	req := resp.Request
 
-	//If the request method is unsafe the response should not be cached
-	if !isMethodSafe(config, req.Method) {
+	//Interim 1xx responses are forwarded to the client while the final response is awaited, they are never stored
+	if !decision.record(RuleInformational, resp.StatusCode >= 200, "interim responses are never stored") {
 		return false
 	}
 
-	//If the request method is marked as not cacheable the response should not be cached
-	if !isMethodCacheable(config, req.Method) {
+	//Preflight responses are stored according to their own rules
+	if isCacheablePreflight(config, req) {
+		return evaluatePreflightRules(config, resp, decision)
+	}
+
+	//A 304 answers the preconditions of a single client, it doesn't contain the representation so it can't be stored
+	if !decision.record(RuleNotModified, resp.StatusCode != http.StatusNotModified, "a 304 response doesn't contain the representation") {
 		return false
 	}
 
 	//If the response is partial and the configuration doesn't permit partial responses don't cache
-	if resp.StatusCode == http.StatusPartialContent && !config.CacheIncompleteResponses {
+	if !decision.record(RulePartialContent, resp.StatusCode != http.StatusPartialContent || config.CacheIncompleteResponses, "partial responses may not be stored") {
 		return false
 	}
 
-	requestCacheControlDirectives := splitCacheControlHeader(req.Header[CacheControlHeader])
-
-	//if the request contains the cache-control header and it contains no-store the response should not be cached
-	for _, directive := range requestCacheControlDirectives {
-		if directive == NoStoreDirective {
-			return false
-		}
+	//A stream may never end, storing it would hold back the response until it does
+	if !decision.record(RuleEventStream, !isEventStream(resp.Header), "event streams are never stored") {
+		return false
 	}
 
-	responseCacheControlDirectives := splitCacheControlHeader(resp.Header[CacheControlHeader])
-
-	for _, directive := range responseCacheControlDirectives {
-		//if the response contains the cache-control header and it contains no-store the response should not be cached
-		if directive == NoStoreDirective {
-			return false
-		}
-
-		//if the response contains the cache-control header and it contains private the response should not be cached
-		// because this is a shared cache server
-		if directive == PrivateDirective {
-			return false
-		}
+	//The status code must be understood by the cache, even if the response has explicit freshness information
+	// Section 3 of RFC 7234. A status code is understood if it has a default expiration time
+	_, understood := config.StatusCodeDefaultExpirationTimes[resp.StatusCode]
+	if !decision.record(RuleStatusCode, understood, "the status code has no default expiration time") {
+		return false
 	}
 
-	//if the authorization header is set and the cache is shared(which it is)
-	// https://tools.ietf.org/html/rfc7234#section-3.2
-	if req.Header.Get("Authorization") != "" {
-
-		//Check if the cache-control header in the response allows this
-		allowed := false
+	//If the request method is unsafe or not marked as cacheable the response should not be cached
+	if !decision.record(RuleMethod, isRequestCacheable(config, req), "the request method is unsafe or not cacheable") {
+		return false
+	}
 
-		for _, directive := range responseCacheControlDirectives {
-			if directive == MustRevalidateDirective || directive == PublicDirective {
-				allowed = true
-			}
+	cc := parseResponseCacheControl(resp.Header)
 
-			if strings.HasPrefix(directive, SMaxAgeDirective) {
-				allowed = true
-			}
-		}
+	//if the response contains the cache-control header and it contains no-store the response should not be cached
+	// if it contains private the response should not be cached because this is a shared cache server
+	if !decision.record(RuleResponseNoStore, !cc.noStore, "the response contains the no-store directive") {
+		return false
+	}
 
-		//Don't cache unless specificity allowed
-		if !allowed {
-			return false
-		}
+	if !decision.record(RulePrivate, !cc.private, "the response contains the private directive") {
+		return false
 	}
 
 	//If the Vary header is a asterisk any variation in the request has a different response
 	//Thus it makes the response not cacheable
-	if resp.Header.Get(VaryHeader) == "*" {
+	if !decision.record(RuleVaryAsterisk, firstHeaderValue(resp.Header, VaryHeader) != "*", "the response varies on '*'") {
 		return false
 	}
 
-	for _, directive := range responseCacheControlDirectives {
+	//Variants of headers which are not allowed are not stored if configured, otherwise the headers are ignored in the secondary key
+	disallowedVary := config.BypassDisallowedVary && variesOnDisallowedHeader(config, resp.Header)
+	if !decision.record(RuleVaryAllowed, !disallowedVary, "the response varies on a header which is not allowed") {
+		return false
+	}
 
-		//if the response header Cache-Control contains a s-maxage response directive (see Section 5.2.2.9 of RFC7234)
-		//  and the cache is shared (which it is)
-		//  the response is cacheable
-		if strings.HasPrefix(directive, SMaxAgeDirective) {
-			return true
-		}
+	//Responses which set cookies can contain session information which must never be shared between clients
+	setsCookie := config.NeverStoreSetCookie && firstHeaderValue(resp.Header, "Set-Cookie") != "" && !isSetCookieStoreAllowed(config, req.URL.Path)
+	if !decision.record(RuleSetCookie, !setsCookie, "the response sets a cookie") {
+		return false
+	}
 
-		//if the Cache-Control header contains max-age the response is cacheable (see Section 5.2.2.8 of RFC7234)
-		if strings.HasPrefix(directive, MaxAgeDirective) {
-			return true
-		}
+	//if the request contains the cache-control header and it contains no-store the response should not be cached
+	// Most requests don't have a Cache-Control header, so parsing is skipped for them
+	requestNoStore := len(req.Header[CacheControlHeader]) > 0 && parseClientCacheControl(req.Header).noStore
+	if !decision.record(RuleRequestNoStore, !requestNoStore, "the request contains the no-store directive") {
+		return false
+	}
 
-		//if the response contains a public response directive (see Section 5.2.2.5).
-		if directive == PublicDirective {
-			return true
-		}
+	//if the authorization header is set and the cache is shared(which it is)
+	// https://tools.ietf.org/html/rfc7234#section-3.2
+	//
+	//Don't cache unless the cache-control header in the response specificity allows this
+	authorized := firstHeaderValue(req.Header, "Authorization") != ""
+	if !decision.record(RuleAuthorization, !authorized || cc.mustRevalidate || cc.public || cc.hasSMaxAge, "the request is authorized and the response doesn't explicitly allow storing") {
+		return false
+	}
+
+	//if the response header Cache-Control contains a s-maxage response directive (see Section 5.2.2.9 of RFC7234)
+	//  and the cache is shared (which it is)
+	//  the response is cacheable
+	//
+	//if the Cache-Control header contains max-age the response is cacheable (see Section 5.2.2.8 of RFC7234)
+	//
+	//if the response contains a public response directive (see Section 5.2.2.5).
+	//
+	//A no-cache directive doesn't prohibit storing, it only requires the stored response to be revalidated before every use
+	// Section 5.2.2.2 of RFC 7234
+	if decision.record(RuleExplicitFreshness, cc.hasSMaxAge || cc.hasMaxAge || cc.public || cc.noCache, "the Cache-Control header doesn't contain s-maxage, max-age, public or no-cache") {
+		return true
 	}
 
 	//if the expires header is set (see Section 5.3 of RFC7234)
-	if resp.Header.Get(ExpiresHeader) != "" {
+	if expiresValue := firstHeaderValue(resp.Header, ExpiresHeader); expiresValue != "" {
 
-		expires, err := http.ParseTime(resp.Header.Get(ExpiresHeader))
-		if err != nil {
+		expires, err := parseHTTPDate(expiresValue, config.LenientExpiresParsing)
 
-			//If parsing the time gives a error it violates http/1.1
+		//If parsing the time gives a error it violates http/1.1
+		if !decision.record(RuleExpires, err == nil, "the Expires header is invalid") {
 			return false
 		}
 
 		//If the expires is in the future, the response is cacheable
-		if time.Until(expires) > 0 {
+		if decision.record(RuleExpires, time.Until(expires) > 0, "the Expires header is in the past") {
 			return true
 		}
 	}
 
-	//Loop over every file extension to check if it is cacheable by default
-	//TODO This comparison may be faster with a string search algorithm like Aho–Corasick
-	defaultCacheableExtension := false
-	for _, extentsion := range config.CacheableFileExtensions {
-		if strings.HasSuffix(req.URL.Path, "."+extentsion) {
-			defaultCacheableExtension = true
-		}
-	}
-
-	if !defaultCacheableExtension {
-		return false
-	}
-
-	//if the response has a status code that is defined as cacheable by default (see
-	//  Section 4.2.2)
-	if _, found := config.StatusCodeDefaultExpirationTimes[resp.StatusCode]; found {
-		return true
-	}
-
-	return false
+	//The response has no explicit freshness information, it is only cacheable by default (see Section 4.2.2) if the
+	// file extension is cacheable by default. The status code is already known to have a default expiration time
+	return decision.record(RuleDefaultExtension, config.getLookups().defaultExtensions.hasCacheableExtension(req.URL.Path), "the file extension isn't cacheable by default")
 }
 
 //getResponseTTL checks what the ttl/freshness_lifetime of a response should be based on the config
@@ -163,46 +162,23 @@ func shouldStoreResponse(config *CacheConfig, resp *http.Response) bool {
 // if the ttl is negative the response is already stale
 func getResponseTTL(config *CacheConfig, resp *http.Response) time.Duration {
 
+	if resp.Request != nil && isCacheablePreflight(config, resp.Request) {
+		return preflightTTL(config, resp)
+	}
+
 	responseAge := getResponseAge(resp)
 
-	//The header value is comma separated, so split it on the comma.
-	// Lowercase the directive so string comparison is easier and trim the spaces from the directives
-	directives := splitCacheControlHeader(resp.Header[CacheControlHeader])
+	cc := parseResponseCacheControl(resp.Header)
 
 	//s-maxage has priority because this is a shared cache
-	for _, directive := range directives {
-
-		//If the directive starts with s-maxage
-		if strings.HasPrefix(directive, SMaxAgeDirective) {
-
-			//Remove the key and equals sign and attempt to parse the remainder as a number
-			// This assumes the origin server adheres to the RFC and sends the argument form.
-			// TODO check for the quoted-string form
-			sMaxAgeString := strings.TrimPrefix(directive, SMaxAgeDirective+"=")
-			sMaxAge, err := strconv.ParseInt(sMaxAgeString, 10, 0)
-
-			if err == nil {
-				//The remaining TTL is the max age minus the age of the response
-				return time.Duration(sMaxAge-responseAge) * time.Second
-			}
-		}
+	if cc.sMaxAgeValid {
+		//The remaining TTL is the max age minus the age of the response
+		return time.Duration(cc.sMaxAge-responseAge) * time.Second
 	}
 
-	for _, directive := range directives {
-		//If the directive starts with max-age
-		if strings.HasPrefix(directive, MaxAgeDirective) {
-
-			//Remove the key and equals sign and attempt to parse the remainder as a number
-			// This assumes the origin server adheres to the RFC and sends the argument form.
-			// TODO check for the quoted-string form
-			maxAgeString := strings.TrimPrefix(directive, MaxAgeDirective+"=")
-			maxAge, err := strconv.ParseInt(maxAgeString, 10, 0)
-
-			if err == nil {
-				//The remaining TTL is the max age minus the age of the response
-				return time.Duration(maxAge-responseAge) * time.Second
-			}
-		}
+	if cc.maxAgeValid {
+		//The remaining TTL is the max age minus the age of the response
+		return time.Duration(cc.maxAge-responseAge) * time.Second
 	}
 
 	//Get the date from the response, if not set or invalid make the date the current time
@@ -214,7 +190,7 @@ func getResponseTTL(config *CacheConfig, resp *http.Response) time.Duration {
 	}
 
 	if expiresString := resp.Header.Get(ExpiresHeader); expiresString != "" {
-		expires, err := http.ParseTime(expiresString)
+		expires, err := parseHTTPDate(expiresString, config.LenientExpiresParsing)
 
 		//If date is invalid it should be assumed to be in the past, Section 5.3 of RFC 7234
 		if err != nil {
@@ -232,68 +208,55 @@ func getResponseTTL(config *CacheConfig, resp *http.Response) time.Duration {
 	return -1
 }
 
-//requestOrResponseHasNoCache checks if a response or its request contains a no-cache directive in the Cache-Control header
-func requestOrResponseHasNoCache(resp *http.Response) bool {
+//responseRequiresRevalidation checks if a response may be stored but has to be revalidated with the origin server before every use.
+// This is the case if the response contains a no-cache directive or if it has a explicit freshness lifetime of zero
+// like 's-maxage=0' or 'max-age=0'. A 'max-age=0' without must-revalidate is also revalidated before every use,
+// even though a client which accepts stale responses with max-stale may get it without revalidation
+func responseRequiresRevalidation(resp *http.Response) bool {
 
-	for _, directive := range splitCacheControlHeader(resp.Header[CacheControlHeader]) {
-		//Check for the plain and field-name form
-		//Section 5.2.2.2 of RFC 7234
-		if strings.TrimSpace(directive) == NoCacheDirective || strings.HasPrefix(directive, NoCacheDirective+"=") {
-			return true
-		}
-	}
+	cc := parseResponseCacheControl(resp.Header)
 
-	for _, directive := range splitCacheControlHeader(resp.Request.Header[CacheControlHeader]) {
-		if strings.TrimSpace(directive) == NoCacheDirective {
-			return true
-		}
+	if cc.noCache {
+		return true
 	}
 
-	//Section 5.4 of RFC 7234
-	if resp.Request.Header.Get(CacheControlHeader) == "" && resp.Request.Header.Get("Pragma") == NoCacheDirective {
+	if cc.sMaxAgeValid && cc.sMaxAge == 0 {
 		return true
 	}
 
-	return false
+	//s-maxage overrides max-age in a shared cache so max-age=0 is only relevant without s-maxage
+	return cc.maxAgeValid && cc.maxAge == 0 && !cc.hasSMaxAge
+}
+
+//responseHasValidators checks if a response contains a validator which can be used in a conditional request
+// Section 2 of RFC 7232
+func responseHasValidators(resp *http.Response) bool {
+	return resp.Header.Get("Etag") != "" || resp.Header.Get("Last-Modified") != ""
 }
 
 //responseHasMustRevalidate checks if a response contains a must-revalidate or proxy-revalidate directive in the Cache-Control header
+// The s-maxage directive also counts because it implies the semantics of proxy-revalidate, section 5.2.2.9 of RFC 7234
 func responseHasMustRevalidate(resp *http.Response) bool {
 
-	for _, directive := range splitCacheControlHeader(resp.Header[CacheControlHeader]) {
-		if strings.TrimSpace(directive) == MustRevalidateDirective || strings.TrimSpace(directive) == ProxyRevalidateDirective {
-			return true
-		}
-	}
+	cc := parseResponseCacheControl(resp.Header)
+
+	return cc.mustRevalidate || cc.proxyRevalidate || cc.hasSMaxAge
+}
 
-	return false
+//isSetCookieStoreAllowed checks if responses with a Set-Cookie header may be stored for the given path
+func isSetCookieStoreAllowed(config *CacheConfig, path string) bool {
+	return matchesPathPrefix(config.SetCookieStorePaths, path, false)
 }
 
 //isMethodSafe checks if a request method is safe
 func isMethodSafe(config *CacheConfig, method string) bool {
-	//Check if the request method is safe
-	//TODO This comparison may be faster with a string search algorithm like Aho–Corasick
-	for _, safeMethod := range config.SafeMethods {
-		if safeMethod == method {
-			return true
-		}
-	}
-
-	return false
+	return config.getLookups().safeMethods.set[method]
 }
 
 //isMethodCacheable checks if a request method is cacheable
 func isMethodCacheable(config *CacheConfig, method string) bool {
 
-	//Check if the request method is in the list of cacheable methods
-	//TODO This comparison may be faster with a string search algorithm like Aho–Corasick
-	for _, configMethod := range config.CacheableMethods {
-		if configMethod == method {
-			return true
-		}
-	}
-
-	return false
+	return config.getLookups().cacheableMethods.set[method]
 }
 
 // //isResponseCacheableByExtension checks if a response is cacheable based on supported Cache-Control extensions
@@ -304,35 +267,53 @@ func isMethodCacheable(config *CacheConfig, method string) bool {
 // }
 
 //mayServeStaleResponse checks if according to the config and rules specified in RFC7234 the caching server is allowed to serve the response if it is stale
-func mayServeStaleResponse(cacheConfig *CacheConfig, response *http.Response) bool {
+// failure is the class of the origin failure because of which the response would be served stale, ttl is the negative ttl of the stale response
+func mayServeStaleResponse(cacheConfig *CacheConfig, response *http.Response, ttl time.Duration, failure string) bool {
+
+	//The origin or the client explicitly allowed the stale response to be served, even if serving of stale responses is turned off
+	if mayServeStaleResponseByExtension(cacheConfig, response, ttl, failure) {
+		return true
+	}
 
 	//If serving of stale responses is turned off
 	if !cacheConfig.ServeStaleOnError {
 		return false
 	}
 
-	if mayServeStaleResponseByExtension(cacheConfig, response) {
-		return true
+	//The configuration can restrict serving stale responses to some failures and stored status codes
+	if !staleAllowedByPolicy(cacheConfig, response, failure) {
+		return false
 	}
 
-	directives := splitCacheControlHeader(response.Header[CacheControlHeader])
-	for _, directive := range directives {
+	//If response contains a cache directive that disallowes stale responses section 4.2.4 of RFC7234
+	cc := parseResponseCacheControl(response.Header)
 
-		//If response contains a cache directive that disallowes stale responses section 4.2.4 of RFC7234
-		if directive == MustRevalidateDirective || directive == ProxyRevalidateDirective ||
-			directive == NoCacheDirective || strings.HasPrefix(directive, SMaxAgeDirective) {
+	return !cc.mustRevalidate && !cc.proxyRevalidate && !cc.noCache && !cc.hasSMaxAge
+}
 
-			return false
-		}
+//mayServeStaleResponseByExtension checks if there are any Cache-Control extensions which allow stale responses to be served
+// The stale-if-error directive of the response allows it to be served regardless of other freshness information while the staleness
+// is within its window. The stale-if-error directive of the client allows it too, unless the response must be revalidated.
+// Section 4 of RFC 5861
+func mayServeStaleResponseByExtension(cacheConfig *CacheConfig, response *http.Response, ttl time.Duration, failure string) bool {
+
+	//A response which was rejected by a validator is not a error in the sense of RFC 5861
+	if failure == OriginFailureInvalidResponse {
+		return false
 	}
 
-	return true
-}
+	staleness := -ttl
 
-//mayServeStaleResponseByExtension checks if there are any Cache-Control extensions which allow stale responses to be served
-func mayServeStaleResponseByExtension(cacheConfig *CacheConfig, response *http.Response) bool {
+	cc := parseResponseCacheControl(response.Header)
+	if cc.staleIfErrorValid && staleness <= time.Duration(cc.staleIfError)*time.Second {
+		return true
+	}
+
+	if response.Request == nil || cc.mustRevalidate || cc.proxyRevalidate || cc.noCache || cc.hasSMaxAge {
+		return false
+	}
 
-	//TODO implement https://tools.ietf.org/html/rfc5861
+	clientDirectives := parseClientCacheControl(response.Request.Header)
 
-	return false
+	return clientDirectives.staleIfError >= 0 && staleness <= time.Duration(clientDirectives.staleIfError)*time.Second
 }
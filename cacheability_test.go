@@ -0,0 +1,212 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShouldStoreResponseStatusCodes(t *testing.T) {
+	config := NewCacheConfig()
+
+	tests := []struct {
+		name         string
+		path         string
+		status       int
+		cacheControl string
+		expected     bool
+	}{
+		{name: "understood with max-age", path: "/", status: http.StatusOK, cacheControl: "max-age=60", expected: true},
+		{name: "not understood with max-age", path: "/", status: http.StatusTemporaryRedirect, cacheControl: "max-age=60", expected: false},
+		{name: "not understood with public", path: "/", status: http.StatusInternalServerError, cacheControl: "public", expected: false},
+		{name: "not understood with s-maxage", path: "/", status: http.StatusCreated, cacheControl: "s-maxage=60", expected: false},
+		{name: "understood heuristic", path: "/style.css", status: http.StatusNotFound, expected: true},
+		{name: "understood heuristic without cacheable extension", path: "/", status: http.StatusOK, expected: false},
+		{name: "not understood heuristic", path: "/style.css", status: http.StatusTemporaryRedirect, expected: false},
+	}
+
+	for _, test := range tests {
+		response := &http.Response{
+			StatusCode: test.status,
+			Header:     http.Header{},
+			Request:    httptest.NewRequest(http.MethodGet, "http://example.com"+test.path, nil),
+		}
+
+		if test.cacheControl != "" {
+			response.Header.Set(CacheControlHeader, test.cacheControl)
+		}
+
+		if result := shouldStoreResponse(config, response); result != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, result)
+		}
+	}
+}
+
+//BenchmarkShouldStoreResponse measures the common cases on the store path of every origin response
+func BenchmarkShouldStoreResponse(b *testing.B) {
+	config := NewCacheConfig()
+
+	benchmarks := []struct {
+		name   string
+		status int
+		header http.Header
+	}{
+		{name: "max-age", status: http.StatusOK, header: http.Header{
+			CacheControlHeader: []string{"public, max-age=3600"},
+			"Content-Type":     []string{"text/html"},
+		}},
+		{name: "no-store", status: http.StatusOK, header: http.Header{
+			CacheControlHeader: []string{"private, no-store, no-cache, must-revalidate"},
+			"Content-Type":     []string{"text/html"},
+		}},
+		{name: "status-not-understood", status: http.StatusInternalServerError, header: http.Header{
+			CacheControlHeader: []string{"max-age=3600"},
+		}},
+		{name: "heuristic", status: http.StatusOK, header: http.Header{
+			"Last-Modified": []string{"Mon, 02 Jan 2006 15:04:05 GMT"},
+		}},
+	}
+
+	for _, benchmark := range benchmarks {
+		response := &http.Response{
+			StatusCode: benchmark.status,
+			Header:     benchmark.header,
+			Request:    httptest.NewRequest(http.MethodGet, "http://example.com/page.css", nil),
+		}
+
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				shouldStoreResponse(config, response)
+			}
+		})
+	}
+}
+
+func TestResponseRequiresRevalidation(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		expected     bool
+	}{
+		{cacheControl: "no-cache", expected: true},
+		{cacheControl: "max-age=0", expected: true},
+		{cacheControl: "max-age=0, must-revalidate", expected: true},
+		{cacheControl: "s-maxage=0, max-age=60", expected: true},
+		{cacheControl: "s-maxage=60, max-age=0", expected: false},
+		{cacheControl: "max-age=60", expected: false},
+		{cacheControl: "", expected: false},
+	}
+
+	for _, test := range tests {
+		response := &http.Response{Header: http.Header{}}
+		if test.cacheControl != "" {
+			response.Header.Set(CacheControlHeader, test.cacheControl)
+		}
+
+		if result := responseRequiresRevalidation(response); result != test.expected {
+			t.Errorf("'%s': expected %v, got %v", test.cacheControl, test.expected, result)
+		}
+	}
+}
+
+func TestStoreResponsesForRevalidation(t *testing.T) {
+	tests := []struct {
+		cacheControl  string
+		etag          string
+		expectedStore bool
+	}{
+		{cacheControl: "no-cache", etag: `"v1"`, expectedStore: true},
+		{cacheControl: "max-age=0", etag: `"v1"`, expectedStore: true},
+		{cacheControl: "max-age=0, must-revalidate", etag: `"v1"`, expectedStore: true},
+		{cacheControl: "s-maxage=0", etag: `"v1"`, expectedStore: true},
+
+		//Without validators the response can't be revalidated, so there is no point in storing it
+		{cacheControl: "no-cache", expectedStore: false},
+		{cacheControl: "max-age=0", expectedStore: false},
+	}
+
+	for _, test := range tests {
+		var conditionalRequests, fullResponses int
+
+		controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set(CacheControlHeader, test.cacheControl)
+			if test.etag != "" {
+				rw.Header().Set("Etag", test.etag)
+			}
+
+			if req.Header.Get("If-None-Match") != "" {
+				conditionalRequests++
+
+				if req.Header.Get("If-None-Match") == test.etag {
+					rw.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+
+			fullResponses++
+			_, _ = rw.Write([]byte("content"))
+		}))
+
+		for i := 0; i < 3; i++ {
+			response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+			if response.StatusCode != http.StatusOK || body != "content" {
+				t.Errorf("'%s': expected the full response, got status %d and body '%s'", test.cacheControl, response.StatusCode, body)
+			}
+		}
+
+		closeOrigin()
+
+		//A stored response is revalidated on every use, it is never served without asking the origin
+		if test.expectedStore && (fullResponses != 1 || conditionalRequests != 2) {
+			t.Errorf("'%s': expected 1 full response and 2 revalidations, got %d and %d", test.cacheControl, fullResponses, conditionalRequests)
+		}
+
+		if !test.expectedStore && (fullResponses != 3 || conditionalRequests != 0) {
+			t.Errorf("'%s': expected the response not to be stored, got %d full responses and %d revalidations", test.cacheControl, fullResponses, conditionalRequests)
+		}
+	}
+}
+
+func TestNeverStoreSetCookie(t *testing.T) {
+	tests := []struct {
+		name                string
+		path                string
+		neverStoreSetCookie bool
+		storePaths          []string
+		expectedStore       bool
+	}{
+		{name: "refused by default", path: "/", neverStoreSetCookie: true, expectedStore: false},
+		{name: "allowed path", path: "/static/app.css", neverStoreSetCookie: true, storePaths: []string{"/static/"}, expectedStore: true},
+		{name: "other path", path: "/account", neverStoreSetCookie: true, storePaths: []string{"/static/"}, expectedStore: false},
+		{name: "disabled", path: "/", neverStoreSetCookie: false, expectedStore: true},
+	}
+
+	for _, test := range tests {
+		originRequests := 0
+
+		controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			originRequests++
+
+			rw.Header().Set(CacheControlHeader, "max-age=60")
+			rw.Header().Set("Set-Cookie", "session=secret")
+			_, _ = rw.Write([]byte("content"))
+		}))
+
+		if !NewCacheConfig().NeverStoreSetCookie {
+			t.Fatal("expected responses with Set-Cookie not to be stored by default")
+		}
+
+		controller.DefaultCacheConfig.NeverStoreSetCookie = test.neverStoreSetCookie
+		controller.DefaultCacheConfig.SetCookieStorePaths = test.storePaths
+
+		for i := 0; i < 2; i++ {
+			doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+test.path, nil))
+		}
+
+		closeOrigin()
+
+		if stored := originRequests == 1; stored != test.expectedStore {
+			t.Errorf("%s: expected stored to be %v, the origin got %d requests", test.name, test.expectedStore, originRequests)
+		}
+	}
+}
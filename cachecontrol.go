@@ -0,0 +1,180 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//forEachDirective calls fn for every directive in the given Cache-Control header values.
+// Directives are separated by commas which are not within a quoted string. Names are lowercased and
+// quotes around values are removed. The name and value are slices of the header values so no allocations are made
+// unless a name contains upper case characters
+func forEachDirective(headerValues []string, fn func(name, value string, hasValue bool)) {
+	for _, headerValue := range headerValues {
+		start := 0
+		inQuote := false
+
+		for i := 0; i <= len(headerValue); i++ {
+			if i < len(headerValue) {
+				if headerValue[i] == '"' {
+					inQuote = !inQuote
+				}
+
+				if headerValue[i] != ',' || inQuote {
+					continue
+				}
+			}
+
+			directive := strings.TrimSpace(headerValue[start:i])
+			start = i + 1
+
+			if directive == "" {
+				continue
+			}
+
+			name, value, hasValue := directive, "", false
+			if equals := strings.IndexByte(directive, '='); equals != -1 {
+				name = strings.TrimSpace(directive[:equals])
+				value = strings.TrimSpace(directive[equals+1:])
+				hasValue = true
+
+				if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+					value = value[1 : len(value)-1]
+				}
+			}
+
+			fn(strings.ToLower(name), value, hasValue)
+		}
+	}
+}
+
+//responseCacheControl holds the parsed response Cache-Control directives as defined in section 5.2.2 of RFC 7234
+type responseCacheControl struct {
+	//hasMaxAge is true if the max-age directive is present, even if its value is invalid
+	hasMaxAge bool
+
+	//maxAge is the value of the max-age directive in seconds, only set if maxAgeValid is true
+	// The value can be negative if the origin sent a negative number, which makes the response stale
+	maxAge      int64
+	maxAgeValid bool
+
+	//hasSMaxAge is true if the s-maxage directive is present, even if its value is invalid
+	hasSMaxAge bool
+
+	//sMaxAge is the value of the s-maxage directive in seconds, only set if sMaxAgeValid is true
+	sMaxAge      int64
+	sMaxAgeValid bool
+
+	//staleWhileRevalidate is the value of the stale-while-revalidate directive in seconds, section 3 of RFC 5861.
+	// Only set if staleWhileRevalidateValid is true
+	staleWhileRevalidate      int64
+	staleWhileRevalidateValid bool
+
+	//staleIfError is the value of the stale-if-error directive in seconds, section 4 of RFC 5861. Only set if staleIfErrorValid is true
+	staleIfError      int64
+	staleIfErrorValid bool
+
+	//noCache is true if the no-cache directive is present in the plain form, without a field-name list
+	noCache bool
+
+	//noCacheFields are the field names of the qualified form of the no-cache directive, section 5.2.2.2 of RFC 7234
+	noCacheFields []string
+
+	noStore         bool
+	noTransform     bool
+	mustRevalidate  bool
+	proxyRevalidate bool
+	public          bool
+	private         bool
+}
+
+//parseResponseCacheControl parses the Cache-Control header of a response
+func parseResponseCacheControl(header http.Header) responseCacheControl {
+	cc := responseCacheControl{}
+
+	forEachDirective(header[CacheControlHeader], func(name, value string, hasValue bool) {
+		switch name {
+		case MaxAgeDirective:
+			cc.hasMaxAge = true
+			cc.maxAge, cc.maxAgeValid = parseDirectiveSeconds(value, hasValue)
+
+		case SMaxAgeDirective:
+			cc.hasSMaxAge = true
+			cc.sMaxAge, cc.sMaxAgeValid = parseDirectiveSeconds(value, hasValue)
+
+		case StaleWhileRevalidateDirective:
+			cc.staleWhileRevalidate, cc.staleWhileRevalidateValid = parseDirectiveSeconds(value, hasValue)
+
+		case StaleIfErrorDirective:
+			cc.staleIfError, cc.staleIfErrorValid = parseDirectiveSeconds(value, hasValue)
+
+		case NoCacheDirective:
+			if !hasValue {
+				cc.noCache = true
+				return
+			}
+
+			for _, fieldName := range strings.Split(value, ",") {
+				if fieldName = strings.TrimSpace(fieldName); fieldName != "" {
+					cc.noCacheFields = append(cc.noCacheFields, fieldName)
+				}
+			}
+
+		case NoStoreDirective:
+			cc.noStore = true
+
+		case NoTransformDirective:
+			cc.noTransform = true
+
+		case MustRevalidateDirective:
+			cc.mustRevalidate = true
+
+		case ProxyRevalidateDirective:
+			cc.proxyRevalidate = true
+
+		case PublicDirective:
+			cc.public = true
+
+		case PrivateDirective:
+			cc.private = true
+		}
+	})
+
+	return cc
+}
+
+//parseDirectiveSeconds parses the amount of seconds of a response directive like max-age
+// Unlike parseDeltaSeconds negative values are accepted, values which are to big are capped at maxDeltaSeconds
+func parseDirectiveSeconds(value string, hasValue bool) (int64, bool) {
+	if !hasValue {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange && seconds > 0 {
+		return maxDeltaSeconds, true
+	}
+
+	if err != nil {
+		return 0, false
+	}
+
+	if seconds > maxDeltaSeconds {
+		return maxDeltaSeconds, true
+	}
+
+	return seconds, true
+}
+
+//stripNoCacheFields removes the headers listed in the qualified form of the no-cache directive from the response
+// and reports if any were listed. Section 5.2.2.2 of RFC 7234
+func stripNoCacheFields(response *http.Response) bool {
+	fields := parseResponseCacheControl(response.Header).noCacheFields
+
+	for _, fieldName := range fields {
+		response.Header.Del(fieldName)
+	}
+
+	return len(fields) > 0
+}
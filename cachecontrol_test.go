@@ -0,0 +1,80 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseResponseCacheControl(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []string
+		expected responseCacheControl
+	}{
+		{
+			name:     "empty",
+			values:   nil,
+			expected: responseCacheControl{},
+		},
+		{
+			name:   "max-age and s-maxage",
+			values: []string{"Max-Age=10, s-maxage=\"20\""},
+			expected: responseCacheControl{
+				hasMaxAge: true, maxAge: 10, maxAgeValid: true,
+				hasSMaxAge: true, sMaxAge: 20, sMaxAgeValid: true,
+			},
+		},
+		{
+			name:     "invalid max-age",
+			values:   []string{"max-age=abc"},
+			expected: responseCacheControl{hasMaxAge: true},
+		},
+		{
+			name:     "negative max-age",
+			values:   []string{"max-age=-5"},
+			expected: responseCacheControl{hasMaxAge: true, maxAge: -5, maxAgeValid: true},
+		},
+		{
+			name:     "overflowing max-age",
+			values:   []string{"max-age=99999999999999999999"},
+			expected: responseCacheControl{hasMaxAge: true, maxAge: maxDeltaSeconds, maxAgeValid: true},
+		},
+		{
+			name:     "no-cache field list with comma in quotes",
+			values:   []string{`no-cache="Set-Cookie, X-Foo", public`},
+			expected: responseCacheControl{noCacheFields: []string{"Set-Cookie", "X-Foo"}, public: true},
+		},
+		{
+			name:   "multiple header values",
+			values: []string{"no-cache", "must-revalidate,proxy-revalidate", ", private,,no-store, no-transform"},
+			expected: responseCacheControl{
+				noCache:         true,
+				mustRevalidate:  true,
+				proxyRevalidate: true,
+				private:         true,
+				noStore:         true,
+				noTransform:     true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cc := parseResponseCacheControl(http.Header{CacheControlHeader: test.values})
+			if !reflect.DeepEqual(cc, test.expected) {
+				t.Errorf("expected: %+v, got: %+v", test.expected, cc)
+			}
+		})
+	}
+}
+
+func BenchmarkParseResponseCacheControl(b *testing.B) {
+	header := http.Header{CacheControlHeader: []string{"public, max-age=3600, s-maxage=600, must-revalidate"}}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		parseResponseCacheControl(header)
+	}
+}
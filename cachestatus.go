@@ -0,0 +1,125 @@
+package sharedhttpcache
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+//The values of the CacheStatusHeader, which tell how the cache handled the request
+const (
+	//CacheStatusHit means a fresh stored response was served
+	CacheStatusHit = "HIT"
+
+	//CacheStatusMiss means no response was stored, the response was fetched from the origin
+	CacheStatusMiss = "MISS"
+
+	//CacheStatusStale means a stale stored response was served, for example because the origin is unavailable
+	CacheStatusStale = "STALE"
+
+	//CacheStatusRevalidated means a stale stored response was served after the origin confirmed it is still valid
+	CacheStatusRevalidated = "REVALIDATED"
+
+	//CacheStatusBypass means the cache wasn't used for the request, like for unsafe methods or refreshes
+	CacheStatusBypass = "BYPASS"
+
+	//CacheStatusExpired means a stale stored response couldn't be used, so a new response was fetched from the origin
+	CacheStatusExpired = "EXPIRED"
+)
+
+//cacheStatusWriter sets the CacheStatusHeader just before the header is written,
+// so the status can't be overwritten by the same header of a origin response, like the one of a cache in front of the origin.
+// It also records what was sent, so the request can be logged
+type cacheStatusWriter struct {
+	http.ResponseWriter
+
+	header      string
+	status      string
+	wroteHeader bool
+
+	statusCode    int
+	written       int64
+	headerWritten time.Time
+}
+
+func (writer *cacheStatusWriter) WriteHeader(statusCode int) {
+	//Interim responses like 103 Early Hints are followed by the final response, which gets the status
+	if writer.wroteHeader || (statusCode < http.StatusOK && statusCode != http.StatusSwitchingProtocols) {
+		writer.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	writer.wroteHeader = true
+	writer.statusCode = statusCode
+	writer.headerWritten = time.Now()
+
+	if writer.header != "" {
+		if writer.status != "" {
+			writer.Header().Set(writer.header, writer.status)
+		} else {
+			writer.Header().Del(writer.header)
+		}
+	}
+
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (writer *cacheStatusWriter) Write(p []byte) (int, error) {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+
+	n, err := writer.ResponseWriter.Write(p)
+	writer.written += int64(n)
+	return n, err
+}
+
+//ReadFrom keeps the ability of the response writer to send files with sendfile
+func (writer *cacheStatusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+
+	var n int64
+	var err error
+	if readerFrom, ok := writer.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(src)
+	} else {
+		n, err = copyWithPooledBuffer(writer.ResponseWriter, src)
+	}
+
+	writer.written += n
+	return n, err
+}
+
+func (writer *cacheStatusWriter) Flush() {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//withCacheStatus wraps the response writer so the CacheStatusHeader is added to the response and the request can be logged.
+// The BypassConfig has no settings, so the header of the default cache config is used for bypassed requests
+func (controller *CacheController) withCacheStatus(cacheConfig *CacheConfig, resp http.ResponseWriter) http.ResponseWriter {
+	header := cacheConfig.CacheStatusHeader
+	if cacheConfig == BypassConfig {
+		header = controller.DefaultCacheConfig.CacheStatusHeader
+	}
+
+	if header == "" && !controller.LogRequests {
+		return resp
+	}
+
+	return &cacheStatusWriter{ResponseWriter: resp, header: header}
+}
+
+//setCacheStatus records how the cache handled the request, a later call replaces the status
+func setCacheStatus(resp http.ResponseWriter, status string) {
+	if writer, ok := resp.(*cacheStatusWriter); ok {
+		writer.status = status
+	}
+}
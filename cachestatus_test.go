@@ -0,0 +1,69 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestCacheStatusHeader(t *testing.T) {
+	version := 0
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		//A cache in front of the origin must not be able to set the status
+		rw.Header().Set("X-Cache-Status", "HIT")
+
+		switch req.URL.Path {
+		case "/revalidate":
+			rw.Header().Set(CacheControlHeader, "no-cache")
+			rw.Header().Set("Etag", `"1"`)
+			if req.Header.Get("If-None-Match") == `"1"` {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+		case "/changed":
+			version++
+			rw.Header().Set(CacheControlHeader, "no-cache")
+			rw.Header().Set("Etag", `"`+strconv.Itoa(version)+`"`)
+
+		default:
+			rw.Header().Set(CacheControlHeader, "max-age=60")
+		}
+
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.CacheStatusHeader = "X-Cache-Status"
+
+	tests := []struct {
+		method   string
+		path     string
+		expected string
+	}{
+		{method: http.MethodGet, path: "/", expected: CacheStatusMiss},
+		{method: http.MethodGet, path: "/", expected: CacheStatusHit},
+		{method: http.MethodPost, path: "/", expected: CacheStatusBypass},
+		{method: http.MethodGet, path: "/revalidate", expected: CacheStatusMiss},
+		{method: http.MethodGet, path: "/revalidate", expected: CacheStatusRevalidated},
+		{method: http.MethodGet, path: "/changed", expected: CacheStatusMiss},
+		{method: http.MethodGet, path: "/changed", expected: CacheStatusExpired},
+	}
+
+	for _, test := range tests {
+		resp, _ := doTestRequest(t, controller, httptest.NewRequest(test.method, "http://"+host+test.path, nil))
+
+		if status := resp.Header.Get("X-Cache-Status"); status != test.expected {
+			t.Errorf("%s %s: expected status %s, got: %s", test.method, test.path, test.expected, status)
+		}
+	}
+
+	controller.DefaultCacheConfig.CacheStatusHeader = ""
+
+	resp, _ := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if status := resp.Header.Get("X-Cache-Status"); status != "HIT" {
+		t.Errorf("expected the header of the response to be served as is without a status header, got: %s", status)
+	}
+}
@@ -0,0 +1,103 @@
+package sharedhttpcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	errNoCertificateHosts = errors.New("The certificate has no hostnames, they must be configured")
+	errUnknownServerName  = errors.New("No certificate for server name")
+)
+
+//CertificateSelector selects the certificate of a TLS listener by the server name the client sends with SNI.
+// A certificate can be registered for exact hostnames and for wildcards like "*.example.com", which match one label.
+// An exact hostname wins over a wildcard. Clients which request a unknown server name or don't use SNI get the default certificate,
+// or the handshake fails if there is no default certificate.
+// Use GetCertificate as the GetCertificate function of a tls.Config
+type CertificateSelector struct {
+	mutex        sync.RWMutex
+	certificates map[string]*tls.Certificate
+	defaultCert  *tls.Certificate
+}
+
+//NewCertificateSelector creates a CertificateSelector without certificates
+func NewCertificateSelector() *CertificateSelector {
+	return &CertificateSelector{
+		certificates: map[string]*tls.Certificate{},
+	}
+}
+
+//AddCertificate registers the certificate for the hosts, which can be wildcards like "*.example.com".
+// If no hosts are given the certificate is registered for the DNS names in the certificate itself.
+// A host which is already registered is replaced
+func (selector *CertificateSelector) AddCertificate(cert *tls.Certificate, hosts ...string) error {
+	if len(hosts) == 0 {
+		if len(cert.Certificate) == 0 {
+			return errNoCertificateHosts
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+
+		hosts = leaf.DNSNames
+		if len(hosts) == 0 {
+			return errNoCertificateHosts
+		}
+	}
+
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+
+	for _, host := range hosts {
+		selector.certificates[normalizeServerName(host)] = cert
+	}
+
+	return nil
+}
+
+//SetDefault sets the certificate which is used for unknown server names, nil makes the handshake of unknown server names fail
+func (selector *CertificateSelector) SetDefault(cert *tls.Certificate) {
+	selector.mutex.Lock()
+	defer selector.mutex.Unlock()
+
+	selector.defaultCert = cert
+}
+
+//GetCertificate returns the certificate of the server name of the client
+func (selector *CertificateSelector) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := normalizeServerName(hello.ServerName)
+
+	selector.mutex.RLock()
+	defer selector.mutex.RUnlock()
+
+	if serverName != "" {
+		if cert, found := selector.certificates[serverName]; found {
+			return cert, nil
+		}
+
+		//A wildcard only replaces the first label, so "*.example.com" matches "www.example.com" but not "example.com"
+		if dot := strings.IndexByte(serverName, '.'); dot > 0 {
+			if cert, found := selector.certificates["*"+serverName[dot:]]; found {
+				return cert, nil
+			}
+		}
+	}
+
+	if selector.defaultCert != nil {
+		return selector.defaultCert, nil
+	}
+
+	return nil, fmt.Errorf("%w '%s'", errUnknownServerName, hello.ServerName)
+}
+
+//normalizeServerName returns the form in which server names are compared, they are case insensitive and can be fully qualified
+func normalizeServerName(serverName string) string {
+	return strings.TrimSuffix(strings.ToLower(asciiHostname(serverName)), ".")
+}
@@ -0,0 +1,90 @@
+package sharedhttpcache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+//newTestCertificate creates a self signed certificate for the DNS names
+func newTestCertificate(t *testing.T, dnsNames ...string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertificateSelector(t *testing.T) {
+	exact := newTestCertificate(t, "example.com")
+	wildcard := newTestCertificate(t, "*.example.com")
+	override := newTestCertificate(t)
+	fallback := newTestCertificate(t, "fallback.test")
+
+	selector := NewCertificateSelector()
+
+	for _, cert := range []*tls.Certificate{exact, wildcard} {
+		if err := selector.AddCertificate(cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := selector.AddCertificate(override, "api.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := selector.AddCertificate(override); err != errNoCertificateHosts {
+		t.Errorf("expected a certificate without names to require hosts, got %v", err)
+	}
+
+	tests := []struct {
+		serverName string
+		expected   *tls.Certificate
+	}{
+		{serverName: "example.com", expected: exact},
+		{serverName: "Example.COM.", expected: exact},
+		{serverName: "www.example.com", expected: wildcard},
+		{serverName: "api.example.com", expected: override},
+		{serverName: "a.b.example.com", expected: nil},
+		{serverName: "other.test", expected: nil},
+		{serverName: "", expected: nil},
+	}
+
+	for _, test := range tests {
+		cert, err := selector.GetCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if cert != test.expected {
+			t.Errorf("%s: unexpected certificate selected", test.serverName)
+		}
+
+		if test.expected == nil && !errors.Is(err, errUnknownServerName) {
+			t.Errorf("%s: expected the handshake to fail, got %v", test.serverName, err)
+		}
+	}
+
+	selector.SetDefault(fallback)
+
+	if cert, err := selector.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); cert != fallback || err != nil {
+		t.Errorf("expected the default certificate for a unknown server name, got %v", err)
+	}
+}
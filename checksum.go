@@ -0,0 +1,115 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+)
+
+//Modes of CacheController.ChecksumVerification
+const (
+	//ChecksumVerifyNever never verifies the checksum of stored bodies
+	ChecksumVerifyNever = "never"
+
+	//ChecksumVerifyAlways verifies the checksum every time a stored response is read
+	ChecksumVerifyAlways = "always"
+
+	//ChecksumVerifySampled verifies the checksum of a random fraction of the stored responses which are read, see ChecksumSampleRate
+	ChecksumVerifySampled = "sampled"
+
+	//ChecksumVerifyFiles verifies the checksum of bodies which are read from files, like the bodies of the DiskCacheLayer.
+	// Bodies in memory are not verified since they don't suffer from damaged storage
+	ChecksumVerifyFiles = "files"
+)
+
+//DefaultChecksumSampleRate is the fraction of stored responses of which the checksum is verified if ChecksumSampleRate is zero
+const DefaultChecksumSampleRate = 0.01
+
+//MetricCacheCorrupted is counted every time a stored response is deleted because its body doesn't match the checksum
+const MetricCacheCorrupted = "cache.corrupted"
+
+var errChecksumMismatch = errors.New("body doesn't match checksum")
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+//newBodyChecksum creates the hash with which the checksum of a body is computed
+// CRC-32C is used since it is fast and only accidental corruption has to be detected
+func newBodyChecksum() hash.Hash32 {
+	return crc32.New(checksumTable)
+}
+
+//encodeBodyChecksum encodes the checksum as it is stored with the entry
+func encodeBodyChecksum(checksum hash.Hash32) string {
+	return hex.EncodeToString(checksum.Sum(nil))
+}
+
+//shouldVerifyChecksum checks if the checksum of the body has to be verified according to the ChecksumVerification mode
+func (controller *CacheController) shouldVerifyChecksum(body io.ReadCloser) bool {
+	switch controller.ChecksumVerification {
+	case ChecksumVerifyAlways:
+		return true
+
+	case ChecksumVerifySampled:
+		sampleRate := controller.ChecksumSampleRate
+		if sampleRate <= 0 {
+			sampleRate = DefaultChecksumSampleRate
+		}
+
+		return rand.Float64() < sampleRate
+
+	case ChecksumVerifyFiles:
+		_, isFile := body.(*os.File)
+		return isFile
+	}
+
+	return false
+}
+
+//verifyBodyChecksum reads the body of the response and compares it to the stored checksum. The body of the response is replaced
+// by a body which starts at the beginning again. A file is rewound, so it can still be served with sendfile, other bodies are buffered.
+// errChecksumMismatch is returned if the body doesn't match, the body is then closed
+func verifyBodyChecksum(response *http.Response, checksum string) error {
+	computed := newBodyChecksum()
+
+	if seeker, isSeeker := response.Body.(io.ReadSeeker); isSeeker {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(computed, seeker); err != nil {
+			return err
+		}
+
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+	} else {
+		body, err := ioutil.ReadAll(io.TeeReader(response.Body, computed))
+		if err != nil {
+			return err
+		}
+
+		original := response.Body
+		response.Body = &releasingReadCloser{
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(body)),
+			release: func() {
+				original.Close()
+			},
+		}
+	}
+
+	if encodeBodyChecksum(computed) != checksum {
+		response.Body.Close()
+		return errChecksumMismatch
+	}
+
+	return nil
+}
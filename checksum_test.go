@@ -0,0 +1,78 @@
+package sharedhttpcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCorruptedEntryIsRefetched(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.ChecksumVerification = ChecksumVerifyAlways
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	doTestRequest(t, controller, req)
+
+	_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if body != "content" || originRequests != 1 {
+		t.Fatalf("expected a intact entry to be served, got body '%s' after %d origin requests", body, originRequests)
+	}
+
+	//Damage the stored body without changing its length
+	cacheKey := getPrimaryCacheKey(controller.DefaultCacheConfig, controller.DefaultForwardConfig, req)
+	err := controller.Layers[0].Set(bodyCacheKeyPrefix+cacheKey, ioutil.NopCloser(strings.NewReader("c0ntent")), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, body = doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if body != "content" || originRequests != 2 {
+		t.Errorf("expected the corrupted entry to be fetched again, got body '%s' after %d origin requests", body, originRequests)
+	}
+}
+
+func TestVerifyBodyChecksumRewindsFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, _ = file.WriteString("headercontent")
+	_, _ = file.Seek(int64(len("header")), 0)
+
+	checksum := newBodyChecksum()
+	_, _ = checksum.Write([]byte("content"))
+
+	response := &http.Response{Body: file}
+	if err := verifyBodyChecksum(response, encodeBodyChecksum(checksum)); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Body != file {
+		t.Error("expected the file to be kept as body so it can be served with sendfile")
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != "content" {
+		t.Errorf("expected the file to be rewound to the start of the body, got '%s'", body)
+	}
+	response.Body.Close()
+
+	response = &http.Response{Body: ioutil.NopCloser(strings.NewReader("damaged"))}
+	if err := verifyBodyChecksum(response, encodeBodyChecksum(checksum)); err != errChecksumMismatch {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+}
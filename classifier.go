@@ -0,0 +1,80 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"strings"
+)
+
+//A RequestClassifier classifies a request into a class like "mobile", "desktop" or "bot"
+// The class can be used to serve a different variant of a resource to different kinds of clients
+type RequestClassifier interface {
+
+	//ClassifyRequest is called to get the class of a request
+	// A empty string means the request has no class
+	ClassifyRequest(req *http.Request) string
+}
+
+//The RequestClassifierFunc type is an adapter to allow the use of ordinary functions as RequestClassifier
+type RequestClassifierFunc func(req *http.Request) string
+
+//ClassifyRequest calls the underlying function to classify a request
+func (classifier RequestClassifierFunc) ClassifyRequest(req *http.Request) string {
+	return classifier(req)
+}
+
+const (
+	DeviceClassBot     = "bot"
+	DeviceClassMobile  = "mobile"
+	DeviceClassTablet  = "tablet"
+	DeviceClassDesktop = "desktop"
+)
+
+var (
+	botUserAgentTokens    = []string{"bot", "crawler", "spider", "slurp", "facebookexternalhit"}
+	tabletUserAgentTokens = []string{"ipad", "tablet", "kindle", "silk"}
+	mobileUserAgentTokens = []string{"mobile", "iphone", "ipod", "android", "blackberry", "opera mini", "windows phone"}
+)
+
+//DeviceClassifier is a simple RequestClassifier which classifies requests as bot, tablet, mobile or desktop based on the User-Agent header
+var DeviceClassifier = RequestClassifierFunc(func(req *http.Request) string {
+	userAgent := strings.ToLower(req.Header.Get("User-Agent"))
+
+	if containsAny(userAgent, botUserAgentTokens) {
+		return DeviceClassBot
+	}
+
+	//Check for tablets before mobile devices since the user agent of most tablets also contains a mobile token
+	if containsAny(userAgent, tabletUserAgentTokens) {
+		return DeviceClassTablet
+	}
+
+	if containsAny(userAgent, mobileUserAgentTokens) {
+		return DeviceClassMobile
+	}
+
+	return DeviceClassDesktop
+})
+
+//containsAny checks if s contains any of the tokens
+func containsAny(s string, tokens []string) bool {
+	for _, token := range tokens {
+		if strings.Contains(s, token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//classifyRequest adds the class of the request to the header configured in the cache config
+// so the origin server knows which variant to serve. The request is cloned if it is modified
+func classifyRequest(cacheConfig *CacheConfig, req *http.Request) *http.Request {
+	if cacheConfig.RequestClassifier == nil || cacheConfig.RequestClassHeader == "" {
+		return req
+	}
+
+	classifiedReq := req.Clone(req.Context())
+	classifiedReq.Header.Set(cacheConfig.RequestClassHeader, cacheConfig.RequestClassifier.ClassifyRequest(req))
+
+	return classifiedReq
+}
@@ -0,0 +1,78 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeviceClassifier(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		expected  string
+	}{
+		{userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", expected: DeviceClassBot},
+		{userAgent: "facebookexternalhit/1.1", expected: DeviceClassBot},
+		{userAgent: "Mozilla/5.0 (iPad; CPU OS 13_2 like Mac OS X) Mobile/15E148", expected: DeviceClassTablet},
+		{userAgent: "Mozilla/5.0 (Linux; Android 10; SM-T510) Tablet", expected: DeviceClassTablet},
+		{userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 13_2 like Mac OS X) Mobile/15E148", expected: DeviceClassMobile},
+		{userAgent: "Mozilla/5.0 (Linux; Android 10; Pixel 3)", expected: DeviceClassMobile},
+		{userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Firefox/70.0", expected: DeviceClassDesktop},
+		{userAgent: "", expected: DeviceClassDesktop},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("User-Agent", test.userAgent)
+
+		if class := DeviceClassifier.ClassifyRequest(req); class != test.expected {
+			t.Errorf("'%s': expected class %s, got %s", test.userAgent, test.expected, class)
+		}
+	}
+}
+
+func TestDeviceClassVariants(t *testing.T) {
+	originRequests := 0
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("variant for " + req.Header.Get("X-Device-Class")))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.RequestClassifier = DeviceClassifier
+	controller.DefaultCacheConfig.RequestClassHeader = "X-Device-Class"
+
+	newRequest := func(userAgent string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.Header.Set("User-Agent", userAgent)
+
+		//The class is set by the cache, a value sent by the client is overwritten
+		req.Header.Set("X-Device-Class", "bot")
+		return req
+	}
+
+	mobile := "Mozilla/5.0 (iPhone) Mobile"
+	desktop := "Mozilla/5.0 (Windows NT 10.0)"
+
+	for _, userAgent := range []string{mobile, desktop, mobile, desktop} {
+		_, body := doTestRequest(t, controller, newRequest(userAgent))
+
+		expected := "variant for " + DeviceClassifier.ClassifyRequest(newRequest(userAgent))
+		if body != expected {
+			t.Errorf("expected '%s', got '%s'", expected, body)
+		}
+	}
+
+	if originRequests != 2 {
+		t.Errorf("expected one origin request per class, got %d", originRequests)
+	}
+
+	key := getSecondaryCacheKey(controller.DefaultCacheConfig, []string{}, newRequest(mobile))
+	if !strings.Contains(key, "|class:"+DeviceClassMobile) {
+		t.Errorf("expected the class in the secondary key, got '%s'", key)
+	}
+}
@@ -0,0 +1,153 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	MaxStaleDirective     = "max-stale"
+	MinFreshDirective     = "min-fresh"
+	OnlyIfCachedDirective = "only-if-cached"
+	NoTransformDirective  = "no-transform"
+)
+
+//clientCacheControl holds the parsed request Cache-Control directives as defined in section 5.2.1 of RFC 7234
+// Every directive is parsed independently so the presence of one directive never changes the meaning of another
+type clientCacheControl struct {
+	//maxAge is the value of the max-age directive in seconds, -1 if the directive is not present or invalid
+	maxAge int64
+
+	//maxStale is the value of the max-stale directive in seconds, -1 if the directive is not present or invalid
+	maxStale int64
+
+	//maxStaleUnlimited is true if the max-stale directive is present without a value
+	// which means the client is willing to accept a stale response of any age
+	maxStaleUnlimited bool
+
+	//minFresh is the value of the min-fresh directive in seconds, -1 if the directive is not present or invalid
+	minFresh int64
+
+	//staleIfError is the value of the stale-if-error directive in seconds, -1 if the directive is not present or invalid.
+	// Section 4 of RFC 5861
+	staleIfError int64
+
+	noCache      bool
+	noStore      bool
+	noTransform  bool
+	onlyIfCached bool
+}
+
+//parseClientCacheControl parses the Cache-Control and Pragma headers of a request
+func parseClientCacheControl(header http.Header) clientCacheControl {
+	cc := clientCacheControl{
+		maxAge:   -1,
+		maxStale: -1,
+		minFresh: -1,
+
+		staleIfError: -1,
+	}
+
+	forEachDirective(header[CacheControlHeader], func(name, value string, hasValue bool) {
+		switch name {
+		case MaxAgeDirective:
+			cc.maxAge = parseDeltaSeconds(value, hasValue)
+
+		case MaxStaleDirective:
+			if !hasValue {
+				cc.maxStaleUnlimited = true
+				return
+			}
+
+			cc.maxStale = parseDeltaSeconds(value, hasValue)
+
+		case MinFreshDirective:
+			cc.minFresh = parseDeltaSeconds(value, hasValue)
+
+		case StaleIfErrorDirective:
+			cc.staleIfError = parseDeltaSeconds(value, hasValue)
+
+		case NoCacheDirective:
+			cc.noCache = true
+
+		case NoStoreDirective:
+			cc.noStore = true
+
+		case NoTransformDirective:
+			cc.noTransform = true
+
+		case OnlyIfCachedDirective:
+			cc.onlyIfCached = true
+		}
+	})
+
+	//Section 5.4 of RFC 7234, Pragma: no-cache is only honored if there is no Cache-Control header
+	if header.Get(CacheControlHeader) == "" && header.Get("Pragma") == NoCacheDirective {
+		cc.noCache = true
+	}
+
+	return cc
+}
+
+//ignoresClientNoCache checks if the no-cache directive and Pragma: no-cache of the client are ignored for the request,
+// see CacheConfig.IgnoreClientNoCache. The directive of trusted clients is always honored
+func (controller *CacheController) ignoresClientNoCache(cacheConfig *CacheConfig, req *http.Request) bool {
+	return cacheConfig.IgnoreClientNoCache &&
+		matchesPathPrefix(cacheConfig.IgnoreClientNoCachePaths, req.URL.Path, true) &&
+		!controller.isTrustedClient(req)
+}
+
+//acceptsAge checks if the client is willing to accept a response with the given age in seconds
+// Section 5.2.1.1 of RFC 7234
+func (cc clientCacheControl) acceptsAge(age int64) bool {
+	return cc.maxAge < 0 || age <= cc.maxAge
+}
+
+//acceptsTTL checks if the client is willing to accept a response with the given remaining freshness lifetime
+// A negative ttl means the response is stale
+//
+// min-fresh (section 5.2.1.3 of RFC 7234) raises the required freshness
+// max-stale (section 5.2.1.2 of RFC 7234) lowers the required freshness by the amount of staleness the client accepts
+func (cc clientCacheControl) acceptsTTL(ttl time.Duration) bool {
+	if cc.maxStaleUnlimited {
+		return true
+	}
+
+	required := time.Duration(0)
+
+	if cc.minFresh > 0 {
+		required += time.Duration(cc.minFresh) * time.Second
+	}
+
+	if cc.maxStale > 0 {
+		required -= time.Duration(cc.maxStale) * time.Second
+	}
+
+	//A response with a ttl of exactly zero is stale, so the max-stale bound is inclusive
+	if cc.maxStale >= 0 {
+		return ttl >= required
+	}
+
+	return ttl > required
+}
+
+//parseDeltaSeconds parses a delta-seconds value as defined in section 1.2.1 of RFC 7234
+// -1 is returned if the value is missing or invalid
+func parseDeltaSeconds(value string, hasValue bool) int64 {
+	if !hasValue {
+		return -1
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange && seconds > 0 {
+		//Values which are to big must be treated as the greatest positive integer, section 1.2.1 of RFC 7234
+		return maxDeltaSeconds
+	}
+
+	if err != nil || seconds < 0 {
+		return -1
+	}
+
+	return capDeltaSeconds(seconds)
+}
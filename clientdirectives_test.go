@@ -0,0 +1,186 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseClientCacheControl(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected clientCacheControl
+	}{
+		{
+			name:     "empty",
+			header:   http.Header{},
+			expected: clientCacheControl{maxAge: -1, maxStale: -1, minFresh: -1, staleIfError: -1},
+		},
+		{
+			name:     "max-age",
+			header:   http.Header{CacheControlHeader: []string{"max-age=10"}},
+			expected: clientCacheControl{maxAge: 10, maxStale: -1, minFresh: -1, staleIfError: -1},
+		},
+		{
+			name:     "quoted max-age",
+			header:   http.Header{CacheControlHeader: []string{`max-age="10"`}},
+			expected: clientCacheControl{maxAge: 10, maxStale: -1, minFresh: -1, staleIfError: -1},
+		},
+		{
+			name:     "invalid max-age",
+			header:   http.Header{CacheControlHeader: []string{"max-age=abc"}},
+			expected: clientCacheControl{maxAge: -1, maxStale: -1, minFresh: -1, staleIfError: -1},
+		},
+		{
+			name:     "max-stale without value",
+			header:   http.Header{CacheControlHeader: []string{"max-stale"}},
+			expected: clientCacheControl{maxAge: -1, maxStale: -1, maxStaleUnlimited: true, minFresh: -1, staleIfError: -1},
+		},
+		{
+			name:     "max-stale with value",
+			header:   http.Header{CacheControlHeader: []string{"max-stale=5"}},
+			expected: clientCacheControl{maxAge: -1, maxStale: 5, minFresh: -1, staleIfError: -1},
+		},
+		{
+			name:     "min-fresh",
+			header:   http.Header{CacheControlHeader: []string{"min-fresh=5"}},
+			expected: clientCacheControl{maxAge: -1, maxStale: -1, minFresh: 5, staleIfError: -1},
+		},
+		{
+			name:     "all value directives",
+			header:   http.Header{CacheControlHeader: []string{"max-age=10, max-stale=5", "min-fresh=2"}},
+			expected: clientCacheControl{maxAge: 10, maxStale: 5, minFresh: 2, staleIfError: -1},
+		},
+		{
+			name:   "boolean directives",
+			header: http.Header{CacheControlHeader: []string{"no-cache, no-store, no-transform, only-if-cached"}},
+			expected: clientCacheControl{
+				maxAge: -1, maxStale: -1, minFresh: -1, staleIfError: -1,
+				noCache: true, noStore: true, noTransform: true, onlyIfCached: true,
+			},
+		},
+		{
+			name:     "stale-if-error",
+			header:   http.Header{CacheControlHeader: []string{"stale-if-error=30"}},
+			expected: clientCacheControl{maxAge: -1, maxStale: -1, minFresh: -1, staleIfError: 30},
+		},
+		{
+			name:     "pragma no-cache",
+			header:   http.Header{"Pragma": []string{"no-cache"}},
+			expected: clientCacheControl{maxAge: -1, maxStale: -1, minFresh: -1, staleIfError: -1, noCache: true},
+		},
+		{
+			name:     "pragma ignored with cache-control",
+			header:   http.Header{"Pragma": []string{"no-cache"}, CacheControlHeader: []string{"max-age=10"}},
+			expected: clientCacheControl{maxAge: 10, maxStale: -1, minFresh: -1, staleIfError: -1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cc := parseClientCacheControl(test.header)
+			if cc != test.expected {
+				t.Errorf("expected: %+v, got: %+v", test.expected, cc)
+			}
+		})
+	}
+}
+
+func TestClientCacheControlAccepts(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		age          int64
+		ttl          time.Duration
+		accepted     bool
+	}{
+		{name: "no directives fresh", age: 10, ttl: 10 * time.Second, accepted: true},
+		{name: "no directives stale", age: 10, ttl: -1 * time.Second, accepted: false},
+
+		{name: "max-age younger", cacheControl: "max-age=20", age: 10, ttl: 10 * time.Second, accepted: true},
+		{name: "max-age older", cacheControl: "max-age=5", age: 10, ttl: 10 * time.Second, accepted: false},
+		{name: "max-age stale", cacheControl: "max-age=20", age: 10, ttl: -1 * time.Second, accepted: false},
+
+		{name: "max-stale unlimited stale", cacheControl: "max-stale", age: 1000, ttl: -1000 * time.Second, accepted: true},
+		{name: "max-stale within bound", cacheControl: "max-stale=10", age: 10, ttl: -5 * time.Second, accepted: true},
+		{name: "max-stale outside bound", cacheControl: "max-stale=10", age: 10, ttl: -15 * time.Second, accepted: false},
+
+		{name: "max-age with max-stale", cacheControl: "max-age=20, max-stale=10", age: 15, ttl: -5 * time.Second, accepted: true},
+		{name: "max-age with max-stale too old", cacheControl: "max-age=20, max-stale=10", age: 25, ttl: -5 * time.Second, accepted: false},
+		{name: "max-age with max-stale unlimited", cacheControl: "max-age=20, max-stale", age: 15, ttl: -500 * time.Second, accepted: true},
+
+		{name: "min-fresh fresh enough", cacheControl: "min-fresh=5", age: 10, ttl: 10 * time.Second, accepted: true},
+		{name: "min-fresh not fresh enough", cacheControl: "min-fresh=15", age: 10, ttl: 10 * time.Second, accepted: false},
+
+		{name: "min-fresh with max-age", cacheControl: "min-fresh=5, max-age=20", age: 10, ttl: 10 * time.Second, accepted: true},
+		{name: "min-fresh with max-age too old", cacheControl: "min-fresh=5, max-age=5", age: 10, ttl: 10 * time.Second, accepted: false},
+
+		{name: "min-fresh with max-stale", cacheControl: "min-fresh=5, max-stale=10", age: 10, ttl: -2 * time.Second, accepted: true},
+		{name: "min-fresh with max-stale too stale", cacheControl: "min-fresh=5, max-stale=10", age: 10, ttl: -7 * time.Second, accepted: false},
+
+		{name: "all directives", cacheControl: "max-age=20, max-stale=10, min-fresh=5", age: 15, ttl: -2 * time.Second, accepted: true},
+		{name: "all directives too old", cacheControl: "max-age=20, max-stale=10, min-fresh=5", age: 25, ttl: -2 * time.Second, accepted: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.cacheControl != "" {
+				header.Set(CacheControlHeader, test.cacheControl)
+			}
+
+			cc := parseClientCacheControl(header)
+
+			accepted := cc.acceptsAge(test.age) && cc.acceptsTTL(test.ttl)
+			if accepted != test.accepted {
+				t.Errorf("expected accepted: %v, got: %v", test.accepted, accepted)
+			}
+		})
+	}
+}
+
+func TestIgnoreClientNoCache(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.IgnoreClientNoCache = true
+	controller.DefaultCacheConfig.IgnoreClientNoCachePaths = []string{"/static/"}
+	controller.TrustResolver = TrustResolverFunc(func(req *http.Request) bool {
+		return req.Header.Get("X-Trusted") == "yes"
+	})
+
+	tests := []struct {
+		name             string
+		path             string
+		header           http.Header
+		expectedRequests int
+	}{
+		{name: "store", path: "/static/app.js", expectedRequests: 1},
+		{name: "no-cache ignored", path: "/static/app.js", header: http.Header{CacheControlHeader: []string{"no-cache"}}, expectedRequests: 1},
+		{name: "pragma ignored", path: "/static/app.js", header: http.Header{"Pragma": []string{"no-cache"}}, expectedRequests: 1},
+		{name: "trusted client", path: "/static/app.js", header: http.Header{CacheControlHeader: []string{"no-cache"}, "X-Trusted": []string{"yes"}}, expectedRequests: 2},
+		{name: "store other path", path: "/page", expectedRequests: 3},
+		{name: "no-cache honored on other path", path: "/page", header: http.Header{CacheControlHeader: []string{"no-cache"}}, expectedRequests: 4},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+test.path, nil)
+		for name, values := range test.header {
+			req.Header[name] = values
+		}
+
+		doTestRequest(t, controller, req)
+
+		if originRequests != test.expectedRequests {
+			t.Errorf("%s: expected %d origin requests, got %d", test.name, test.expectedRequests, originRequests)
+		}
+	}
+}
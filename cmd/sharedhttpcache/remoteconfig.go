@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dylandreimerink/sharedhttpcache"
+
+	"github.com/spf13/viper"
+)
+
+//Backends from which the config can be read, see the config-backend flag
+const (
+	configBackendFile   = "file"
+	configBackendEtcd   = "etcd"
+	configBackendConsul = "consul"
+)
+
+//remoteConfigRetryInterval is the time between attempts to watch the remote config after a error
+const remoteConfigRetryInterval = 5 * time.Second
+
+//consulWaitTime is the maximum time a blocking query to Consul waits for a change
+const consulWaitTime = "5m"
+
+//A remoteConfigSource reads the YAML config from a key value store shared by a fleet of caches
+type remoteConfigSource interface {
+	//read returns the current config and its version
+	read(ctx context.Context) ([]byte, int64, error)
+
+	//watch blocks until the version of the config is newer than the given version and returns the new config and version
+	watch(ctx context.Context, version int64) ([]byte, int64, error)
+}
+
+//newRemoteConfigSource creates the source of the backend, endpoint is the base URL of the HTTP API of the backend
+func newRemoteConfigSource(backend, endpoint, key string) (remoteConfigSource, error) {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	switch backend {
+	case configBackendEtcd:
+		if endpoint == "" {
+			endpoint = "http://127.0.0.1:2379"
+		}
+
+		return &etcdConfigSource{endpoint: endpoint, key: key, client: &http.Client{}}, nil
+
+	case configBackendConsul:
+		if endpoint == "" {
+			endpoint = "http://127.0.0.1:8500"
+		}
+
+		return &consulConfigSource{
+			endpoint: endpoint,
+			key:      strings.TrimPrefix(key, "/"),
+			token:    os.Getenv("CONSUL_HTTP_TOKEN"),
+			client:   &http.Client{},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid config backend '%s'", backend)
+}
+
+//consulConfigSource reads the config from the KV store of Consul, changes are watched with blocking queries
+type consulConfigSource struct {
+	endpoint string
+	key      string
+	token    string
+	client   *http.Client
+}
+
+func (source *consulConfigSource) read(ctx context.Context) ([]byte, int64, error) {
+	return source.get(ctx, url.Values{})
+}
+
+func (source *consulConfigSource) watch(ctx context.Context, version int64) ([]byte, int64, error) {
+	for {
+		//A blocking query returns when the index of the key changes or the wait time passed
+		value, index, err := source.get(ctx, url.Values{
+			"index": {strconv.FormatInt(version, 10)},
+			"wait":  {consulWaitTime},
+		})
+		if err != nil || index != version {
+			return value, index, err
+		}
+	}
+}
+
+//get requests the raw value of the key and returns it with the X-Consul-Index of the response
+func (source *consulConfigSource) get(ctx context.Context, query url.Values) ([]byte, int64, error) {
+	query.Set("raw", "")
+
+	req, err := http.NewRequest(http.MethodGet, source.endpoint+"/v1/kv/"+source.key+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if source.token != "" {
+		req.Header.Set("X-Consul-Token", source.token)
+	}
+
+	resp, err := source.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	value, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("Consul responded with status %s for key '%s'", resp.Status, source.key)
+	}
+
+	index, err := strconv.ParseInt(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Consul responded without a valid index: %w", err)
+	}
+
+	return value, index, nil
+}
+
+//etcdConfigSource reads the config from etcd using the JSON gateway of the v3 API, changes are watched with a watch stream
+type etcdConfigSource struct {
+	endpoint string
+	key      string
+	client   *http.Client
+}
+
+//etcdKeyValue is a key value pair of the etcd v3 JSON gateway, bytes are base64 encoded and integers are strings
+type etcdKeyValue struct {
+	Value       string `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+func (source *etcdConfigSource) read(ctx context.Context) ([]byte, int64, error) {
+	result := struct {
+		KVs []etcdKeyValue `json:"kvs"`
+	}{}
+
+	resp, err := source.post(ctx, "/v3/kv/range", map[string]interface{}{
+		"key": base64.StdEncoding.EncodeToString([]byte(source.key)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+
+	if len(result.KVs) == 0 {
+		return nil, 0, fmt.Errorf("The key '%s' doesn't exist in etcd", source.key)
+	}
+
+	return source.decode(result.KVs[0])
+}
+
+func (source *etcdConfigSource) watch(ctx context.Context, version int64) ([]byte, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp, err := source.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            base64.StdEncoding.EncodeToString([]byte(source.key)),
+			"start_revision": strconv.FormatInt(version+1, 10),
+		},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	//The watch stream is a sequence of JSON objects, the first confirms the creation of the watch
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		message := struct {
+			Result struct {
+				Events []struct {
+					Type string       `json:"type"`
+					KV   etcdKeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}{}
+
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return nil, 0, err
+		}
+
+		//A deleted config is ignored, the last config remains in use
+		events := message.Result.Events
+		for index := len(events) - 1; index >= 0; index-- {
+			if events[index].Type != "DELETE" {
+				return source.decode(events[index].KV)
+			}
+		}
+	}
+}
+
+//post sends the body as JSON to the path of the etcd gateway
+func (source *etcdConfigSource) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, source.endpoint+path, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := source.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd responded with status %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+func (source *etcdConfigSource) decode(kv etcdKeyValue) ([]byte, int64, error) {
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return value, kv.ModRevision, nil
+}
+
+//liveCacheConfig is the cache config resolver of the controller if the config is read from a remote backend,
+// the cache config is replaced without a restart when the remote config changes.
+// The DefaultCacheConfig of the controller is not replaced, it is read without synchronization.
+// Purges and the cache status header of bypassed requests keep using the cache config of the startup config until a restart
+type liveCacheConfig struct {
+	current atomic.Value
+}
+
+func (live *liveCacheConfig) GetCacheConfig(req *http.Request) *sharedhttpcache.CacheConfig {
+	return live.current.Load().(*sharedhttpcache.CacheConfig)
+}
+
+//watchRemoteConfig applies changes of the remote config until the context is canceled.
+// Changes to the cache_config are applied immediately, changes to other sections are only applied after a restart
+func watchRemoteConfig(ctx context.Context, source remoteConfigSource, version int64, live *liveCacheConfig) {
+	for {
+		configBytes, newVersion, err := source.watch(ctx, version)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while watching remote config: %s\n", err.Error())
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(remoteConfigRetryInterval):
+			}
+
+			continue
+		}
+
+		version = newVersion
+
+		newConfig, err := parseConfig(configBytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring invalid remote config version %d: %s\n", version, err.Error())
+			continue
+		}
+
+		cacheConfig, err := newConfig.CacheConfig.toRealCacheConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring invalid remote config version %d: %s\n", version, err.Error())
+			continue
+		}
+
+		live.current.Store(cacheConfig)
+		fmt.Printf("Applied cache config of remote config version %d\n", version)
+
+		if !reflect.DeepEqual(config.CacheConfig, newConfig.CacheConfig) {
+			fmt.Fprintf(os.Stderr, "Purges use the cache_config of the startup config, changes to it apply to purges after a restart\n")
+		}
+
+		//Only the cache config is compared, the other sections of the running config don't change
+		oldSections, newSections := config, newConfig
+		oldSections.CacheConfig, newSections.CacheConfig = CacheConfig{}, CacheConfig{}
+		if !reflect.DeepEqual(oldSections, newSections) {
+			fmt.Fprintf(os.Stderr, "Remote config version %d changes sections other than cache_config, they are applied after a restart\n", version)
+		}
+	}
+}
+
+//parseConfig parses the YAML config, the defaults are applied to missing values.
+// A new viper instance is used, the global instance holds the startup config and isn't safe for use from multiple goroutines
+func parseConfig(configBytes []byte) (Config, error) {
+	parsed := Config{}
+
+	v := viper.New()
+	setConfigDefaults(v)
+
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(bytes.NewReader(configBytes))
+	if err != nil {
+		return parsed, err
+	}
+
+	err = v.Unmarshal(&parsed)
+	return parsed, err
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestConsulConfigSource(t *testing.T) {
+	var lock sync.Mutex
+	blockingQueries := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/kv/sharedhttpcache/config.yaml" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if _, raw := req.URL.Query()["raw"]; !raw {
+			t.Errorf("expected the raw value to be requested")
+		}
+
+		if token := req.Header.Get("X-Consul-Token"); token != "secret" {
+			t.Errorf("expected the Consul token to be sent, got '%s'", token)
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		if req.URL.Query().Get("index") == "" {
+			rw.Header().Set("X-Consul-Index", "5")
+			_, _ = rw.Write([]byte("version: 1"))
+			return
+		}
+
+		if req.URL.Query().Get("index") != "5" || req.URL.Query().Get("wait") != consulWaitTime {
+			t.Errorf("expected a blocking query for index 5, got: %s", req.URL.RawQuery)
+		}
+
+		//The first blocking query times out without a change, the next one returns the new value
+		blockingQueries++
+		if blockingQueries == 1 {
+			rw.Header().Set("X-Consul-Index", "5")
+			_, _ = rw.Write([]byte("version: 1"))
+			return
+		}
+
+		rw.Header().Set("X-Consul-Index", "7")
+		_, _ = rw.Write([]byte("version: 2"))
+	}))
+	defer server.Close()
+
+	source, err := newRemoteConfigSource(configBackendConsul, server.URL+"/", "/sharedhttpcache/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.(*consulConfigSource).token = "secret"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	configBytes, version, err := source.read(ctx)
+	if err != nil || string(configBytes) != "version: 1" || version != 5 {
+		t.Fatalf("expected version 5 of the config, got '%s' version %d, error: %v", configBytes, version, err)
+	}
+
+	configBytes, version, err = source.watch(ctx, version)
+	if err != nil || string(configBytes) != "version: 2" || version != 7 {
+		t.Fatalf("expected version 7 of the config, got '%s' version %d, error: %v", configBytes, version, err)
+	}
+
+	_, _, err = (&consulConfigSource{endpoint: server.URL, key: "missing", client: &http.Client{}}).read(ctx)
+	if err == nil {
+		t.Errorf("expected a error for a missing key")
+	}
+}
+
+func TestEtcdConfigSource(t *testing.T) {
+	encode := func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("expected a JSON request body: %v", err)
+		}
+
+		switch req.URL.Path {
+		case "/v3/kv/range":
+			if body["key"] != encode("sharedhttpcache/config.yaml") {
+				_, _ = rw.Write([]byte(`{"header":{}}`))
+				return
+			}
+
+			_, _ = rw.Write([]byte(`{"kvs":[{"key":"` + encode("sharedhttpcache/config.yaml") + `","value":"` + encode("version: 1") + `","mod_revision":"10"}]}`))
+
+		case "/v3/watch":
+			create, _ := body["create_request"].(map[string]interface{})
+			if create["start_revision"] != "11" {
+				t.Errorf("expected the watch to start after the read revision, got: %v", create["start_revision"])
+			}
+
+			//The watch is confirmed first, a deleted config is ignored
+			_, _ = rw.Write([]byte(`{"result":{"created":true}}` + "\n"))
+			_, _ = rw.Write([]byte(`{"result":{"events":[{"type":"DELETE","kv":{"mod_revision":"11"}}]}}` + "\n"))
+			_, _ = rw.Write([]byte(`{"result":{"events":[{"kv":{"value":"` + encode("version: 2") + `","mod_revision":"12"}},{"type":"DELETE","kv":{"mod_revision":"13"}}]}}` + "\n"))
+
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	source, err := newRemoteConfigSource(configBackendEtcd, server.URL, "sharedhttpcache/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	configBytes, version, err := source.read(ctx)
+	if err != nil || string(configBytes) != "version: 1" || version != 10 {
+		t.Fatalf("expected revision 10 of the config, got '%s' revision %d, error: %v", configBytes, version, err)
+	}
+
+	configBytes, version, err = source.watch(ctx, version)
+	if err != nil || string(configBytes) != "version: 2" || version != 12 {
+		t.Fatalf("expected revision 12 of the config, got '%s' revision %d, error: %v", configBytes, version, err)
+	}
+
+	_, _, err = (&etcdConfigSource{endpoint: server.URL, key: "missing", client: &http.Client{}}).read(ctx)
+	if err == nil {
+		t.Errorf("expected a error for a missing key")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	parsed, err := parseConfig([]byte("cache_config:\n  cache_status_header: X-Cache-Status\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.CacheConfig.CacheStatusHeader != "X-Cache-Status" {
+		t.Errorf("expected the value of the config, got '%s'", parsed.CacheConfig.CacheStatusHeader)
+	}
+
+	if !parsed.CacheConfig.ServeStaleOnError {
+		t.Errorf("expected the defaults to be applied to missing values")
+	}
+
+	//The startup config in the global viper instance must not change
+	if viper.IsSet("cache_config.cache_status_header") {
+		t.Errorf("expected the global config to be unmodified")
+	}
+
+	if _, err := parseConfig([]byte("cache_config: [")); err == nil {
+		t.Errorf("expected a error for invalid YAML")
+	}
+}
+
+//testConfigSource is a remote config source which returns the configs sent to its channel
+type testConfigSource struct {
+	configs chan string
+}
+
+func (source *testConfigSource) read(ctx context.Context) ([]byte, int64, error) {
+	return nil, 0, nil
+}
+
+func (source *testConfigSource) watch(ctx context.Context, version int64) ([]byte, int64, error) {
+	select {
+	case config := <-source.configs:
+		return []byte(config), version + 1, nil
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+func TestWatchRemoteConfig(t *testing.T) {
+	live := &liveCacheConfig{}
+	initial, err := config.CacheConfig.toRealCacheConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.current.Store(initial)
+
+	source := &testConfigSource{configs: make(chan string)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchRemoteConfig(ctx, source, 1, live)
+		close(done)
+	}()
+
+	//A invalid config is ignored, the next valid config is applied
+	source.configs <- "cache_config: ["
+	source.configs <- "cache_config:\n  cache_status_header: X-Cache-Status\n"
+
+	deadline := time.Now().Add(5 * time.Second)
+	for live.GetCacheConfig(nil).CacheStatusHeader != "X-Cache-Status" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the remote cache config to be applied")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
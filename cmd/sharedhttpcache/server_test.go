@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//startTestServer serves the listen config of the YAML config with a handler which always responds with 200
+func startTestServer(t *testing.T, yamlConfig string) (net.Addr, func()) {
+	parsed, err := parseConfig([]byte(yamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newHTTPServer(parsed.ListenConfig, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+
+	go server.Serve(listener)
+
+	return listener.Addr(), func() {
+		server.Close()
+	}
+}
+
+func TestListenConfigDefaults(t *testing.T) {
+	parsed, err := parseConfig([]byte("listen_config:\n  listen_address: \":8080\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newHTTPServer(parsed.ListenConfig, http.NotFoundHandler())
+
+	if server.ReadHeaderTimeout != 10*time.Second {
+		t.Errorf("expected a default read header timeout of 10s, got %s", server.ReadHeaderTimeout)
+	}
+
+	if server.MaxHeaderBytes != http.DefaultMaxHeaderBytes {
+		t.Errorf("expected the default max header bytes, got %d", server.MaxHeaderBytes)
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	addr, stop := startTestServer(t, "listen_config:\n  read_header_timeout: 100ms\n")
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	//The header is never finished, like a slowloris client
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_ = conn.SetReadDeadline(start.Add(5 * time.Second))
+
+	response, _ := ioutil.ReadAll(conn)
+	if time.Since(start) >= 5*time.Second {
+		t.Fatalf("expected the connection to be closed after the read header timeout")
+	}
+
+	if strings.Contains(string(response), "200 OK") {
+		t.Errorf("expected no response to a incomplete header, got: %s", response)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	addr, stop := startTestServer(t, "listen_config:\n  max_header_bytes: 1024\n")
+	defer stop()
+
+	send := func(headerSize int) *http.Response {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req := "GET / HTTP/1.1\r\nHost: example.com\r\nX-Padding: " + strings.Repeat("a", headerSize) + "\r\n\r\n"
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		return response
+	}
+
+	if response := send(100); response.StatusCode != http.StatusOK {
+		t.Errorf("expected a small header to be accepted, got status %d", response.StatusCode)
+	}
+
+	//The server allows a margin of 4096 bytes on top of the limit
+	if response := send(16 * 1024); response.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("expected status 431 for a large header, got %d", response.StatusCode)
+	}
+}
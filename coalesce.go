@@ -0,0 +1,40 @@
+package sharedhttpcache
+
+//flight is a request to the origin for a cache key, other requests for the same key in this instance wait for it
+// instead of sending the same request to the origin, see CacheController.CoalesceRequests
+type flight struct {
+	//done is closed once the response of the leader is stored, or once the leader gave up
+	done chan struct{}
+}
+
+//joinFlight returns the flight of the key. If no request for the key is in flight a new flight is started
+// and true is returned, the caller is then the leader and must call landFlight once it is done
+func (controller *CacheController) joinFlight(key string) (*flight, bool) {
+	controller.flightsMutex.Lock()
+	defer controller.flightsMutex.Unlock()
+
+	if existing, found := controller.flights[key]; found {
+		return existing, false
+	}
+
+	if controller.flights == nil {
+		controller.flights = make(map[string]*flight)
+	}
+
+	started := &flight{done: make(chan struct{})}
+	controller.flights[key] = started
+
+	return started, true
+}
+
+//landFlight ends the flight of the key, the waiting requests are released so they can look up the stored response
+func (controller *CacheController) landFlight(key string, landed *flight) {
+	controller.flightsMutex.Lock()
+	defer controller.flightsMutex.Unlock()
+
+	if controller.flights[key] == landed {
+		delete(controller.flights, key)
+	}
+
+	close(landed.done)
+}
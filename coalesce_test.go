@@ -0,0 +1,92 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceRequests(t *testing.T) {
+	var originRequests int32
+	received := make(chan struct{})
+	release := make(chan struct{})
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&originRequests, 1) == 1 {
+			close(received)
+			<-release
+		}
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.CoalesceRequests = true
+
+	bodies := make([]string, 5)
+	wg := sync.WaitGroup{}
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			recorder := httptest.NewRecorder()
+			controller.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+			bodies[i] = recorder.Body.String()
+		}(i)
+
+		//The other requests are sent while the first request is in flight
+		if i == 0 {
+			<-received
+		}
+	}
+
+	//Give the other requests time to join the flight
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if requests := atomic.LoadInt32(&originRequests); requests != 1 {
+		t.Errorf("expected 1 request to the origin, got %d", requests)
+	}
+
+	for i, body := range bodies {
+		if body != "content" {
+			t.Errorf("expected request %d to get the content, got '%s'", i, body)
+		}
+	}
+
+	if len(controller.flights) != 0 {
+		t.Errorf("expected no flights after all requests are done, got %d", len(controller.flights))
+	}
+}
+
+func TestCoalesceRequestsUncacheable(t *testing.T) {
+	var originRequests int32
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&originRequests, 1)
+
+		rw.Header().Set(CacheControlHeader, "no-store")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.CoalesceRequests = true
+
+	//Responses which aren't stored can't be shared, every request is forwarded
+	for i := 0; i < 3; i++ {
+		_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if body != "content" {
+			t.Errorf("expected the content, got '%s'", body)
+		}
+	}
+
+	if requests := atomic.LoadInt32(&originRequests); requests != 3 {
+		t.Errorf("expected 3 requests to the origin, got %d", requests)
+	}
+}
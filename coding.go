@@ -0,0 +1,151 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//A ContentCoding decodes and encodes bodies with a content coding like gzip, section 3.1.2.1 of RFC 7231
+// It is used to decode encoded responses before they are transformed and to encode them again afterwards
+type ContentCoding interface {
+
+	//Decode returns the decoded body
+	Decode(encoded []byte) ([]byte, error)
+
+	//Encode returns the encoded body
+	Encode(body []byte) ([]byte, error)
+}
+
+type gzipContentCoding struct{}
+
+func (gzipContentCoding) Decode(encoded []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (gzipContentCoding) Encode(body []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+
+	return finishEncoding(buf, writer, body)
+}
+
+type deflateContentCoding struct{}
+
+func (deflateContentCoding) Decode(encoded []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(encoded))
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (deflateContentCoding) Encode(body []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	return finishEncoding(buf, writer, body)
+}
+
+//finishEncoding writes the body to the encoder and returns the encoded bytes once the encoder is closed
+func finishEncoding(buf *bytes.Buffer, writer io.WriteCloser, body []byte) ([]byte, error) {
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+var (
+	//GzipContentCoding is the ContentCoding for gzip, section 4.2.3 of RFC 7230
+	GzipContentCoding ContentCoding = gzipContentCoding{}
+
+	//DeflateContentCoding is the ContentCoding for raw deflate data. Section 4.2.2 of RFC 7230 specifies deflate as zlib data,
+	// but like most browsers raw deflate data is assumed since that is what most servers send
+	DeflateContentCoding ContentCoding = deflateContentCoding{}
+)
+
+//DefaultContentCodings are the content codings which are used if CacheConfig.ContentCodings is nil
+// Other codings like brotli ("br") can be supported by adding a ContentCoding for them to CacheConfig.ContentCodings
+var DefaultContentCodings = map[string]ContentCoding{
+	"gzip":    GzipContentCoding,
+	"x-gzip":  GzipContentCoding,
+	"deflate": DeflateContentCoding,
+}
+
+//contentCodingOf returns the content coding of the response. The coding is nil if the body isn't encoded,
+// false is returned if the body is encoded with a coding which isn't supported or with multiple codings
+func contentCodingOf(cacheConfig *CacheConfig, header http.Header) (ContentCoding, bool) {
+	contentEncoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	if contentEncoding == "" || contentEncoding == "identity" {
+		return nil, true
+	}
+
+	codings := cacheConfig.ContentCodings
+	if codings == nil {
+		codings = DefaultContentCodings
+	}
+
+	coding, found := codings[contentEncoding]
+	return coding, found && coding != nil
+}
+
+//readDecodedBody reads the complete body of the response and decodes it with the content coding
+// The encoded body is returned as well so it can be served unchanged if the decoded body isn't modified
+func readDecodedBody(coding ContentCoding, response *http.Response) (decoded []byte, encoded []byte, err error) {
+	encoded, err = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return encoded, encoded, err
+	}
+
+	if coding == nil {
+		return encoded, encoded, nil
+	}
+
+	decoded, err = coding.Decode(encoded)
+	return decoded, encoded, err
+}
+
+//encodeBody encodes the body with the content coding, if the coding is nil the body isn't encoded
+func encodeBody(coding ContentCoding, body []byte) ([]byte, error) {
+	if coding == nil {
+		return body, nil
+	}
+
+	return coding.Encode(body)
+}
+
+//defaultOriginTransport is used if the controller has no transport
+var defaultOriginTransport = NewOriginTransport(nil)
+
+//NewOriginTransport returns a transport for requests to origin servers based on http.DefaultTransport.
+// Compression is disabled so the transport doesn't ask for and transparently decode compressed responses,
+// the cache has to store and serve the representation exactly as it was sent by the origin
+func NewOriginTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport
+}
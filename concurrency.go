@@ -0,0 +1,183 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//DefaultOriginRetryAfter is the Retry-After of the 503 response which is send when a origin has MaxConcurrentRequests in flight,
+// if RetryAfter of the forward config is zero
+const DefaultOriginRetryAfter = time.Second
+
+//DefaultOriginQueueTimeout is the maximum time a request waits for a slot of the origin if QueueTimeout of the forward config is zero
+const DefaultOriginQueueTimeout = 5 * time.Second
+
+//MetricOriginQueueWait is observed every time a request waited in the queue of a origin which has MaxConcurrentRequests in flight,
+// tagged with the origin host and the result, which is "acquired", "timeout" or "full" if the queue had no room
+const MetricOriginQueueWait = "origin.queue_wait"
+
+//MetricOriginConcurrencyLimited is counted every time a request isn't forwarded because the origin has MaxConcurrentRequests in flight,
+// tagged with the origin host
+const MetricOriginConcurrencyLimited = "origin.concurrency_limited"
+
+//originBusyMessage is the body of the 503 response which is send when the concurrency limit of a origin is reached
+const originBusyMessage = "Origin server is busy\n"
+
+//originSlots tracks the requests in flight to a single origin and the requests waiting for one of them to finish
+type originSlots struct {
+	inFlight int
+
+	//queue holds a channel for every waiting request in order of arrival, it is closed when the slot is handed over
+	queue []chan struct{}
+}
+
+//acquireOriginSlot reserves one of the MaxConcurrentRequests of the origin. If all are in use the request waits in the queue
+// of the origin for at most QueueTimeout, unless MaxQueuedRequests are already waiting.
+// false is returned if no slot was acquired. The release function must be called once the request to the origin is done
+func (controller *CacheController) acquireOriginSlot(ctx context.Context, forwardConfig *ForwardConfig) (func(), bool) {
+	if forwardConfig.MaxConcurrentRequests <= 0 {
+		return func() {}, true
+	}
+
+	host := forwardConfig.Host
+	release := func() {
+		controller.releaseOriginSlot(host)
+	}
+
+	controller.originSlotsMutex.Lock()
+
+	if controller.originSlots == nil {
+		controller.originSlots = make(map[string]*originSlots)
+	}
+
+	slots := controller.originSlots[host]
+	if slots == nil {
+		slots = &originSlots{}
+		controller.originSlots[host] = slots
+	}
+
+	if slots.inFlight < forwardConfig.MaxConcurrentRequests {
+		slots.inFlight++
+		controller.originSlotsMutex.Unlock()
+
+		return release, true
+	}
+
+	if len(slots.queue) >= forwardConfig.MaxQueuedRequests {
+		controller.originSlotsMutex.Unlock()
+
+		controller.observeOriginQueueWait(host, 0, "full")
+		return nil, false
+	}
+
+	handover := make(chan struct{})
+	slots.queue = append(slots.queue, handover)
+	controller.originSlotsMutex.Unlock()
+
+	start := time.Now()
+
+	timeout := forwardConfig.QueueTimeout
+	if timeout <= 0 {
+		timeout = DefaultOriginQueueTimeout
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-handover:
+		controller.observeOriginQueueWait(host, time.Since(start), "acquired")
+		return release, true
+
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	controller.originSlotsMutex.Lock()
+	removed := false
+	for index, waiting := range slots.queue {
+		if waiting == handover {
+			slots.queue = append(slots.queue[:index], slots.queue[index+1:]...)
+			removed = true
+			break
+		}
+	}
+	controller.originSlotsMutex.Unlock()
+
+	//The slot was handed over at the same moment the wait ended, pass it on to the next in the queue
+	if !removed {
+		release()
+	}
+
+	controller.observeOriginQueueWait(host, time.Since(start), "timeout")
+	return nil, false
+}
+
+//releaseOriginSlot hands the slot over to the first request in the queue, or frees it if no request is waiting
+func (controller *CacheController) releaseOriginSlot(host string) {
+	controller.originSlotsMutex.Lock()
+	defer controller.originSlotsMutex.Unlock()
+
+	slots := controller.originSlots[host]
+	if slots == nil {
+		return
+	}
+
+	if len(slots.queue) > 0 {
+		close(slots.queue[0])
+		slots.queue = slots.queue[1:]
+		return
+	}
+
+	slots.inFlight--
+	if slots.inFlight <= 0 {
+		delete(controller.originSlots, host)
+	}
+}
+
+//observeOriginQueueWait records how long a request waited for a slot of the origin and how the wait ended
+func (controller *CacheController) observeOriginQueueWait(host string, wait time.Duration, result string) {
+	if controller.Metrics == nil {
+		return
+	}
+
+	controller.Metrics.ObserveDuration(MetricOriginQueueWait, wait, map[string]string{
+		"origin": host,
+		"result": result,
+	})
+}
+
+//makeOriginBusyResponse creates the response which is used instead of a origin response when the origin has MaxConcurrentRequests in flight
+// It is handled like a 503 of the origin, so a stale response is served instead if allowed
+func makeOriginBusyResponse(forwardConfig *ForwardConfig, req *http.Request) *http.Response {
+	retryAfter := forwardConfig.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = DefaultOriginRetryAfter
+	}
+
+	//Retry-After is in whole seconds, round up so clients never retry too early
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+
+	header := http.Header{}
+	header.Set("Retry-After", strconv.FormatInt(seconds, 10))
+	header.Set(CacheControlHeader, "no-store")
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(originBusyMessage)))
+
+	return &http.Response{
+		Status:        "503 Service Unavailable",
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewBufferString(originBusyMessage)),
+		ContentLength: int64(len(originBusyMessage)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,117 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOriginConcurrencyLimit(t *testing.T) {
+	started := make(chan bool)
+	unblock := make(chan bool)
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			started <- true
+			<-unblock
+		}
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultForwardConfig.MaxConcurrentRequests = 1
+
+	done := make(chan bool)
+	go func() {
+		controller.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://"+host+"/slow", nil))
+		close(done)
+	}()
+	<-started
+
+	response, _ := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/other", nil))
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 while the origin is at its limit, got %d", response.StatusCode)
+	}
+	if retryAfter := response.Header.Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("expected Retry-After 1, got '%s'", retryAfter)
+	}
+
+	close(unblock)
+	<-done
+
+	response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/other", nil))
+	if response.StatusCode != http.StatusOK || body != "content" {
+		t.Errorf("expected the request to be forwarded once the slot is released, got status %d", response.StatusCode)
+	}
+}
+
+func TestOriginRequestQueue(t *testing.T) {
+	started := make(chan bool)
+	unblock := make(chan bool)
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			started <- true
+			<-unblock
+		}
+
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultForwardConfig.MaxConcurrentRequests = 1
+	controller.DefaultForwardConfig.MaxQueuedRequests = 1
+	controller.DefaultForwardConfig.QueueTimeout = 50 * time.Millisecond
+
+	slowDone := make(chan bool)
+	go func() {
+		controller.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://"+host+"/slow", nil))
+		close(slowDone)
+	}()
+	<-started
+
+	//The queued request times out since the slow request holds the only slot
+	response, _ := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/queued", nil))
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 after the queue timeout, got %d", response.StatusCode)
+	}
+
+	//A queued request gets the slot once the slow request finishes
+	controller.DefaultForwardConfig.QueueTimeout = 5 * time.Second
+
+	queued := httptest.NewRecorder()
+	queuedDone := make(chan bool)
+	go func() {
+		controller.ServeHTTP(queued, httptest.NewRequest(http.MethodGet, "http://"+host+"/queued", nil))
+		close(queuedDone)
+	}()
+
+	//Wait until the request is queued
+	for {
+		controller.originSlotsMutex.Lock()
+		waiting := len(controller.originSlots[controller.DefaultForwardConfig.Host].queue)
+		controller.originSlotsMutex.Unlock()
+
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//The queue is full, so this request fails immediately
+	response, _ = doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/full", nil))
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 when the queue is full, got %d", response.StatusCode)
+	}
+
+	close(unblock)
+	<-slowDone
+	<-queuedDone
+
+	if queued.Code != http.StatusOK || queued.Body.String() != "content" {
+		t.Errorf("expected the queued request to be forwarded, got status %d", queued.Code)
+	}
+}
@@ -0,0 +1,91 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"strings"
+)
+
+//clientValidationHeaders are the preconditions with which a client validates its own stored response, section 3 of RFC 7232
+var clientValidationHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+//notModifiedHeaders are the headers which are sent in a 304 response if the full response contains them, section 4.1 of RFC 7232
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Vary"}
+
+//stripClientValidators removes the validation preconditions of the client from the request
+// so the origin returns a full response which can be stored instead of a 304.
+// The request is only copied if it contains preconditions
+func stripClientValidators(req *http.Request) *http.Request {
+	for _, name := range clientValidationHeaders {
+		if req.Header.Get(name) == "" {
+			continue
+		}
+
+		stripped := req.Clone(req.Context())
+		for _, name := range clientValidationHeaders {
+			stripped.Header.Del(name)
+		}
+
+		return stripped
+	}
+
+	return req
+}
+
+//clientHasCurrentResponse evaluates the validation preconditions of the client against a full response
+// It returns true if the response the client has stored is still valid, in which case a 304 can be sent.
+// The order of evaluation follows section 6 of RFC 7232
+func clientHasCurrentResponse(req *http.Request, response *http.Response) bool {
+	if response.StatusCode != http.StatusOK {
+		return false
+	}
+
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := response.Header.Get("Etag")
+		if etag == "" {
+			return false
+		}
+
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakETagEqual(candidate, etag) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	//If-Modified-Since is only evaluated for GET and HEAD requests, section 3.3 of RFC 7232
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(response.Header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.After(ifModifiedSince)
+}
+
+//writeNotModified sends a 304 response to the client based on the full response, the body of the full response is discarded
+func writeNotModified(rw http.ResponseWriter, response *http.Response) {
+	if response.Body != nil {
+		response.Body.Close()
+	}
+
+	restoreOriginCacheControl(response.Header)
+
+	for _, name := range notModifiedHeaders {
+		if values, found := response.Header[http.CanonicalHeaderKey(name)]; found {
+			rw.Header()[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	rw.WriteHeader(http.StatusNotModified)
+}
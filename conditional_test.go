@@ -0,0 +1,54 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStripClientValidators(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		originRequests := 0
+
+		controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			originRequests++
+
+			rw.Header().Set(CacheControlHeader, "max-age=60")
+			rw.Header().Set("Etag", `"v1"`)
+
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			_, _ = rw.Write([]byte("content"))
+		}))
+
+		controller.DefaultCacheConfig.StripClientValidators = strip
+
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.Header.Set("If-None-Match", `"v1"`)
+
+		response, _ := doTestRequest(t, controller, req)
+		if response.StatusCode != http.StatusNotModified {
+			t.Errorf("strip %v: expected the client to get a 304, got %d", strip, response.StatusCode)
+		}
+
+		//Only if the validators were stripped the full response was stored, so the next request is a hit
+		response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if response.StatusCode != http.StatusOK || body != "content" {
+			t.Errorf("strip %v: expected full response, got status %d and body '%s'", strip, response.StatusCode, body)
+		}
+
+		expectedOriginRequests := 2
+		if strip {
+			expectedOriginRequests = 1
+		}
+
+		if originRequests != expectedOriginRequests {
+			t.Errorf("strip %v: expected %d origin requests, got %d", strip, expectedOriginRequests, originRequests)
+		}
+
+		closeOrigin()
+	}
+}
@@ -2,6 +2,7 @@ package sharedhttpcache
 
 import (
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
@@ -53,9 +54,247 @@ type CacheConfig struct {
 	//This setting respects the Cache-Control header of the client and server.
 	ServeStaleOnError bool
 
+	//ServeStaleOnFailures restricts ServeStaleOnError to the listed classes of origin failures: OriginFailureUnreachable,
+	// OriginFailureTimeout, OriginFailureServerError and OriginFailureInvalidResponse. If empty all failures are allowed
+	ServeStaleOnFailures []string
+
+	//ServeStaleStatusCodes restricts ServeStaleOnError to stored responses with the listed status codes,
+	// so for example a stale 200 can be served while a stale 404 never is. If empty all status codes are allowed
+	ServeStaleStatusCodes []int
+
+	//ResponseValidators check 200 responses of the origin before they are stored, a response rejected by any of them isn't stored.
+	// If a stale response is revalidated and the new response is rejected, the stale response is served instead if allowed,
+	// see OriginFailureInvalidResponse. Validating buffers the whole body, like body transformers
+	ResponseValidators []ResponseValidator
+
+	//PoisoningProtection is the way responses which depend on unkeyed request headers are handled, to protect against web cache poisoning:
+	// PoisoningProtectionWarn, PoisoningProtectionStrip or PoisoningProtectionRefuse. If empty there is no protection
+	PoisoningProtection string
+
+	//UnkeyedHeaders are the request headers which are not part of the cache key and can be used to poison the cache,
+	// if nil DefaultUnkeyedHeaders is used
+	UnkeyedHeaders []string
+
+	//RequestAuthorizer can optionally be set. If not nil every request must be authorized by it before it is served from the cache
+	// or forwarded to the origin, a 403 is sent otherwise. See URLSigner for signed URLs
+	RequestAuthorizer RequestAuthorizer
+
+	//EdgeAuthenticationPaths is a list of path prefixes on which the cache authenticates requests with the EdgeAuthenticator,
+	// a 401 is sent if it rejects the request. The Authorization header is removed from authenticated requests,
+	// so their responses are stored once and served to every authenticated client.
+	// The prefixes are matched case insensitively against the path without dot segments and duplicate slashes,
+	// which is also the path forwarded to the origin
+	EdgeAuthenticationPaths []string
+
+	//EdgeAuthenticator authenticates requests on EdgeAuthenticationPaths, like a JWTAuthenticator or URLSigner.
+	// If nil every request on those paths is refused
+	EdgeAuthenticator RequestAuthorizer
+
+	//OriginAuthenticationPaths is a list of path prefixes on which the origin authenticates requests.
+	// Requests with a Authorization header are always forwarded with the header and the response is never stored or served from the cache.
+	// The prefixes are matched the same way as EdgeAuthenticationPaths
+	OriginAuthenticationPaths []string
+
+	//Grace is the time after expiry during which a stale response is served immediately while it is refreshed in the background,
+	// regardless of the max-stale of the client. This keeps the latency low when popular responses expire.
+	// Responses which must be revalidated and clients which send no-cache are never served from grace. Zero disables grace
+	Grace time.Duration
+
+	//QueryCanonicalization is the way the query is used in the cache key, QuerySort or QueryPreserve.
+	// If empty the query is sorted, so requests which only differ in the order of parameters share a stored response
+	QueryCanonicalization string
+
+	//QueryCanonicalizer can optionally be set to rewrite the query used in the cache key, it takes precedence over QueryCanonicalization
+	QueryCanonicalizer QueryCanonicalizer
+
+	//TrustForwardedProto if true the scheme in the X-Forwarded-Proto header of clients trusted by the TrustResolver of the CacheController
+	// is used as scheme of the request, for caches behind a load balancer which terminates TLS
+	TrustForwardedProto bool
+
+	//IgnoreSchemeInCacheKey if true the scheme is left out of the cache key, so a resource requested over http and https
+	// shares the stored responses. Only use this if the origin serves the same content for both schemes
+	IgnoreSchemeInCacheKey bool
+
+	//NormalizeHostnames if true the hostname of requests is lowercased, internationalized hostnames are converted to punycode
+	// and the trailing dot of a fully qualified name is removed before the forward config is resolved,
+	// so "Example.COM." and "example.com" or "bücher.example" and "xn--bcher-kva.example" share the origin and the stored responses.
+	// The tenant and the cache config are always resolved with the canonical hostname.
+	// This is opt-in since it changes the primary cache key of responses stored for hosts which are not in the canonical form,
+	// enabling it on a cache with persistent layers makes those responses unreachable until they expire
+	NormalizeHostnames bool
+
+	//NormalizeDefaultPorts if true the default port of the scheme is removed from the host in the cache key,
+	// so "example.com:443" and "example.com" share the stored responses of https requests.
+	// This is opt-in since it changes the primary cache key of responses stored for hosts with a default port,
+	// enabling it on a cache with persistent layers makes those responses unreachable until they expire
+	NormalizeDefaultPorts bool
+
+	//CacheKeyCookies is a list of cookie names of which the values are included in the secondary cache key
+	// This allows a origin to serve different variants based on for example a currency or language cookie
+	// without having to vary on the whole Cookie header
+	CacheKeyCookies []string
+
+	//RequestClassifier can optionally be set.
+	// If not nil the class of the request is included in the secondary cache key
+	// so different variants of a resource can be cached for for example mobile and desktop clients
+	RequestClassifier RequestClassifier
+
+	//RequestClassHeader is the name of the header in which the class of the request is forwarded to the origin server
+	// The header is only set if RequestClassifier is not nil, any value sent by the client is overwritten
+	RequestClassHeader string
+
+	//GeoVariant determines if a different variant is cached per country or continent of the client
+	// Valid values are GeoVariantNone, GeoVariantCountry and GeoVariantContinent.
+	// Requires the GeoIPResolver of the CacheController to be set
+	GeoVariant string
+
+	//TargetedCacheControlHeaders is a list of targeted cache control fields as defined in RFC 9213, like CDN-Cache-Control
+	// The first field in this list which is present in a response takes precedence over the Cache-Control header.
+	// Targeted fields are stripped from responses before they are sent to the client
+	TargetedCacheControlHeaders []string
+
+	//SurrogateControl if true the Surrogate-Control header of responses takes precedence over the Cache-Control header,
+	// unless a targeted cache control field is present. The header is stripped from responses before they are sent to the client.
+	// This is opt-in, enabling it changes how long responses of origins which already send the header are stored
+	SurrogateControl bool
+
+	//SurrogateTarget is the device token of the cache, directives of the Surrogate-Control header targeted at other tokens are ignored.
+	// If empty only untargeted directives are used
+	SurrogateTarget string
+
+	//LenientExpiresParsing enables best effort parsing of malformed Expires headers
+	// like a lowercase weekday, a single digit hour or extra spaces.
+	// If false a malformed Expires header causes the response to be considered stale, as section 5.3 of RFC 7234 requires
+	LenientExpiresParsing bool
+
+	//StripResponseHeaders is a list of headers which are removed from every response before it is stored or served
+	// This prevents sensitive origin headers from landing in a shared cache.
+	// A name ending with a asterisk like "X-Backend-*" removes all headers starting with that prefix
+	StripResponseHeaders []string
+
+	//NeverStoreSetCookie if true responses with a Set-Cookie header are never stored
+	// This protects against leaking sessions of one client to other clients through the shared cache
+	NeverStoreSetCookie bool
+
+	//SetCookieStorePaths is a list of path prefixes for which responses with a Set-Cookie header may be stored
+	// even if NeverStoreSetCookie is true
+	SetCookieStorePaths []string
+
+	//StripRequestCookies if true cookies are removed from cacheable requests before they are forwarded to the origin server
+	// Cookies in RequestCookieAllowlist and CacheKeyCookies are kept
+	StripRequestCookies bool
+
+	//RequestCookieAllowlist is a list of cookie names which are not removed when StripRequestCookies is true
+	RequestCookieAllowlist []string
+
+	//StripRequestCookiesPaths is a list of path prefixes to which StripRequestCookies applies
+	// If empty StripRequestCookies applies to all paths
+	StripRequestCookiesPaths []string
+
+	//EnableESI enables processing of Edge Side Includes in HTML responses
+	// The <esi:include> tags are replaced with the fragments they refer to every time the page is served.
+	// Fragments are cached independently with their own TTL, only fragments on the same host are included
+	EnableESI bool
+
+	//StoreTransformers are applied to the body of responses from the origin server before they are stored
+	// Responses with the no-transform directive are never transformed
+	StoreTransformers []BodyTransformer
+
+	//ServeTransformers are applied to the body of responses every time before they are sent to the client
+	// Responses with the no-transform directive, or requests with no-transform, are never transformed
+	ServeTransformers []BodyTransformer
+
+	//ContentCodings are used to decode encoded responses before they are transformed or processed for ESI,
+	// after which they are encoded again. The key is the lowercase value of the Content-Encoding header.
+	// If nil DefaultContentCodings is used, responses with other codings are not transformed
+	ContentCodings map[string]ContentCoding
+
+	//BulkRevalidation if true the entity tags of all stored variants of a resource are sent in the If-None-Match precondition
+	// when revalidating, so the origin can select which variant is still valid with a single request.
+	// Disabled by default because origins which don't expect multiple entity tags may answer with the wrong variant.
+	// Section 4.3.2 of RFC 7234
+	BulkRevalidation bool
+
+	//StripClientValidators controls what happens with the If-None-Match and If-Modified-Since headers of a client on a cache miss.
+	// If false they are forwarded to the origin, which can answer with a 304 directly but that response can't be stored.
+	// If true they are removed so the cache always obtains a full response to store, the preconditions
+	// are then evaluated by the cache and a 304 is sent to the client if its stored response is still valid
+	StripClientValidators bool
+
+	//SliceSize enables slicing if larger than zero. GET requests are then fetched from the origin with range requests
+	// and stored in slices of this amount of bytes, each slice is a separate cache entry.
+	// Only the slices which contain the range requested by the client are fetched, so very large resources
+	// can be cached partially and interrupted downloads can be resumed from the cache.
+	// The origin must support range requests, the Vary header of sliced responses is ignored
+	SliceSize int64
+
+	//EpochResolver can optionally be set.
+	// If not nil responses which were stored before the epoch of the request are considered stale from the epoch on,
+	// they are revalidated or fetched again as if their TTL ran out
+	EpochResolver EpochResolver
+
+	//RefreshHeader is the name of a request header with which trusted clients can force a stored response to be refreshed.
+	// The response is then fetched from the origin without a cache lookup and replaces the stored response.
+	// The header of clients which are not trusted by the TrustResolver of the CacheController is ignored,
+	// so they can't bypass the cache. Refreshes don't apply to sliced resources
+	RefreshHeader string
+
+	//IgnoreClientNoCache if true the no-cache directive and Pragma: no-cache of clients are ignored, like most CDNs do.
+	// Otherwise any client can force a request to the origin for every request it sends.
+	// The directive of clients trusted by the TrustResolver of the CacheController is still honored
+	IgnoreClientNoCache bool
+
+	//IgnoreClientNoCachePaths is a list of path prefixes to which IgnoreClientNoCache applies
+	// If empty IgnoreClientNoCache applies to all paths
+	IgnoreClientNoCachePaths []string
+
+	//AllowedVaryHeaders is a list of header names the cache honors in the Vary header of responses, if empty all headers are honored.
+	// This protects the cache from origins which vary on headers like User-Agent, which would store a variant for every client.
+	// Headers which are not allowed are ignored, so all clients share one variant, unless BypassDisallowedVary is true
+	AllowedVaryHeaders []string
+
+	//BypassDisallowedVary if true responses which vary on a header not in AllowedVaryHeaders are not stored
+	// instead of ignoring the header
+	BypassDisallowedVary bool
+
+	//MaxVariants is the maximum amount of variants which are stored per primary cache key, zero means no limit.
+	// If a new variant is stored the least recently used variants above the limit are deleted
+	MaxVariants int
+
+	//AdmissionPolicy can optionally be set. If not nil it decides if a cacheable response is stored,
+	// responses of sliced resources are always stored
+	AdmissionPolicy AdmissionPolicy
+
+	//CachePreflight if true responses to CORS preflight requests are stored, even though OPTIONS isn't a cacheable method.
+	// Their secondary key always contains the Origin, Access-Control-Request-Method and Access-Control-Request-Headers of the request
+	CachePreflight bool
+
+	//PreflightTTL is the ttl of stored preflight responses. If zero the Access-Control-Max-Age of the response is used,
+	// responses without it are not stored
+	PreflightTTL time.Duration
+
+	//CacheStatusHeader is the name of a header which is added to every response to tell how the cache handled the request,
+	// like "X-Cache-Status". The value is one of CacheStatusHit, CacheStatusMiss, CacheStatusStale, CacheStatusRevalidated,
+	// CacheStatusBypass or CacheStatusExpired. If empty no header is added
+	CacheStatusHeader string
+
+	//ResponseRateLimit is the maximum rate in bytes per second at which a single response is sent to the client, zero means no limit
+	ResponseRateLimit int64
+
+	//ClientRateLimit is the maximum rate in bytes per second at which all responses to a client are sent together, zero means no limit.
+	// Clients are identified by their IP address, so a shared cache serving large files can't be starved by a few clients
+	ClientRateLimit int64
+
+	//RateLimitBurst is the amount of bytes which is sent at full speed before ResponseRateLimit and ClientRateLimit apply,
+	// if zero it is the amount of bytes of one second
+	RateLimitBurst int64
+
 	//If HTTPWarnings is true warnings as described in section 5.5 of RFC7234 will be added to HTTP responses
 	// This is a option because the feature will be removed from future HTTP specs https://github.com/httpwg/http-core/issues/139
 	HTTPWarnings bool
+
+	//lookups contains sets built from the method and extension lists so they don't have to be scanned on every request
+	lookups atomic.Value
 }
 
 //NewCacheConfig creates a new CacheConfig struct which is configures with good defaults which satisfy RFC7234
@@ -72,6 +311,17 @@ func NewCacheConfig() *CacheConfig {
 
 		HTTPWarnings: true, //Be RFC compliant by default
 
+		BulkRevalidation: false, //Opt in, not all origins can handle multiple entity tags in a single precondition
+
+		NormalizeHostnames:    false, //Opt in, it changes the primary cache key of stored responses
+		NormalizeDefaultPorts: false, //Opt in, it changes the primary cache key of stored responses
+
+		NeverStoreSetCookie: true, //Safe by default, storing cookies in a shared cache is rarely intended
+
+		TargetedCacheControlHeaders: []string{CDNCacheControlHeader}, //Section 3.1 of RFC 9213
+
+		SurrogateControl: false, //Opt in, origins may send the header for other surrogates and expect this cache to ignore it
+
 		CacheableFileExtensions: []string{ //Default used by CloudFlare
 			"bmp", "ejs", "jpeg", "pdf", "ps", "ttf",
 			"class", "eot", "jpg", "pict", "svg", "webp",
@@ -94,15 +344,28 @@ func NewCacheConfig() *CacheConfig {
 	}
 }
 
+//BypassConfig is a sentinel CacheConfig which can be returned by a CacheConfigResolver to bypass the cache.
+// The request is proxied to the origin server without looking it up in the cache and the response is not stored
+var BypassConfig = &CacheConfig{}
+
 //A CacheConfigResolver resolves which cache config to use for which request.
 // Different websites or even different pages on the same site can have different cache settings
 type CacheConfigResolver interface {
 
 	//GetCacheConfig is called to resolve a CacheConfig depending on the request
 	// If nil is returned the default config will be used
+	// If BypassConfig is returned the request will not be cached and just be proxied to the origin server
 	GetCacheConfig(req *http.Request) *CacheConfig
 }
 
+//The CacheConfigResolverFunc type is an adapter to allow the use of ordinary functions as CacheConfigResolver
+type CacheConfigResolverFunc func(req *http.Request) *CacheConfig
+
+//GetCacheConfig calls the underlying function to resolve a cache config from a request
+func (resolver CacheConfigResolverFunc) GetCacheConfig(req *http.Request) *CacheConfig {
+	return resolver(req)
+}
+
 //A TransportResolver resolves which transport should be used for a particulair request
 type TransportResolver interface {
 
@@ -127,6 +390,62 @@ type ForwardConfig struct {
 
 	//If a https (http over TLS) connection should be used
 	TLS bool
+
+	//FollowRedirects is the maximum amount of 301 and 302 redirects the cache will follow for GET and HEAD requests
+	// The final response is cached under the URL of the original request. Only redirects to the same host are followed.
+	// Zero disables following of redirects
+	FollowRedirects int
+
+	//StripPathPrefix is removed from the path of the request before it is forwarded, like "/app".
+	// The prefix only matches whole path segments, requests of which the path doesn't start with the prefix are forwarded unchanged,
+	// AddPathPrefix is not added to them either
+	StripPathPrefix string
+
+	//AddPathPrefix is prepended to the path of the request before it is forwarded, like "/v2". It is added after StripPathPrefix is removed
+	//
+	// The cache key is always based on the path requested by the client, not the path send to the origin
+	AddPathPrefix string
+
+	//SendOriginHost if true sends the request to Host and uses Host as the Host header of the forwarded request
+	// instead of the host requested by the client. This is needed for origins which route requests by their own virtual host.
+	// The cache key is always based on the host requested by the client
+	SendOriginHost bool
+
+	//RequestHeaders are set on every request which is forwarded to the origin, for example a shared secret which proves
+	// the request came through the cache or a internal routing header. Headers with the same name send by the client are replaced.
+	// The values are redacted when the forward config is logged
+	RequestHeaders http.Header
+
+	//MaxConcurrentRequests is the maximum amount of requests which are in flight to the origin at the same time, counted per Host.
+	// Requests above the limit wait in a queue, see MaxQueuedRequests. If they can't be forwarded a 503 response with a Retry-After header
+	// is send instead, or a stale response if allowed.
+	// Misses of cacheable requests for the same response are coalesced when a Locker is configured, so they don't count against the limit.
+	// Zero means no limit
+	MaxConcurrentRequests int
+
+	//MaxQueuedRequests is the maximum amount of requests which wait for one of the MaxConcurrentRequests to finish,
+	// so short bursts are absorbed instead of failing. Requests above it get a 503 response immediately. Zero disables waiting
+	MaxQueuedRequests int
+
+	//QueueTimeout is the maximum time a request waits in the queue before a 503 response is send,
+	// if zero DefaultOriginQueueTimeout is used
+	QueueTimeout time.Duration
+
+	//RetryAfter is the value of the Retry-After header of the 503 response send when MaxConcurrentRequests is reached,
+	// if zero DefaultOriginRetryAfter is used
+	RetryAfter time.Duration
+
+	//HedgeAfter if not zero a second attempt of GET and HEAD requests is send if the origin didn't respond within it,
+	// the response which arrives first is used. This cuts the tail latency of flaky origins at the cost of extra origin requests
+	HedgeAfter time.Duration
+
+	//HedgeForwardConfig is the forward config of the alternate origin to which the second attempt is send,
+	// if nil the forward config of the first attempt is used
+	HedgeForwardConfig *ForwardConfig
+
+	//HedgeTransport is used to send the second attempt, it dials the address of the alternate origin.
+	// If nil the transport of the first attempt is used
+	HedgeTransport http.RoundTripper
 }
 
 //A ForwardConfigResolver resolves which forward config should be used for a particulair request
@@ -2,15 +2,17 @@ package sharedhttpcache
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
@@ -34,7 +36,7 @@ type CacheController struct {
 	CacheConfigResolver CacheConfigResolver
 
 	//The default transport used to contact the origin server
-	// If nil the http.DefaultTransport will be used
+	// If nil a transport created with NewOriginTransport will be used
 	DefaultTransport http.RoundTripper
 
 	//TransportResolver can optionally be set.
@@ -56,14 +58,181 @@ type CacheController struct {
 	// Faster caching layers typically have less capacity and thus will replace content sooner
 	Layers []layer.CacheLayer
 
+	//GeoIPResolver can optionally be set.
+	// If not nil the location of the client is resolved before any other resolver is called
+	// so the location can be used for cache variants and origin selection, see GeoLocationFromRequest
+	GeoIPResolver GeoIPResolver
+
+	//TenantResolver can optionally be set.
+	// If not nil the tenant of a request is resolved and used to namespace the cache keys
+	// so multiple customers can safely share one cache, see TenantFromRequest
+	TenantResolver TenantResolver
+
+	//TrustResolver can optionally be set.
+	// If not nil it decides which clients are trusted, only trusted clients can refresh stored responses, see CacheConfig.RefreshHeader
+	TrustResolver TrustResolver
+
+	//RequestIDHeader can optionally be set to the header which contains the ID of a request, like DefaultRequestIDHeader.
+	// If set every request gets a ID which is added to the log entries of the request, forwarded to the origin and returned to the client.
+	// The ID send by clients trusted by the TrustResolver is kept, other clients get a generated ID
+	RequestIDHeader string
+
+	//Locker can optionally be set.
+	// If not nil only one request at a time, across all cache instances sharing the locker, fetches a missing or stale response
+	// from the origin. Other requests serve the stale response if allowed, or wait up to LockWait for the response to be stored.
+	// Layers which implement layer.Locker, like the InMemoryCacheLayer, or a layer.RedisLocker can be used
+	Locker layer.Locker
+
+	//CoalesceRequests if true only one request at a time within this instance fetches a missing or stale response from the origin
+	// per cache key, including the secondary key. Other requests wait up to LockWait for the response to be stored and share it,
+	// or serve the stale response if allowed. Combined with a Locker only one of the waiting requests attempts to acquire the shared lock
+	CoalesceRequests bool
+
+	//LockTTL is the maximum time a lock is held, after which it is released even if the response wasn't stored
+	// If zero DefaultLockTTL is used
+	LockTTL time.Duration
+
+	//LockWait is the maximum time a request waits for the response to be stored by the holder of the lock,
+	// after which the request is forwarded to the origin anyway. If zero DefaultLockWait is used
+	LockWait time.Duration
+
+	//PurgePropagator can optionally be set.
+	// If not nil purges issued with Purge are sent to the other instances of the cluster, see HTTPPurgePropagator
+	PurgePropagator PurgePropagator
+
+	//PurgeMethodResolver can optionally be set.
+	// If not nil requests with the PURGE method of clients trusted by it purge the requested resource, see PurgeRequest.
+	// Other clients get a 403 response. If nil PURGE requests are forwarded to the origin like any other method
+	PurgeMethodResolver TrustResolver
+
+	//InvalidationRuleLifetime is the time purges of a prefix or tag are remembered, responses which were stored before the purge
+	// and have a longer TTL are served again after it. If zero DefaultInvalidationRuleLifetime is used
+	InvalidationRuleLifetime time.Duration
+
+	//TenantQuotas is a map of the maximum amount of bytes which may be stored per tenant
+	// Tenants which are not in the map use the DefaultTenantQuota
+	TenantQuotas map[string]int64
+
+	//DefaultTenantQuota is the maximum amount of bytes which may be stored for a tenant without a specific quota
+	// Zero means unlimited
+	DefaultTenantQuota int64
+
+	//AsynchronousLayerWrites if true a entry is only written to the first layer before the response is send to the client,
+	// copying the entry to the other layers is done in the background
+	AsynchronousLayerWrites bool
+
+	//LayerReplaySize is the maximum amount of bytes of a entry which are kept in memory while it is stored,
+	// so the entry can be stored in the next layer if a layer fails to store it after reading part of it.
+	// A entry of which more is read before the layer fails is not stored. Nothing is kept for the last layer which can store the entry.
+	// If zero DefaultLayerReplaySize is used, a negative value disables keeping entries in memory
+	LayerReplaySize int64
+
+	//BackgroundWorkers is the maximum amount of goroutines used for background work like asynchronous layer writes
+	// If zero DefaultBackgroundWorkers is used
+	BackgroundWorkers int
+
+	//BackgroundQueueSize is the maximum amount of background tasks which can be queued.
+	// If the queue is full the tasks with the lowest priority are dropped. If zero DefaultBackgroundQueueSize is used
+	BackgroundQueueSize int
+
+	//FlushInterval is the interval at which the response is flushed to the client while its body is copied.
+	// Zero disables periodic flushing, a negative value flushes after every write.
+	// Streaming responses like Server-Sent Events are always flushed after every write
+	FlushInterval time.Duration
+
+	//CopyBufferSize is the size of the buffers used to copy bodies to the client. If zero 32KB buffers are used
+	// Bigger buffers reduce the amount of system calls for large responses, smaller buffers reduce memory usage
+	CopyBufferSize int
+
+	//LargeObjectThreshold is the size in bytes above which the body of a response is stored in the LargeObjectLayer
+	// instead of the first layer, keeping the fast layers for small hot objects. Zero disables large object routing
+	LargeObjectThreshold int64
+
+	//LargeObjectLayer is the index in Layers of the first layer in which large objects are stored, like a disk layer.
+	// The layers before it are skipped for large objects, the layers after it are used as usual
+	LargeObjectLayer int
+
+	//PathPatternResolver can optionally be set.
+	// If not nil it groups requests by path pattern, the size distribution of the stored responses is tracked per pattern
+	// to route responses of unknown length, see ResponseSizes. If nil requests are grouped by host, directory and file extension
+	PathPatternResolver PathPatternResolver
+
+	//Metrics can optionally be set.
+	// If not nil metrics about hits, misses, evictions and origin latency are reported to the sink
+	Metrics MetricsSink
+
 	//The Logger which will be used for logging
 	// if nil the default logger will be used
 	Logger *logrus.Logger
-}
 
-func (controller *CacheController) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	var err error
+	//ChecksumVerification is the mode in which the checksums of stored bodies are verified when they are read,
+	// one of the ChecksumVerify constants. If empty checksums are never verified.
+	// Verification reads the whole body before it is served, a stored response which doesn't match is deleted
+	ChecksumVerification string
+
+	//ChecksumSampleRate is the fraction of stored responses which is verified if ChecksumVerification is ChecksumVerifySampled,
+	// if zero DefaultChecksumSampleRate is used
+	ChecksumSampleRate float64
+
+	//RedactedLogHeaders is a list of header names of which the values are redacted when requests and responses are logged
+	// The headers in AlwaysRedactedHeaders are always redacted
+	RedactedLogHeaders []string
+
+	//LogRequests if true a line is logged for completed requests with the status, the cache status, the size and the duration,
+	// sampled with LogHitSampleRate so logging stays affordable at high request rates
+	LogRequests bool
+
+	//LogHitSampleRate logs 1 in N requests which are served from the cache, misses and errors are always logged.
+	// If zero or one every request is logged
+	LogHitSampleRate int
+
+	//SlowRequestThreshold is the duration above which a request is slow. Slow requests are always logged
+	// with a trace of the request containing the headers and the time until the header was sent. Zero disables traces
+	SlowRequestThreshold time.Duration
+
+	initOnce sync.Once
+
+	//loggedHits counts the requests served from the cache which could be logged, to sample them
+	loggedHits uint32
+
+	tenantUsage     *tenantUsageTracker
+	tenantUsageOnce sync.Once
+
+	variantIndexMutex sync.Mutex
+	tagIndexMutex     sync.Mutex
 
+	eventSubscribers      map[chan CacheEvent]bool
+	eventSubscribersMutex sync.RWMutex
+
+	backgroundPool     *backgroundPool
+	backgroundPoolOnce sync.Once
+
+	copyBufferPool     *sync.Pool
+	copyBufferPoolOnce sync.Once
+
+	invalidationRules      []invalidationRule
+	invalidationRulesMutex sync.RWMutex
+
+	originSlots      map[string]*originSlots
+	originSlotsMutex sync.Mutex
+
+	backgroundRefreshes      map[string]time.Time
+	backgroundRefreshesMutex sync.Mutex
+
+	flights      map[string]*flight
+	flightsMutex sync.Mutex
+
+	clientBuckets      map[string]*tokenBucket
+	clientBucketsMutex sync.Mutex
+	clientBucketsSwept time.Time
+
+	sizeTracker     *sizeTracker
+	sizeTrackerOnce sync.Once
+}
+
+//initialize sets the defaults of the controller and registers the handlers on the layers
+// it is called once, on the first request
+func (controller *CacheController) initialize() {
 	if controller.Logger == nil {
 		controller.Logger = logrus.New()
 	}
@@ -72,46 +241,144 @@ func (controller *CacheController) ServeHTTP(resp http.ResponseWriter, req *http
 		controller.DefaultCacheConfig = NewCacheConfig()
 	}
 
-	cacheConfig := controller.DefaultCacheConfig
+	for index, cacheLayer := range controller.Layers {
+		if reporter, ok := cacheLayer.(layer.EvictionReporter); ok {
+			layerTags := map[string]string{"layer": strconv.Itoa(index)}
 
-	if controller.CacheConfigResolver != nil {
-		if resolvedConfig := controller.CacheConfigResolver.GetCacheConfig(req); resolvedConfig != nil {
-			cacheConfig = resolvedConfig
+			reporter.SetEvictionHandler(func(key string, size int) {
+				controller.incrMetric(MetricCacheEviction, 1, layerTags)
+				controller.emitEvent(CacheEventEvict, key, int64(size), false)
+			})
 		}
 	}
+}
 
-	forwardConfig := controller.DefaultForwardConfig
+func (controller *CacheController) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var err error
 
-	if controller.ForwardConfigResolver != nil {
-		if resolvedConfig := controller.ForwardConfigResolver.GetForwardConfig(req); resolvedConfig != nil {
-			forwardConfig = resolvedConfig
-		}
+	start := time.Now()
+
+	controller.initOnce.Do(controller.initialize)
+
+	req = controller.resolveRequestID(resp, req)
+
+	if req.Method == PurgeMethod && controller.PurgeMethodResolver != nil {
+		controller.servePurgeMethod(resp, req)
+		return
 	}
 
-	//Set default transport
-	transport := controller.DefaultTransport
+	if controller.GeoIPResolver != nil {
+		req = controller.resolveGeoLocation(req)
+	}
 
-	//Use resolver to get transport based on request
-	if controller.TransportResolver != nil {
-		if transportConfig := controller.TransportResolver.GetTransport(req); transportConfig != nil {
-			transport = transportConfig
-		}
+	//The tenant and the cache config are resolved with the canonical hostname, so a different notation of the same host,
+	// like "Example.COM.", can't select another tenant or cache config
+	canonicalReq := withCanonicalHost(req)
+
+	if controller.TenantResolver != nil {
+		tenant := controller.TenantResolver.GetTenant(canonicalReq)
+		req = withTenant(req, tenant)
+		canonicalReq = withTenant(canonicalReq, tenant)
 	}
 
-	//If default is nil and resolver is nil or returned nil use http default transport
-	if transport == nil {
-		transport = http.DefaultTransport
+	cacheConfig := controller.resolveCacheConfig(canonicalReq)
+
+	//Responses are sent at a limited rate so a few clients can't use all bandwidth of the cache
+	resp, releaseShaping := controller.shapeResponseWriter(cacheConfig, resp, req)
+	defer releaseShaping()
+
+	//Operators can see in the response how the cache handled the request
+	resp = controller.withCacheStatus(cacheConfig, resp)
+
+	if controller.LogRequests {
+		defer controller.logRequest(cacheConfig, req, resp, start)
+	}
+
+	//A load balancer which terminates TLS tells the scheme used by the client, so it is used in the cache key
+	req = controller.resolveForwardedProto(cacheConfig, req)
+
+	//Different notations of the same host are resolved to the same origin and cache key if the cache config allows it
+	req = normalizeRequestHost(cacheConfig, req)
+
+	//Add the class of the request so the origin can serve the correct variant
+	req = classifyRequest(cacheConfig, req)
+
+	//Remove cookies the origin doesn't need to improve the hit ratio and privacy
+	req = filterRequestCookies(cacheConfig, req)
+
+	//Headers which are not in the cache key must not reach the origin if they can be used to poison the cache
+	req = stripUnkeyedHeaders(cacheConfig, req)
+
+	//Protected content is stored once, but every client must be authorized before it is served
+	req, authorized := controller.authorizeRequest(cacheConfig, resp, req)
+	if !authorized {
+		return
+	}
+
+	//Depending on the path the cache or the origin authenticates the client
+	req, authenticated, originAuth := controller.authenticateRequest(cacheConfig, resp, req)
+	if !authenticated {
+		return
+	}
+
+	//A trusted client can force the stored response to be replaced by a new response from the origin
+	req, refresh := controller.resolveRefresh(cacheConfig, req)
+
+	forwardConfig := controller.resolveForwardConfig(req)
+
+	transport := controller.resolveTransport(req)
+
+	//The resolver explicitly disabled caching for this request, or the origin has to authenticate the client
+	if cacheConfig == BypassConfig || originAuth {
+		setCacheStatus(resp, CacheStatusBypass)
+		controller.bypassCache(cacheConfig, forwardConfig, transport, resp, req)
+		return
 	}
 
 	//TODO handle validation request from client, section 4.3.2 of RFC 7234
 
 	primaryCacheKey := getPrimaryCacheKey(cacheConfig, forwardConfig, req)
 
-	response, stop := controller.getCachedResponse(cacheConfig, forwardConfig, transport, resp, req, primaryCacheKey)
-	if stop {
+	//Large resources can be stored in slices, which are fetched using range requests
+	if cacheConfig.SliceSize > 0 && req.Method == http.MethodGet && isMethodCacheable(cacheConfig, req.Method) {
+		controller.serveSliced(cacheConfig, forwardConfig, transport, resp, req, primaryCacheKey)
+		return
+	}
+
+	//A HEAD request can be answered with the header of a stored GET response
+	if req.Method == http.MethodHead && !refresh && controller.serveHeadFromCache(cacheConfig, forwardConfig, resp, req) {
 		return
 	}
 
+	//Only one request at a time fetches a missing or stale response from the origin, see Locker and CoalesceRequests
+	lock := controller.newOriginLock(primaryCacheKey)
+	defer lock.release()
+
+	var response *http.Response
+	stop := false
+
+	if refresh || !isRequestCacheable(cacheConfig, req) {
+		setCacheStatus(resp, CacheStatusBypass)
+	}
+
+	//A refresh skips the cache lookup, the response of the origin replaces the stored response
+	if !refresh {
+		response, stop = controller.getCachedResponse(cacheConfig, forwardConfig, transport, resp, req, primaryCacheKey, lock)
+		if stop {
+			return
+		}
+
+		//A other request is fetching the response, wait for it to be stored instead of sending the same request to the origin
+		if response == nil && isRequestCacheable(cacheConfig, req) && !lock.acquire() {
+			lock.wait(req.Context())
+
+			response, stop = controller.getCachedResponse(cacheConfig, forwardConfig, transport, resp, req, primaryCacheKey, lock)
+			if stop {
+				return
+			}
+		}
+	}
+
 	// If response has not been set from the cache or by the revalidation process
 	// Proxy the request to the origin server
 	if response == nil {
@@ -128,16 +395,153 @@ func (controller *CacheController) ServeHTTP(resp http.ResponseWriter, req *http
 
 	response = controller.storeResponse(cacheConfig, req, response, primaryCacheKey)
 
+	//The response is stored, so requests waiting for the lock can be served from the cache.
+	// A response which is stored while it is served is only stored once its body is closed, the deferred release handles it
+	if !isStoringWhileServing(response) {
+		lock.release()
+	}
+
 	//TODO add warnings https://tools.ietf.org/html/rfc7234#section-5.5
 
-	err = writeHTTPResponse(resp, response)
+	controller.prepareResponseForClient(cacheConfig, req, response)
+
+	//The preconditions of the client were not forwarded, so the cache has to evaluate them
+	if cacheConfig.StripClientValidators && clientHasCurrentResponse(req, response) {
+		writeNotModified(resp, response)
+		return
+	}
+
+	err = controller.writeHTTPResponse(cacheConfig, resp, response)
 	if err != nil {
-		controller.Logger.WithError(err).Error("Error while writing response to http client")
+		controller.requestLogger(req).WithError(err).Error("Error while writing response to http client")
 
 		panic(err)
 	}
 }
 
+//resolveCacheConfig returns the cache config of the request, the DefaultCacheConfig is used if the resolver returns nil
+func (controller *CacheController) resolveCacheConfig(req *http.Request) *CacheConfig {
+	if controller.CacheConfigResolver != nil {
+		if resolvedConfig := controller.CacheConfigResolver.GetCacheConfig(req); resolvedConfig != nil {
+			return resolvedConfig
+		}
+	}
+
+	return controller.DefaultCacheConfig
+}
+
+//resolveForwardConfig returns the forward config of the request, the DefaultForwardConfig is used if the resolver returns nil
+func (controller *CacheController) resolveForwardConfig(req *http.Request) *ForwardConfig {
+	if controller.ForwardConfigResolver != nil {
+		if resolvedConfig := controller.ForwardConfigResolver.GetForwardConfig(req); resolvedConfig != nil {
+			return resolvedConfig
+		}
+	}
+
+	return controller.DefaultForwardConfig
+}
+
+//resolveTransport returns the transport used to forward the request to the origin
+func (controller *CacheController) resolveTransport(req *http.Request) http.RoundTripper {
+	//Set default transport
+	transport := controller.DefaultTransport
+
+	//Use resolver to get transport based on request
+	if controller.TransportResolver != nil {
+		if transportConfig := controller.TransportResolver.GetTransport(req); transportConfig != nil {
+			transport = transportConfig
+		}
+	}
+
+	//If default is nil and resolver is nil or returned nil use http default transport
+	if transport == nil {
+		transport = defaultOriginTransport
+	}
+
+	return transport
+}
+
+//bypassCache proxies the request to the origin server without looking it up in the cache or storing the response
+func (controller *CacheController) bypassCache(cacheConfig *CacheConfig, forwardConfig *ForwardConfig, transport http.RoundTripper, resp http.ResponseWriter, req *http.Request) {
+
+	//Create a forward context which will stop the connection to the backend if the connection from the clients stops
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	ctx = forwardInformationalResponses(ctx, resp, req)
+
+	response, err := controller.roundTripOrigin(ctx, transport, forwardConfig, req)
+	if err != nil {
+		//Log as a warning since errors here are exprected when a origin server is down
+		controller.requestLogger(req).WithError(err).WithFields(controller.redactLogFields(logrus.Fields{
+			"transport":      transport,
+			"forward-config": forwardConfig,
+			"request":        req,
+		})).Warning("Error while proxying request to origin server")
+
+		http.Error(resp, "Unable to contact origin server", http.StatusBadGateway)
+		return
+	}
+
+	err = controller.writeHTTPResponse(cacheConfig, resp, response)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).Error("Error while writing response to http client")
+	}
+}
+
+//prepareOriginResponse applies the processing which has to happen when a response is received from the origin server,
+// before it is stored
+func (controller *CacheController) prepareOriginResponse(cacheConfig *CacheConfig, req *http.Request, response *http.Response) {
+	applyTargetedCacheControl(cacheConfig, response)
+
+	//Only transform complete responses, a 304 for example has no body and a 206 only contains part of the body
+	if response.StatusCode == http.StatusOK {
+		err := applyBodyTransformers(cacheConfig, cacheConfig.StoreTransformers, response)
+		if err != nil {
+			controller.requestLogger(req).WithError(err).Warning("Error while transforming origin response")
+		}
+	}
+}
+
+//prepareResponseForClient applies the processing which has to happen every time a response is served,
+// after it has been stored and before it is sent to the client
+func (controller *CacheController) prepareResponseForClient(cacheConfig *CacheConfig, req *http.Request, response *http.Response) {
+	controller.processESI(cacheConfig, req, response)
+
+	//The client can request that the response is not transformed, section 5.2.1.6 of RFC 7234
+	if response.StatusCode == http.StatusOK && !parseClientCacheControl(req.Header).noTransform {
+		err := applyBodyTransformers(cacheConfig, cacheConfig.ServeTransformers, response)
+		if err != nil {
+			controller.requestLogger(req).WithError(err).Warning("Error while transforming response for client")
+		}
+	}
+}
+
+//resolveGeoLocation resolves the location of the client and adds it to the context of the request
+func (controller *CacheController) resolveGeoLocation(req *http.Request) *http.Request {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return req
+	}
+
+	location, err := controller.GeoIPResolver.LookupIP(ip)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).WithField("ip", ip.String()).Warning("Error while resolving geo location of client")
+		return req
+	}
+
+	if location == nil {
+		return req
+	}
+
+	return withGeoLocation(req, location)
+}
+
 func (controller *CacheController) proxyRequestToOrigin(
 	cacheConfig *CacheConfig,
 	forwardConfig *ForwardConfig,
@@ -150,20 +554,35 @@ func (controller *CacheController) proxyRequestToOrigin(
 ) {
 
 	//Create a forward context which will stop the connection to the backend if the connection from the clients stops
+	// The context is canceled when the body of the response is closed, a stream is still being read after this function returns
 	ctx, cancel := context.WithCancel(req.Context())
-	if cancel != nil {
-		defer cancel()
+	ctx = forwardInformationalResponses(ctx, resp, req)
+
+	originRequest := req
+	if cacheConfig.StripClientValidators && isRequestCacheable(cacheConfig, req) {
+		originRequest = stripClientValidators(req)
+	}
+
+	response, err := controller.roundTripOrigin(ctx, transport, forwardConfig, originRequest)
+	if err == nil && forwardConfig.FollowRedirects > 0 {
+		response, err = followRedirects(ctx, transport, forwardConfig, originRequest, response)
+	}
+
+	if err == nil {
+		response.Body = &releasingReadCloser{ReadCloser: response.Body, release: cancel}
+
+		controller.prepareOriginResponse(cacheConfig, req, response)
 	}
 
-	response, err := proxyToOrigin(ctx, transport, forwardConfig, req)
 	if err != nil {
+		cancel()
 
 		//Log as a warning since errors here are exprected when a origin server is down
-		controller.Logger.WithError(err).WithFields(logrus.Fields{
+		controller.requestLogger(req).WithError(err).WithFields(controller.redactLogFields(logrus.Fields{
 			"transport":      transport,
 			"forward-config": forwardConfig,
 			"request":        req,
-		}).Warning("Error while proxying request to origin server")
+		})).Warning("Error while proxying request to origin server")
 
 		http.Error(resp, "Unable to contact origin server", http.StatusBadGateway)
 
@@ -176,7 +595,7 @@ func (controller *CacheController) proxyRequestToOrigin(
 		//Only invalidate if the response is a 'non-error response'
 		if response.StatusCode >= 200 && response.StatusCode < 400 {
 
-			urls := []string{getEffectiveURI(req, forwardConfig)}
+			urls := []string{getEffectiveURI(req, cacheConfig, forwardConfig)}
 
 			locationVal := response.Header.Get("Location")
 			if location, err := url.Parse(locationVal); err == nil {
@@ -186,7 +605,7 @@ func (controller *CacheController) proxyRequestToOrigin(
 					Host: req.Host,
 				}
 
-				urls = append(urls, getEffectiveURI(locationPseudoRequest, forwardConfig))
+				urls = append(urls, getEffectiveURI(locationPseudoRequest, cacheConfig, forwardConfig))
 			}
 
 			contentLocationVal := response.Header.Get("Content-Location")
@@ -197,32 +616,46 @@ func (controller *CacheController) proxyRequestToOrigin(
 					Host: req.Host,
 				}
 
-				urls = append(urls, getEffectiveURI(contentLocationPseudoRequest, forwardConfig))
+				urls = append(urls, getEffectiveURI(contentLocationPseudoRequest, cacheConfig, forwardConfig))
 			}
 
 			for _, url := range urls {
 				for _, method := range cacheConfig.SafeMethods {
 					//TODO use a method which also accounts for custom cache keys
-					primaryKey := method + url
+					primaryKey := tenantCacheKeyPrefix(TenantFromRequest(req)) + method + url
 
-					secondaryKeys, _, err := controller.findSecondaryKeysInCache(primaryKey)
+					//The variant index lists the secondary cache keys of all stored variants
+					variants, err := controller.findVariantsInCache(primaryKey)
 					if err != nil {
-						controller.Logger.WithError(err).WithField("cache-key", primaryKey).Error("Error while attempting to find secondary cache key in cache")
+						controller.requestLogger(req).WithError(err).WithField("cache-key", primaryKey).Error("Error while attempting to find variants in cache")
 					}
 
-					if len(secondaryKeys) == 0 {
-						secondaryKeys = []string{""}
+					secondaryKeys := []string{""}
+					for _, variant := range variants {
+						if !containsString(secondaryKeys, variant.secondaryKey) {
+							secondaryKeys = append(secondaryKeys, variant.secondaryKey)
+						}
 					}
 
 					for _, secondaryKey := range secondaryKeys {
 
-						_, ttl, _ := controller.findResponseInCache(primaryKey + secondaryKey)
+						cachedResponse, ttl, _ := controller.findResponseInCache(primaryKey + secondaryKey)
+						if cachedResponse != nil {
+							//Only the ttl is needed, the body would keep a file open when using a disk layer
+							cachedResponse.Body.Close()
+						}
+
 						if ttl >= 0 {
 
 							//Set the ttl negative, so it will no longer be fresh
 							err = controller.refreshCacheEntry(primaryKey+secondaryKey, time.Duration(-1))
-							if err != nil {
-								controller.Logger.WithError(err).WithField("cache-key", primaryKey+secondaryKey).Error("Error while attempting to set ttl of cache key to -1")
+							if errors.Is(err, layer.ErrNotFound) {
+								//The entry was evicted since it was found
+								continue
+							} else if err != nil {
+								controller.requestLogger(req).WithError(err).WithField("cache-key", primaryKey+secondaryKey).Error("Error while attempting to set ttl of cache key to -1")
+							} else {
+								controller.emitEvent(CacheEventPurge, primaryKey+secondaryKey, -1, false)
 							}
 						}
 					}
@@ -232,8 +665,6 @@ func (controller *CacheController) proxyRequestToOrigin(
 		}
 	}
 
-	//TODO Deal with 101 Switching Protocols responses: (WebSocket, h2c, etc) https://golang.org/src/net/http/httputil/reverseproxy.go?s=3318:3379#L256
-
 	return response, false
 }
 
@@ -244,35 +675,62 @@ func (controller *CacheController) getCachedResponse(
 	resp http.ResponseWriter,
 	req *http.Request,
 	primaryCacheKey string,
+	lock *originLock,
 ) (*http.Response, bool) {
 
 	var response *http.Response
 
 	//Optimization: only if the method is safe and cacheable will it be in the cache
 	// if if one of the two is false we can save the cache loopup and just forward the request
-	if isMethodSafe(cacheConfig, req.Method) && isMethodCacheable(cacheConfig, req.Method) {
+	if isRequestCacheable(cacheConfig, req) {
 
 		secondaryKeys, _, err := controller.findSecondaryKeysInCache(primaryCacheKey)
 		if err != nil {
-			controller.Logger.WithError(err).WithField("cache-key", primaryCacheKey).Error("Error while attempting to find secondary cache key in cache")
+			controller.requestLogger(req).WithError(err).WithField("cache-key", primaryCacheKey).Error("Error while attempting to find secondary cache key in cache")
 		}
 
-		secondaryCacheKey := getSecondaryCacheKey(secondaryKeys, req)
+		secondaryCacheKey := getSecondaryCacheKey(cacheConfig, secondaryKeys, req)
 
 		//The full cacheKey is the primary cache key plus the secondary cache key
 		cacheKey := primaryCacheKey + secondaryCacheKey
 
-		cachedResponse, ttl, err := controller.findResponseInCache(cacheKey)
+		//Requests for other variants don't have to wait for this request
+		lock.setCacheKey(cacheKey)
+
+		cachedResponse, freshness, ttl, err := controller.findEntryInCache(cacheKey)
 		if err != nil {
 			//TODO make erroring optional, if the cache fails we may just want to forward the request instead of erroring
 
-			controller.Logger.WithError(err).WithField("cache-key", cacheKey).Error("Error while attempting to find cache key in cache")
+			controller.requestLogger(req).WithError(err).WithField("cache-key", cacheKey).Error("Error while attempting to find cache key in cache")
 
 			http.Error(resp, "Error while attempting to find cached response", http.StatusInternalServerError)
 
 			return response, true
 		}
 
+		if cachedResponse != nil && cacheConfig.EpochResolver != nil {
+			ttl = boundTTLByEpoch(cacheConfig.EpochResolver.GetEpoch(req), freshness, ttl)
+		}
+
+		//A response which matches a prefix or tag purge is treated as if it isn't stored, it is replaced once the new response is stored
+		if cachedResponse != nil && controller.isInvalidated(cacheConfig, req, forwardConfig, cachedResponse, freshness) {
+			cachedResponse.Body.Close()
+			cachedResponse = nil
+		}
+
+		if cachedResponse == nil {
+			setCacheStatus(resp, CacheStatusMiss)
+			controller.incrMetric(MetricCacheMiss, 1, nil)
+			controller.emitEvent(CacheEventMiss, cacheKey, -1, false)
+		}
+
+		//The client only wants a stored response, so we are not allowed to contact the origin server
+		// Section 5.2.1.7 of RFC 7234
+		if cachedResponse == nil && parseClientCacheControl(req.Header).onlyIfCached {
+			http.Error(resp, "No stored response available", http.StatusGatewayTimeout)
+			return response, true
+		}
+
 		//If there is a cached response
 		if cachedResponse != nil {
 
@@ -280,87 +738,123 @@ func (controller *CacheController) getCachedResponse(
 			//So replace it
 			cachedResponse.Request = req
 
-			//The value of of the max-age header
-			maxAge := int64(-1)
+			clientDirectives := parseClientCacheControl(req.Header)
+			if clientDirectives.noCache && controller.ignoresClientNoCache(cacheConfig, req) {
+				clientDirectives.noCache = false
+			}
 
-			//The value we will need to compare the cache entry ttl to
-			compareTTL := int64(0)
+			//The freshness information was computed when the response was stored, so the headers don't have to be parsed again
+			age := freshness.age()
 
-			for _, directive := range splitCacheControlHeader(req.Header[CacheControlHeader]) {
-				if strings.HasPrefix(directive, MaxAgeDirective) {
-					//TODO check ofr quoted-string form
-					maxAgeString := strings.TrimPrefix(directive, MaxAgeDirective+"=")
-					maxAge, err = strconv.ParseInt(maxAgeString, 10, 0)
-					if err != nil {
-						//TODO make a warning log of the protocol violation
-						maxAge = -1
-					}
-					continue
-				}
+			//If the client wants a response which is older or less fresh than what we have, we can't serve the cached response
+			clientWantsResponse := clientDirectives.acceptsAge(age) && clientDirectives.acceptsTTL(ttl)
 
-				if strings.HasPrefix(directive, "max-stale") {
-					//TODO check ofr quoted-string form
-					maxStaleString := strings.TrimPrefix(directive, "max-stale=")
-					maxStale, err := strconv.ParseInt(maxStaleString, 10, 0)
+			cachedResponseIsFresh := ttl > 0
+			cachedResponseHasNoCache := freshness.noCache || clientDirectives.noCache
+			cachedresponseHasMustRevalidate := freshness.mustRevalidate
 
-					compareTTL = -maxStale
+			if clientWantsResponse && //If the client doesn't accept the age or freshness of the response we can't serve it
+				!cachedResponseHasNoCache && //If the request or response contains a no-cache we can't return a cached result
+				(cachedResponseIsFresh || !cachedresponseHasMustRevalidate) { //If the response contains a must-revalidate, we must revalidate once it is stale even if the client accepts stale responses
+
+				if cachedResponseIsFresh {
+					setCacheStatus(resp, CacheStatusHit)
+					controller.incrMetric(MetricCacheHit, 1, nil)
+				} else {
+					setCacheStatus(resp, CacheStatusStale)
+					controller.incrMetric(MetricCacheStale, 1, nil)
+				}
+				controller.emitEvent(CacheEventHit, cacheKey, cachedResponse.ContentLength, !cachedResponseIsFresh)
 
-					//If error no (valid) value is specified and thus any stale response is accepted
+				if cacheConfig.MaxVariants > 0 {
+					err = controller.touchVariantInIndex(primaryCacheKey, secondaryCacheKey)
 					if err != nil {
-						compareTTL = math.MinInt64
+						controller.requestLogger(req).WithError(err).WithField("cache-key", primaryCacheKey).Error("Error while attempting to update variant index in cache")
 					}
-					continue
 				}
 
-				if strings.HasPrefix(directive, "min-fresh") {
-					//TODO check ofr quoted-string form
-					minFreshString := strings.TrimPrefix(directive, "min-fresh=")
-					compareTTL, err = strconv.ParseInt(minFreshString, 10, 0)
-					if err != nil {
-						//TODO make a warning log of the protocol violation
-						compareTTL = 0
-					}
-					continue
+				controller.prepareResponseForClient(cacheConfig, req, cachedResponse)
+
+				err = controller.writeCachedResponse(cacheConfig, resp, cachedResponse, age)
+				if err != nil {
+					controller.requestLogger(req).WithError(err).Error("Error while writing cached response to http client")
+					panic(err)
 				}
+
+				return response, true
 			}
 
-			clientWantsResponse := true
+			//response is stale, unless it is served anyway a new response is fetched from the origin
+			setCacheStatus(resp, CacheStatusExpired)
 
-			//If compareTTL is negative the max-stale directive is set and if max-age is defined
-			if compareTTL >= 0 && maxAge > -1 {
+			//The client only wants a stored response, so we are not allowed to contact the origin server
+			// Section 5.2.1.7 of RFC 7234
+			if clientDirectives.onlyIfCached {
+				http.Error(resp, "No suitable stored response available", http.StatusGatewayTimeout)
+				return response, true
+			}
 
-				//Get the age of the cached response
-				responseAge := getResponseAge(cachedResponse)
+			//The response expired a short while ago, serve it immediately and revalidate it in the background
+			inGrace := mayServeInGrace(cacheConfig, clientDirectives, ttl, cachedResponse)
+			if inGrace || mayServeWhileRevalidating(clientDirectives, age, ttl, cachedResponse) {
+				setCacheStatus(resp, CacheStatusStale)
+				controller.incrMetric(MetricCacheStale, 1, nil)
+				if inGrace {
+					controller.incrMetric(MetricCacheGrace, 1, nil)
+				} else {
+					controller.incrMetric(MetricCacheStaleWhileRevalidate, 1, nil)
+				}
+				controller.emitEvent(CacheEventHit, cacheKey, cachedResponse.ContentLength, true)
+
+				controller.refreshInBackground(cacheConfig, forwardConfig, transport, req, primaryCacheKey, cacheKey)
 
-				//if the cache is older than the client requested
-				if responseAge > maxAge {
-					clientWantsResponse = false
+				if cacheConfig.HTTPWarnings {
+					cachedResponse.Header.Add("Warning", `110 - "Response is Stale"`)
 				}
 
+				controller.prepareResponseForClient(cacheConfig, req, cachedResponse)
+
+				err = controller.writeCachedResponse(cacheConfig, resp, cachedResponse, age)
+				if err != nil {
+					controller.requestLogger(req).WithError(err).Error("Error while writing stale response to client")
+				}
+
+				return response, true
 			}
 
-			cachedResponseIsFresh := ttl > (time.Duration(compareTTL) * time.Second)
-			cachedResponseHasNoCache := requestOrResponseHasNoCache(cachedResponse)
-			cachedresponseHasMustRevalidate := responseHasMustRevalidate(cachedResponse)
+			//A other request is already revalidating the response, serve it stale instead of revalidating it again
+			if !lock.acquire() && mayServeStaleWhileLocked(clientDirectives, age, cachedResponse) {
+				setCacheStatus(resp, CacheStatusStale)
+				controller.incrMetric(MetricCacheStale, 1, nil)
+				controller.emitEvent(CacheEventHit, cacheKey, cachedResponse.ContentLength, true)
 
-			if cachedResponseIsFresh && //If the response is older than the TTL it is stale
-				!cachedResponseHasNoCache && //If the request or response contains a no-cache we can't return a cached result
-				!cachedresponseHasMustRevalidate && //If the response contains a must-revalidate, we must always revalidate, can serve from cache
-				clientWantsResponse { //If the client wants a response which is fresher than what we have, we can't serve the cached response
+				if cacheConfig.HTTPWarnings {
+					cachedResponse.Header.Add("Warning", `110 - "Response is Stale"`)
+				}
+
+				controller.prepareResponseForClient(cacheConfig, req, cachedResponse)
 
-				err = writeCachedResponse(resp, cachedResponse, ttl)
+				err = controller.writeCachedResponse(cacheConfig, resp, cachedResponse, age)
 				if err != nil {
-					controller.Logger.WithError(err).Error("Error while writing cached response to http client")
-					panic(err)
+					controller.requestLogger(req).WithError(err).Error("Error while writing stale response to client")
 				}
 
 				return response, true
 			}
 
-			//response is stale
-
 			revalidationRequest := makeRevalidationRequest(req, cachedResponse)
 
+			//Ask the origin to validate all stored variants at once, so it can select a other variant if the current is no longer valid
+			var variants []variant
+			if revalidationRequest != nil && cacheConfig.BulkRevalidation {
+				variants, err = controller.findVariantsInCache(primaryCacheKey)
+				if err != nil {
+					controller.requestLogger(req).WithError(err).WithField("cache-key", primaryCacheKey).Error("Error while attempting to find variants in cache")
+				}
+
+				addVariantETags(revalidationRequest, variants)
+			}
+
 			//If no revalidation request can be made the cached response can't be used
 			if revalidationRequest != nil {
 
@@ -370,7 +864,10 @@ func (controller *CacheController) getCachedResponse(
 					defer cancel()
 				}
 
-				validationResponse, err := proxyToOrigin(ctx, transport, forwardConfig, revalidationRequest)
+				validationResponse, err := controller.roundTripOrigin(ctx, transport, forwardConfig, revalidationRequest)
+				if err == nil {
+					controller.prepareOriginResponse(cacheConfig, revalidationRequest, validationResponse)
+				}
 
 				//If the origin server can't be reached or a error is returned
 				if err != nil || validationResponse.StatusCode > 500 {
@@ -381,39 +878,37 @@ func (controller *CacheController) getCachedResponse(
 					// }
 
 					//Check if we are allowed the serve the stale content
-					if mayServeStaleResponse(cacheConfig, cachedResponse) {
+					if mayServeStaleResponse(cacheConfig, cachedResponse, ttl, classifyOriginFailure(err, validationResponse)) {
 
 						//If the response contains a no-cache directive with a field-list strip the headers from the response
 						//Section 5.2.2.2 of RFC 7234
-						for _, directive := range splitCacheControlHeader(response.Header[CacheControlHeader]) {
-							if strings.HasPrefix(directive, NoCacheDirective+"=") {
-								fieldList := strings.TrimPrefix(directive, NoCacheDirective+"=")
-								fieldList = strings.Trim(fieldList, "\"")
-								for _, fieldName := range strings.Split(fieldList, ",") {
-									cachedResponse.Header.Del(strings.TrimSpace(fieldName))
-								}
-							}
-						}
+						stripNoCacheFields(cachedResponse)
+
+						setCacheStatus(resp, CacheStatusStale)
+						controller.incrMetric(MetricCacheStale, 1, nil)
+						controller.emitEvent(CacheEventHit, cacheKey, cachedResponse.ContentLength, true)
+
+						controller.prepareResponseForClient(cacheConfig, req, cachedResponse)
 
-						err := writeCachedResponse(resp, cachedResponse, ttl)
+						err := controller.writeCachedResponse(cacheConfig, resp, cachedResponse, age)
 						if err != nil {
-							controller.Logger.WithError(err).Error("Error while writing stale response to client")
+							controller.requestLogger(req).WithError(err).Error("Error while writing stale response to client")
 						}
 
 					} else {
 
 						if validationResponse == nil {
-							log := logrus.NewEntry(controller.Logger)
+							log := controller.requestLogger(req)
 							if err != nil {
 								log = log.WithError(err)
 							}
 
-							log = log.WithFields(logrus.Fields{
+							log = log.WithFields(controller.redactLogFields(logrus.Fields{
 								"transport":      transport,
 								"forward-config": forwardConfig,
 								"request":        revalidationRequest,
 								"response":       validationResponse,
-							})
+							}))
 
 							log.Warning("Unable to revalidate cache at origin server")
 
@@ -423,9 +918,9 @@ func (controller *CacheController) getCachedResponse(
 						} else {
 							//If we reached this block it means we were able to contact the origin but it returned a 5xx code and are not allowed to serve a stale response
 							//So we have to send the error to the client as per section 4.3.3 of RFC7234
-							err := writeHTTPResponse(resp, validationResponse)
+							err := controller.writeHTTPResponse(cacheConfig, resp, validationResponse)
 							if err != nil {
-								controller.Logger.WithError(err).Error("Error while writing validation response to client")
+								controller.requestLogger(req).WithError(err).Error("Error while writing validation response to client")
 							}
 						}
 					}
@@ -435,14 +930,41 @@ func (controller *CacheController) getCachedResponse(
 
 				//If the response is not modified we can refresh the response
 				if validationResponse.StatusCode == http.StatusNotModified {
+					setCacheStatus(resp, CacheStatusRevalidated)
+					controller.incrMetric(MetricCacheRevalidated, 1, nil)
+					controller.emitEvent(CacheEventRevalidate, cacheKey, -1, false)
 
 					// if cacheConfig.HTTPWarnings {
 					//TODO remove warnings from stored response
 					// }
 
+					//The secondary key under which the revalidated response is stored
+					storedSecondaryKey := secondaryCacheKey
+
+					//If the origin selected a different stored variant, use that variant for this request
+					// Section 4.3.4 of RFC 7234
+					validatedETag := validationResponse.Header.Get("Etag")
+					if validatedETag != "" && !weakETagEqual(validatedETag, cachedResponse.Header.Get("Etag")) {
+						if selected, found := selectVariant(variants, validatedETag); found {
+							selectedResponse, _, err := controller.findResponseInCache(primaryCacheKey + selected.secondaryKey)
+							if err != nil {
+								controller.requestLogger(req).WithError(err).WithField("cache-key", primaryCacheKey+selected.secondaryKey).Error("Error while attempting to find selected variant in cache")
+							}
+
+							if selectedResponse != nil {
+								selectedResponse.Request = req
+								cachedResponse = selectedResponse
+								storedSecondaryKey = selected.secondaryKey
+							}
+						}
+					}
+
 					//Overwrite cached headers with the headers from the validation response
-					for header, value := range validationResponse.Header {
-						cachedResponse.Header[header] = value
+					mergeValidationHeaders(cachedResponse, validationResponse)
+
+					//If the validation response changed the Vary header the stored response has to be selected with the new secondary keys
+					if _, found := validationResponse.Header[VaryHeader]; found {
+						controller.updateVaryOfStoredResponse(cacheConfig, req, primaryCacheKey, storedSecondaryKey, cachedResponse)
 					}
 
 					//Set the updated cachedResponse as the response
@@ -452,11 +974,45 @@ func (controller *CacheController) getCachedResponse(
 					//If status code is 200 we can use this response
 				} else if validationResponse.StatusCode == http.StatusOK {
 
+					//A response rejected by a validator isn't stored, serve the stale response instead of the broken one if allowed
+					err := validateResponse(cacheConfig, validationResponse)
+					if err != nil && mayServeStaleResponse(cacheConfig, cachedResponse, ttl, OriginFailureInvalidResponse) {
+						validationResponse.Body.Close()
+
+						controller.requestLogger(req).WithError(err).WithField("cache-key", cacheKey).Warning("Serving stale response because the response of the origin was rejected by a validator")
+
+						stripNoCacheFields(cachedResponse)
+
+						setCacheStatus(resp, CacheStatusStale)
+						controller.incrMetric(MetricCacheRejected, 1, nil)
+						controller.incrMetric(MetricCacheStale, 1, nil)
+						controller.emitEvent(CacheEventHit, cacheKey, cachedResponse.ContentLength, true)
+
+						controller.prepareResponseForClient(cacheConfig, req, cachedResponse)
+
+						err := controller.writeCachedResponse(cacheConfig, resp, cachedResponse, age)
+						if err != nil {
+							controller.requestLogger(req).WithError(err).Error("Error while writing stale response to client")
+						}
+
+						return response, true
+					}
+
 					//Set validation response as the response to be cached and send to the client
 					response = validationResponse
-				}
 
-				//TODO if 206 save partial response if partial responses are allowed
+					//The stored response was modified and the origin only sent the range requested by the client
+				} else if validationResponse.StatusCode == http.StatusPartialContent {
+
+					//A partial response containing the complete representation can be stored like a 200 response
+					if cacheConfig.CacheIncompleteResponses && cacheConfig.CombinePartialResponses {
+						completePartialResponse(validationResponse)
+					}
+
+					//The partial response replaces the stored response if incomplete responses may be stored, see shouldStoreResponse.
+					// Otherwise it is only send to the client, since the origin already answered its range request
+					response = validationResponse
+				}
 
 				//If no revalidation can be done or precondition failed
 			} else {
@@ -468,35 +1024,40 @@ func (controller *CacheController) getCachedResponse(
 					!cachedresponseHasMustRevalidate && //If the response contains a must-revalidate, we must always revalidate, can serve from cache
 					clientWantsResponse { //If the client wants a response which is fresher than what we have, we can't serve the cached response
 
-					noCacheFields := false
-
 					//If the response contains a no-cache directive with a field-list strip the headers from the response
 					//Section 5.2.2.2 of RFC 7234
-					for _, directive := range splitCacheControlHeader(cachedResponse.Header[CacheControlHeader]) {
-						if strings.HasPrefix(directive, NoCacheDirective+"=") {
-							noCacheFields = true
-
-							fieldList := strings.TrimPrefix(directive, NoCacheDirective+"=")
-							fieldList = strings.Trim(fieldList, "\"")
-							for _, fieldName := range strings.Split(fieldList, ",") {
-								cachedResponse.Header.Del(strings.TrimSpace(fieldName))
-							}
-						}
-					}
+					noCacheFields := stripNoCacheFields(cachedResponse)
 
 					//If the Cache-Control header contained a no-cache directive with a field set
 					// We can may return the cached response without the headers in the fieldset
 					if noCacheFields {
-						err := writeCachedResponse(resp, cachedResponse, ttl)
+						setCacheStatus(resp, CacheStatusHit)
+						controller.incrMetric(MetricCacheHit, 1, nil)
+						controller.emitEvent(CacheEventHit, cacheKey, cachedResponse.ContentLength, false)
+
+						controller.prepareResponseForClient(cacheConfig, req, cachedResponse)
+
+						err := controller.writeCachedResponse(cacheConfig, resp, cachedResponse, age)
 						if err != nil {
-							controller.Logger.WithError(err).Error("Error while writing un-revalidated response to client")
+							controller.requestLogger(req).WithError(err).Error("Error while writing un-revalidated response to client")
 						}
 
 						return response, true
 					}
 				}
 
-				//TODO invalidate cache key
+				//If the stored response itself requires validation it can never be used again, not only for this client.
+				// Delete it so it isn't looked up on every request and doesn't take up space if the new response is not stored
+				if !freshness.hasValidators && (!cachedResponseIsFresh || freshness.noCache) {
+					cachedResponse.Body.Close()
+
+					err := controller.deleteCacheEntry(cacheKey)
+					if err != nil {
+						controller.requestLogger(req).WithError(err).WithField("cache-key", cacheKey).Error("Error while deleting unusable cache entry")
+					} else {
+						controller.emitEvent(CacheEventPurge, cacheKey, -1, false)
+					}
+				}
 			}
 		}
 	}
@@ -507,91 +1068,190 @@ func (controller *CacheController) getCachedResponse(
 //storeResponse stores the response if it should be stored
 func (controller *CacheController) storeResponse(cacheConfig *CacheConfig, req *http.Request, response *http.Response, primaryCacheKey string) *http.Response {
 
+	//Strip headers which should never be stored or served, this is done before storing so they never land in the cache
+	stripResponseHeaders(cacheConfig, response.Header)
+
 	//If the response is cacheable
 	if shouldStoreResponse(cacheConfig, response) {
 
-		//Get ttl and check if the response is not considered stale on arrival
-		if ttl := getResponseTTL(cacheConfig, response); ttl > 0 {
+		ttl := getResponseTTL(cacheConfig, response)
+
+		//Responses which have to be revalidated before every use are stored even if they are stale on arrival
+		// as long as they can be revalidated. The ttl is clamped to zero so the entry is always considered stale
+		alwaysRevalidate := responseRequiresRevalidation(response) && responseHasValidators(response)
+		if alwaysRevalidate && ttl < 0 {
+			ttl = 0
+		}
+
+		//Check if the response is not considered stale on arrival
+		if ttl > 0 || alwaysRevalidate {
 
 			//Get the secondary key fields from the response (if any exist)
-			secondaryKeyFields := []string{}
-			vary := response.Header.Get(VaryHeader)
-			if vary != "" {
-				for _, key := range strings.Split(vary, ",") {
-					secondaryKeyFields = append(secondaryKeyFields, strings.TrimSpace(key))
-				}
-			}
+			secondaryKeyFields := addPreflightKeyFields(cacheConfig, req, getSecondaryKeyFields(cacheConfig, response.Header))
 
 			//Get the secondaryCacheKey
-			secondaryCacheKey := getSecondaryCacheKey(secondaryKeyFields, req)
+			secondaryCacheKey := getSecondaryCacheKey(cacheConfig, secondaryKeyFields, req)
 
 			//Append the two to get the full cache key
 			cacheKey := primaryCacheKey + secondaryCacheKey
 
-			//Store the latest set of secondary keys we find
-			//this can cause issues if the origin returns a different value in Vary for different primary cache keys
-			//TODO look into this
-			err := controller.storeSecondaryKeysInCache(primaryCacheKey, secondaryKeyFields, ttl)
-			if err != nil {
+			//A response broken by the origin would be served from the cache until it expires
+			if err := validateResponse(cacheConfig, response); err != nil {
+				controller.incrMetric(MetricCacheRejected, 1, nil)
+				controller.requestLogger(req).WithError(err).WithField("cache-key", cacheKey).Warning("Not storing response because it was rejected by a validator")
+
+				return response
+			}
 
-				controller.Logger.WithError(err).WithFields(logrus.Fields{
+			//A response generated from headers which are not in the cache key would be served to clients which didn't send them
+			if !controller.allowedByPoisoningProtection(cacheConfig, req, response, cacheKey) {
+				return response
+			}
+
+			if cacheConfig.AdmissionPolicy != nil && !cacheConfig.AdmissionPolicy.Admit(cacheKey, response) {
+				controller.incrMetric(MetricCacheNotAdmitted, 1, nil)
+				return response
+			}
+
+			//The quota is checked before anything is stored, so a refused response leaves no index entries behind
+			if tenant := TenantFromRequest(req); !controller.tenantQuotaAllows(tenant, cacheKey, response.ContentLength) {
+				controller.requestLogger(req).WithFields(controller.redactLogFields(logrus.Fields{
 					"cache-key": cacheKey,
-					"response":  response,
-				}).Error("Error while attempting to store secondary cache keys in cache")
+					"tenant":    tenant,
+				})).Warning("Not storing response because the tenant quota is exceeded")
 
-				//TODO handle gracefully so the requests can continue even if we can't store the response
-				panic(err)
+				return response
 			}
 
-			err = controller.storeResponseInCache(cacheKey, response, ttl)
+			//Store the latest set of secondary keys we find, responses stored under a different set of secondary keys
+			// can no longer be selected. If a 304 response changes the Vary header the old variant is removed, see updateVaryOfStoredResponse
+			//Without the secondary keys the response can't be found, so it is not stored but still served
+			err := controller.storeSecondaryKeysInCache(primaryCacheKey, secondaryKeyFields, ttl)
 			if err != nil {
-				controller.Logger.WithError(err).WithFields(logrus.Fields{
+
+				controller.requestLogger(req).WithError(err).WithFields(controller.redactLogFields(logrus.Fields{
 					"cache-key": cacheKey,
 					"response":  response,
-				}).Error("Error while attempting to store response in cache")
+				})).Error("Error while attempting to store secondary cache keys in cache")
 
-				//TODO handle gracefully so the requests can continue even if we can't store the response
-				panic(err)
+				return response
 			}
 
-			response, _, err = controller.findResponseInCache(cacheKey)
-			if err != nil {
-				panic(err)
-			}
+			//The body is served to the client while it is stored, instead of reading it back from the cache after storing it
+			response = controller.storeWhileServing(req, response, primaryCacheKey, secondaryCacheKey, ttl, cacheConfig.MaxVariants)
 		}
+
+	} else if controller.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		//Explaining is only done when it is logged since it evaluates all rules again
+		controller.requestLogger(req).WithFields(controller.redactLogFields(logrus.Fields{
+			"cache-key": primaryCacheKey,
+			"decision":  controller.Explain(req, response).String(),
+		})).Debug("Response not stored")
 	}
 
 	return response
 }
 
+//errResponseBodyLost is returned when a response could not be stored and its body was consumed while attempting to do so
+var errResponseBodyLost = errors.New("response body lost while storing")
+
+//errResponseTruncated is returned when the body of a response is shorter or longer than its Content-Length or Content-Range
+// The body has been consumed, so it is also a errResponseBodyLost
+var errResponseTruncated = fmt.Errorf("%w: body length doesn't match the declared length", errResponseBodyLost)
+
+//expectedBodyLength returns the length of the body declared by the origin, false is returned if it is unknown
+// The body of a partial response must match its Content-Range
+func expectedBodyLength(response *http.Response) (int64, bool) {
+	if response.StatusCode == http.StatusPartialContent {
+		if contentRange, err := parseContentRange(response.Header.Get("Content-Range")); err == nil {
+			return contentRange.end - contentRange.start + 1, true
+		}
+	}
+
+	return response.ContentLength, response.ContentLength >= 0
+}
+
 //storeResponseInCache stores the given response in the cache under the cacheKey
 //The main difference with storeInCache is that this function handels the generation of the byte representation of the response
-func (controller *CacheController) storeResponseInCache(cacheKey string, response *http.Response, ttl time.Duration) error {
+// The size of the byte representation is returned
+//The body is stored first under its own key, so the metadata can contain the exact content length
+// and a metadata entry never refers to a body which was not stored
+func (controller *CacheController) storeResponseInCache(cacheKey string, response *http.Response, ttl time.Duration) (int64, error) {
+
+	body := response.Body
+	if body == nil {
+		body = http.NoBody
+	}
 
-	pipeReader, pipeWriter := io.Pipe()
+	bodyReader := &countingReadCloser{ReadCloser: body, checksum: newBodyChecksum()}
 
-	//Make a error reporting mechanism
-	writeErrChan := make(chan error)
+	//HEAD responses have no body but keep the Content-Length of the GET response
+	isHeadResponse := response.Request != nil && response.Request.Method == http.MethodHead
+	hasBody := !isHeadResponse && bodyAllowedForStatus(response.StatusCode)
 
-	//Write the response is a different goroutine because otherwise we risk a deadlock
-	go func() {
-		err := response.Write(pipeWriter)
-		pipeWriter.Close()
-		writeErrChan <- err
-	}()
+	expectedLength, lengthKnown := expectedBodyLength(response)
 
-	storeErr := controller.storeInCache(cacheKey, pipeReader, ttl)
-	writeErr := <-writeErrChan
+	//If no layer stored the body the client still needs it, so the body of the response is replaced by what remains
+	bodySize := int64(-1)
+	if !hasBody {
+		bodySize = 0
+	} else if lengthKnown {
+		bodySize = expectedLength
+	}
+
+	remaining, err := controller.storeEntryInLayers(bodyCacheKeyPrefix+cacheKey, bodyReader, bodySize, ttl, controller.firstStorageLayer(response))
+	if err != nil {
+		if remaining == nil {
+			return bodyReader.count, fmt.Errorf("%w: %v", errResponseBodyLost, err)
+		}
+
+		response.Body = remaining
+		return bodyReader.count, fmt.Errorf("Store error: %w", err)
+	}
 
-	if storeErr != nil {
-		return fmt.Errorf("Store error: %w", storeErr)
+	//A connection which is closed before the whole body is received results in a incomplete response,
+	// which must not be stored as if it were complete. Section 3.1 of RFC 7234
+	if hasBody && lengthKnown && bodyReader.count != expectedLength {
+		controller.incrMetric(MetricCacheTruncated, 1, nil)
+
+		if err := controller.deleteCacheEntry(cacheKey); err != nil {
+			controller.Logger.WithError(err).WithField("cache-key", cacheKey).Error("Error while deleting truncated response from cache")
+		}
+
+		return bodyReader.count, fmt.Errorf("%w: received %d of %d bytes", errResponseTruncated, bodyReader.count, expectedLength)
 	}
 
-	if writeErr != nil {
-		return fmt.Errorf("Write error: %w", writeErr)
+	if hasBody {
+		response.ContentLength = bodyReader.count
+		response.Header.Set("Content-Length", strconv.FormatInt(bodyReader.count, 10))
+
+		controller.recordResponseSize(response, bodyReader.count)
 	}
 
-	return nil
+	metadata := getBuffer()
+	defer putBuffer(metadata)
+
+	err = writeCacheEntry(metadata, response, encodeBodyChecksum(bodyReader.checksum))
+	if err != nil {
+		return bodyReader.count, fmt.Errorf("Write error: %w", err)
+	}
+
+	size := bodyReader.count + int64(metadata.Len())
+
+	//Layers consume the entry before Set returns, so the buffer can be returned to the pool afterwards
+	err = controller.storeInCache(cacheKey, ioutil.NopCloser(metadata), ttl)
+	if err != nil {
+		//The body was stored, so it can be served from the cache even though the response can't be found
+		body, findErr := controller.findRawEntryInCache(bodyCacheKeyPrefix + cacheKey)
+		if findErr != nil || body == nil {
+			return size, fmt.Errorf("%w: %v", errResponseBodyLost, err)
+		}
+
+		response.Body = body
+		return size, fmt.Errorf("Store error: %w", err)
+	}
+
+	return size, nil
 }
 
 //storeSecondaryKeysInCache creates a special purpose cache entry which stores a list of header names used as secondary cache keys
@@ -608,63 +1268,233 @@ func (controller *CacheController) storeSecondaryKeysInCache(primaryCacheKey str
 	return controller.storeInCache(secondaryCacheKeys, keysReader, ttl)
 }
 
-//refreshCacheEntry updates the ttl of the given cacheKey
+//refreshCacheEntry updates the ttl of the given cacheKey in every layer which contains it
+// layer.ErrNotFound is returned if no layer contains the cache key.
+// If a layer fails to refresh the entry the other layers are still refreshed and the first error is returned
 func (controller *CacheController) refreshCacheEntry(cacheKey string, ttl time.Duration) error {
+	found := false
+	var firstErr error
 
 	for _, cacheLayer := range controller.Layers {
 		err := cacheLayer.Refresh(cacheKey, ttl)
-		if err != nil {
-			//TODO detect expected vs unexpected errors
+		if err == nil {
+			found = true
+			continue
+		}
 
-			controller.Logger.WithError(err).WithField("cache-key", cacheKey).Error("Error while refreshing cache entry")
+		//A entry doesn't have to be stored in every layer
+		if errors.Is(err, layer.ErrNotFound) {
+			continue
 		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if !found {
+		return layer.ErrNotFound
 	}
 
 	return nil
 }
 
+//deleteCacheEntry deletes a stored response and its body from all layers
+// If a layer fails to delete the entry the other layers are still tried and the first error is returned
+func (controller *CacheController) deleteCacheEntry(cacheKey string) error {
+	var firstErr error
+
+	for _, cacheLayer := range controller.Layers {
+		for _, key := range []string{cacheKey, bodyCacheKeyPrefix + cacheKey} {
+			if err := cacheLayer.Delete(key); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
 //storeInCache attempts to store the entity in the cache
 func (controller *CacheController) storeInCache(cacheKey string, entry io.ReadCloser, ttl time.Duration) error {
+	remaining, err := controller.storeEntryInLayers(cacheKey, entry, -1, ttl, 0)
+	if remaining != nil {
+		remaining.Close()
+	}
+
+	return err
+}
+
+//storeEntryInLayers stores the entry in the first layer which accepts it and copies it to all layers after that one.
+// A layer which fails to store the entry, for example because the entry is to big or the layer is full, is skipped.
+// If the size of the entry is known, layers which are smaller than the entry are skipped without reading the entry.
+//
+// The layers before firstLayer are skipped.
+//
+// If no layer stored the entry the error of the last layer is returned together with a reader
+// which reads the complete entry, so it can still be used. The reader is nil if the entry was lost
+func (controller *CacheController) storeEntryInLayers(cacheKey string, entry io.ReadCloser, size int64, ttl time.Duration, firstLayer int) (io.ReadCloser, error) {
+	candidates := controller.candidateLayers(size, firstLayer)
+
+	replaySize := controller.LayerReplaySize
+	if replaySize == 0 {
+		replaySize = DefaultLayerReplaySize
+	}
 
-	//Make sure the entry is always closed so we don't leak resources
-	defer entry.Close()
+	replayable := newReplayableReader(entry, replaySize)
 
-	//TODO make a good fail mechanism. Currently if the first layer errors when trying to write to the cache
-	// the content is lost. This is likely to happen if the first layer has finite capacity.
-	// If the first layer only has 512 MB and a 1G movie is cached we have a issue
+	lastErr := error(layer.ErrEntryTooLarge)
+	if len(controller.Layers) <= firstLayer {
+		lastErr = errors.New("no cache layers configured")
+	}
 
-	//Loop over all layers and insert the cached entity
-	for _, cacheLayer := range controller.Layers {
+	//Loop over the layers until one stores the entry
+	for candidate, index := range candidates {
+		cacheLayer := controller.Layers[index]
+
+		//The entry can't be read again after the last layer which can store it, so it is no longer recorded
+		if candidate == len(candidates)-1 {
+			replayable.stopRecording()
+		}
+
+		source, ok := replayable.replay()
+		if !ok {
+			replayable.Close()
+			return nil, lastErr
+		}
 
-		err := cacheLayer.Set(cacheKey, entry, ttl)
+		err := cacheLayer.Set(cacheKey, ioutil.NopCloser(source), ttl)
 		if err != nil {
-			return err
+			controller.Logger.WithError(err).WithFields(logrus.Fields{
+				"cache-key": cacheKey,
+				"layer":     index,
+			}).Warning("Cache layer failed to store entry, trying next layer")
+
+			lastErr = err
+			continue
 		}
 
-		//TODO asynchronous writes. After the first layer has been successfully written writing to the next layers can happen asynchronously
+		replayable.Close()
+
+		//After the first layer has been successfully written the next layers can be written in the background
 		// this way the latency of the initial request is improved
+		if controller.AsynchronousLayerWrites && index+1 < len(controller.Layers) {
+			controller.getBackgroundPool().submit(BackgroundPriorityLayerWrite, func() {
+				controller.copyToLayers(cacheKey, index, ttl)
+			})
+
+			return nil, nil
+		}
+
+		controller.copyToLayers(cacheKey, index, ttl)
+
+		return nil, nil
+	}
+
+	//The returned reader is the last reader of the entry
+	replayable.stopRecording()
 
-		//Replace the entity with a reader from the previous layer
-		// We have to do this because the initial reader has now been fully read and closed
-		entry, _, err = cacheLayer.Get(cacheKey)
+	source, ok := replayable.replay()
+	if !ok {
+		replayable.Close()
+		return nil, lastErr
+	}
+
+	return &releasingReadCloser{
+		ReadCloser: ioutil.NopCloser(source),
+		release: func() {
+			replayable.Close()
+		},
+	}, lastErr
+}
+
+//candidateLayers returns the indexes of the layers from firstLayer on which can store a entry of the size.
+// Layers which report a capacity smaller than the size are left out, the size is -1 if it is unknown
+func (controller *CacheController) candidateLayers(size int64, firstLayer int) []int {
+	candidates := make([]int, 0, len(controller.Layers))
+
+	for index := firstLayer; index < len(controller.Layers); index++ {
+		if reporter, ok := controller.Layers[index].(layer.SizeReporter); ok && size >= 0 {
+			if _, capacity := reporter.Size(); capacity > 0 && size > capacity {
+				continue
+			}
+		}
+
+		candidates = append(candidates, index)
+	}
+
+	return candidates
+}
+
+//copyToLayers copies a entry from the source layer to all layers after it
+// Layers which fail to store the entry are skipped, the errors are logged
+func (controller *CacheController) copyToLayers(cacheKey string, sourceLayer int, ttl time.Duration) {
+	for index := sourceLayer + 1; index < len(controller.Layers); index++ {
+
+		//Get the entity from the last layer which stored it
+		// We have to do this because the previous reader has been fully read and closed
+		entry, _, err := controller.Layers[sourceLayer].Get(cacheKey)
 		if err != nil {
-			return err
+			controller.Logger.WithError(err).WithField("cache-key", cacheKey).Error("Error while reading entry to copy it to the next layers")
+			return
+		}
+
+		//The entry was evicted or replaced before it could be copied
+		if entry == nil {
+			return
+		}
+
+		err = controller.Layers[index].Set(cacheKey, entry, ttl)
+		if err != nil {
+			controller.Logger.WithError(err).WithFields(logrus.Fields{
+				"cache-key": cacheKey,
+				"layer":     index,
+			}).Warning("Cache layer failed to store entry, skipping layer")
+
+			continue
 		}
+
+		sourceLayer = index
 	}
+}
 
-	return nil
+//findRawEntryInCache returns a reader for the stored bytes of the cache key from the first layer which has it
+func (controller *CacheController) findRawEntryInCache(cacheKey string) (io.ReadCloser, error) {
+	for _, cacheLayer := range controller.Layers {
+		reader, _, err := cacheLayer.Get(cacheKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if reader != nil {
+			return reader, nil
+		}
+	}
+
+	return nil, nil
 }
 
 //findResponseInCache attempts to find a cached response in the caching layers
 // it returns the cached response and the TTL. A negative TTL means the response is stale
 func (controller *CacheController) findResponseInCache(cacheKey string) (*http.Response, time.Duration, error) {
+	response, _, ttl, err := controller.findEntryInCache(cacheKey)
+	return response, ttl, err
+}
+
+//findEntryInCache attempts to find a cached response and its freshness information in the caching layers
+// it returns the cached response, the freshness information and the TTL. A negative TTL means the response is stale
+func (controller *CacheController) findEntryInCache(cacheKey string) (*http.Response, *entryFreshness, time.Duration, error) {
 
 	//TODO if a entry is found in a lower layer consider moving it to a higher layer if it is requested more frequently
 
 	for _, cacheLayer := range controller.Layers {
 		reader, ttl, err := cacheLayer.Get(cacheKey)
 		if err != nil {
-			return nil, -1, err
+			return nil, nil, -1, err
 		}
 
 		//If the entry was not found
@@ -672,21 +1502,56 @@ func (controller *CacheController) findResponseInCache(cacheKey string) (*http.R
 			continue
 		}
 
-		httpReader := bufio.NewReader(reader)
+		httpReader := getBufioReader(reader)
 
 		//Close the cache reader when we are done
 		defer reader.Close()
 
-		response, err := http.ReadResponse(httpReader, nil)
+		//The body is read from the same layer as the metadata, it is only opened here, not read
+		openBody := func() (io.ReadCloser, error) {
+			body, _, err := cacheLayer.Get(bodyCacheKeyPrefix + cacheKey)
+			return body, err
+		}
+
+		response, freshness, err := readCacheEntry(httpReader, openBody)
 		if err != nil {
-			return nil, -1, err
+			//A entry written by a newer version of the cache is treated as if it doesn't exist
+			// It will be replaced by a entry in the current format when the response is stored again
+			if errors.Is(err, errUnsupportedEntryVersion) || errors.Is(err, errEntryBodyMissing) {
+				controller.Logger.WithError(err).WithField("cache-key", cacheKey).Debug("Skipping unusable cache entry")
+				continue
+			}
+
+			return nil, nil, -1, err
+		}
+
+		//A corrupted entry is deleted from the layer, so the response is read from the next layer or fetched again
+		if freshness.checksum != "" && response.Body != nil && controller.shouldVerifyChecksum(response.Body) {
+			err = verifyBodyChecksum(response, freshness.checksum)
+			if errors.Is(err, errChecksumMismatch) {
+				controller.incrMetric(MetricCacheCorrupted, 1, nil)
+				controller.Logger.WithField("cache-key", cacheKey).Warning("Deleting stored response of which the body doesn't match the checksum")
+
+				for _, key := range []string{cacheKey, bodyCacheKeyPrefix + cacheKey} {
+					if err := cacheLayer.Delete(key); err != nil {
+						controller.Logger.WithError(err).WithField("cache-key", key).Error("Error while deleting corrupted entry from cache")
+					}
+				}
+
+				continue
+			}
+
+			if err != nil {
+				response.Body.Close()
+				return nil, nil, -1, err
+			}
 		}
 
-		return response, ttl, nil
+		return response, freshness, ttl, nil
 	}
 
 	//If entry wasn't found in any layer
-	return nil, -1, nil
+	return nil, nil, -1, nil
 }
 
 //findSecondaryKeysInCache attempts to find the secondary keys defined for a set of responses with the given primary cache key
@@ -711,14 +1576,12 @@ func (controller *CacheController) findSecondaryKeysInCache(cacheKey string) ([]
 			continue
 		}
 
-		keyReader := bufio.NewReader(reader)
-
 		//Close the cache reader when we are done
 		defer reader.Close()
 
 		keys := []string{}
 
-		scanner := bufio.NewScanner(keyReader)
+		scanner := bufio.NewScanner(reader)
 		for scanner.Scan() {
 			keys = append(keys, scanner.Text())
 		}
@@ -0,0 +1,799 @@
+package sharedhttpcache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dylandreimerink/sharedhttpcache/layer"
+)
+
+//newTestController creates a cache controller with a in-memory layer which forwards all requests to the origin handler
+// The returned host can be used as the host of requests to the controller
+func newTestController(t *testing.T, origin http.Handler) (*CacheController, string, func()) {
+	originServer := httptest.NewServer(origin)
+
+	originURL, err := url.Parse(originServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller := &CacheController{
+		DefaultCacheConfig: NewCacheConfig(),
+		DefaultForwardConfig: &ForwardConfig{
+			Host: originURL.Host,
+		},
+		Layers: []layer.CacheLayer{
+			layer.NewInMemoryCacheLayer(1024 * 1024),
+		},
+	}
+
+	return controller, originURL.Host, originServer.Close
+}
+
+//doTestRequest sends a request to the controller and returns the response and body
+func doTestRequest(t *testing.T, controller *CacheController, req *http.Request) (*http.Response, string) {
+	recorder := httptest.NewRecorder()
+	controller.ServeHTTP(recorder, req)
+
+	response := recorder.Result()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response, string(body)
+}
+
+func TestESI(t *testing.T) {
+	fragmentRequests := 0
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/page":
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			rw.Header().Set(CacheControlHeader, "max-age=60")
+			_, _ = rw.Write([]byte(`<p>page</p><esi:include src="/fragment"/><esi:remove>fallback</esi:remove><!--esi <b>esi only</b>-->`))
+
+		case "/fragment":
+			fragmentRequests++
+			rw.Header().Set(CacheControlHeader, "max-age=60")
+			_, _ = rw.Write([]byte("<p>fragment</p>"))
+
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.EnableESI = true
+
+	for i := 0; i < 2; i++ {
+		_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil))
+
+		expected := "<p>page</p><p>fragment</p> <b>esi only</b>"
+		if body != expected {
+			t.Errorf("expected: %s, got: %s", expected, body)
+		}
+	}
+
+	if fragmentRequests != 1 {
+		t.Errorf("expected the fragment to be cached, got %d origin requests", fragmentRequests)
+	}
+}
+
+func TestESIFragmentLimits(t *testing.T) {
+	var active, maxActive int32
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/page":
+			rw.Header().Set("Content-Type", "text/html")
+			page := `<esi:include src="/panic"/>`
+			for i := 0; i < 20; i++ {
+				page += fmt.Sprintf(`<esi:include src="/fragment?%d"/>`, i)
+			}
+			_, _ = rw.Write([]byte(page))
+
+		case "/fragment":
+			current := atomic.AddInt32(&active, 1)
+			for {
+				seen := atomic.LoadInt32(&maxActive)
+				if current <= seen || atomic.CompareAndSwapInt32(&maxActive, seen, current) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+
+			_, _ = rw.Write([]byte("f"))
+
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.EnableESI = true
+	controller.CacheConfigResolver = CacheConfigResolverFunc(func(req *http.Request) *CacheConfig {
+		if req.URL.Path == "/panic" {
+			panic("resolver failed")
+		}
+
+		return nil
+	})
+
+	_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil))
+
+	//The panicking fragment is omitted, the other fragments are included
+	if body != strings.Repeat("f", 20) {
+		t.Errorf("expected all fragments except the panicking one, got: %s", body)
+	}
+
+	if maxActive > maxESIFragmentRequests {
+		t.Errorf("expected at most %d concurrent fragment requests, got %d", maxESIFragmentRequests, maxActive)
+	}
+}
+
+func TestBulkRevalidation(t *testing.T) {
+	lastIfNoneMatch := ""
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lastIfNoneMatch = req.Header.Get("If-None-Match")
+
+		etag := `"` + req.Header.Get("Accept-Language") + `"`
+
+		rw.Header().Set(CacheControlHeader, "max-age=0")
+		rw.Header().Set(VaryHeader, "Accept-Language")
+		rw.Header().Set("Etag", etag)
+
+		if lastIfNoneMatch != "" {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		_, _ = rw.Write([]byte(req.Header.Get("Accept-Language")))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.BulkRevalidation = true
+
+	for _, lang := range []string{"en", "nl", "en"} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.Header.Set("Accept-Language", lang)
+
+		_, body := doTestRequest(t, controller, req)
+		if body != lang {
+			t.Errorf("expected body: %s, got: %s", lang, body)
+		}
+	}
+
+	if lastIfNoneMatch != `"en", "nl"` {
+		t.Errorf("expected the etags of all variants in If-None-Match, got: %s", lastIfNoneMatch)
+	}
+}
+
+func TestVaryChangedByRevalidation(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=0")
+		rw.Header().Set("Etag", `"v1"`)
+
+		//The origin starts to vary on a different header when the response is revalidated
+		if req.Header.Get("If-None-Match") != "" {
+			rw.Header().Set(VaryHeader, "Accept-Encoding")
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		rw.Header().Set(VaryHeader, "Accept-Language")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.Header.Set("Accept-Language", "en")
+		return req
+	}
+
+	for i := 0; i < 2; i++ {
+		_, body := doTestRequest(t, controller, newRequest())
+		if body != "content" {
+			t.Fatalf("expected body: content, got: %s", body)
+		}
+	}
+
+	req := newRequest()
+	primaryCacheKey := getPrimaryCacheKey(controller.DefaultCacheConfig, controller.DefaultForwardConfig, req)
+	oldSecondaryKey := getSecondaryCacheKey(controller.DefaultCacheConfig, []string{"Accept-Language"}, req)
+	newSecondaryKey := getSecondaryCacheKey(controller.DefaultCacheConfig, []string{"Accept-Encoding"}, req)
+
+	secondaryKeys, _, err := controller.findSecondaryKeysInCache(primaryCacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secondaryKeys) != 1 || secondaryKeys[0] != "Accept-Encoding" {
+		t.Errorf("expected the secondary keys of the 304 response, got: %v", secondaryKeys)
+	}
+
+	variants, err := controller.findVariantsInCache(primaryCacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 1 || variants[0].secondaryKey != newSecondaryKey {
+		t.Errorf("expected only the variant with the new secondary key, got: %v", variants)
+	}
+
+	if entry, _, _ := controller.Layers[0].Get(primaryCacheKey + oldSecondaryKey); entry != nil {
+		t.Error("expected the response under the old secondary key to be deleted")
+	}
+
+	if entry, _, _ := controller.Layers[0].Get(primaryCacheKey + newSecondaryKey); entry == nil {
+		t.Error("expected the response to be stored under the new secondary key")
+	}
+}
+
+func TestAllowedVaryHeaders(t *testing.T) {
+	for _, bypass := range []bool{false, true} {
+		originRequests := 0
+		controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			originRequests++
+
+			rw.Header().Set(CacheControlHeader, "max-age=60")
+			rw.Header().Set(VaryHeader, "Accept-Encoding, User-Agent")
+			_, _ = rw.Write([]byte("content"))
+		}))
+
+		controller.DefaultCacheConfig.AllowedVaryHeaders = []string{"accept-encoding"}
+		controller.DefaultCacheConfig.BypassDisallowedVary = bypass
+
+		for _, userAgent := range []string{"a", "b"} {
+			req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+			req.Header.Set("User-Agent", userAgent)
+			doTestRequest(t, controller, req)
+		}
+
+		//User-Agent is ignored, so the second client is served the variant of the first.
+		// If disallowed headers bypass the cache nothing is stored
+		expectedRequests := 1
+		if bypass {
+			expectedRequests = 2
+		}
+
+		if originRequests != expectedRequests {
+			t.Errorf("bypass %v: expected %d origin requests, got %d", bypass, expectedRequests, originRequests)
+		}
+
+		closeOrigin()
+	}
+}
+
+func TestMaxVariants(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		rw.Header().Set(VaryHeader, "Accept-Language")
+		_, _ = rw.Write([]byte(req.Header.Get("Accept-Language")))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.MaxVariants = 2
+
+	newRequest := func(language string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.Header.Set("Accept-Language", language)
+		return req
+	}
+
+	//"en" is used again after "nl" is stored, so "nl" is the least recently used variant when "de" is stored
+	for _, language := range []string{"en", "nl", "en", "de"} {
+		doTestRequest(t, controller, newRequest(language))
+	}
+
+	primaryCacheKey := getPrimaryCacheKey(controller.DefaultCacheConfig, controller.DefaultForwardConfig, newRequest("en"))
+	variants, err := controller.findVariantsInCache(primaryCacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(variants) != 2 {
+		t.Fatalf("expected 2 variants, got %d", len(variants))
+	}
+
+	for _, language := range []string{"en", "de", "nl"} {
+		secondaryKey := getSecondaryCacheKey(controller.DefaultCacheConfig, []string{"Accept-Language"}, newRequest(language))
+		entry, _, _ := controller.Layers[0].Get(primaryCacheKey + secondaryKey)
+		if entry != nil {
+			entry.Close()
+		}
+
+		if stored := entry != nil; stored != (language != "nl") {
+			t.Errorf("%s: expected stored %v, got %v", language, language != "nl", stored)
+		}
+	}
+}
+
+func TestPartialRevalidationResponse(t *testing.T) {
+	for _, combine := range []bool{false, true} {
+		originRequests := 0
+		controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			originRequests++
+
+			rw.Header().Set(CacheControlHeader, "max-age=0")
+
+			//The stored response is modified when it is revalidated
+			if req.Header.Get("If-None-Match") == "" {
+				rw.Header().Set("Etag", `"v1"`)
+				_, _ = rw.Write([]byte("old content"))
+				return
+			}
+
+			rw.Header().Set("Etag", `"v2"`)
+			rw.Header().Set("Content-Range", "bytes 0-10/11")
+			rw.WriteHeader(http.StatusPartialContent)
+			_, _ = rw.Write([]byte("new content"))
+		}))
+
+		controller.DefaultCacheConfig.CacheIncompleteResponses = true
+		controller.DefaultCacheConfig.CombinePartialResponses = combine
+
+		doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.Header.Set("Range", "bytes=0-")
+
+		response, body := doTestRequest(t, controller, req)
+		if body != "new content" {
+			t.Errorf("expected the partial response of the origin, got: %s", body)
+		}
+
+		if originRequests != 2 {
+			t.Errorf("expected the origin to be contacted once for revalidation, got %d requests", originRequests)
+		}
+
+		expectedStatus := http.StatusPartialContent
+		if combine {
+			expectedStatus = http.StatusOK
+		}
+
+		if response.StatusCode != expectedStatus {
+			t.Errorf("expected status %d, got %d", expectedStatus, response.StatusCode)
+		}
+
+		cacheKey := getPrimaryCacheKey(controller.DefaultCacheConfig, controller.DefaultForwardConfig, req)
+		storedResponse, _, err := controller.findResponseInCache(cacheKey)
+		if err != nil || storedResponse == nil {
+			t.Fatalf("expected the partial response to be stored: %v", err)
+		}
+		storedResponse.Body.Close()
+
+		if storedResponse.StatusCode != expectedStatus {
+			t.Errorf("expected stored status %d, got %d", expectedStatus, storedResponse.StatusCode)
+		}
+
+		closeOrigin()
+	}
+}
+
+func TestBypassConfig(t *testing.T) {
+	originRequests := 0
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.CacheConfigResolver = CacheConfigResolverFunc(func(req *http.Request) *CacheConfig {
+		if req.URL.Path == "/bypass" {
+			return BypassConfig
+		}
+
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/bypass", nil))
+		doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/cached", nil))
+	}
+
+	if originRequests != 3 {
+		t.Errorf("expected 3 origin requests, got: %d", originRequests)
+	}
+}
+
+func TestStoreFallsBackToNextLayer(t *testing.T) {
+	content := strings.Repeat("x", 100)
+
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte(content))
+	}))
+	defer closeOrigin()
+
+	//The first layer is to small for the body, the second layer can store it
+	controller.Layers = []layer.CacheLayer{
+		layer.NewInMemoryCacheLayer(50),
+		layer.NewInMemoryCacheLayer(1024 * 1024),
+	}
+
+	for i := 0; i < 2; i++ {
+		_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if body != content {
+			t.Fatalf("expected the full body, got %d bytes", len(body))
+		}
+	}
+
+	if originRequests != 1 {
+		t.Errorf("expected the second request to be served from the second layer, got %d origin requests", originRequests)
+	}
+
+	//If no layer can store the response the client still gets it
+	controller.Layers = []layer.CacheLayer{
+		layer.NewInMemoryCacheLayer(50),
+	}
+
+	_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/other", nil))
+	if body != content {
+		t.Errorf("expected the full body when no layer stores it, got %d bytes", len(body))
+	}
+}
+
+//failingLayer reads the complete entry and then fails to store it, it counts the amount of entries it was asked to store
+type failingLayer struct {
+	layer.CacheLayer
+	sets int
+}
+
+func (cacheLayer *failingLayer) Size() (int64, int64) {
+	return cacheLayer.CacheLayer.(layer.SizeReporter).Size()
+}
+
+func (cacheLayer *failingLayer) Set(key string, entry io.ReadCloser, ttl time.Duration) error {
+	cacheLayer.sets++
+	_, _ = ioutil.ReadAll(entry)
+	return errors.New("layer failure")
+}
+
+func TestStoreSkipsLayersSmallerThanEntry(t *testing.T) {
+	controller, _, closeOrigin := newTestController(t, http.NotFoundHandler())
+	defer closeOrigin()
+
+	controller.initialize()
+
+	smallLayer := &failingLayer{CacheLayer: layer.NewInMemoryCacheLayer(50)}
+	controller.Layers = []layer.CacheLayer{
+		smallLayer,
+		layer.NewInMemoryCacheLayer(1024 * 1024),
+	}
+
+	content := strings.Repeat("x", 100)
+	remaining, err := controller.storeEntryInLayers("key", ioutil.NopCloser(strings.NewReader(content)), int64(len(content)), time.Minute, 0)
+	if remaining != nil || err != nil {
+		t.Fatalf("expected the entry to be stored, got error: %v", err)
+	}
+
+	if smallLayer.sets != 0 {
+		t.Errorf("expected the layer which is smaller than the entry to be skipped")
+	}
+
+	//If the size is unknown the small layer is tried first
+	remaining, err = controller.storeEntryInLayers("other", ioutil.NopCloser(strings.NewReader(content)), -1, time.Minute, 0)
+	if remaining != nil || err != nil {
+		t.Fatalf("expected the entry to be stored, got error: %v", err)
+	}
+
+	if smallLayer.sets != 1 {
+		t.Errorf("expected the layer to be tried if the size of the entry is unknown")
+	}
+}
+
+func TestStoreReplaySizeLimit(t *testing.T) {
+	controller, _, closeOrigin := newTestController(t, http.NotFoundHandler())
+	defer closeOrigin()
+
+	controller.initialize()
+
+	content := strings.Repeat("x", 100)
+	controller.Layers = []layer.CacheLayer{
+		&failingLayer{CacheLayer: layer.NewInMemoryCacheLayer(1024 * 1024)},
+		layer.NewInMemoryCacheLayer(1024 * 1024),
+	}
+
+	//The entry is larger than the replay size so it can't be stored in the next layer
+	controller.LayerReplaySize = 10
+	remaining, err := controller.storeEntryInLayers("key", ioutil.NopCloser(strings.NewReader(content)), -1, time.Minute, 0)
+	if remaining != nil || err == nil {
+		t.Fatalf("expected the entry to be lost if it is larger than the replay size")
+	}
+
+	controller.LayerReplaySize = 0
+	remaining, err = controller.storeEntryInLayers("key", ioutil.NopCloser(strings.NewReader(content)), -1, time.Minute, 0)
+	if remaining != nil || err != nil {
+		t.Fatalf("expected the entry to be stored in the next layer, got error: %v", err)
+	}
+}
+
+func TestReplayableReaderStopRecording(t *testing.T) {
+	reader := newReplayableReader(ioutil.NopCloser(strings.NewReader("hello world")), DefaultLayerReplaySize)
+	defer reader.Close()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	//The last layer reads the rest of the entry without recording it
+	reader.stopRecording()
+
+	source, ok := reader.replay()
+	if !ok {
+		t.Fatal("expected the recording to be replayable")
+	}
+
+	body, _ := ioutil.ReadAll(source)
+	if string(body) != "hello world" {
+		t.Errorf("expected the full entry, got '%s'", body)
+	}
+
+	if reader.recorded.Len() != 0 {
+		t.Errorf("expected nothing to be recorded after recording was stopped, got %d bytes", reader.recorded.Len())
+	}
+}
+
+func TestDeleteUnrevalidatableEntry(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		//The first response is stored but must always be revalidated and has no validators, after that it can't be stored
+		if originRequests > 1 {
+			rw.Header().Set(CacheControlHeader, "no-store")
+		} else {
+			rw.Header().Set(CacheControlHeader, "max-age=60, no-cache")
+		}
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	memoryLayer := layer.NewInMemoryCacheLayer(1024 * 1024)
+	controller.Layers = []layer.CacheLayer{memoryLayer}
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	cacheKey := getPrimaryCacheKey(controller.DefaultCacheConfig, controller.DefaultForwardConfig, req) +
+		getSecondaryCacheKey(controller.DefaultCacheConfig, []string{}, req)
+
+	doTestRequest(t, controller, req)
+	if entry, _, _ := memoryLayer.Get(cacheKey); entry == nil {
+		t.Fatal("expected the first response to be stored")
+	}
+
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	for _, key := range []string{cacheKey, bodyCacheKeyPrefix + cacheKey} {
+		if entry, _, _ := memoryLayer.Get(key); entry != nil {
+			t.Errorf("expected '%s' to be deleted", key)
+		}
+	}
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	t := &testing.T{}
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write(make([]byte, 16*1024))
+	}))
+	defer closeOrigin()
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	controller.ServeHTTP(httptest.NewRecorder(), req)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		controller.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func TestTruncatedResponseNotStored(t *testing.T) {
+	controller, _, closeOrigin := newTestController(t, http.NotFoundHandler())
+	defer closeOrigin()
+
+	tests := []struct {
+		name     string
+		status   int
+		header   http.Header
+		length   int64
+		body     string
+		expectOK bool
+	}{
+		{name: "complete", status: http.StatusOK, header: http.Header{}, length: 7, body: "content", expectOK: true},
+		{name: "truncated", status: http.StatusOK, header: http.Header{}, length: 10, body: "content", expectOK: false},
+		{name: "unknown length", status: http.StatusOK, header: http.Header{}, length: -1, body: "content", expectOK: true},
+		{name: "truncated range", status: http.StatusPartialContent, header: http.Header{"Content-Range": {"bytes 0-9/20"}}, length: -1, body: "content", expectOK: false},
+	}
+
+	for _, test := range tests {
+		cacheKey := "test-" + test.name
+		response := &http.Response{
+			StatusCode:    test.status,
+			Header:        test.header,
+			ContentLength: test.length,
+			Body:          ioutil.NopCloser(strings.NewReader(test.body)),
+			Request:       httptest.NewRequest(http.MethodGet, "http://example.com/", nil),
+		}
+
+		_, err := controller.storeResponseInCache(cacheKey, response, time.Minute)
+		if (err == nil) != test.expectOK {
+			t.Errorf("%s: expected ok %v, got error %v", test.name, test.expectOK, err)
+		}
+
+		if err != nil && !errors.Is(err, errResponseBodyLost) {
+			t.Errorf("%s: expected the truncation to be reported as a lost body, got %v", test.name, err)
+		}
+
+		stored, _, _ := controller.findResponseInCache(cacheKey)
+		if stored != nil {
+			stored.Body.Close()
+		}
+
+		if (stored != nil) != test.expectOK {
+			t.Errorf("%s: expected stored %v", test.name, test.expectOK)
+		}
+
+		if body, _, _ := controller.Layers[0].Get(bodyCacheKeyPrefix + cacheKey); body != nil {
+			body.Close()
+			if !test.expectOK {
+				t.Errorf("%s: expected the body of the truncated response to be deleted", test.name)
+			}
+		}
+	}
+}
+
+func TestStripResponseHeadersOnServe(t *testing.T) {
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Backend-Server", "app-1")
+		w.Write([]byte("hello"))
+	})
+
+	controller, host, closeOrigin := newTestController(t, origin)
+	defer closeOrigin()
+
+	//Store the response before the header is stripped
+	resp, _ := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if resp.Header.Get("X-Backend-Server") != "app-1" {
+		t.Fatalf("expected header to be served without strip config, got: %v", resp.Header)
+	}
+
+	controller.DefaultCacheConfig.StripResponseHeaders = []string{"X-Backend-*"}
+
+	resp, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if body != "hello" {
+		t.Fatalf("expected stored body, got: %q", body)
+	}
+
+	if resp.Header.Get("X-Backend-Server") != "" {
+		t.Errorf("expected header to be stripped from stored response, got: %v", resp.Header)
+	}
+
+	//Responses of unsafe methods are never stored, but must also be stripped
+	resp, _ = doTestRequest(t, controller, httptest.NewRequest(http.MethodPost, "http://"+host+"/", nil))
+	if resp.Header.Get("X-Backend-Server") != "" {
+		t.Errorf("expected header to be stripped from unsafe method response, got: %v", resp.Header)
+	}
+}
+
+//openReadersLayer counts the entries which were read from the layer but not closed yet
+type openReadersLayer struct {
+	layer.CacheLayer
+	open int32
+}
+
+func (cacheLayer *openReadersLayer) Get(key string) (io.ReadCloser, time.Duration, error) {
+	reader, ttl, err := cacheLayer.CacheLayer.Get(key)
+	if reader == nil {
+		return reader, ttl, err
+	}
+
+	atomic.AddInt32(&cacheLayer.open, 1)
+	return &openReader{ReadCloser: reader, cacheLayer: cacheLayer}, ttl, err
+}
+
+type openReader struct {
+	io.ReadCloser
+	cacheLayer *openReadersLayer
+	closed     int32
+}
+
+func (reader *openReader) Close() error {
+	if atomic.CompareAndSwapInt32(&reader.closed, 0, 1) {
+		atomic.AddInt32(&reader.cacheLayer.open, -1)
+	}
+
+	return reader.ReadCloser.Close()
+}
+
+func TestUnsafeMethodInvalidation(t *testing.T) {
+	originRequests := 0
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			originRequests++
+		}
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("hello"))
+	}))
+	defer closeOrigin()
+
+	cacheLayer := &openReadersLayer{CacheLayer: controller.Layers[0]}
+	controller.Layers[0] = cacheLayer
+
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil))
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodPost, "http://"+host+"/page", nil))
+
+	if open := atomic.LoadInt32(&cacheLayer.open); open != 0 {
+		t.Errorf("expected all entries read during invalidation to be closed, %d are open", open)
+	}
+
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil))
+
+	if originRequests != 2 {
+		t.Errorf("expected the stored response to be invalidated by the POST, got %d origin requests", originRequests)
+	}
+}
+
+func TestUnsafeMethodInvalidatesVariants(t *testing.T) {
+	originRequests := 0
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			originRequests++
+		}
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		rw.Header().Set(VaryHeader, "Accept-Language")
+		_, _ = rw.Write([]byte(req.Header.Get("Accept-Language")))
+	}))
+	defer closeOrigin()
+
+	newRequest := func(method, lang string) *http.Request {
+		req := httptest.NewRequest(method, "http://"+host+"/page", nil)
+		req.Header.Set("Accept-Language", lang)
+		return req
+	}
+
+	for _, lang := range []string{"en", "nl", "en", "nl"} {
+		doTestRequest(t, controller, newRequest(http.MethodGet, lang))
+	}
+
+	if originRequests != 2 {
+		t.Fatalf("expected both variants to be stored, got %d origin requests", originRequests)
+	}
+
+	doTestRequest(t, controller, newRequest(http.MethodPost, "en"))
+
+	//Both variants are stale after the POST, so both are fetched again
+	for _, lang := range []string{"en", "nl"} {
+		_, body := doTestRequest(t, controller, newRequest(http.MethodGet, lang))
+		if body != lang {
+			t.Errorf("expected body: %s, got: %s", lang, body)
+		}
+	}
+
+	if originRequests != 4 {
+		t.Errorf("expected the POST to invalidate all variants, got %d origin requests", originRequests)
+	}
+}
@@ -0,0 +1,68 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"strings"
+)
+
+//filterRequestCookies removes cookies from a cacheable request before it is forwarded to the origin server
+// as configured by StripRequestCookies. Cookies in the RequestCookieAllowlist or CacheKeyCookies are kept.
+// The request is cloned if it is modified
+func filterRequestCookies(cacheConfig *CacheConfig, req *http.Request) *http.Request {
+	if !cacheConfig.StripRequestCookies || req.Header.Get("Cookie") == "" {
+		return req
+	}
+
+	//Cookies are only stripped from requests which can be served from the cache
+	if !isRequestCacheable(cacheConfig, req) {
+		return req
+	}
+
+	if !matchesPathPrefix(cacheConfig.StripRequestCookiesPaths, req.URL.Path, true) {
+		return req
+	}
+
+	keptCookies := []string{}
+	for _, cookie := range req.Cookies() {
+		if containsString(cacheConfig.RequestCookieAllowlist, cookie.Name) || containsString(cacheConfig.CacheKeyCookies, cookie.Name) {
+			keptCookies = append(keptCookies, cookie.String())
+		}
+	}
+
+	filteredReq := req.Clone(req.Context())
+
+	if len(keptCookies) == 0 {
+		filteredReq.Header.Del("Cookie")
+	} else {
+		filteredReq.Header.Set("Cookie", strings.Join(keptCookies, "; "))
+	}
+
+	return filteredReq
+}
+
+//matchesPathPrefix checks if the path starts with any of the prefixes
+// emptyMatches is returned if there are no prefixes
+func matchesPathPrefix(prefixes []string, path string, emptyMatches bool) bool {
+	if len(prefixes) == 0 {
+		return emptyMatches
+	}
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//containsString checks if the slice contains the value
+func containsString(slice []string, value string) bool {
+	for _, item := range slice {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,341 @@
+package sharedhttpcache
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dylandreimerink/sharedhttpcache/layer"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//dashboardMaxTrackedKeys is the maximum amount of cache keys for which request counts are kept
+	// when the limit is reached all counts are halved and keys which reach zero are forgotten
+	dashboardMaxTrackedKeys = 10000
+
+	dashboardTopKeys      = 20
+	dashboardRecentErrors = 20
+)
+
+//Dashboard is a http.Handler which serves a HTML page with live statistics of a CacheController.
+// It shows the hit ratio, the most requested cache keys, the memory usage per layer, the health of origin servers and recent errors.
+// It is meant to be served on a admin listener, not to the public
+type Dashboard struct {
+	controller *CacheController
+
+	//next is the metrics sink which was configured on the controller before the dashboard was attached
+	next MetricsSink
+
+	unsubscribe func()
+
+	lock         sync.Mutex
+	started      time.Time
+	counters     map[string]int64
+	keyRequests  map[string]int64
+	origins      map[string]*dashboardOrigin
+	recentErrors []dashboardError
+}
+
+type dashboardOrigin struct {
+	Host        string
+	Requests    int64
+	Errors      int64
+	LastStatus  string
+	LastLatency time.Duration
+	LastSeen    time.Time
+}
+
+type dashboardError struct {
+	Time    time.Time
+	Level   string
+	Message string
+}
+
+//NewDashboard creates a dashboard and attaches it to the controller.
+// The dashboard wraps the metrics sink of the controller, subscribes to its event stream and adds a hook to its logger
+// so it must be created before the controller starts serving requests
+func NewDashboard(controller *CacheController) *Dashboard {
+	dashboard := &Dashboard{
+		controller:  controller,
+		next:        controller.Metrics,
+		started:     time.Now(),
+		counters:    make(map[string]int64),
+		keyRequests: make(map[string]int64),
+		origins:     make(map[string]*dashboardOrigin),
+	}
+
+	controller.Metrics = dashboard
+
+	if controller.Logger == nil {
+		controller.Logger = logrus.New()
+	}
+	controller.Logger.AddHook(dashboard)
+
+	events, unsubscribe := controller.SubscribeEvents(1024)
+	dashboard.unsubscribe = unsubscribe
+
+	go func() {
+		for event := range events {
+			dashboard.recordEvent(event)
+		}
+	}()
+
+	return dashboard
+}
+
+//Close stops the dashboard from receiving events
+func (dashboard *Dashboard) Close() {
+	dashboard.unsubscribe()
+}
+
+//IncrCounter records the counter and passes it on to the wrapped metrics sink
+func (dashboard *Dashboard) IncrCounter(name string, value int64, tags map[string]string) {
+	dashboard.lock.Lock()
+	dashboard.counters[name] += value
+	dashboard.lock.Unlock()
+
+	if dashboard.next != nil {
+		dashboard.next.IncrCounter(name, value, tags)
+	}
+}
+
+//ObserveDuration records the origin health and passes the duration on to the wrapped metrics sink
+func (dashboard *Dashboard) ObserveDuration(name string, duration time.Duration, tags map[string]string) {
+	if name == MetricOriginLatency {
+		dashboard.lock.Lock()
+
+		origin := dashboard.origins[tags["origin"]]
+		if origin == nil {
+			origin = &dashboardOrigin{Host: tags["origin"]}
+			dashboard.origins[tags["origin"]] = origin
+		}
+
+		origin.Requests++
+		if tags["status"] == "error" || tags["status"] == "5xx" {
+			origin.Errors++
+		}
+		origin.LastStatus = tags["status"]
+		origin.LastLatency = duration
+		origin.LastSeen = time.Now()
+
+		dashboard.lock.Unlock()
+	}
+
+	if dashboard.next != nil {
+		dashboard.next.ObserveDuration(name, duration, tags)
+	}
+}
+
+//Levels returns the log levels which are shown as recent errors, part of the logrus.Hook interface
+func (dashboard *Dashboard) Levels() []logrus.Level {
+	return []logrus.Level{
+		logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+		logrus.WarnLevel,
+	}
+}
+
+//Fire records a log entry as recent error, part of the logrus.Hook interface
+func (dashboard *Dashboard) Fire(entry *logrus.Entry) error {
+	message := entry.Message
+	if err, ok := entry.Data[logrus.ErrorKey].(error); ok {
+		message += ": " + err.Error()
+	}
+
+	dashboard.lock.Lock()
+	defer dashboard.lock.Unlock()
+
+	dashboard.recentErrors = append(dashboard.recentErrors, dashboardError{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: message,
+	})
+
+	if len(dashboard.recentErrors) > dashboardRecentErrors {
+		dashboard.recentErrors = dashboard.recentErrors[len(dashboard.recentErrors)-dashboardRecentErrors:]
+	}
+
+	return nil
+}
+
+func (dashboard *Dashboard) recordEvent(event CacheEvent) {
+	if event.Type != CacheEventHit && event.Type != CacheEventMiss {
+		return
+	}
+
+	dashboard.lock.Lock()
+	defer dashboard.lock.Unlock()
+
+	dashboard.keyRequests[event.Key]++
+
+	if len(dashboard.keyRequests) > dashboardMaxTrackedKeys {
+		for key, count := range dashboard.keyRequests {
+			if count/2 == 0 {
+				delete(dashboard.keyRequests, key)
+				continue
+			}
+
+			dashboard.keyRequests[key] = count / 2
+		}
+	}
+}
+
+type dashboardKey struct {
+	Key      string
+	Requests int64
+}
+
+type dashboardLayer struct {
+	Index    int
+	Used     int64
+	Capacity int64
+	Percent  float64
+}
+
+type dashboardData struct {
+	Uptime       time.Duration
+	Hits         int64
+	Stale        int64
+	Misses       int64
+	Revalidated  int64
+	HitRatio     float64
+	StoredBytes  int64
+	Evictions    int64
+	TopKeys      []dashboardKey
+	Layers       []dashboardLayer
+	Origins      []dashboardOrigin
+	RecentErrors []dashboardError
+}
+
+//snapshot copies the current statistics
+func (dashboard *Dashboard) snapshot() dashboardData {
+	dashboard.lock.Lock()
+	defer dashboard.lock.Unlock()
+
+	data := dashboardData{
+		Uptime:      time.Since(dashboard.started).Round(time.Second),
+		Hits:        dashboard.counters[MetricCacheHit],
+		Stale:       dashboard.counters[MetricCacheStale],
+		Misses:      dashboard.counters[MetricCacheMiss],
+		Revalidated: dashboard.counters[MetricCacheRevalidated],
+		StoredBytes: dashboard.counters[MetricCacheStoredBytes],
+		Evictions:   dashboard.counters[MetricCacheEviction],
+	}
+
+	if total := data.Hits + data.Stale + data.Misses; total > 0 {
+		data.HitRatio = float64(data.Hits+data.Stale) / float64(total) * 100
+	}
+
+	for key, requests := range dashboard.keyRequests {
+		data.TopKeys = append(data.TopKeys, dashboardKey{Key: key, Requests: requests})
+	}
+	sort.Slice(data.TopKeys, func(i, j int) bool {
+		if data.TopKeys[i].Requests == data.TopKeys[j].Requests {
+			return data.TopKeys[i].Key < data.TopKeys[j].Key
+		}
+		return data.TopKeys[i].Requests > data.TopKeys[j].Requests
+	})
+	if len(data.TopKeys) > dashboardTopKeys {
+		data.TopKeys = data.TopKeys[:dashboardTopKeys]
+	}
+
+	for _, origin := range dashboard.origins {
+		data.Origins = append(data.Origins, *origin)
+	}
+	sort.Slice(data.Origins, func(i, j int) bool {
+		return data.Origins[i].Host < data.Origins[j].Host
+	})
+
+	//Show the newest error first
+	for i := len(dashboard.recentErrors) - 1; i >= 0; i-- {
+		data.RecentErrors = append(data.RecentErrors, dashboard.recentErrors[i])
+	}
+
+	for index, cacheLayer := range dashboard.controller.Layers {
+		dashLayer := dashboardLayer{Index: index, Used: -1, Capacity: -1}
+
+		if reporter, ok := cacheLayer.(layer.SizeReporter); ok {
+			dashLayer.Used, dashLayer.Capacity = reporter.Size()
+			if dashLayer.Capacity > 0 {
+				dashLayer.Percent = float64(dashLayer.Used) / float64(dashLayer.Capacity) * 100
+			}
+		}
+
+		data.Layers = append(data.Layers, dashLayer)
+	}
+
+	return data
+}
+
+func (dashboard *Dashboard) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header().Set(CacheControlHeader, "no-store")
+
+	err := dashboardTemplate.Execute(resp, dashboard.snapshot())
+	if err != nil {
+		dashboard.controller.Logger.WithError(err).Error("Error while rendering dashboard")
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>sharedhttpcache</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>sharedhttpcache</h1>
+<p>Uptime: {{.Uptime}}</p>
+
+<h2>Cache</h2>
+<table>
+<tr><th>Hit ratio</th><td>{{printf "%.2f" .HitRatio}}%</td></tr>
+<tr><th>Hits</th><td>{{.Hits}}</td></tr>
+<tr><th>Stale hits</th><td>{{.Stale}}</td></tr>
+<tr><th>Misses</th><td>{{.Misses}}</td></tr>
+<tr><th>Revalidated</th><td>{{.Revalidated}}</td></tr>
+<tr><th>Stored bytes</th><td>{{.StoredBytes}}</td></tr>
+<tr><th>Evictions</th><td>{{.Evictions}}</td></tr>
+</table>
+
+<h2>Layers</h2>
+<table>
+<tr><th>Layer</th><th>Used</th><th>Capacity</th><th>Usage</th></tr>
+{{range .Layers}}<tr><td>{{.Index}}</td>{{if ge .Capacity 0}}<td>{{.Used}}</td><td>{{.Capacity}}</td><td>{{printf "%.2f" .Percent}}%</td>{{else}}<td colspan="3">unknown</td>{{end}}</tr>
+{{end}}</table>
+
+<h2>Origins</h2>
+<table>
+<tr><th>Origin</th><th>Requests</th><th>Errors</th><th>Last status</th><th>Last latency</th><th>Last seen</th></tr>
+{{range .Origins}}<tr><td>{{.Host}}</td><td>{{.Requests}}</td><td>{{.Errors}}</td><td>{{.LastStatus}}</td><td>{{.LastLatency}}</td><td>{{.LastSeen.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+
+<h2>Top keys</h2>
+<table>
+<tr><th>Requests</th><th>Cache key</th></tr>
+{{range .TopKeys}}<tr><td>{{.Requests}}</td><td>{{.Key}}</td></tr>
+{{end}}</table>
+
+<h2>Recent errors</h2>
+<table>
+<tr><th>Time</th><th>Level</th><th>Message</th></tr>
+{{range .RecentErrors}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Level}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
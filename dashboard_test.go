@@ -0,0 +1,36 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	dashboard := NewDashboard(controller)
+	defer dashboard.Close()
+
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+
+	recorder := httptest.NewRecorder()
+	dashboard.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"<tr><th>Hit ratio</th><td>50.00%</td></tr>",
+		"<td>" + host + "</td><td>1</td><td>0</td><td>2xx</td>",
+		"<tr><td>0</td><td>",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected dashboard to contain '%s', got: %s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package sharedhttpcache
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+var (
+	errInvalidDryRunURL    = errors.New("The url parameter must be a absolute URL")
+	errInvalidDryRunHeader = errors.New("A header parameter must be formatted like 'Name: value'")
+)
+
+//A DryRunResult describes how the cache would handle the response to a URL, see DryRunHandler
+type DryRunResult struct {
+	URL string `json:"url"`
+
+	//CacheKey is the key under which the response would be stored, including the secondary key of the Vary header
+	CacheKey string `json:"cache_key"`
+
+	//StatusCode is the status code of the response of the origin
+	StatusCode int `json:"status_code"`
+
+	//Header is the header of the response of the origin after the headers which are never stored are removed
+	Header http.Header `json:"header"`
+
+	//TTLSeconds is the freshness lifetime of the response, it is negative if the response is stale on arrival
+	TTLSeconds int64 `json:"ttl_seconds"`
+
+	Decision Decision `json:"decision"`
+}
+
+//DryRunHandler is a http.Handler which fetches a URL from the origin and explains how the cache would handle the response,
+// without storing it. The URL is passed in the "url" query parameter, like "/dry-run?url=https://example.com/page".
+// Request headers can be added with "header" query parameters, like "header=Accept-Encoding:%20gzip", since they can change
+// the cache key and the response of the origin. It is meant to be served on a admin listener, not to the public
+type DryRunHandler struct {
+	controller *CacheController
+
+	//token is the bearer token which must be send, requests are accepted without authentication if empty
+	token string
+}
+
+//NewDryRunHandler creates a DryRunHandler which explains the handling of the controller
+func NewDryRunHandler(controller *CacheController, token string) *DryRunHandler {
+	return &DryRunHandler{
+		controller: controller,
+		token:      token,
+	}
+}
+
+func (handler *DryRunHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if handler.token != "" {
+		authorization := req.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+handler.token)) != 1 {
+			http.Error(resp, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	dryRunRequest, err := makeDryRunRequest(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	handler.controller.initOnce.Do(handler.controller.initialize)
+
+	result, err := handler.controller.dryRun(dryRunRequest)
+	if err != nil {
+		handler.controller.Logger.WithError(err).WithFields(handler.controller.redactLogFields(logrus.Fields{
+			"request": dryRunRequest,
+		})).Warning("Error while fetching dry run from origin server")
+
+		http.Error(resp, "Unable to contact origin server", http.StatusBadGateway)
+		return
+	}
+
+	result.Header = handler.controller.redactHeader(result.Header)
+
+	resp.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(resp)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		handler.controller.Logger.WithError(err).Error("Error while writing dry run result")
+	}
+}
+
+//makeDryRunRequest creates the request which is send to the origin from the query of the admin request
+// The request is built as if it was received by the server, so the cache key is the same as for a client
+func makeDryRunRequest(req *http.Request) (*http.Request, error) {
+	query := req.URL.Query()
+
+	dryRunURL, err := url.Parse(query.Get("url"))
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRunURL.Scheme == "" || dryRunURL.Host == "" {
+		return nil, errInvalidDryRunURL
+	}
+
+	header := http.Header{}
+	for _, line := range query["header"] {
+		colon := strings.Index(line, ":")
+		if colon < 1 {
+			return nil, errInvalidDryRunHeader
+		}
+
+		header.Add(textproto.TrimString(line[:colon]), textproto.TrimString(line[colon+1:]))
+	}
+
+	dryRunRequest := (&http.Request{
+		Method:     http.MethodGet,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		URL: &url.URL{
+			Path:     dryRunURL.Path,
+			RawPath:  dryRunURL.RawPath,
+			RawQuery: dryRunURL.RawQuery,
+		},
+		RequestURI: dryRunURL.RequestURI(),
+		Header:     header,
+		Host:       dryRunURL.Host,
+		RemoteAddr: req.RemoteAddr,
+	}).WithContext(req.Context())
+
+	if strings.EqualFold(dryRunURL.Scheme, "https") {
+		dryRunRequest.TLS = &tls.ConnectionState{}
+	}
+
+	return dryRunRequest, nil
+}
+
+//dryRun fetches the response to the request from the origin and explains how it would be handled, nothing is stored
+// Body transformers are not applied since they don't change if the response is stored
+func (controller *CacheController) dryRun(req *http.Request) (DryRunResult, error) {
+	canonicalReq := withCanonicalHost(req)
+
+	if controller.TenantResolver != nil {
+		tenant := controller.TenantResolver.GetTenant(canonicalReq)
+		req = withTenant(req, tenant)
+		canonicalReq = withTenant(canonicalReq, tenant)
+	}
+
+	cacheConfig := controller.resolveCacheConfig(canonicalReq)
+	req = normalizeRequestHost(cacheConfig, req)
+	forwardConfig := controller.resolveForwardConfig(req)
+
+	result := DryRunResult{
+		URL: getEffectiveURI(req, cacheConfig, forwardConfig),
+	}
+
+	//A bypassed request is never stored, the origin doesn't have to be contacted to explain that
+	if cacheConfig == BypassConfig {
+		result.Decision = controller.Explain(req, &http.Response{Header: http.Header{}})
+		return result, nil
+	}
+
+	req = classifyRequest(cacheConfig, req)
+	req = filterRequestCookies(cacheConfig, req)
+	req = stripUnkeyedHeaders(cacheConfig, req)
+	req = stripAuthorizationParams(cacheConfig.RequestAuthorizer, req)
+	req = removeEdgeCredentials(cacheConfig, cleanRequestPath(cacheConfig, req))
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	response, err := controller.roundTripOrigin(ctx, controller.resolveTransport(req), forwardConfig, req)
+	if err != nil {
+		return result, err
+	}
+	response.Body.Close()
+
+	applyTargetedCacheControl(cacheConfig, response)
+	stripResponseHeaders(cacheConfig, response.Header)
+
+	primaryCacheKey := getPrimaryCacheKey(cacheConfig, forwardConfig, req)
+
+	result.CacheKey = primaryCacheKey + getSecondaryCacheKey(cacheConfig, addPreflightKeyFields(cacheConfig, req, getSecondaryKeyFields(cacheConfig, response.Header)), req)
+	result.StatusCode = response.StatusCode
+	result.Header = response.Header
+	result.TTLSeconds = int64(getResponseTTL(cacheConfig, response).Seconds())
+	result.Decision = controller.Explain(req, response)
+
+	return result, nil
+}
@@ -0,0 +1,74 @@
+package sharedhttpcache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDryRunHandler(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		rw.Header().Set(VaryHeader, "Accept-Encoding")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	handler := NewDryRunHandler(controller, "secret")
+
+	query := url.Values{
+		"url":    {"http://" + host + "/page"},
+		"header": {"Accept-Encoding: gzip"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/dry-run?"+query.Encode(), nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 without token, got %d", recorder.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	result := DryRunResult{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Decision.Store || result.TTLSeconds != 60 || result.StatusCode != http.StatusOK {
+		t.Errorf("expected a stored response with a ttl of 60, got %+v", result)
+	}
+
+	clientRequest := httptest.NewRequest(http.MethodGet, "/page", nil)
+	clientRequest.Host = host
+	clientRequest.Header.Set("Accept-Encoding", "gzip")
+	expectedKey := getPrimaryCacheKey(controller.DefaultCacheConfig, controller.DefaultForwardConfig, clientRequest) +
+		getSecondaryCacheKey(controller.DefaultCacheConfig, []string{"Accept-Encoding"}, clientRequest)
+	if result.CacheKey != expectedKey {
+		t.Errorf("expected cache key '%s', got '%s'", expectedKey, result.CacheKey)
+	}
+
+	//Nothing may be stored, so a client request still goes to the origin
+	doTestRequest(t, controller, clientRequest)
+	if originRequests != 2 {
+		t.Errorf("expected the dry run not to store the response, got %d origin requests", originRequests)
+	}
+
+	recorder = httptest.NewRecorder()
+	invalid := httptest.NewRequest(http.MethodGet, "/dry-run?url=/page", nil)
+	invalid.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(recorder, invalid)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a relative URL, got %d", recorder.Code)
+	}
+}
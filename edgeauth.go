@@ -0,0 +1,247 @@
+package sharedhttpcache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//AuthorizationHeader is the request header with the credentials of the client
+const AuthorizationHeader = "Authorization"
+
+var (
+	errTokenMissing     = errors.New("The request has no bearer token")
+	errTokenMalformed   = errors.New("The bearer token is not a valid JWT")
+	errTokenAlgorithm   = errors.New("The algorithm of the JWT is not HS256")
+	errTokenSignature   = errors.New("The signature of the JWT is invalid")
+	errTokenExpired     = errors.New("The JWT has expired")
+	errTokenNotYetValid = errors.New("The JWT is not valid yet")
+	errTokenClaims      = errors.New("The issuer or audience of the JWT is not accepted")
+	errNoAuthenticator  = errors.New("No edge authenticator is configured")
+)
+
+//A JWTAuthenticator authorizes requests with a JSON Web Token in the Authorization header, signed with HMAC-SHA256 (HS256).
+// The exp and nbf claims are checked if present, so it can be used as EdgeAuthenticator of a cache config
+type JWTAuthenticator struct {
+	//Secret is the key of the HMAC, it must be shared with the issuer of the tokens
+	Secret []byte
+
+	//Issuer if not empty must match the iss claim of the token
+	Issuer string
+
+	//Audience if not empty must be the aud claim of the token, or one of them
+	Audience string
+
+	//Leeway is the allowed clock difference with the issuer when checking the exp and nbf claims
+	Leeway time.Duration
+}
+
+//jwtClaims are the registered claims of a JWT which are checked, aud can be a string or a list of strings
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+//hasAudience checks if the audience is the aud claim or in the list of the aud claim
+func (claims *jwtClaims) hasAudience(audience string) bool {
+	var single string
+	if err := json.Unmarshal(claims.Audience, &single); err == nil {
+		return single == audience
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(claims.Audience, &multiple); err == nil {
+		return containsString(multiple, audience)
+	}
+
+	return false
+}
+
+//AuthorizeRequest returns a error if the request has no bearer token, or the token is not a valid JWT signed with the secret
+func (authenticator *JWTAuthenticator) AuthorizeRequest(req *http.Request) error {
+	authorization := req.Header.Get(AuthorizationHeader)
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return errTokenMissing
+	}
+
+	parts := strings.Split(strings.TrimSpace(authorization[7:]), ".")
+	if len(parts) != 3 {
+		return errTokenMalformed
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return errTokenMalformed
+	}
+
+	//Only the configured algorithm is accepted, so a token with "none" or a other algorithm can't be used to bypass the check
+	if header.Algorithm != "HS256" {
+		return errTokenAlgorithm
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errTokenMalformed
+	}
+
+	mac := hmac.New(sha256.New, authenticator.Secret)
+	_, _ = mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errTokenSignature
+	}
+
+	claims := jwtClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return errTokenMalformed
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt != nil && now.Add(-authenticator.Leeway).After(unixTime(*claims.ExpiresAt)) {
+		return errTokenExpired
+	}
+
+	if claims.NotBefore != nil && now.Add(authenticator.Leeway).Before(unixTime(*claims.NotBefore)) {
+		return errTokenNotYetValid
+	}
+
+	if authenticator.Issuer != "" && claims.Issuer != authenticator.Issuer {
+		return errTokenClaims
+	}
+
+	if authenticator.Audience != "" && !claims.hasAudience(authenticator.Audience) {
+		return errTokenClaims
+	}
+
+	return nil
+}
+
+//decodeJWTPart decodes a base64url encoded JSON part of a JWT
+func decodeJWTPart(part string, value interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(decoded, value)
+}
+
+//unixTime converts a NumericDate of a JWT, which can have a fraction, to a time
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+//authenticateRequest applies the authentication mode of the path of the request.
+// Requests on a EdgeAuthenticationPaths path are checked with the EdgeAuthenticator, a 401 is sent if it is rejected and false is returned.
+// The credentials are removed from authenticated requests, so the responses are stored and shared by all authenticated clients.
+// originAuth is true if the request has credentials for a OriginAuthenticationPaths path, it must then be forwarded without using the cache
+func (controller *CacheController) authenticateRequest(cacheConfig *CacheConfig, resp http.ResponseWriter, req *http.Request) (_ *http.Request, authenticated bool, originAuth bool) {
+	req = cleanRequestPath(cacheConfig, req)
+
+	if matchesAuthenticationPath(cacheConfig.EdgeAuthenticationPaths, req.URL.Path) {
+		err := errNoAuthenticator
+		if cacheConfig.EdgeAuthenticator != nil {
+			err = cacheConfig.EdgeAuthenticator.AuthorizeRequest(req)
+		}
+
+		if err != nil {
+			controller.incrMetric(MetricRequestUnauthorized, 1, nil)
+
+			controller.requestLogger(req).WithError(err).WithFields(logrus.Fields{
+				"url": req.URL.Path,
+			}).Debug("Request refused by the edge authenticator")
+
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(resp, "Unauthorized", http.StatusUnauthorized)
+			return req, false, false
+		}
+
+		return removeEdgeCredentials(cacheConfig, req), true, false
+	}
+
+	if matchesAuthenticationPath(cacheConfig.OriginAuthenticationPaths, req.URL.Path) && req.Header.Get(AuthorizationHeader) != "" {
+		return req, true, true
+	}
+
+	return req, true, false
+}
+
+//removeEdgeCredentials removes the Authorization header and authorization parameters from a request on a EdgeAuthenticationPaths path,
+// the origin then sees the same request for every client. The request is cloned if it is modified
+func removeEdgeCredentials(cacheConfig *CacheConfig, req *http.Request) *http.Request {
+	if !matchesAuthenticationPath(cacheConfig.EdgeAuthenticationPaths, req.URL.Path) {
+		return req
+	}
+
+	req = stripAuthorizationParams(cacheConfig.EdgeAuthenticator, req)
+
+	if _, found := req.Header[AuthorizationHeader]; !found {
+		return req
+	}
+
+	strippedReq := req.Clone(req.Context())
+	strippedReq.Header.Del(AuthorizationHeader)
+
+	return strippedReq
+}
+
+//matchesAuthenticationPath checks if the path starts with any of the authentication path prefixes.
+// The prefixes are matched case insensitively, since some origins serve "/Members/" and "/members/" from the same directory
+func matchesAuthenticationPath(prefixes []string, requestPath string) bool {
+	for _, prefix := range prefixes {
+		if len(requestPath) >= len(prefix) && strings.EqualFold(requestPath[:len(prefix)], prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//cleanRequestPath removes dot segments and duplicate slashes from the path of the request if authentication paths are configured,
+// so paths like "//members/page" or "/public/../members/page" can't be used to avoid the authentication.
+// The clean path is also forwarded to the origin, so the origin serves the resource which was authenticated
+func cleanRequestPath(cacheConfig *CacheConfig, req *http.Request) *http.Request {
+	if len(cacheConfig.EdgeAuthenticationPaths) == 0 && len(cacheConfig.OriginAuthenticationPaths) == 0 {
+		return req
+	}
+
+	cleanPath := cleanURLPath(req.URL.Path)
+	if cleanPath == req.URL.Path {
+		return req
+	}
+
+	cleanURL := *req.URL
+	cleanURL.Path = cleanPath
+	cleanURL.RawPath = ""
+
+	cleanReq := req.WithContext(req.Context())
+	cleanReq.URL = &cleanURL
+
+	return cleanReq
+}
+
+//cleanURLPath returns the shortest path equivalent to the path, the trailing slash of a directory is kept.
+// Paths which don't start with a slash, like the "*" of a server wide OPTIONS request, are returned unchanged
+func cleanURLPath(urlPath string) string {
+	if !strings.HasPrefix(urlPath, "/") {
+		return urlPath
+	}
+
+	cleanPath := path.Clean(urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleanPath != "/" {
+		cleanPath += "/"
+	}
+
+	return cleanPath
+}
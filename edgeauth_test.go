@@ -0,0 +1,190 @@
+package sharedhttpcache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//makeTestJWT creates a JWT with the algorithm and claims, signed with the secret
+func makeTestJWT(secret, algorithm, claims string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	unsigned := encode([]byte(`{"alg":"`+algorithm+`","typ":"JWT"}`)) + "." + encode([]byte(claims))
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(unsigned))
+
+	return unsigned + "." + encode(mac.Sum(nil))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	authenticator := &JWTAuthenticator{Secret: []byte("secret"), Audience: "cdn"}
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		token  string
+		expect error
+	}{
+		{name: "valid", token: makeTestJWT("secret", "HS256", `{"aud":"cdn","exp":`+strconv.FormatInt(future, 10)+`}`), expect: nil},
+		{name: "audience list", token: makeTestJWT("secret", "HS256", `{"aud":["api","cdn"]}`), expect: nil},
+		{name: "expired", token: makeTestJWT("secret", "HS256", `{"aud":"cdn","exp":`+strconv.FormatInt(past, 10)+`}`), expect: errTokenExpired},
+		{name: "not yet valid", token: makeTestJWT("secret", "HS256", `{"aud":"cdn","nbf":`+strconv.FormatInt(future, 10)+`}`), expect: errTokenNotYetValid},
+		{name: "other audience", token: makeTestJWT("secret", "HS256", `{"aud":"api"}`), expect: errTokenClaims},
+		{name: "other secret", token: makeTestJWT("other", "HS256", `{"aud":"cdn"}`), expect: errTokenSignature},
+		{name: "none algorithm", token: makeTestJWT("secret", "none", `{"aud":"cdn"}`), expect: errTokenAlgorithm},
+		{name: "malformed", token: "not-a-token", expect: errTokenMalformed},
+		{name: "missing", token: "", expect: errTokenMissing},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if test.token != "" {
+			req.Header.Set(AuthorizationHeader, "Bearer "+test.token)
+		}
+
+		if err := authenticator.AuthorizeRequest(req); err != test.expect {
+			t.Errorf("%s: expected error '%v', got '%v'", test.name, test.expect, err)
+		}
+	}
+}
+
+func TestAuthenticationPaths(t *testing.T) {
+	var originRequests int32
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&originRequests, 1)
+
+		if req.Header.Get(AuthorizationHeader) != "" && req.URL.Path == "/members/page" {
+			t.Errorf("expected the credentials to be removed on a edge authenticated path")
+		}
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.EdgeAuthenticationPaths = []string{"/members/"}
+	controller.DefaultCacheConfig.EdgeAuthenticator = &JWTAuthenticator{Secret: []byte("secret")}
+	controller.DefaultCacheConfig.OriginAuthenticationPaths = []string{"/account/"}
+
+	//Clients with different valid tokens share the stored response
+	for _, subject := range []string{"alice", "bob"} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/members/page", nil)
+		req.Header.Set(AuthorizationHeader, "Bearer "+makeTestJWT("secret", "HS256", `{"sub":"`+subject+`"}`))
+
+		response, body := doTestRequest(t, controller, req)
+		if response.StatusCode != http.StatusOK || body != "content" {
+			t.Errorf("expected a authenticated client to be served, got status %d", response.StatusCode)
+		}
+	}
+
+	if requests := atomic.LoadInt32(&originRequests); requests != 1 {
+		t.Errorf("expected 1 origin request for edge authenticated clients, got %d", requests)
+	}
+
+	response, _ := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/members/page", nil))
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without a token, got %d", response.StatusCode)
+	}
+
+	//Authorized requests on a origin authenticated path are always forwarded, even if a response is stored
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/account/page", nil))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/account/page", nil)
+		req.Header.Set(AuthorizationHeader, "Basic dXNlcjpwYXNz")
+		doTestRequest(t, controller, req)
+	}
+
+	if requests := atomic.LoadInt32(&originRequests); requests != 4 {
+		t.Errorf("expected authorized requests on a origin authenticated path to be forwarded, got %d origin requests", requests)
+	}
+}
+
+func TestCleanURLPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		expect string
+	}{
+		{path: "/members/page", expect: "/members/page"},
+		{path: "//members/page", expect: "/members/page"},
+		{path: "/public//../members/page", expect: "/members/page"},
+		{path: "/public/./../members/", expect: "/members/"},
+		{path: "/../members/page", expect: "/members/page"},
+		{path: "/members/..", expect: "/"},
+		{path: "/", expect: "/"},
+		{path: "*", expect: "*"},
+	}
+
+	for _, test := range tests {
+		if cleanPath := cleanURLPath(test.path); cleanPath != test.expect {
+			t.Errorf("%s: expected '%s', got '%s'", test.path, test.expect, cleanPath)
+		}
+	}
+}
+
+func TestAuthenticationPathBypass(t *testing.T) {
+	originPaths := make(chan string, 10)
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originPaths <- req.URL.Path
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.EdgeAuthenticationPaths = []string{"/members/"}
+	controller.DefaultCacheConfig.EdgeAuthenticator = &JWTAuthenticator{Secret: []byte("secret")}
+	controller.DefaultCacheConfig.OriginAuthenticationPaths = []string{"/account/"}
+
+	for _, path := range []string{"//members/page", "/public/../members/page", "/public/%2e%2e/members/page", "/Members/page", "/./members//page"} {
+		response, _ := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+path, nil))
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected status 401 without a token, got %d", path, response.StatusCode)
+		}
+	}
+
+	if len(originPaths) != 0 {
+		t.Fatalf("expected no unauthenticated request to reach the origin, got %d", len(originPaths))
+	}
+
+	//The origin gets the path which was authenticated
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/public/../members//page", nil)
+	req.Header.Set(AuthorizationHeader, "Bearer "+makeTestJWT("secret", "HS256", `{"sub":"alice"}`))
+
+	response, _ := doTestRequest(t, controller, req)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected a authenticated client to be served, got status %d", response.StatusCode)
+	}
+
+	if path := <-originPaths; path != "/members/page" {
+		t.Errorf("expected the clean path to be forwarded, got '%s'", path)
+	}
+
+	//Authorized requests on a origin authenticated path are forwarded, whatever the notation of the path
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/account/page", nil))
+	<-originPaths
+
+	for _, path := range []string{"//account/page", "/public/../account/page", "/Account/page"} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		req.Header.Set(AuthorizationHeader, "Basic dXNlcjpwYXNz")
+		doTestRequest(t, controller, req)
+
+		select {
+		case <-originPaths:
+		default:
+			t.Errorf("%s: expected the authorized request to be forwarded", path)
+		}
+	}
+}
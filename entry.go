@@ -0,0 +1,225 @@
+package sharedhttpcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//cacheEntryMagic is the start of the first line of every versioned cache entry, it is followed by the format version and a newline
+// A HTTP response always starts with "HTTP/" so entries stored before the envelope was introduced can never be mistaken for a versioned entry
+const cacheEntryMagic = "SHC-ENTRY/"
+
+//cacheEntryVersion is the version of the format in which new cache entries are written
+// It must be incremented every time the serialization of cache entries changes
+//
+// Since version 2 a entry only contains the metadata of a response: the status line and headers.
+// The body is stored as is under a separate key so metadata can be read without touching the body
+//
+// Since version 3 the status line is preceded by a line with the freshness information of the response, see entryFreshness
+//
+// Since version 4 the freshness information contains the time the response was received
+//
+// Since version 5 the freshness information contains a checksum of the body
+const cacheEntryVersion = 5
+
+//bodyCacheKeyPrefix is prepended to the cache key of a response to get the key under which the body is stored
+const bodyCacheKeyPrefix = "body"
+
+//errUnsupportedEntryVersion is returned when a cache entry was written in a format this version doesn't know how to read
+// This can happen when a newer version of the cache wrote the entry to a persistent layer
+var errUnsupportedEntryVersion = errors.New("unsupported cache entry version")
+
+//errEntryBodyMissing is returned when the metadata of a entry is found but its body is not,
+// the body may be evicted separately from the metadata
+var errEntryBodyMissing = errors.New("body of cache entry is missing")
+
+//entryBodyOpener opens the separately stored body of a entry, nil is returned if the body doesn't exist
+type entryBodyOpener func() (io.ReadCloser, error)
+
+//cacheEntryReaders contains a reader for every known entry format version.
+// Version 0 is the unversioned format in which the raw output of http.Response.Write was stored.
+// Entries in old formats are read as if they were written in the current format, they are migrated when they are stored again
+//
+// Readers may return nil freshness information, it is then computed from the headers
+var cacheEntryReaders = map[int]func(reader *bufio.Reader, openBody entryBodyOpener) (*http.Response, *entryFreshness, error){
+	0: readResponseEntry,
+	1: readResponseEntry,
+	2: readMetadataEntry,
+	3: readFreshnessEntry,
+	4: readFreshnessEntry,
+	5: readFreshnessEntry,
+}
+
+//writeCacheEntry writes the metadata of the response to the writer in the current entry format
+// The body of the response is not written, it must be stored separately. checksum is the checksum of the stored body, see bodyChecksum
+func writeCacheEntry(writer io.Writer, response *http.Response, checksum string) error {
+	_, err := io.WriteString(writer, cacheEntryMagic+strconv.Itoa(cacheEntryVersion)+"\n")
+	if err != nil {
+		return err
+	}
+
+	//The entry is written when the response is received, or when a revalidated response is stored again
+	freshness := computeEntryFreshness(response)
+	freshness.responseTime = time.Now().Unix()
+	freshness.checksum = checksum
+
+	_, err = io.WriteString(writer, freshness.marshal()+"\n")
+	if err != nil {
+		return err
+	}
+
+	protoMajor, protoMinor := response.ProtoMajor, response.ProtoMinor
+	if protoMajor == 0 {
+		protoMajor, protoMinor = 1, 1
+	}
+
+	statusText := strings.TrimPrefix(response.Status, strconv.Itoa(response.StatusCode)+" ")
+	if statusText == "" || statusText == response.Status {
+		statusText = http.StatusText(response.StatusCode)
+	}
+
+	_, err = fmt.Fprintf(writer, "HTTP/%d.%d %03d %s\r\n", protoMajor, protoMinor, response.StatusCode, statusText)
+	if err != nil {
+		return err
+	}
+
+	err = response.Header.Write(writer)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(writer, "\r\n")
+	return err
+}
+
+//readCacheEntry reads a cache entry in any known format version
+// errUnsupportedEntryVersion is returned if the version of the entry is unknown
+// errEntryBodyMissing is returned if the entry has a separate body which can't be found
+//
+// readCacheEntry takes ownership of the buffered reader, it is returned to the pool once it is no longer needed
+func readCacheEntry(reader *bufio.Reader, openBody entryBodyOpener) (*http.Response, *entryFreshness, error) {
+	version, err := readCacheEntryVersion(reader)
+	if err != nil {
+		putBufioReader(reader)
+		return nil, nil, err
+	}
+
+	entryReader, found := cacheEntryReaders[version]
+	if !found {
+		putBufioReader(reader)
+		return nil, nil, fmt.Errorf("%w: %d", errUnsupportedEntryVersion, version)
+	}
+
+	response, freshness, err := entryReader(reader, openBody)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if freshness == nil {
+		freshness = computeEntryFreshness(response)
+	}
+
+	return response, freshness, nil
+}
+
+//readCacheEntryVersion reads the version line of a entry, if the entry has no version line version 0 is returned and nothing is consumed
+func readCacheEntryVersion(reader *bufio.Reader) (int, error) {
+	magic, err := reader.Peek(len(cacheEntryMagic))
+	if err != nil || !bytes.Equal(magic, []byte(cacheEntryMagic)) {
+		//Let the entry reader report errors for entries which are to short
+		return 0, nil
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := strconv.Atoi(line[len(cacheEntryMagic) : len(line)-1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid cache entry version line: %w", err)
+	}
+
+	return version, nil
+}
+
+//readResponseEntry reads a entry which contains the full response, used up to version 1
+// The body is read from the buffered reader so it is only returned to the pool when the body is closed
+func readResponseEntry(reader *bufio.Reader, openBody entryBodyOpener) (*http.Response, *entryFreshness, error) {
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		putBufioReader(reader)
+		return nil, nil, err
+	}
+
+	response.Body = &releasingReadCloser{
+		ReadCloser: response.Body,
+		release: func() {
+			putBufioReader(reader)
+		},
+	}
+
+	return response, nil, nil
+}
+
+//readMetadataEntry reads a entry which only contains the metadata and attaches the separately stored body
+func readMetadataEntry(reader *bufio.Reader, openBody entryBodyOpener) (*http.Response, *entryFreshness, error) {
+	response, err := http.ReadResponse(reader, nil)
+	putBufioReader(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := openBody()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if body == nil {
+		return nil, nil, errEntryBodyMissing
+	}
+
+	response.Body = body
+
+	return response, nil, nil
+}
+
+//readFreshnessEntry reads the freshness line of a entry followed by the metadata and attaches the separately stored body
+func readFreshnessEntry(reader *bufio.Reader, openBody entryBodyOpener) (*http.Response, *entryFreshness, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		putBufioReader(reader)
+		return nil, nil, err
+	}
+
+	freshness, err := unmarshalEntryFreshness(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		putBufioReader(reader)
+		return nil, nil, err
+	}
+
+	response, _, err := readMetadataEntry(reader, openBody)
+
+	return response, freshness, err
+}
+
+//bodyAllowedForStatus reports whether a response with the given status code may have a body, section 3.3 of RFC 7230
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent:
+		return false
+	case status == http.StatusNotModified:
+		return false
+	}
+
+	return true
+}
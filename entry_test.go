@@ -0,0 +1,132 @@
+package sharedhttpcache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCacheEntryRoundTrip(t *testing.T) {
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Etag":           []string{`"abc"`},
+			"Content-Length": []string{"7"},
+			"Cache-Control":  []string{"no-cache, must-revalidate"},
+			"Age":            []string{"10"},
+			"Vary":           []string{"Accept-Encoding, Accept-Language"},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeCacheEntry(buf, response, "1a2b3c4d"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(buf.String(), "SHC-ENTRY/5\n0 10 nmv Accept-Encoding,Accept-Language ") {
+		t.Errorf("expected entry to start with version line, got: %q", buf.String())
+	}
+
+	openBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("content")), nil
+	}
+
+	readResponse, freshness, err := readCacheEntry(bufio.NewReader(buf), openBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if freshness.responseTime == 0 {
+		t.Error("expected the response time to be stored")
+	}
+
+	if freshness.checksum != "1a2b3c4d" {
+		t.Errorf("expected the checksum to be stored, got '%s'", freshness.checksum)
+	}
+
+	//The response time and checksum aren't derived from the headers
+	freshness.responseTime = 0
+	freshness.checksum = ""
+	if !reflect.DeepEqual(freshness, computeEntryFreshness(readResponse)) {
+		t.Errorf("stored freshness %+v doesn't match the headers %+v", freshness, computeEntryFreshness(readResponse))
+	}
+
+	body, _ := ioutil.ReadAll(readResponse.Body)
+	if string(body) != "content" || readResponse.Header.Get("Etag") != `"abc"` {
+		t.Errorf("entry not read back correctly, got headers: %v, body: %s", readResponse.Header, body)
+	}
+
+	missingBody := func() (io.ReadCloser, error) {
+		return nil, nil
+	}
+
+	_, _, err = readCacheEntry(bufio.NewReader(strings.NewReader("SHC-ENTRY/2\nHTTP/1.1 200 OK\r\n\r\n")), missingBody)
+	if !errors.Is(err, errEntryBodyMissing) {
+		t.Errorf("expected missing body error, got: %v", err)
+	}
+}
+
+func TestCacheEntryVersions(t *testing.T) {
+	legacy := "HTTP/1.1 200 OK\r\nContent-Length: 7\r\n\r\ncontent"
+
+	for _, entry := range []string{legacy, "SHC-ENTRY/1\n" + legacy} {
+		response, _, err := readCacheEntry(bufio.NewReader(strings.NewReader(entry)), nil)
+		if err != nil {
+			t.Fatalf("expected old entry format to be readable, got: %s", err)
+		}
+
+		body, _ := ioutil.ReadAll(response.Body)
+		if string(body) != "content" {
+			t.Errorf("expected body 'content', got: %s", body)
+		}
+	}
+
+	_, _, err := readCacheEntry(bufio.NewReader(strings.NewReader("SHC-ENTRY/999\n"+legacy)), nil)
+	if !errors.Is(err, errUnsupportedEntryVersion) {
+		t.Errorf("expected unsupported version error, got: %v", err)
+	}
+}
+
+func TestSeparateBodyStorage(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if body != "content" {
+		t.Fatalf("expected body 'content', got: %s", body)
+	}
+
+	cacheKey := "GET" + "http://" + host + "/"
+
+	bodyReader, _, err := controller.Layers[0].Get(bodyCacheKeyPrefix + cacheKey)
+	if err != nil || bodyReader == nil {
+		t.Fatalf("expected body to be stored under a separate key, err: %v", err)
+	}
+
+	storedBody, _ := ioutil.ReadAll(bodyReader)
+	if string(storedBody) != "content" {
+		t.Errorf("expected stored body 'content', got: %s", storedBody)
+	}
+
+	//If the body is evicted the metadata alone must not be served
+	if err := controller.Layers[0].Delete(bodyCacheKeyPrefix + cacheKey); err != nil {
+		t.Fatal(err)
+	}
+
+	response, _, err := controller.findResponseInCache(cacheKey)
+	if err != nil || response != nil {
+		t.Errorf("expected entry without body to be skipped, got: %v, err: %v", response, err)
+	}
+}
@@ -0,0 +1,68 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//A EpochResolver resolves the epoch of a request, all responses stored before the epoch are considered stale.
+// This allows for example a deploy pipeline to invalidate all content cached before a deploy at once without purging
+type EpochResolver interface {
+
+	//GetEpoch is called to get the epoch of a request
+	// A zero time means the request has no epoch
+	GetEpoch(req *http.Request) time.Time
+}
+
+//The EpochResolverFunc type is an adapter to allow the use of ordinary functions as EpochResolver
+type EpochResolverFunc func(req *http.Request) time.Time
+
+//GetEpoch calls the underlying function to get the epoch of a request
+func (resolver EpochResolverFunc) GetEpoch(req *http.Request) time.Time {
+	return resolver(req)
+}
+
+//HeaderEpochResolver returns a EpochResolver which reads the epoch as unix time from a request header like X-Deploy-Epoch
+// Only use this if the header is set by a trusted proxy in front of the cache, otherwise any client can make stored responses stale
+func HeaderEpochResolver(name string) EpochResolver {
+	return EpochResolverFunc(func(req *http.Request) time.Time {
+		epoch, err := strconv.ParseInt(req.Header.Get(name), 10, 64)
+		if err != nil || epoch <= 0 {
+			return time.Time{}
+		}
+
+		return time.Unix(epoch, 0)
+	})
+}
+
+//StaticEpochResolver returns a EpochResolver which always returns the same epoch
+func StaticEpochResolver(epoch time.Time) EpochResolver {
+	return EpochResolverFunc(func(req *http.Request) time.Time {
+		return epoch
+	})
+}
+
+//boundTTLByEpoch limits the ttl of a stored response so it expires at the epoch of the request if it was stored before it
+// Entries of which it is unknown when they were stored are stored before every epoch
+func boundTTLByEpoch(epoch time.Time, freshness *entryFreshness, ttl time.Duration) time.Duration {
+	if epoch.IsZero() {
+		return ttl
+	}
+
+	storedAt := freshness.responseTime
+	if storedAt == 0 {
+		storedAt = freshness.date
+	}
+
+	if storedAt >= epoch.Unix() {
+		return ttl
+	}
+
+	//The response became stale at the epoch
+	if bound := time.Until(epoch); bound < ttl {
+		return bound
+	}
+
+	return ttl
+}
@@ -0,0 +1,75 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBoundTTLByEpoch(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		epoch     time.Time
+		freshness *entryFreshness
+		expected  func(ttl time.Duration) bool
+	}{
+		{
+			name:      "no epoch",
+			freshness: &entryFreshness{responseTime: now.Add(-time.Hour).Unix()},
+			expected:  func(ttl time.Duration) bool { return ttl == time.Hour },
+		},
+		{
+			name:      "stored after epoch",
+			epoch:     now.Add(-2 * time.Hour),
+			freshness: &entryFreshness{responseTime: now.Add(-time.Hour).Unix()},
+			expected:  func(ttl time.Duration) bool { return ttl == time.Hour },
+		},
+		{
+			name:      "stored before epoch",
+			epoch:     now.Add(-time.Minute),
+			freshness: &entryFreshness{responseTime: now.Add(-time.Hour).Unix()},
+			expected:  func(ttl time.Duration) bool { return ttl <= -time.Minute },
+		},
+		{
+			name:      "date used without response time",
+			epoch:     now.Add(-time.Minute),
+			freshness: &entryFreshness{date: now.Add(-time.Hour).Unix()},
+			expected:  func(ttl time.Duration) bool { return ttl <= -time.Minute },
+		},
+		{
+			name:      "epoch in the future",
+			epoch:     now.Add(time.Minute),
+			freshness: &entryFreshness{responseTime: now.Unix()},
+			expected:  func(ttl time.Duration) bool { return ttl > 0 && ttl <= time.Minute },
+		},
+	}
+
+	for _, test := range tests {
+		if ttl := boundTTLByEpoch(test.epoch, test.freshness, time.Hour); !test.expected(ttl) {
+			t.Errorf("%s: unexpected ttl %s", test.name, ttl)
+		}
+	}
+}
+
+func TestHeaderEpochResolver(t *testing.T) {
+	resolver := HeaderEpochResolver("X-Deploy-Epoch")
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if epoch := resolver.GetEpoch(req); !epoch.IsZero() {
+		t.Errorf("expected no epoch without header, got: %s", epoch)
+	}
+
+	req.Header.Set("X-Deploy-Epoch", strconv.FormatInt(1600000000, 10))
+	if epoch := resolver.GetEpoch(req); epoch.Unix() != 1600000000 {
+		t.Errorf("expected epoch 1600000000, got: %d", epoch.Unix())
+	}
+
+	req.Header.Set("X-Deploy-Epoch", "invalid")
+	if epoch := resolver.GetEpoch(req); !epoch.IsZero() {
+		t.Errorf("expected no epoch for invalid header, got: %s", epoch)
+	}
+}
@@ -0,0 +1,252 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+//maxESIDepth is the maximum depth of nested ESI includes, this prevents infinite recursion when fragments include each other
+const maxESIDepth = 3
+
+//maxESIFragmentRequests is the maximum amount of fragments of a page which are requested at the same time,
+// so a page with many includes can't flood the cache and origin with sub requests
+const maxESIFragmentRequests = 4
+
+var (
+	esiIncludeRegexp = regexp.MustCompile(`(?is)<esi:include\s([^>]*?)/?>(?:\s*</esi:include>)?`)
+	esiRemoveRegexp  = regexp.MustCompile(`(?is)<esi:remove>.*?</esi:remove>`)
+	esiCommentRegexp = regexp.MustCompile(`(?s)<!--esi(.*?)-->`)
+	esiAttrRegexp    = regexp.MustCompile(`(?i)([a-z]+)\s*=\s*"([^"]*)"`)
+)
+
+type esiDepthContextKey struct{}
+
+//esiDepth returns the depth of ESI includes of the request
+func esiDepth(req *http.Request) int {
+	depth, _ := req.Context().Value(esiDepthContextKey{}).(int)
+	return depth
+}
+
+//isESICandidate checks if a response body should be processed for ESI tags
+func isESICandidate(cacheConfig *CacheConfig, response *http.Response) bool {
+	if !cacheConfig.EnableESI || response.Body == nil {
+		return false
+	}
+
+	//Encoded bodies can only be parsed if they can be decoded
+	if _, supported := contentCodingOf(cacheConfig, response.Header); !supported {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "text/html"
+}
+
+//processESI assembles a page by replacing the ESI tags in the response body with the included fragments.
+// Fragments are requested through the cache controller so they are cached independently with their own TTL.
+// Only fragments on the same host as the page are included.
+func (controller *CacheController) processESI(cacheConfig *CacheConfig, req *http.Request, response *http.Response) {
+	if !isESICandidate(cacheConfig, response) {
+		return
+	}
+
+	coding, _ := contentCodingOf(cacheConfig, response.Header)
+
+	body, encoded, err := readDecodedBody(coding, response)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).Error("Error while reading body for ESI processing")
+		response.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+		return
+	}
+
+	if !bytes.Contains(body, []byte("<esi:")) && !bytes.Contains(body, []byte("<!--esi")) {
+		response.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+		return
+	}
+
+	body = esiRemoveRegexp.ReplaceAll(body, nil)
+	body = esiCommentRegexp.ReplaceAll(body, []byte("$1"))
+
+	includes := esiIncludeRegexp.FindAllSubmatchIndex(body, -1)
+	fragments := make([][]byte, len(includes))
+
+	if esiDepth(req) < maxESIDepth {
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, maxESIFragmentRequests)
+		for i, include := range includes {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(i int, attributes string) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				fragments[i] = controller.fetchESIFragment(cacheConfig, req, attributes)
+			}(i, string(body[include[2]:include[3]]))
+		}
+		wg.Wait()
+	}
+
+	assembled := &bytes.Buffer{}
+	last := 0
+	for i, include := range includes {
+		assembled.Write(body[last:include[0]])
+		assembled.Write(fragments[i])
+		last = include[1]
+	}
+	assembled.Write(body[last:])
+
+	assembledBody, err := encodeBody(coding, assembled.Bytes())
+	if err != nil {
+		controller.requestLogger(req).WithError(err).Error("Error while encoding assembled ESI page")
+		response.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+		return
+	}
+
+	response.Body = ioutil.NopCloser(bytes.NewReader(assembledBody))
+	response.ContentLength = int64(len(assembledBody))
+	response.Header.Set("Content-Length", strconv.Itoa(len(assembledBody)))
+
+	//The assembled page is different for every combination of fragments, so the validators of the template no longer apply
+	response.Header.Del("Etag")
+	response.Header.Del("Last-Modified")
+}
+
+//fetchESIFragment requests a fragment through the cache controller
+func (controller *CacheController) fetchESIFragment(cacheConfig *CacheConfig, req *http.Request, attributes string) []byte {
+	attrs := map[string]string{}
+	for _, match := range esiAttrRegexp.FindAllStringSubmatch(attributes, -1) {
+		attrs[strings.ToLower(match[1])] = match[2]
+	}
+
+	fragment, err := controller.requestESIFragment(cacheConfig, req, attrs["src"])
+	if err != nil && attrs["alt"] != "" {
+		fragment, err = controller.requestESIFragment(cacheConfig, req, attrs["alt"])
+	}
+
+	if err != nil {
+		controller.requestLogger(req).WithError(err).WithFields(logrus.Fields{
+			"src": attrs["src"],
+			"alt": attrs["alt"],
+		}).Warning("Unable to include ESI fragment")
+
+		return nil
+	}
+
+	return fragment
+}
+
+//requestESIFragment makes a sub request for a fragment and returns the decoded body
+func (controller *CacheController) requestESIFragment(cacheConfig *CacheConfig, req *http.Request, src string) (fragment []byte, err error) {
+	if src == "" {
+		return nil, errESIMissingSrc
+	}
+
+	pageURL := &url.URL{Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+	fragmentURL, err := pageURL.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if fragmentURL.Host != "" && !strings.EqualFold(fragmentURL.Host, req.Host) {
+		return nil, errESIOtherHost
+	}
+
+	ctx := context.WithValue(req.Context(), esiDepthContextKey{}, esiDepth(req)+1)
+
+	fragmentReq := req.Clone(ctx)
+	fragmentReq.Method = http.MethodGet
+	fragmentReq.URL.Path = fragmentURL.Path
+	fragmentReq.URL.RawPath = fragmentURL.RawPath
+	fragmentReq.URL.RawQuery = fragmentURL.RawQuery
+	fragmentReq.Body = nil
+	fragmentReq.ContentLength = 0
+
+	//Headers which only apply to the page must not be sent along with the fragment request
+	for _, header := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range", "Content-Length", "Content-Type"} {
+		fragmentReq.Header.Del(header)
+	}
+
+	recorder := newBufferedResponseWriter()
+
+	//The fragment is requested from a goroutine of the page, a panic in the sub request would crash the whole process
+	// instead of being recovered by the http server, so it is turned into a error which omits the fragment
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			fragment, err = nil, fmt.Errorf("ESI fragment request panicked: %v", recovered)
+		}
+	}()
+
+	controller.ServeHTTP(recorder, fragmentReq)
+
+	if recorder.statusCode < 200 || recorder.statusCode > 299 {
+		return nil, fmt.Errorf("ESI fragment request returned status %d", recorder.statusCode)
+	}
+
+	//The fragment is inserted in the decoded page, so it has to be decoded as well
+	coding, supported := contentCodingOf(cacheConfig, recorder.header)
+	if !supported {
+		return nil, fmt.Errorf("ESI fragment has unsupported Content-Encoding '%s'", recorder.header.Get("Content-Encoding"))
+	}
+
+	if coding == nil {
+		return recorder.body.Bytes(), nil
+	}
+
+	return coding.Decode(recorder.body.Bytes())
+}
+
+var (
+	errESIMissingSrc = errors.New("ESI include has no src attribute")
+	errESIOtherHost  = errors.New("ESI include refers to a different host")
+)
+
+//bufferedResponseWriter is a http.ResponseWriter which buffers the response in memory
+type bufferedResponseWriter struct {
+	header      http.Header
+	statusCode  int
+	wroteHeader bool
+	body        *bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{
+		header:     make(http.Header),
+		statusCode: http.StatusOK,
+		body:       &bytes.Buffer{},
+	}
+}
+
+func (rw *bufferedResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *bufferedResponseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		return
+	}
+
+	rw.statusCode = statusCode
+	rw.wroteHeader = true
+}
+
+func (rw *bufferedResponseWriter) Write(p []byte) (int, error) {
+	rw.wroteHeader = true
+	return rw.body.Write(p)
+}
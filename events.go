@@ -0,0 +1,96 @@
+package sharedhttpcache
+
+import (
+	"time"
+)
+
+//CacheEventType is the type of a CacheEvent
+type CacheEventType string
+
+const (
+	//CacheEventStore is emitted when a response is stored in the cache
+	CacheEventStore CacheEventType = "store"
+
+	//CacheEventMiss is emitted when no stored response was found for a request
+	CacheEventMiss CacheEventType = "miss"
+
+	//CacheEventHit is emitted when a stored response is served to a client, both fresh and stale
+	CacheEventHit CacheEventType = "hit"
+
+	//CacheEventPurge is emitted when a stored response is invalidated
+	CacheEventPurge CacheEventType = "purge"
+
+	//CacheEventEvict is emitted when a layer evicts a stored response to make room
+	// The key of a evict event is the key as it is known by the layer
+	CacheEventEvict CacheEventType = "evict"
+
+	//CacheEventRevalidate is emitted when a stored response is successfully revalidated with the origin server
+	CacheEventRevalidate CacheEventType = "revalidate"
+)
+
+//A CacheEvent describes something which happened to a stored response
+type CacheEvent struct {
+	Type CacheEventType
+
+	//Key is the full cache key of the stored response
+	Key string
+
+	//Size is the size in bytes of the stored entry, including headers, for store and evict events
+	// and the size of the body for hit events. -1 if unknown
+	Size int64
+
+	//Stale is true if a hit event served a stale response
+	Stale bool
+
+	Time time.Time
+}
+
+//SubscribeEvents returns a channel on which all cache events will be send and a function to end the subscription.
+// Events are send without blocking, if the buffer of the channel is full events are dropped so a slow consumer
+// never slows down requests. The channel is closed when the subscription is ended
+func (controller *CacheController) SubscribeEvents(bufferSize int) (<-chan CacheEvent, func()) {
+	events := make(chan CacheEvent, bufferSize)
+
+	controller.eventSubscribersMutex.Lock()
+	if controller.eventSubscribers == nil {
+		controller.eventSubscribers = make(map[chan CacheEvent]bool)
+	}
+	controller.eventSubscribers[events] = true
+	controller.eventSubscribersMutex.Unlock()
+
+	unsubscribe := func() {
+		controller.eventSubscribersMutex.Lock()
+		if controller.eventSubscribers[events] {
+			delete(controller.eventSubscribers, events)
+			close(events)
+		}
+		controller.eventSubscribersMutex.Unlock()
+	}
+
+	return events, unsubscribe
+}
+
+//emitEvent sends a event to all subscribers
+func (controller *CacheController) emitEvent(eventType CacheEventType, key string, size int64, stale bool) {
+	controller.eventSubscribersMutex.RLock()
+	defer controller.eventSubscribersMutex.RUnlock()
+
+	if len(controller.eventSubscribers) == 0 {
+		return
+	}
+
+	event := CacheEvent{
+		Type:  eventType,
+		Key:   key,
+		Size:  size,
+		Stale: stale,
+		Time:  time.Now(),
+	}
+
+	for subscriber := range controller.eventSubscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
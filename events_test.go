@@ -0,0 +1,40 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSubscribeEvents(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	events, unsubscribe := controller.SubscribeEvents(10)
+
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+
+	unsubscribe()
+
+	types := []CacheEventType{}
+	for event := range events {
+		if event.Type == CacheEventHit && event.Size != int64(len("content")) {
+			t.Errorf("expected hit size %d, got: %d", len("content"), event.Size)
+		}
+
+		types = append(types, event.Type)
+	}
+
+	expected := []CacheEventType{CacheEventMiss, CacheEventStore, CacheEventHit}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected events: %v, got: %v", expected, types)
+	}
+
+	//Emitting after unsubscribing must not panic on the closed channel
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+}
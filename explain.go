@@ -0,0 +1,124 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"strings"
+)
+
+//Names of the rules which are evaluated to decide if a response is stored, see Decision
+const (
+	RuleBypass            = "bypass"
+	RulePreflight         = "preflight"
+	RuleInformational     = "informational"
+	RuleNotModified       = "not-modified"
+	RulePartialContent    = "partial-content"
+	RuleEventStream       = "event-stream"
+	RuleStatusCode        = "status-code"
+	RuleMethod            = "method"
+	RuleResponseNoStore   = "response-no-store"
+	RulePrivate           = "private"
+	RuleVaryAsterisk      = "vary-asterisk"
+	RuleVaryAllowed       = "vary-allowed"
+	RuleSetCookie         = "set-cookie"
+	RuleRequestNoStore    = "request-no-store"
+	RuleAuthorization     = "authorization"
+	RuleExplicitFreshness = "explicit-freshness"
+	RuleExpires           = "expires"
+	RuleDefaultExtension  = "default-extension"
+	RuleFreshOnArrival    = "fresh-on-arrival"
+)
+
+//A RuleEvaluation is the result of a single rule which was evaluated to decide if a response is stored
+type RuleEvaluation struct {
+	//Rule is the name of the rule, one of the Rule constants
+	Rule string `json:"rule"`
+
+	//Passed is true if the rule allows the response to be stored
+	Passed bool `json:"passed"`
+
+	//Reason explains why the rule didn't pass, it is empty if the rule passed
+	Reason string `json:"reason,omitempty"`
+}
+
+//A Decision explains why a response is or isn't stored by the cache
+type Decision struct {
+	//Store is true if the response would be stored. The AdmissionPolicy isn't consulted, since it can count the requests it sees
+	Store bool `json:"store"`
+
+	//Rules are the evaluated rules in order of evaluation. Rules which are not needed to make the decision are not evaluated.
+	// A rule which didn't pass doesn't always prevent storing, for example a response without explicit freshness
+	// can still be stored if its file extension is cacheable by default
+	Rules []RuleEvaluation `json:"rules"`
+}
+
+//record adds the evaluation of a rule to the decision and returns passed, so it can wrap a check.
+// It is safe to call on a nil decision, nothing is recorded then
+func (decision *Decision) record(rule string, passed bool, reason string) bool {
+	if decision == nil {
+		return passed
+	}
+
+	evaluation := RuleEvaluation{
+		Rule:   rule,
+		Passed: passed,
+	}
+
+	if !passed {
+		evaluation.Reason = reason
+	}
+
+	decision.Rules = append(decision.Rules, evaluation)
+
+	return passed
+}
+
+//String summarizes the decision, including the reasons of all rules which didn't pass
+func (decision Decision) String() string {
+	summary := "not stored"
+	if decision.Store {
+		summary = "stored"
+	}
+
+	reasons := []string{}
+	for _, evaluation := range decision.Rules {
+		if !evaluation.Passed {
+			reasons = append(reasons, evaluation.Rule+": "+evaluation.Reason)
+		}
+	}
+
+	if len(reasons) == 0 {
+		return summary
+	}
+
+	return summary + " (" + strings.Join(reasons, ", ") + ")"
+}
+
+//Explain evaluates if the response to the request would be stored using the cache config resolved for the request
+// and returns every evaluated rule. It doesn't contact the origin or change the cache
+func (controller *CacheController) Explain(req *http.Request, resp *http.Response) Decision {
+	decision := Decision{}
+
+	cacheConfig := controller.resolveCacheConfig(req)
+	if !decision.record(RuleBypass, cacheConfig != BypassConfig, "the cache config resolver bypasses the cache for this request") {
+		return decision
+	}
+
+	//The rules read the request from the response, a copy is used so the response of the caller isn't modified
+	if resp.Request != req {
+		withRequest := *resp
+		withRequest.Request = req
+		resp = &withRequest
+	}
+
+	if !evaluateStoreRules(cacheConfig, resp, &decision) {
+		return decision
+	}
+
+	//Responses which have to be revalidated before every use are stored even if they are stale on arrival, see storeResponse
+	ttl := getResponseTTL(cacheConfig, resp)
+	alwaysRevalidate := responseRequiresRevalidation(resp) && responseHasValidators(resp)
+
+	decision.Store = decision.record(RuleFreshOnArrival, ttl > 0 || alwaysRevalidate, "the response is stale on arrival and can't be revalidated")
+
+	return decision
+}
@@ -0,0 +1,56 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	controller := &CacheController{
+		DefaultCacheConfig: NewCacheConfig(),
+	}
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		status     int
+		expectRule string
+		expectPass bool
+	}{
+		{name: "max-age", header: http.Header{CacheControlHeader: {"max-age=60"}}, status: http.StatusOK, expectRule: RuleFreshOnArrival, expectPass: true},
+		{name: "no-store", header: http.Header{CacheControlHeader: {"no-store"}}, status: http.StatusOK, expectRule: RuleResponseNoStore, expectPass: false},
+		{name: "private", header: http.Header{CacheControlHeader: {"private, max-age=60"}}, status: http.StatusOK, expectRule: RulePrivate, expectPass: false},
+		{name: "unknown status", header: http.Header{CacheControlHeader: {"max-age=60"}}, status: 599, expectRule: RuleStatusCode, expectPass: false},
+		{name: "stale on arrival", header: http.Header{CacheControlHeader: {"max-age=0"}}, status: http.StatusOK, expectRule: RuleFreshOnArrival, expectPass: false},
+		{name: "no freshness", header: http.Header{}, status: http.StatusOK, expectRule: RuleDefaultExtension, expectPass: false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+		resp := &http.Response{StatusCode: test.status, Header: test.header}
+
+		decision := controller.Explain(req, resp)
+		if decision.Store != test.expectPass {
+			t.Errorf("%s: expected store %v, got %v", test.name, test.expectPass, decision.Store)
+		}
+
+		if len(decision.Rules) == 0 {
+			t.Errorf("%s: expected evaluated rules", test.name)
+			continue
+		}
+
+		last := decision.Rules[len(decision.Rules)-1]
+		if last.Rule != test.expectRule || last.Passed != test.expectPass {
+			t.Errorf("%s: expected last rule %s passed %v, got %+v", test.name, test.expectRule, test.expectPass, last)
+		}
+
+		if resp.Request != nil {
+			t.Errorf("%s: expected the response of the caller to be unmodified", test.name)
+		}
+
+		if decision.Store != shouldStoreResponse(controller.DefaultCacheConfig, &http.Response{StatusCode: test.status, Header: test.header, Request: req}) && test.expectRule != RuleFreshOnArrival {
+			t.Errorf("%s: expected the decision to match shouldStoreResponse", test.name)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package sharedhttpcache
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//entryFreshness contains the information of a stored response which is needed on every cache hit.
+// It is computed once when the response is stored and written alongside the entry
+// so the hit path doesn't have to parse the Cache-Control, Date and Age headers on every request
+type entryFreshness struct {
+	//date is the Date header as unix time, 0 if the header is missing or invalid
+	date int64
+
+	//ageValue is the value of the Age header, -1 if the header is missing or invalid
+	// Responses from the origin have a Age header which is already corrected for the response delay, see correctAgeHeader
+	ageValue int64
+
+	//responseTime is the time the response was received as unix time, 0 if unknown.
+	// Entries stored before version 4 of the entry format don't have it
+	responseTime int64
+
+	//noCache is true if the Cache-Control header contains a no-cache directive in the plain or field-name form
+	noCache bool
+
+	//mustRevalidate is true if the response may not be served stale without revalidation, see responseHasMustRevalidate
+	mustRevalidate bool
+
+	//hasValidators is true if the response has a Etag or Last-Modified header
+	hasValidators bool
+
+	//vary contains the field names of the Vary header
+	vary []string
+
+	//checksum is the hex encoded CRC-32C of the body, empty if unknown.
+	// Entries stored before version 5 of the entry format don't have it
+	checksum string
+}
+
+var errInvalidFreshnessLine = errors.New("invalid freshness line")
+
+//computeEntryFreshness computes the freshness information from the headers of a response
+func computeEntryFreshness(response *http.Response) *entryFreshness {
+	freshness := &entryFreshness{
+		ageValue:       -1,
+		mustRevalidate: responseHasMustRevalidate(response),
+		hasValidators:  responseHasValidators(response),
+	}
+
+	if date, err := http.ParseTime(response.Header.Get(DateHeader)); err == nil {
+		freshness.date = date.Unix()
+	}
+
+	if ageValue, valid := parseAgeHeader(response.Header); valid {
+		freshness.ageValue = ageValue
+	}
+
+	cc := parseResponseCacheControl(response.Header)
+	freshness.noCache = cc.noCache || len(cc.noCacheFields) > 0
+
+	for _, field := range strings.Split(response.Header.Get(VaryHeader), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			freshness.vary = append(freshness.vary, field)
+		}
+	}
+
+	return freshness
+}
+
+//age returns the current age of the response in seconds, see getResponseAge
+func (freshness *entryFreshness) age() int64 {
+	if freshness.responseTime == 0 {
+		return freshness.ageWithoutResponseTime()
+	}
+
+	//The corrected_initial_age is the greatest of the apparent_age and the corrected_age_value,
+	// the current_age adds the resident_time. Section 4.2.3 of RFC 7234
+	initialAge := int64(0)
+	if freshness.date != 0 && freshness.responseTime > freshness.date {
+		initialAge = freshness.responseTime - freshness.date
+	}
+
+	if freshness.ageValue > initialAge {
+		initialAge = freshness.ageValue
+	}
+
+	residentTime := time.Now().Unix() - freshness.responseTime
+	if residentTime < 0 {
+		residentTime = 0
+	}
+
+	return capDeltaSeconds(initialAge + residentTime)
+}
+
+//ageWithoutResponseTime estimates the current age of a response of which it is unknown when it was received
+// The age value and the time since the Date of the response are added, which never underestimates the age
+func (freshness *entryFreshness) ageWithoutResponseTime() int64 {
+	apparentAge := int64(0)
+
+	//Get the second difference between date and now
+	// this is the apparent_age method described in section 4.2.3 of RFC 7234
+	if freshness.date != 0 {
+		apparentAge = time.Now().Unix() - freshness.date
+		if apparentAge < 0 {
+			apparentAge = 0
+		}
+	}
+
+	if freshness.ageValue >= 0 {
+		return capDeltaSeconds(freshness.ageValue + apparentAge)
+	}
+
+	return apparentAge
+}
+
+//marshal encodes the freshness information as a single line: date, age, flags, vary fields, response time and checksum separated by spaces
+func (freshness *entryFreshness) marshal() string {
+	flags := []byte{}
+	if freshness.noCache {
+		flags = append(flags, 'n')
+	}
+	if freshness.mustRevalidate {
+		flags = append(flags, 'm')
+	}
+	if freshness.hasValidators {
+		flags = append(flags, 'v')
+	}
+	if len(flags) == 0 {
+		flags = append(flags, '-')
+	}
+
+	vary := "-"
+	if len(freshness.vary) > 0 {
+		vary = strings.Join(freshness.vary, ",")
+	}
+
+	checksum := "-"
+	if freshness.checksum != "" {
+		checksum = freshness.checksum
+	}
+
+	return strconv.FormatInt(freshness.date, 10) + " " + strconv.FormatInt(freshness.ageValue, 10) + " " + string(flags) + " " + vary +
+		" " + strconv.FormatInt(freshness.responseTime, 10) + " " + checksum
+}
+
+//unmarshalEntryFreshness decodes a line created by marshal
+// Lines written in version 3 of the entry format don't have the response time, lines written in version 4 don't have the checksum
+func unmarshalEntryFreshness(line string) (*entryFreshness, error) {
+	parts := strings.Split(line, " ")
+	if len(parts) < 4 || len(parts) > 6 {
+		return nil, errInvalidFreshnessLine
+	}
+
+	date, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errInvalidFreshnessLine
+	}
+
+	ageValue, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errInvalidFreshnessLine
+	}
+
+	freshness := &entryFreshness{
+		date:           date,
+		ageValue:       ageValue,
+		noCache:        strings.IndexByte(parts[2], 'n') != -1,
+		mustRevalidate: strings.IndexByte(parts[2], 'm') != -1,
+		hasValidators:  strings.IndexByte(parts[2], 'v') != -1,
+	}
+
+	if parts[3] != "-" {
+		freshness.vary = strings.Split(parts[3], ",")
+	}
+
+	if len(parts) >= 5 {
+		freshness.responseTime, err = strconv.ParseInt(parts[4], 10, 64)
+		if err != nil {
+			return nil, errInvalidFreshnessLine
+		}
+	}
+
+	if len(parts) == 6 && parts[5] != "-" {
+		freshness.checksum = parts[5]
+	}
+
+	return freshness, nil
+}
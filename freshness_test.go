@@ -0,0 +1,171 @@
+package sharedhttpcache
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEntryFreshnessRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		freshness *entryFreshness
+		line      string
+	}{
+		{
+			name:      "empty",
+			freshness: &entryFreshness{ageValue: -1},
+			line:      "0 -1 - - 0 -",
+		},
+		{
+			name: "all fields",
+			freshness: &entryFreshness{
+				date:           1600000000,
+				ageValue:       30,
+				responseTime:   1600000010,
+				noCache:        true,
+				mustRevalidate: true,
+				hasValidators:  true,
+				vary:           []string{"Accept-Encoding", "Accept-Language"},
+				checksum:       "1a2b3c4d",
+			},
+			line: "1600000000 30 nmv Accept-Encoding,Accept-Language 1600000010 1a2b3c4d",
+		},
+		{
+			name:      "single flag",
+			freshness: &entryFreshness{date: 1600000000, ageValue: -1, hasValidators: true, vary: []string{"Cookie"}},
+			line:      "1600000000 -1 v Cookie 0 -",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := test.freshness.marshal()
+			if line != test.line {
+				t.Errorf("expected line: %q, got: %q", test.line, line)
+			}
+
+			freshness, err := unmarshalEntryFreshness(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(freshness, test.freshness) {
+				t.Errorf("expected: %+v, got: %+v", test.freshness, freshness)
+			}
+		})
+	}
+}
+
+func TestUnmarshalEntryFreshness(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		freshness *entryFreshness
+		err       error
+	}{
+		{
+			name:      "version 3",
+			line:      "1600000000 5 m Accept",
+			freshness: &entryFreshness{date: 1600000000, ageValue: 5, mustRevalidate: true, vary: []string{"Accept"}},
+		},
+		{
+			name:      "version 4",
+			line:      "1600000000 5 n - 1600000002",
+			freshness: &entryFreshness{date: 1600000000, ageValue: 5, noCache: true, responseTime: 1600000002},
+		},
+		{
+			name:      "version 5",
+			line:      "1600000000 -1 - - 1600000002 deadbeef",
+			freshness: &entryFreshness{date: 1600000000, ageValue: -1, responseTime: 1600000002, checksum: "deadbeef"},
+		},
+		{name: "empty", line: "", err: errInvalidFreshnessLine},
+		{name: "too few fields", line: "1600000000 5 -", err: errInvalidFreshnessLine},
+		{name: "too many fields", line: "1600000000 5 - - 0 - extra", err: errInvalidFreshnessLine},
+		{name: "invalid date", line: "yesterday 5 - -", err: errInvalidFreshnessLine},
+		{name: "invalid age", line: "1600000000 old - -", err: errInvalidFreshnessLine},
+		{name: "invalid response time", line: "1600000000 5 - - later", err: errInvalidFreshnessLine},
+		{name: "double space", line: "1600000000  5 - -", err: errInvalidFreshnessLine},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			freshness, err := unmarshalEntryFreshness(test.line)
+			if err != test.err {
+				t.Fatalf("expected error: %v, got: %v", test.err, err)
+			}
+
+			if !reflect.DeepEqual(freshness, test.freshness) {
+				t.Errorf("expected: %+v, got: %+v", test.freshness, freshness)
+			}
+		})
+	}
+}
+
+func TestEntryFreshnessAge(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name      string
+		freshness *entryFreshness
+		age       int64
+	}{
+		{
+			name:      "apparent age",
+			freshness: &entryFreshness{date: now - 15, ageValue: 3, responseTime: now - 10},
+			age:       15,
+		},
+		{
+			name:      "age value",
+			freshness: &entryFreshness{date: now - 12, ageValue: 20, responseTime: now - 10},
+			age:       30,
+		},
+		{
+			name:      "response time in the future",
+			freshness: &entryFreshness{date: now - 5, ageValue: -1, responseTime: now + 60},
+			age:       65,
+		},
+		{
+			name:      "capped",
+			freshness: &entryFreshness{date: now, ageValue: maxDeltaSeconds, responseTime: now - 10},
+			age:       maxDeltaSeconds,
+		},
+		{
+			name:      "without response time",
+			freshness: &entryFreshness{date: now - 20, ageValue: 5},
+			age:       25,
+		},
+		{
+			name:      "without response time and age value",
+			freshness: &entryFreshness{date: now - 20, ageValue: -1},
+			age:       20,
+		},
+		{
+			name:      "without response time and date",
+			freshness: &entryFreshness{ageValue: -1},
+			age:       0,
+		},
+		{
+			name:      "date in the future",
+			freshness: &entryFreshness{date: now + 60, ageValue: 5},
+			age:       5,
+		},
+		{
+			name:      "overflow is capped",
+			freshness: &entryFreshness{date: now - 20, ageValue: math.MaxInt64},
+			age:       maxDeltaSeconds,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			age := test.freshness.age()
+
+			//The clock can tick between computing now and the age
+			if age != test.age && (test.age == maxDeltaSeconds || age != test.age+1) {
+				t.Errorf("expected age: %d, got: %d", test.age, age)
+			}
+		})
+	}
+}
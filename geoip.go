@@ -0,0 +1,110 @@
+package sharedhttpcache
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+//GeoLocation is the geographical location of a client
+type GeoLocation struct {
+	//Country is the ISO 3166-1 alpha-2 country code, like "NL" or "US"
+	Country string
+
+	//Continent is the two letter continent code, like "EU" or "NA"
+	Continent string
+}
+
+//A GeoIPResolver resolves the geographical location of a IP address
+type GeoIPResolver interface {
+
+	//LookupIP is called to resolve the location of the client IP
+	// If the location is unknown nil should be returned
+	LookupIP(ip net.IP) (*GeoLocation, error)
+}
+
+//The GeoIPResolverFunc type is an adapter to allow the use of ordinary functions as GeoIPResolver
+type GeoIPResolverFunc func(ip net.IP) (*GeoLocation, error)
+
+//LookupIP calls the underlying function to resolve the location of a IP address
+func (resolver GeoIPResolverFunc) LookupIP(ip net.IP) (*GeoLocation, error) {
+	return resolver(ip)
+}
+
+const (
+	//GeoVariantNone disables geographical variants
+	GeoVariantNone = ""
+
+	//GeoVariantCountry caches a different variant per country
+	GeoVariantCountry = "country"
+
+	//GeoVariantContinent caches a different variant per continent
+	GeoVariantContinent = "continent"
+)
+
+type geoLocationContextKey struct{}
+
+//GeoLocationFromRequest returns the location of the client which was resolved by the GeoIPResolver of the CacheController
+// nil is returned if the location is unknown or no GeoIPResolver is configured.
+// This function can be used in the CacheConfigResolver, ForwardConfigResolver or TransportResolver
+func GeoLocationFromRequest(req *http.Request) *GeoLocation {
+	location, _ := req.Context().Value(geoLocationContextKey{}).(*GeoLocation)
+	return location
+}
+
+//withGeoLocation returns a shallow copy of the request with the location of the client in its context
+func withGeoLocation(req *http.Request, location *GeoLocation) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), geoLocationContextKey{}, location))
+}
+
+//geoCacheKey returns the part of the cache key which contains the geographical variant
+func geoCacheKey(cacheConfig *CacheConfig, req *http.Request) string {
+	if cacheConfig.GeoVariant == GeoVariantNone {
+		return ""
+	}
+
+	value := ""
+	if location := GeoLocationFromRequest(req); location != nil {
+		switch cacheConfig.GeoVariant {
+		case GeoVariantCountry:
+			value = location.Country
+		case GeoVariantContinent:
+			value = location.Continent
+		}
+	}
+
+	return "|geo:" + value
+}
+
+//GeoForwardConfigResolver is a ForwardConfigResolver which selects a origin server based on the location of the client
+// The country takes precedence over the continent.
+type GeoForwardConfigResolver struct {
+	//PerCountry maps country codes to forward configs
+	PerCountry map[string]*ForwardConfig
+
+	//PerContinent maps continent codes to forward configs
+	PerContinent map[string]*ForwardConfig
+
+	//Fallback is used if the location is unknown or has no matching forward config
+	// If nil the DefaultForwardConfig of the controller is used
+	Fallback ForwardConfigResolver
+}
+
+//GetForwardConfig resolves the forward config based on the location of the client
+func (resolver *GeoForwardConfigResolver) GetForwardConfig(req *http.Request) *ForwardConfig {
+	if location := GeoLocationFromRequest(req); location != nil {
+		if forwardConfig, found := resolver.PerCountry[location.Country]; found {
+			return forwardConfig
+		}
+
+		if forwardConfig, found := resolver.PerContinent[location.Continent]; found {
+			return forwardConfig
+		}
+	}
+
+	if resolver.Fallback != nil {
+		return resolver.Fallback.GetForwardConfig(req)
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package sharedhttpcache
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+//testGeoIPResolver locates 192.0.2.0/24 in the Netherlands, 198.51.100.0/24 in Germany and 203.0.113.0/24 in the United States
+var testGeoIPResolver = GeoIPResolverFunc(func(ip net.IP) (*GeoLocation, error) {
+	switch {
+	case ip.Equal(net.ParseIP("192.0.2.1")):
+		return &GeoLocation{Country: "NL", Continent: "EU"}, nil
+	case ip.Equal(net.ParseIP("198.51.100.1")):
+		return &GeoLocation{Country: "DE", Continent: "EU"}, nil
+	case ip.Equal(net.ParseIP("203.0.113.1")):
+		return &GeoLocation{Country: "US", Continent: "NA"}, nil
+	}
+
+	return nil, nil
+})
+
+func TestGeoCacheKey(t *testing.T) {
+	req := withGeoLocation(httptest.NewRequest(http.MethodGet, "http://example.com/", nil), &GeoLocation{Country: "NL", Continent: "EU"})
+	unknown := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	tests := []struct {
+		variant  string
+		req      *http.Request
+		expected string
+	}{
+		{variant: GeoVariantNone, req: req, expected: ""},
+		{variant: GeoVariantCountry, req: req, expected: "|geo:NL"},
+		{variant: GeoVariantContinent, req: req, expected: "|geo:EU"},
+		{variant: GeoVariantCountry, req: unknown, expected: "|geo:"},
+	}
+
+	for _, test := range tests {
+		config := NewCacheConfig()
+		config.GeoVariant = test.variant
+
+		if key := geoCacheKey(config, test.req); key != test.expected {
+			t.Errorf("variant '%s': expected key '%s', got '%s'", test.variant, test.expected, key)
+		}
+	}
+}
+
+func TestGeoVariants(t *testing.T) {
+	originRequests := 0
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.GeoIPResolver = testGeoIPResolver
+	controller.DefaultCacheConfig.GeoVariant = GeoVariantContinent
+
+	for _, clientIP := range []string{"192.0.2.1", "203.0.113.1", "198.51.100.1", "203.0.113.1"} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.RemoteAddr = clientIP + ":1234"
+
+		doTestRequest(t, controller, req)
+	}
+
+	//The Dutch and German clients share the European variant
+	if originRequests != 2 {
+		t.Errorf("expected one origin request per continent, got %d", originRequests)
+	}
+}
+
+func TestGeoForwardConfigResolver(t *testing.T) {
+	newOrigin := func(name string) (*ForwardConfig, func()) {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(name))
+		}))
+
+		originURL, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &ForwardConfig{Host: originURL.Host, SendOriginHost: true}, server.Close
+	}
+
+	dutchOrigin, closeDutch := newOrigin("nl")
+	defer closeDutch()
+
+	europeanOrigin, closeEuropean := newOrigin("eu")
+	defer closeEuropean()
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("default"))
+	}))
+	defer closeOrigin()
+
+	controller.GeoIPResolver = testGeoIPResolver
+	controller.ForwardConfigResolver = &GeoForwardConfigResolver{
+		PerCountry:   map[string]*ForwardConfig{"NL": dutchOrigin},
+		PerContinent: map[string]*ForwardConfig{"EU": europeanOrigin},
+	}
+
+	tests := []struct {
+		clientIP string
+		expected string
+	}{
+		{clientIP: "192.0.2.1", expected: "nl"},
+		{clientIP: "198.51.100.1", expected: "eu"},
+		{clientIP: "203.0.113.1", expected: "default"},
+		{clientIP: "127.0.0.1", expected: "default"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.RemoteAddr = test.clientIP + ":1234"
+
+		if _, body := doTestRequest(t, controller, req); body != test.expected {
+			t.Errorf("%s: expected origin '%s', got '%s'", test.clientIP, test.expected, body)
+		}
+	}
+}
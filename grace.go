@@ -0,0 +1,163 @@
+package sharedhttpcache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//MetricCacheGrace is counted every time a stale response is served within the grace period of the cache config
+const MetricCacheGrace = "cache.grace"
+
+//detachedContext keeps the values of its parent but is never canceled, so work started for a request
+// can continue after the client is gone while the tenant, request ID and other values of the request remain available
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+//mayServeInGrace checks if a stale response may be served immediately because it expired less than the Grace of the cache config ago
+// The max-stale and min-fresh of the client are ignored, but a client which sends no-cache and responses which must be revalidated
+// are never served from grace, section 4.2.4 of RFC 7234
+func mayServeInGrace(cacheConfig *CacheConfig, clientDirectives clientCacheControl, ttl time.Duration, response *http.Response) bool {
+	if cacheConfig.Grace <= 0 || ttl > 0 || -ttl > cacheConfig.Grace || clientDirectives.noCache {
+		return false
+	}
+
+	cc := parseResponseCacheControl(response.Header)
+
+	return !cc.mustRevalidate && !cc.proxyRevalidate && !cc.noCache && !cc.hasSMaxAge
+}
+
+//startBackgroundRefresh marks the cache key as being refreshed, false is returned if a refresh of the key is already running.
+// A mark expires after the lock TTL, so a refresh which was dropped by the background pool doesn't block refreshes forever
+func (controller *CacheController) startBackgroundRefresh(cacheKey string) bool {
+	controller.backgroundRefreshesMutex.Lock()
+	defer controller.backgroundRefreshesMutex.Unlock()
+
+	if controller.backgroundRefreshes == nil {
+		controller.backgroundRefreshes = make(map[string]time.Time)
+	}
+
+	now := time.Now()
+	if expiration, found := controller.backgroundRefreshes[cacheKey]; found && expiration.After(now) {
+		return false
+	}
+
+	controller.backgroundRefreshes[cacheKey] = now.Add(controller.lockTTL())
+
+	return true
+}
+
+//finishBackgroundRefresh removes the mark of a refresh of the cache key
+func (controller *CacheController) finishBackgroundRefresh(cacheKey string) {
+	controller.backgroundRefreshesMutex.Lock()
+	delete(controller.backgroundRefreshes, cacheKey)
+	controller.backgroundRefreshesMutex.Unlock()
+}
+
+//refreshInBackground revalidates the stored response to the request with the origin and stores the result, after the stale response
+// has been served from grace or within its stale-while-revalidate window. If the stored response has no validators the response
+// is fetched again. Only one refresh per cache key runs at a time within this instance, and across instances if there is a Locker
+func (controller *CacheController) refreshInBackground(
+	cacheConfig *CacheConfig,
+	forwardConfig *ForwardConfig,
+	transport http.RoundTripper,
+	req *http.Request,
+	primaryCacheKey string,
+	cacheKey string,
+) {
+	if !controller.startBackgroundRefresh(cacheKey) {
+		return
+	}
+
+	//The client validators are not forwarded, the response of the origin must be a complete response which can be stored
+	refreshRequest := stripClientValidators(req.Clone(detachedContext{req.Context()}))
+
+	submitted := controller.getBackgroundPool().submit(BackgroundPriorityRevalidation, func() {
+		defer controller.finishBackgroundRefresh(cacheKey)
+
+		lock := controller.newOriginLock(cacheKey)
+		defer lock.release()
+
+		//A other instance is already fetching the response
+		if !lock.acquire() {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(refreshRequest.Context())
+		defer cancel()
+
+		//The stored response is looked up again, its body is being served to the client which triggered the refresh
+		stored, _, err := controller.findResponseInCache(cacheKey)
+		if err != nil {
+			controller.requestLogger(refreshRequest).WithError(err).WithField("cache-key", cacheKey).Error("Error while attempting to find stale response in cache")
+		}
+
+		originRequest := refreshRequest
+		if stored != nil {
+			stored.Request = refreshRequest
+			defer stored.Body.Close()
+
+			if revalidationRequest := makeRevalidationRequest(refreshRequest, stored); revalidationRequest != nil {
+				originRequest = revalidationRequest.WithContext(refreshRequest.Context())
+			}
+		}
+
+		response, err := controller.roundTripOrigin(ctx, transport, forwardConfig, originRequest)
+		if err != nil {
+			controller.requestLogger(refreshRequest).WithError(err).WithField("cache-key", cacheKey).Warning("Error while refreshing stale response in the background")
+			return
+		}
+
+		controller.prepareOriginResponse(cacheConfig, originRequest, response)
+
+		//A error of the origin doesn't replace the stale response, it can still be served when the origin fails
+		if response.StatusCode >= http.StatusInternalServerError {
+			response.Body.Close()
+			return
+		}
+
+		//The stored response is still valid, it is stored again with the updated headers so it is fresh again
+		if response.StatusCode == http.StatusNotModified && stored != nil && originRequest != refreshRequest {
+			response.Body.Close()
+
+			controller.incrMetric(MetricCacheRevalidated, 1, nil)
+			controller.emitEvent(CacheEventRevalidate, cacheKey, -1, false)
+
+			mergeValidationHeaders(stored, response)
+			response = stored
+		}
+
+		if response.Header.Get(DateHeader) == "" {
+			response.Header.Set(DateHeader, time.Now().Format(http.TimeFormat))
+		}
+
+		response = controller.storeResponse(cacheConfig, refreshRequest, response, primaryCacheKey)
+
+		//The body is stored while it is read, so it has to be read completely
+		_, err = io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+		if err != nil {
+			controller.requestLogger(refreshRequest).WithError(err).WithField("cache-key", cacheKey).Warning("Error while reading refreshed response")
+		}
+	})
+
+	if !submitted {
+		controller.finishBackgroundRefresh(cacheKey)
+	}
+}
@@ -0,0 +1,85 @@
+package sharedhttpcache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGrace(t *testing.T) {
+	var version int32
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		current := atomic.AddInt32(&version, 1)
+
+		//The response is stored but immediately stale
+		rw.Header().Set(CacheControlHeader, "max-age=0")
+		rw.Header().Set("Etag", fmt.Sprintf(`"v%d"`, current))
+		_, _ = rw.Write([]byte(fmt.Sprintf("v%d", current)))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.Grace = time.Minute
+
+	_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if body != "v1" {
+		t.Fatalf("expected v1 from the origin, got '%s'", body)
+	}
+
+	response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if body != "v1" {
+		t.Errorf("expected the stale v1 to be served from grace, got '%s'", body)
+	}
+	if response.Header.Get("Warning") == "" {
+		t.Errorf("expected a stale warning")
+	}
+
+	//The response is refreshed in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for body == "v1" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, body = doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	}
+
+	if body == "v1" {
+		t.Errorf("expected the response to be refreshed in the background")
+	}
+
+	//A client which sends no-cache is never served from grace
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	req.Header.Set(CacheControlHeader, "no-cache")
+
+	before := atomic.LoadInt32(&version)
+	doTestRequest(t, controller, req)
+	if atomic.LoadInt32(&version) == before {
+		t.Errorf("expected the no-cache request to be forwarded to the origin")
+	}
+}
+
+func TestMayServeInGrace(t *testing.T) {
+	cacheConfig := &CacheConfig{Grace: time.Minute}
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		ttl          time.Duration
+		expectGrace  bool
+	}{
+		{name: "within grace", cacheControl: "max-age=60", ttl: -time.Second, expectGrace: true},
+		{name: "past grace", cacheControl: "max-age=60", ttl: -2 * time.Minute, expectGrace: false},
+		{name: "fresh", cacheControl: "max-age=60", ttl: time.Second, expectGrace: false},
+		{name: "must-revalidate", cacheControl: "max-age=60, must-revalidate", ttl: -time.Second, expectGrace: false},
+		{name: "s-maxage", cacheControl: "s-maxage=60", ttl: -time.Second, expectGrace: false},
+	}
+
+	for _, test := range tests {
+		response := &http.Response{Header: http.Header{CacheControlHeader: {test.cacheControl}}}
+
+		if grace := mayServeInGrace(cacheConfig, clientCacheControl{}, test.ttl, response); grace != test.expectGrace {
+			t.Errorf("%s: expected grace %v, got %v", test.name, test.expectGrace, grace)
+		}
+	}
+}
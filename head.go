@@ -0,0 +1,88 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+)
+
+//serveHeadFromCache answers a HEAD request with the header of the stored response to a GET request for the same resource,
+// as allowed by section 4.3.5 of RFC 7234, so HEAD requests don't have to be forwarded or stored separately.
+// The body of the stored response is never read. false is returned if no fresh GET response can be served,
+// the HEAD request is then handled like any other request
+func (controller *CacheController) serveHeadFromCache(cacheConfig *CacheConfig, forwardConfig *ForwardConfig, resp http.ResponseWriter, req *http.Request) bool {
+	if !isMethodCacheable(cacheConfig, http.MethodGet) {
+		return false
+	}
+
+	//The header served for a GET request depends on its body if it is processed, which would have to be read
+	if cacheConfig.EnableESI || len(cacheConfig.ServeTransformers) > 0 {
+		return false
+	}
+
+	//The GET response is stored under the key of a GET request, its secondary key uses the same request headers
+	getRequest := req.WithContext(req.Context())
+	getRequest.Method = http.MethodGet
+
+	primaryCacheKey := getPrimaryCacheKey(cacheConfig, forwardConfig, getRequest)
+
+	secondaryKeys, _, err := controller.findSecondaryKeysInCache(primaryCacheKey)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).WithField("cache-key", primaryCacheKey).Error("Error while attempting to find secondary cache key in cache")
+		return false
+	}
+
+	cacheKey := primaryCacheKey + getSecondaryCacheKey(cacheConfig, secondaryKeys, getRequest)
+
+	cachedResponse, freshness, ttl, err := controller.findEntryInCache(cacheKey)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).WithField("cache-key", cacheKey).Error("Error while attempting to find cache key in cache")
+		return false
+	}
+
+	if cachedResponse == nil {
+		return false
+	}
+
+	//Only the header is served, the body is closed without reading it
+	if cachedResponse.Body != nil {
+		cachedResponse.Body.Close()
+	}
+	cachedResponse.Body = http.NoBody
+	cachedResponse.Request = req
+
+	if cacheConfig.EpochResolver != nil {
+		ttl = boundTTLByEpoch(cacheConfig.EpochResolver.GetEpoch(req), freshness, ttl)
+	}
+
+	clientDirectives := parseClientCacheControl(req.Header)
+	if clientDirectives.noCache && controller.ignoresClientNoCache(cacheConfig, req) {
+		clientDirectives.noCache = false
+	}
+
+	age := freshness.age()
+
+	//Stale responses and responses which must be revalidated are left to the regular handling, which forwards the HEAD request
+	if ttl <= 0 ||
+		freshness.noCache ||
+		clientDirectives.noCache ||
+		!clientDirectives.acceptsAge(age) ||
+		!clientDirectives.acceptsTTL(ttl) ||
+		controller.isInvalidated(cacheConfig, getRequest, forwardConfig, cachedResponse, freshness) {
+		return false
+	}
+
+	setCacheStatus(resp, CacheStatusHit)
+	controller.incrMetric(MetricCacheHit, 1, nil)
+	controller.emitEvent(CacheEventHit, cacheKey, cachedResponse.ContentLength, false)
+
+	if clientHasCurrentResponse(req, cachedResponse) {
+		writeNotModified(resp, cachedResponse)
+		return true
+	}
+
+	err = controller.writeCachedResponse(cacheConfig, resp, cachedResponse, age)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).Error("Error while writing cached response to http client")
+	}
+
+	return true
+}
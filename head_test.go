@@ -0,0 +1,52 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeHeadFromCachedGet(t *testing.T) {
+	requests := map[string]int{}
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests[req.Method]++
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		rw.Header().Set("Content-Length", "7")
+		rw.Header().Set("Etag", `"v1"`)
+		if req.Method != http.MethodHead {
+			_, _ = rw.Write([]byte("content"))
+		}
+	}))
+	defer closeOrigin()
+
+	//Without a stored GET response the HEAD request is forwarded
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodHead, "http://"+host+"/page", nil))
+	if requests[http.MethodHead] != 1 {
+		t.Fatalf("expected the HEAD request to be forwarded, origin got %d", requests[http.MethodHead])
+	}
+
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil))
+
+	response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodHead, "http://"+host+"/page", nil))
+	if requests[http.MethodHead] != 1 || requests[http.MethodGet] != 1 {
+		t.Errorf("expected the HEAD request to be served from the stored GET response, origin got %v", requests)
+	}
+	if response.StatusCode != http.StatusOK || body != "" {
+		t.Errorf("expected status 200 without body, got %d with '%s'", response.StatusCode, body)
+	}
+	if length := response.Header.Get("Content-Length"); length != "7" {
+		t.Errorf("expected the Content-Length of the stored response, got '%s'", length)
+	}
+	if response.Header.Get(AgeHeader) == "" {
+		t.Errorf("expected a Age header")
+	}
+
+	req := httptest.NewRequest(http.MethodHead, "http://"+host+"/page", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	response, _ = doTestRequest(t, controller, req)
+	if response.StatusCode != http.StatusNotModified {
+		t.Errorf("expected status 304 for a matching validator, got %d", response.StatusCode)
+	}
+}
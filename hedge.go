@@ -0,0 +1,123 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//MetricOriginHedged is counted every time a hedged request is send because the origin didn't respond within HedgeAfter,
+// tagged with the origin host and the winner, which is "primary" or "hedge"
+const MetricOriginHedged = "origin.hedged"
+
+//hedgeResult is the outcome of one of the attempts of a hedged request
+type hedgeResult struct {
+	response *http.Response
+	err      error
+	cancel   context.CancelFunc
+	hedged   bool
+}
+
+//isHedgeable checks if a second attempt of the request can be send, which is only safe for idempotent requests without body
+func isHedgeable(forwardConfig *ForwardConfig, req *http.Request) bool {
+	if forwardConfig.HedgeAfter <= 0 {
+		return false
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0
+}
+
+//roundTripOriginHedged sends the request to the origin, if no response arrives within HedgeAfter a second attempt is send
+// to the HedgeForwardConfig. The response which arrives first is returned and the other attempt is canceled.
+// If the first attempt fails the response of the other attempt is returned
+func (controller *CacheController) roundTripOriginHedged(forwardContext context.Context, transport http.RoundTripper, forwardConfig *ForwardConfig, req *http.Request) (*http.Response, error) {
+	hedgeConfig := forwardConfig.HedgeForwardConfig
+	if hedgeConfig == nil {
+		hedgeConfig = forwardConfig
+	}
+
+	hedgeTransport := forwardConfig.HedgeTransport
+	if hedgeTransport == nil {
+		hedgeTransport = transport
+	}
+
+	//Both attempts can send their result without waiting, so the attempt which loses doesn't block
+	results := make(chan hedgeResult, 2)
+
+	attempt := func(ctx context.Context, cancel context.CancelFunc, transport http.RoundTripper, forwardConfig *ForwardConfig, hedged bool) {
+		response, err := controller.roundTripOriginOnce(ctx, transport, forwardConfig, req)
+		results <- hedgeResult{response: response, err: err, cancel: cancel, hedged: hedged}
+	}
+
+	primaryContext, cancelPrimary := context.WithCancel(forwardContext)
+	go attempt(primaryContext, cancelPrimary, transport, forwardConfig, false)
+
+	timer := time.NewTimer(forwardConfig.HedgeAfter)
+	defer timer.Stop()
+
+	select {
+	case result := <-results:
+		return finishHedgeAttempt(result)
+
+	case <-timer.C:
+	}
+
+	hedgeContext, cancelHedge := context.WithCancel(forwardContext)
+	go attempt(hedgeContext, cancelHedge, hedgeTransport, hedgeConfig, true)
+
+	result := <-results
+
+	//The other attempt can still succeed
+	pending := true
+	if result.err != nil {
+		result.cancel()
+
+		result = <-results
+		pending = false
+	}
+
+	winner := "primary"
+	if result.hedged {
+		winner = "hedge"
+	}
+
+	controller.incrMetric(MetricOriginHedged, 1, map[string]string{
+		"origin": forwardConfig.Host,
+		"winner": winner,
+	})
+
+	//The attempt which lost is canceled, its response is discarded once it arrives
+	if pending {
+		if result.hedged {
+			cancelPrimary()
+		} else {
+			cancelHedge()
+		}
+
+		go func() {
+			lost := <-results
+			if lost.response != nil {
+				lost.response.Body.Close()
+			}
+		}()
+	}
+
+	return finishHedgeAttempt(result)
+}
+
+//finishHedgeAttempt returns the response of the winning attempt, the context of the attempt is canceled once the body is closed
+func finishHedgeAttempt(result hedgeResult) (*http.Response, error) {
+	if result.err != nil {
+		result.cancel()
+		return nil, result.err
+	}
+
+	result.response.Body = &releasingReadCloser{ReadCloser: result.response.Body, release: result.cancel}
+
+	return result.response, nil
+}
@@ -0,0 +1,74 @@
+package sharedhttpcache
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHedgedRequest(t *testing.T) {
+	unblock := make(chan bool)
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-unblock:
+		case <-req.Context().Done():
+		}
+
+		_, _ = rw.Write([]byte("primary"))
+	}))
+	defer closeOrigin()
+	defer close(unblock)
+
+	hedgeServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hedge"))
+	}))
+	defer hedgeServer.Close()
+
+	hedgeURL, err := url.Parse(hedgeServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller.DefaultForwardConfig.HedgeAfter = 10 * time.Millisecond
+	controller.DefaultForwardConfig.HedgeForwardConfig = &ForwardConfig{
+		Host: hedgeURL.Host,
+	}
+
+	//The transport determines the address which is dialed, so the second attempt is send to the hedge origin
+	controller.DefaultForwardConfig.HedgeTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, hedgeURL.Host)
+		},
+	}
+
+	response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil))
+	if response.StatusCode != http.StatusOK || body != "hedge" {
+		t.Errorf("expected the response of the hedge origin, got status %d and body '%s'", response.StatusCode, body)
+	}
+
+	//Requests with side effects are never send twice
+	unsafe := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		controller.ServeHTTP(unsafe, httptest.NewRequest(http.MethodPost, "http://"+host+"/page", nil))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("expected the POST request to wait for the primary origin, got '%s'", unsafe.Body.String())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unblock <- true
+	<-done
+
+	if unsafe.Body.String() != "primary" {
+		t.Errorf("expected the response of the primary origin, got '%s'", unsafe.Body.String())
+	}
+}
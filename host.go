@@ -0,0 +1,118 @@
+package sharedhttpcache
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+//defaultPorts are the ports which are implied by the scheme of a URI
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+//normalizeHost normalizes the host of a effective URI according to the cache config,
+// so different notations of the same host share the cache key
+func normalizeHost(cacheConfig *CacheConfig, scheme, host string) string {
+	if cacheConfig == nil {
+		return host
+	}
+
+	if cacheConfig.NormalizeHostnames {
+		host = canonicalHostname(host)
+	}
+
+	if cacheConfig.NormalizeDefaultPorts {
+		host = stripDefaultPort(scheme, host)
+	}
+
+	return host
+}
+
+//stripDefaultPort removes the port from the host if it is the default port of the scheme, like ":443" for https
+func stripDefaultPort(scheme, host string) string {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil || port != defaultPorts[scheme] {
+		return host
+	}
+
+	//The brackets of a IPv6 address are removed by SplitHostPort
+	if strings.Contains(hostname, ":") {
+		return "[" + hostname + "]"
+	}
+
+	return hostname
+}
+
+//canonicalHostname lowercases the hostname, converts a internationalized hostname to punycode
+// and removes the trailing dot of a fully qualified name, the port is kept
+func canonicalHostname(host string) string {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return asciiHostname(strings.TrimSuffix(strings.ToLower(host), "."))
+	}
+
+	return net.JoinHostPort(asciiHostname(strings.TrimSuffix(strings.ToLower(hostname), ".")), port)
+}
+
+//asciiHostname converts a internationalized hostname like "bücher.example" to its ASCII form "xn--bcher-kva.example",
+// which is the form used in DNS. Hostnames which are already ASCII or can't be converted are returned unchanged
+func asciiHostname(hostname string) string {
+	for i := 0; i < len(hostname); i++ {
+		if hostname[i] < utf8.RuneSelf {
+			continue
+		}
+
+		ascii, err := idna.Lookup.ToASCII(hostname)
+		if err != nil {
+			return hostname
+		}
+
+		return ascii
+	}
+
+	return hostname
+}
+
+//asciiHost converts the hostname of a host, which may contain a port, to its ASCII form
+func asciiHost(host string) string {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return asciiHostname(host)
+	}
+
+	return net.JoinHostPort(asciiHostname(hostname), port)
+}
+
+//normalizeRequestHost replaces the host of the request with its canonical hostname if NormalizeHostnames is true,
+// so the forward config is resolved and the origin is contacted the same way for every notation of the host
+func normalizeRequestHost(cacheConfig *CacheConfig, req *http.Request) *http.Request {
+	if !cacheConfig.NormalizeHostnames {
+		return req
+	}
+
+	return withCanonicalHost(req)
+}
+
+//withCanonicalHost returns a shallow copy of the request with the canonical hostname as host,
+// the request itself is returned if the host already is canonical
+func withCanonicalHost(req *http.Request) *http.Request {
+	host := canonicalHostname(req.Host)
+	urlHost := canonicalHostname(req.URL.Host)
+	if host == req.Host && urlHost == req.URL.Host {
+		return req
+	}
+
+	normalizedURL := *req.URL
+	normalizedURL.Host = urlHost
+
+	normalizedReq := req.WithContext(req.Context())
+	normalizedReq.Host = host
+	normalizedReq.URL = &normalizedURL
+
+	return normalizedReq
+}
@@ -0,0 +1,187 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	config := NewCacheConfig()
+	config.NormalizeHostnames = true
+	config.NormalizeDefaultPorts = true
+
+	tests := []struct {
+		scheme string
+		host   string
+		expect string
+	}{
+		{scheme: "https", host: "example.com:443", expect: "example.com"},
+		{scheme: "http", host: "example.com:80", expect: "example.com"},
+		{scheme: "http", host: "example.com:443", expect: "example.com:443"},
+		{scheme: "https", host: "example.com:8443", expect: "example.com:8443"},
+		{scheme: "https", host: "[2001:db8::1]:443", expect: "[2001:db8::1]"},
+		{scheme: "https", host: "example.com", expect: "example.com"},
+		{scheme: "https", host: "Example.COM.", expect: "example.com"},
+		{scheme: "https", host: "Example.COM.:443", expect: "example.com"},
+		{scheme: "http", host: "Example.COM.:8080", expect: "example.com:8080"},
+		{scheme: "https", host: "Bücher.example", expect: "xn--bcher-kva.example"},
+		{scheme: "https", host: "bücher.example.:443", expect: "xn--bcher-kva.example"},
+		{scheme: "https", host: "BÜCHER.Example", expect: "xn--bcher-kva.example"},
+		{scheme: "https", host: "XN--BCHER-KVA.example", expect: "xn--bcher-kva.example"},
+		{scheme: "http", host: "Bücher.Example.:8080", expect: "xn--bcher-kva.example:8080"},
+		{scheme: "https", host: "[2001:DB8::1]:8443", expect: "[2001:db8::1]:8443"},
+		{scheme: "https", host: "Bü_cher.example", expect: "bü_cher.example"},
+		{scheme: "https", host: "-Bücher.example.", expect: "-bücher.example"},
+	}
+
+	for _, test := range tests {
+		if host := normalizeHost(config, test.scheme, test.host); host != test.expect {
+			t.Errorf("%s %s: expected '%s', got '%s'", test.scheme, test.host, test.expect, host)
+		}
+	}
+
+	//Normalizing hostnames and default ports changes the cache key, so it is opt-in
+	if host := normalizeHost(NewCacheConfig(), "https", "Example.COM.:443"); host != "Example.COM.:443" {
+		t.Errorf("expected the host to be kept by default, got '%s'", host)
+	}
+}
+
+func TestNormalizeRequestHost(t *testing.T) {
+	config := NewCacheConfig()
+	config.NormalizeHostnames = true
+
+	req := httptest.NewRequest(http.MethodGet, "/page", nil)
+	req.Host = "Example.COM.:8080"
+
+	normalized := normalizeRequestHost(config, req)
+	if normalized.Host != "example.com:8080" {
+		t.Errorf("expected the canonical host, got '%s'", normalized.Host)
+	}
+	if req.Host != "Example.COM.:8080" {
+		t.Error("expected the original request to be unmodified")
+	}
+
+	absolute := httptest.NewRequest(http.MethodGet, "http://Example.COM./page", nil)
+	normalized = normalizeRequestHost(config, absolute)
+	if normalized.URL.Host != "example.com" || absolute.URL.Host != "Example.COM." {
+		t.Errorf("expected the canonical host in a copy of the URL, got '%s'", normalized.URL.Host)
+	}
+
+	config.NormalizeHostnames = false
+	if normalizeRequestHost(config, req) != req {
+		t.Error("expected the request to be unmodified if hostnames are not normalized")
+	}
+}
+
+func TestResolversSeeCanonicalHost(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.NormalizeHostnames = false
+	controller.DefaultForwardConfig.SendOriginHost = true
+
+	var tenantHost, configHost string
+	controller.TenantResolver = TenantResolverFunc(func(req *http.Request) string {
+		tenantHost = req.Host
+		return req.Host
+	})
+	controller.CacheConfigResolver = CacheConfigResolverFunc(func(req *http.Request) *CacheConfig {
+		configHost = req.Host
+		return nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil)
+	req.Host = "Example.COM."
+	doTestRequest(t, controller, req)
+
+	//The tenant and the cache config are resolved with the canonical host, even if hostnames are not normalized
+	if tenantHost != "example.com" || configHost != "example.com" {
+		t.Errorf("expected the resolvers to see the canonical host, got '%s' and '%s'", tenantHost, configHost)
+	}
+
+	if req.Host != "Example.COM." {
+		t.Errorf("expected the original request to be unmodified")
+	}
+}
+
+func TestAsciiHost(t *testing.T) {
+	tests := []struct {
+		host   string
+		expect string
+	}{
+		{host: "example.com", expect: "example.com"},
+		{host: "bücher.example", expect: "xn--bcher-kva.example"},
+		{host: "BÜCHER.example", expect: "xn--bcher-kva.example"},
+		{host: "bücher.example:8080", expect: "xn--bcher-kva.example:8080"},
+		{host: "bücher.example.", expect: "xn--bcher-kva.example."},
+		//Hostnames which are not valid IDNs are passed on unchanged, the origin or DNS rejects them
+		{host: "bü_cher.example", expect: "bü_cher.example"},
+		{host: "-bücher.example:8080", expect: "-bücher.example:8080"},
+	}
+
+	for _, test := range tests {
+		if host := asciiHost(test.host); host != test.expect {
+			t.Errorf("%s: expected '%s', got '%s'", test.host, test.expect, host)
+		}
+	}
+}
+
+func TestInternationalizedCacheKey(t *testing.T) {
+	config := NewCacheConfig()
+	config.NormalizeHostnames = true
+	config.NormalizeDefaultPorts = true
+	forwardConfig := &ForwardConfig{}
+
+	cacheKey := func(host string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+		req.Host = host
+		req.URL.Host = ""
+		return getPrimaryCacheKey(config, forwardConfig, normalizeRequestHost(config, req))
+	}
+
+	expected := cacheKey("xn--bcher-kva.example")
+	for _, host := range []string{"bücher.example", "BÜCHER.Example", "bücher.example.", "XN--BCHER-KVA.EXAMPLE.:80"} {
+		if key := cacheKey(host); key != expected {
+			t.Errorf("%s: expected cache key '%s', got '%s'", host, expected, key)
+		}
+	}
+
+	//A invalid IDN can't be converted, but different notations still share the cache key
+	if cacheKey("Bü_cher.example.") != cacheKey("bü_cher.example") {
+		t.Errorf("expected invalid IDNs which only differ in case to share the cache key")
+	}
+
+	if cacheKey("bü_cher.example") == expected {
+		t.Errorf("expected a invalid IDN to have its own cache key")
+	}
+}
+
+func TestInternationalizedOriginHost(t *testing.T) {
+	config := NewCacheConfig()
+	config.NormalizeHostnames = true
+
+	tests := []struct {
+		forwardConfig *ForwardConfig
+		host          string
+		expect        string
+	}{
+		{forwardConfig: &ForwardConfig{Host: "Bücher.example", SendOriginHost: true}, host: "example.com", expect: "xn--bcher-kva.example"},
+		{forwardConfig: &ForwardConfig{Host: "bücher.example.:8080", SendOriginHost: true}, host: "example.com", expect: "xn--bcher-kva.example.:8080"},
+		{forwardConfig: &ForwardConfig{Host: "bü_cher.example", SendOriginHost: true}, host: "example.com", expect: "bü_cher.example"},
+		//Without SendOriginHost the normalized host of the client is sent
+		{forwardConfig: &ForwardConfig{Host: "origin"}, host: "BÜCHER.example.", expect: "xn--bcher-kva.example"},
+		{forwardConfig: &ForwardConfig{Host: "origin"}, host: "Bü_cher.example", expect: "bü_cher.example"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.Host = test.host
+
+		if host := originHost(test.forwardConfig, normalizeRequestHost(config, req)); host != test.expect {
+			t.Errorf("%s %s: expected '%s', got '%s'", test.forwardConfig.Host, test.host, test.expect, host)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package sharedhttpcache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+
+	"golang.org/x/net/context"
+)
+
+//errSwitchingProtocols is returned when the origin switches protocols, upgrades are not supported since hop-by-hop headers
+// like Upgrade are never forwarded, so a origin should never switch protocols
+var errSwitchingProtocols = errors.New("origin switched protocols, upgrades are not supported")
+
+//forwardInformationalResponses returns a context with which the interim 1xx responses of the origin, like 103 Early Hints,
+// are forwarded to the client while the final response is awaited. Interim responses are never stored.
+// Clients using HTTP/1.0 don't understand interim responses, so they are not forwarded to them. Section 6.2 of RFC 7231
+func forwardInformationalResponses(ctx context.Context, resp http.ResponseWriter, req *http.Request) context.Context {
+	if !req.ProtoAtLeast(1, 1) {
+		return ctx
+	}
+
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			//A 101 is a final response, it is returned by the transport
+			if code == http.StatusSwitchingProtocols {
+				return nil
+			}
+
+			//The headers of the interim response are not sent with the final response, so headers which were
+			// already set are restored after the interim response is written
+			clientHeader := resp.Header()
+			previous := make(map[string][]string, len(header))
+			for name, values := range header {
+				if existing, found := clientHeader[name]; found {
+					previous[name] = existing
+				}
+
+				clientHeader[name] = values
+			}
+
+			resp.WriteHeader(code)
+
+			for name := range header {
+				if existing, found := previous[name]; found {
+					clientHeader[name] = existing
+				} else {
+					delete(clientHeader, name)
+				}
+			}
+
+			return nil
+		},
+	}
+
+	return httptrace.WithClientTrace(ctx, trace)
+}
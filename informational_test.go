@@ -0,0 +1,68 @@
+package sharedhttpcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+)
+
+func TestForwardEarlyHints(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		rw.WriteHeader(http.StatusEarlyHints)
+		rw.Header().Del("Link")
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	server := httptest.NewServer(controller)
+	defer server.Close()
+
+	request := func() ([]int, []string, *http.Response) {
+		codes := []int{}
+		links := []string{}
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				codes = append(codes, code)
+				links = append(links, header.Get("Link"))
+				return nil
+			},
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		req.Host = host
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		return codes, links, response
+	}
+
+	codes, links, response := request()
+	if len(codes) != 1 || codes[0] != http.StatusEarlyHints || links[0] == "" {
+		t.Errorf("expected the early hints to be forwarded, got codes %v with links %v", codes, links)
+	}
+
+	if response.StatusCode != http.StatusOK || response.Header.Get("Link") != "" {
+		t.Errorf("expected the final response without the headers of the early hints, got status %d and headers %v", response.StatusCode, response.Header)
+	}
+
+	//The final response is stored, the early hints are not replayed from the cache
+	codes, _, response = request()
+	if len(codes) != 0 || response.StatusCode != http.StatusOK || originRequests != 1 {
+		t.Errorf("expected the final response to be served from the cache, got codes %v after %d origin requests", codes, originRequests)
+	}
+}
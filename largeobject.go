@@ -0,0 +1,217 @@
+package sharedhttpcache
+
+import (
+	"math/bits"
+	"net/http"
+	"path"
+	"sync"
+)
+
+//MetricCacheLargeObject is counted every time a response is stored in the LargeObjectLayer instead of the first layer
+const MetricCacheLargeObject = "cache.large_object"
+
+//largeObjectMinSamples is the amount of responses of a path pattern which must have been stored before the size distribution
+// is used to decide if a response of unknown length is a large object
+const largeObjectMinSamples = 10
+
+//maxSizePatterns is the maximum amount of path patterns of which the size distribution is tracked,
+// responses of new patterns are not tracked once it is reached so clients can't exhaust the memory with random paths
+const maxSizePatterns = 4096
+
+//A PathPatternResolver groups requests by path pattern, the sizes of responses are tracked per pattern
+type PathPatternResolver interface {
+	GetPathPattern(req *http.Request) string
+}
+
+//The PathPatternResolverFunc type is an adapter to allow the use of ordinary functions as PathPatternResolver.
+// If f is a function with the appropriate signature, PathPatternResolverFunc(f) is a PathPatternResolver that calls f.
+type PathPatternResolverFunc func(req *http.Request) string
+
+//GetPathPattern calls f(req)
+func (f PathPatternResolverFunc) GetPathPattern(req *http.Request) string {
+	return f(req)
+}
+
+//defaultPathPattern groups requests by host, directory and file extension, like "example.com/videos/*.mp4"
+func defaultPathPattern(req *http.Request) string {
+	dir, file := path.Split(req.URL.Path)
+
+	return req.Host + dir + "*" + path.Ext(file)
+}
+
+//A SizeDistribution describes the sizes of the bodies of the responses of a path pattern which were stored
+type SizeDistribution struct {
+	//Samples is the amount of stored responses
+	Samples int64
+
+	//Total is the sum of the sizes of all stored responses
+	Total int64
+
+	//Max is the size of the largest stored response
+	Max int64
+
+	//buckets counts the sizes per power of two, bucket n holds the sizes which need n bits
+	buckets [65]int64
+}
+
+//Mean returns the average size, zero if no responses were stored
+func (distribution SizeDistribution) Mean() int64 {
+	if distribution.Samples == 0 {
+		return 0
+	}
+
+	return distribution.Total / distribution.Samples
+}
+
+//Percentile estimates the size below which the given fraction of the responses falls, like 0.5 for the median.
+// The estimate is the upper bound of the power of two bucket which contains the percentile, capped at Max
+func (distribution SizeDistribution) Percentile(fraction float64) int64 {
+	if distribution.Samples == 0 {
+		return 0
+	}
+
+	target := int64(fraction * float64(distribution.Samples))
+	if target < 1 {
+		target = 1
+	}
+
+	var seen int64
+	for bucket, count := range distribution.buckets {
+		seen += count
+		if seen < target {
+			continue
+		}
+
+		if bucket == 0 {
+			return 0
+		}
+
+		upper := int64(1)<<uint(bucket) - 1
+		if bucket >= 63 || upper > distribution.Max {
+			return distribution.Max
+		}
+
+		return upper
+	}
+
+	return distribution.Max
+}
+
+//record adds the size of a stored response to the distribution
+func (distribution *SizeDistribution) record(size int64) {
+	distribution.Samples++
+	distribution.Total += size
+	if size > distribution.Max {
+		distribution.Max = size
+	}
+
+	distribution.buckets[bits.Len64(uint64(size))]++
+}
+
+//sizeTracker keeps the size distribution of the stored responses per path pattern
+type sizeTracker struct {
+	mutex    sync.Mutex
+	patterns map[string]*SizeDistribution
+}
+
+func newSizeTracker() *sizeTracker {
+	return &sizeTracker{
+		patterns: make(map[string]*SizeDistribution),
+	}
+}
+
+//record adds the size of a stored response to the distribution of its pattern
+func (tracker *sizeTracker) record(pattern string, size int64) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	distribution := tracker.patterns[pattern]
+	if distribution == nil {
+		if len(tracker.patterns) >= maxSizePatterns {
+			return
+		}
+
+		distribution = &SizeDistribution{}
+		tracker.patterns[pattern] = distribution
+	}
+
+	distribution.record(size)
+}
+
+//distribution returns a copy of the distribution of the pattern
+func (tracker *sizeTracker) distribution(pattern string) SizeDistribution {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if distribution := tracker.patterns[pattern]; distribution != nil {
+		return *distribution
+	}
+
+	return SizeDistribution{}
+}
+
+func (controller *CacheController) getSizeTracker() *sizeTracker {
+	controller.sizeTrackerOnce.Do(func() {
+		controller.sizeTracker = newSizeTracker()
+	})
+
+	return controller.sizeTracker
+}
+
+//ResponseSizes returns the size distribution of the stored responses per path pattern, see PathPatternResolver
+func (controller *CacheController) ResponseSizes() map[string]SizeDistribution {
+	tracker := controller.getSizeTracker()
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	sizes := make(map[string]SizeDistribution, len(tracker.patterns))
+	for pattern, distribution := range tracker.patterns {
+		sizes[pattern] = *distribution
+	}
+
+	return sizes
+}
+
+//getPathPattern returns the path pattern of the request using the PathPatternResolver or defaultPathPattern
+func (controller *CacheController) getPathPattern(req *http.Request) string {
+	if controller.PathPatternResolver != nil {
+		return controller.PathPatternResolver.GetPathPattern(req)
+	}
+
+	return defaultPathPattern(req)
+}
+
+//recordResponseSize adds the size of the body of a stored response to the distribution of its path pattern
+func (controller *CacheController) recordResponseSize(response *http.Response, size int64) {
+	if controller.LargeObjectThreshold <= 0 || response.Request == nil {
+		return
+	}
+
+	controller.getSizeTracker().record(controller.getPathPattern(response.Request), size)
+}
+
+//firstStorageLayer returns the index of the first layer in which the body of the response is stored.
+// Bodies above the LargeObjectThreshold skip the layers before the LargeObjectLayer, so the fast layers are kept for small objects.
+// If the origin didn't send the length the median size of the stored responses of the same path pattern is used
+func (controller *CacheController) firstStorageLayer(response *http.Response) int {
+	if controller.LargeObjectThreshold <= 0 || controller.LargeObjectLayer <= 0 || controller.LargeObjectLayer >= len(controller.Layers) {
+		return 0
+	}
+
+	large := false
+	if length, known := expectedBodyLength(response); known {
+		large = length > controller.LargeObjectThreshold
+	} else if response.Request != nil {
+		distribution := controller.getSizeTracker().distribution(controller.getPathPattern(response.Request))
+		large = distribution.Samples >= largeObjectMinSamples && distribution.Percentile(0.5) > controller.LargeObjectThreshold
+	}
+
+	if !large {
+		return 0
+	}
+
+	controller.incrMetric(MetricCacheLargeObject, 1, nil)
+
+	return controller.LargeObjectLayer
+}
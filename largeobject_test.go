@@ -0,0 +1,105 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dylandreimerink/sharedhttpcache/layer"
+)
+
+func TestLargeObjectLayer(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+
+		if req.URL.Path == "/large.bin" {
+			_, _ = rw.Write([]byte(strings.Repeat("a", 1000)))
+			return
+		}
+
+		_, _ = rw.Write([]byte("small"))
+	}))
+	defer closeOrigin()
+
+	memoryLayer := layer.NewInMemoryCacheLayer(1024 * 1024)
+	largeLayer := layer.NewInMemoryCacheLayer(1024 * 1024)
+	controller.Layers = []layer.CacheLayer{memoryLayer, largeLayer}
+	controller.LargeObjectThreshold = 100
+	controller.LargeObjectLayer = 1
+
+	_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/large.bin", nil))
+	if len(body) != 1000 {
+		t.Fatalf("expected a body of 1000 bytes, got %d", len(body))
+	}
+
+	memoryUsed, _ := memoryLayer.Size()
+	largeUsed, _ := largeLayer.Size()
+	if memoryUsed >= 1000 || largeUsed < 1000 {
+		t.Errorf("expected the body to be stored in the large object layer only, memory layer uses %d bytes, large layer %d", memoryUsed, largeUsed)
+	}
+
+	response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/large.bin", nil))
+	if len(body) != 1000 || response.Header.Get("Age") == "" {
+		t.Errorf("expected the large object to be served from the cache")
+	}
+
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/small.txt", nil))
+	if used, _ := memoryLayer.Size(); used-memoryUsed < int64(len("small")) {
+		t.Errorf("expected the small object to be stored in the memory layer")
+	}
+
+	distribution := controller.ResponseSizes()[host+"/*.bin"]
+	if distribution.Samples != 1 || distribution.Max != 1000 {
+		t.Errorf("expected the size of the large object to be tracked, got %+v", distribution)
+	}
+}
+
+func TestLargeObjectUnknownLength(t *testing.T) {
+	controller := &CacheController{
+		Layers:               []layer.CacheLayer{layer.NewInMemoryCacheLayer(1024), layer.NewInMemoryCacheLayer(1024)},
+		LargeObjectThreshold: 100,
+		LargeObjectLayer:     1,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/videos/clip.mp4", nil)
+	response := &http.Response{StatusCode: http.StatusOK, ContentLength: -1, Request: req}
+
+	for i := 0; i < largeObjectMinSamples-1; i++ {
+		controller.recordResponseSize(response, 5000)
+	}
+
+	if layerIndex := controller.firstStorageLayer(response); layerIndex != 0 {
+		t.Errorf("expected the first layer before enough samples are recorded, got %d", layerIndex)
+	}
+
+	controller.recordResponseSize(response, 5000)
+
+	if layerIndex := controller.firstStorageLayer(response); layerIndex != 1 {
+		t.Errorf("expected the large object layer based on the size distribution, got %d", layerIndex)
+	}
+
+	other := &http.Response{StatusCode: http.StatusOK, ContentLength: -1, Request: httptest.NewRequest(http.MethodGet, "http://example.com/videos/index.html", nil)}
+	if layerIndex := controller.firstStorageLayer(other); layerIndex != 0 {
+		t.Errorf("expected the first layer for a pattern without samples, got %d", layerIndex)
+	}
+}
+
+func TestSizeDistributionPercentile(t *testing.T) {
+	distribution := SizeDistribution{}
+	for _, size := range []int64{10, 20, 30, 5000} {
+		distribution.record(size)
+	}
+
+	if median := distribution.Percentile(0.5); median < 20 || median > 31 {
+		t.Errorf("expected a median between 20 and 31, got %d", median)
+	}
+
+	if p100 := distribution.Percentile(1); p100 != 5000 {
+		t.Errorf("expected the maximum as 100th percentile, got %d", p100)
+	}
+
+	if mean := distribution.Mean(); mean != 1265 {
+		t.Errorf("expected mean 1265, got %d", mean)
+	}
+}
@@ -0,0 +1,344 @@
+package layer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//diskTempPrefix is the prefix of files which are still being written, they are ignored and removed on startup
+const diskTempPrefix = "tmp-"
+
+//The DiskCacheLayer stores responses as files in a directory.
+// Every entry is stored in its own file named after the hash of the key. The file starts with the key so the index
+// can be rebuilt when the layer is created, the modification time of the file is used as expiration time.
+//
+// Get returns the *os.File of the entry, positioned after the key, so the http server can serve it with sendfile
+type DiskCacheLayer struct {
+	//Directory is the directory in which the entries are stored
+	Directory string
+
+	//Maximum size of the cache in bytes
+	MaxSize int64
+
+	entries      map[string]diskCacheEntry
+	entriesMutex sync.RWMutex
+
+	currentSize int64
+
+	evictionHandler func(key string, size int)
+}
+
+type diskCacheEntry struct {
+	fileName   string
+	size       int64
+	expiration time.Time
+}
+
+//NewDiskCacheLayer creates a disk layer which stores entries in the given directory.
+// The directory is created if it doesn't exist. Entries which are already in the directory are loaded
+func NewDiskCacheLayer(directory string, maxSize int64) (*DiskCacheLayer, error) {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	layer := &DiskCacheLayer{
+		Directory: directory,
+		MaxSize:   maxSize,
+		entries:   make(map[string]diskCacheEntry),
+	}
+
+	err = layer.loadEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	return layer, nil
+}
+
+//loadEntries rebuilds the index from the files in the directory
+func (layer *DiskCacheLayer) loadEntries() error {
+	files, err := ioutil.ReadDir(layer.Directory)
+	if err != nil {
+		return err
+	}
+
+	for _, fileInfo := range files {
+		if fileInfo.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(layer.Directory, fileInfo.Name())
+
+		//A temporary file is left behind if the process stopped while writing a entry
+		if strings.HasPrefix(fileInfo.Name(), diskTempPrefix) {
+			os.Remove(path)
+			continue
+		}
+
+		key, err := readDiskEntryKey(path)
+		if err != nil || diskFileName(key) != fileInfo.Name() {
+			//Not a valid entry, remove it so it doesn't take up space
+			os.Remove(path)
+			continue
+		}
+
+		size := fileInfo.Size() - diskEntryHeaderSize(key)
+
+		layer.entries[key] = diskCacheEntry{
+			fileName:   fileInfo.Name(),
+			size:       size,
+			expiration: fileInfo.ModTime(),
+		}
+		layer.currentSize += size
+	}
+
+	return nil
+}
+
+func (layer *DiskCacheLayer) Get(key string) (io.ReadCloser, time.Duration, error) {
+	layer.entriesMutex.RLock()
+	entry, found := layer.entries[key]
+	layer.entriesMutex.RUnlock()
+
+	if !found {
+		return nil, 0, nil
+	}
+
+	file, err := os.Open(filepath.Join(layer.Directory, entry.fileName))
+	if err != nil {
+		//The entry may have been deleted between the index lookup and opening the file
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+
+		return nil, 0, err
+	}
+
+	//Skip the key at the start of the file, the file offset is respected by sendfile
+	_, err = file.Seek(diskEntryHeaderSize(key), io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, time.Until(entry.expiration), nil
+}
+
+func (layer *DiskCacheLayer) Set(key string, entry io.ReadCloser, ttl time.Duration) error {
+	defer entry.Close()
+
+	tempFile, err := ioutil.TempFile(layer.Directory, diskTempPrefix)
+	if err != nil {
+		return err
+	}
+
+	//Removing the temp file fails once it has been renamed, which is fine
+	defer os.Remove(tempFile.Name())
+
+	//At most one byte more than the maximum size is read, that is enough to know the entry doesn't fit
+	size, err := writeDiskEntry(tempFile, key, io.LimitReader(entry, layer.MaxSize+1))
+	closeErr := tempFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	//The entry can never fit, evicting other entries to make room would only empty the cache
+	if size > layer.MaxSize {
+		return ErrEntryTooLarge
+	}
+
+	expiration := time.Now().Add(ttl)
+	err = os.Chtimes(tempFile.Name(), expiration, expiration)
+	if err != nil {
+		return err
+	}
+
+	layer.entriesMutex.Lock()
+	defer layer.entriesMutex.Unlock()
+
+	//Delete the existing entry first so the current size is correct
+	layer.delete(key)
+
+	neededSize := size - (layer.MaxSize - layer.currentSize)
+	if neededSize > 0 {
+		err = layer.replaceCache(neededSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	fileName := diskFileName(key)
+
+	//Renaming is atomic, readers which still have the old file open keep reading the old entry
+	err = os.Rename(tempFile.Name(), filepath.Join(layer.Directory, fileName))
+	if err != nil {
+		return err
+	}
+
+	layer.entries[key] = diskCacheEntry{
+		fileName:   fileName,
+		size:       size,
+		expiration: expiration,
+	}
+	layer.currentSize += size
+
+	return nil
+}
+
+func (layer *DiskCacheLayer) Refresh(key string, ttl time.Duration) error {
+	layer.entriesMutex.Lock()
+	defer layer.entriesMutex.Unlock()
+
+	entry, found := layer.entries[key]
+	if !found {
+		return ErrNotFound
+	}
+
+	entry.expiration = time.Now().Add(ttl)
+
+	err := os.Chtimes(filepath.Join(layer.Directory, entry.fileName), entry.expiration, entry.expiration)
+	if err != nil {
+		return err
+	}
+
+	layer.entries[key] = entry
+
+	return nil
+}
+
+func (layer *DiskCacheLayer) Delete(key string) error {
+	layer.entriesMutex.Lock()
+	layer.delete(key)
+	layer.entriesMutex.Unlock()
+	return nil
+}
+
+//SetEvictionHandler sets a function which is called for every entry which is evicted to make room for new entries
+func (layer *DiskCacheLayer) SetEvictionHandler(handler func(key string, size int)) {
+	layer.entriesMutex.Lock()
+	layer.evictionHandler = handler
+	layer.entriesMutex.Unlock()
+}
+
+//Size returns the amount of bytes stored and the maximum size of the layer
+func (layer *DiskCacheLayer) Size() (int64, int64) {
+	layer.entriesMutex.RLock()
+	defer layer.entriesMutex.RUnlock()
+
+	return layer.currentSize, layer.MaxSize
+}
+
+//WARNING call this function only when the layer is already write locked
+func (layer *DiskCacheLayer) replaceCache(neededSize int64) error {
+
+	//Remove stale entries first
+	now := time.Now()
+	for key, entry := range layer.entries {
+		if entry.expiration.After(now) {
+			continue
+		}
+
+		neededSize -= layer.evict(key)
+		if neededSize <= 0 {
+			return nil
+		}
+	}
+
+	//If we still need room start removing fresh entries
+	for key := range layer.entries {
+		neededSize -= layer.evict(key)
+		if neededSize <= 0 {
+			return nil
+		}
+	}
+
+	return errors.New("Can't make enough room")
+}
+
+//WARNING call this function only when the layer is already write locked
+func (layer *DiskCacheLayer) evict(key string) int64 {
+	size := layer.delete(key)
+
+	if layer.evictionHandler != nil && size > 0 {
+		layer.evictionHandler(key, int(size))
+	}
+
+	return size
+}
+
+//WARNING call this function only when the layer is already write locked
+func (layer *DiskCacheLayer) delete(key string) int64 {
+	entry, found := layer.entries[key]
+	if !found {
+		return 0
+	}
+
+	delete(layer.entries, key)
+	layer.currentSize -= entry.size
+
+	//Open readers keep reading the removed file
+	os.Remove(filepath.Join(layer.Directory, entry.fileName))
+
+	return entry.size
+}
+
+//diskFileName returns the name of the file in which the entry with the given key is stored
+func diskFileName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+//diskEntryHeaderSize returns the size of the key header at the start of a entry file
+func diskEntryHeaderSize(key string) int64 {
+	return 4 + int64(len(key))
+}
+
+//writeDiskEntry writes the key header and the entry to the file and returns the size of the entry, without the header
+func writeDiskEntry(file *os.File, key string, entry io.Reader) (int64, error) {
+	header := make([]byte, diskEntryHeaderSize(key))
+	binary.BigEndian.PutUint32(header, uint32(len(key)))
+	copy(header[4:], key)
+
+	_, err := file.Write(header)
+	if err != nil {
+		return 0, err
+	}
+
+	return io.Copy(file, entry)
+}
+
+//readDiskEntryKey reads the key from the header of a entry file
+func readDiskEntryKey(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	lengthBytes := make([]byte, 4)
+	_, err = io.ReadFull(file, lengthBytes)
+	if err != nil {
+		return "", err
+	}
+
+	keyBytes := make([]byte, binary.BigEndian.Uint32(lengthBytes))
+	_, err = io.ReadFull(file, keyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return string(keyBytes), nil
+}
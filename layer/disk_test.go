@@ -0,0 +1,114 @@
+package layer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDiskLayer(t *testing.T, maxSize int64) (*DiskCacheLayer, func()) {
+	directory, err := ioutil.TempDir("", "sharedhttpcache-disk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := NewDiskCacheLayer(directory, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return layer, func() { os.RemoveAll(directory) }
+}
+
+func TestDiskCacheLayer_SetGet(t *testing.T) {
+	layer, cleanup := newTestDiskLayer(t, 1024)
+	defer cleanup()
+
+	if err := layer.Set("key1", ioutil.NopCloser(strings.NewReader("Content")), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, ttl, err := layer.Get("key1")
+	if err != nil || reader == nil {
+		t.Fatalf("Expected entry, got reader: %v, err: %v", reader, err)
+	}
+	defer reader.Close()
+
+	if _, ok := reader.(*os.File); !ok {
+		t.Errorf("Expected the reader to be a *os.File, got: %T", reader)
+	}
+
+	if !(ttl > 59*time.Second && ttl <= time.Minute) {
+		t.Errorf("Expected ttl of 1 minute, got: %v", ttl)
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "Content" {
+		t.Errorf("Content of key is not equal, expected: Content, got %s", content)
+	}
+
+	reader, _, err = layer.Get("key2")
+	if reader != nil || err != nil {
+		t.Errorf("Expected no entry for unknown key, got reader: %v, err: %v", reader, err)
+	}
+}
+
+func TestDiskCacheLayer_Reload(t *testing.T) {
+	layer, cleanup := newTestDiskLayer(t, 1024)
+	defer cleanup()
+
+	if err := layer.Set("key1", ioutil.NopCloser(strings.NewReader("Content")), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewDiskCacheLayer(layer.Directory, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, ttl, err := reloaded.Get("key1")
+	if err != nil || reader == nil {
+		t.Fatalf("Expected entry after reload, got reader: %v, err: %v", reader, err)
+	}
+	defer reader.Close()
+
+	if ttl <= 0 {
+		t.Errorf("Expected entry to still be fresh after reload, got ttl: %v", ttl)
+	}
+
+	if used, _ := reloaded.Size(); used != int64(len("Content")) {
+		t.Errorf("Expected size %d after reload, got: %d", len("Content"), used)
+	}
+}
+
+func TestDiskCacheLayer_Evict(t *testing.T) {
+	layer, cleanup := newTestDiskLayer(t, 10)
+	defer cleanup()
+
+	evicted := []string{}
+	layer.SetEvictionHandler(func(key string, size int) {
+		evicted = append(evicted, key)
+	})
+
+	if err := layer.Set("key1", ioutil.NopCloser(strings.NewReader("Content")), -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := layer.Set("key2", ioutil.NopCloser(strings.NewReader("Content")), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(evicted) != 1 || evicted[0] != "key1" {
+		t.Errorf("Expected key1 to be evicted, got: %v", evicted)
+	}
+
+	if err := layer.Refresh("key1", time.Minute); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound when refreshing evicted key, got: %v", err)
+	}
+}
@@ -3,7 +3,6 @@ package layer
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"sync"
@@ -16,25 +15,51 @@ type InMemoryCacheLayer struct {
 	//Maximum size of the cache in bytes
 	MaxSize int
 
+	//MaxHeapSize is the maximum estimated heap usage of the cache in bytes, including the keys and the overhead of the index.
+	// MaxSize only counts the bytes of the entries, which underestimates the heap usage of many small entries.
+	// Zero means the heap usage is not limited, see HeapSize and ResizeToMemory
+	MaxHeapSize int
+
 	entityStore      map[string]inMemoryCacheEntity
 	entityStoreMutex sync.RWMutex
 
 	currentSize int
+	currentHeap int
+
+	evictionHandler func(key string, size int)
 
-	staleKeys      map[string]bool
-	staleKeysMutex sync.Mutex
+	locks      map[string]inMemoryLock
+	lockTokens uint64
+	locksMutex sync.Mutex
+}
+
+//inMemoryLock is a lock acquired with TryLock, the token identifies the holder so a expired lock can't release the lock of the next holder
+type inMemoryLock struct {
+	token      uint64
+	expiration time.Time
 }
 
 type inMemoryCacheEntity struct {
 	Data       []byte
 	Expiration time.Time
+
+	//heapSize is the estimated amount of heap used by the entity, see entityHeapSize
+	heapSize int
+}
+
+//inMemoryEntryOverhead is the estimated amount of heap used by the index for every entry, besides the key and data.
+// It is the size of the key and value in the map plus the unused room of the map buckets
+const inMemoryEntryOverhead = 96
+
+//entityHeapSize estimates the amount of heap used by a entry
+func entityHeapSize(key string, data []byte) int {
+	return len(key) + cap(data) + inMemoryEntryOverhead
 }
 
 func NewInMemoryCacheLayer(maxSize int) *InMemoryCacheLayer {
 	return &InMemoryCacheLayer{
 		MaxSize:     maxSize,
 		entityStore: make(map[string]inMemoryCacheEntity, 500),
-		staleKeys:   make(map[string]bool, 100),
 	}
 }
 
@@ -42,37 +67,50 @@ func (layer *InMemoryCacheLayer) Get(key string) (io.ReadCloser, time.Duration,
 	layer.entityStoreMutex.RLock()
 	defer layer.entityStoreMutex.RUnlock()
 
+	//Get only reads, stale entries are found by replaceCache when room is needed
 	if entity, found := layer.entityStore[key]; found {
-		ttl := time.Until(entity.Expiration)
-
-		//If entry is stale
-		if ttl <= 0 {
-			layer.staleKeysMutex.Lock()
-			layer.staleKeys[key] = true
-			layer.staleKeysMutex.Unlock()
-		}
-
-		return ioutil.NopCloser(bytes.NewReader(entity.Data)), ttl, nil
+		return ioutil.NopCloser(bytes.NewReader(entity.Data)), time.Until(entity.Expiration), nil
 	}
 
 	return nil, 0, nil
 }
 
 func (layer *InMemoryCacheLayer) Set(key string, entry io.ReadCloser, ttl time.Duration) error {
-	entryBytes, err := ioutil.ReadAll(entry)
+	//At most one byte more than the maximum size is read, that is enough to know the entry doesn't fit
+	entryBytes, err := ioutil.ReadAll(io.LimitReader(entry, int64(layer.MaxSize)+1))
 	defer entry.Close()
 
 	if err != nil {
 		return err
 	}
 
+	//ReadAll grows the buffer by doubling it, the unused capacity would be kept in memory as long as the entry
+	if cap(entryBytes)-len(entryBytes) > len(entryBytes)/8 {
+		entryBytes = append([]byte(nil), entryBytes...)
+	}
+
+	heapSize := entityHeapSize(key, entryBytes)
+
 	layer.entityStoreMutex.Lock()
 	defer layer.entityStoreMutex.Unlock()
 
-	availableRoom := (layer.MaxSize - layer.currentSize)
-	//If the entry is bigger than the max size we have to make room
-	if len(entryBytes) > availableRoom {
-		err := layer.replaceCache(availableRoom - len(entryBytes))
+	//The entry can never fit, evicting other entries to make room would only empty the cache
+	if len(entryBytes) > layer.MaxSize || (layer.MaxHeapSize > 0 && heapSize > layer.MaxHeapSize) {
+		return ErrEntryTooLarge
+	}
+
+	//Delete the existing entry first so the room it takes up can be reused
+	layer.delete(key)
+
+	//If the entry is bigger than the available room we have to make room
+	neededSize := len(entryBytes) - (layer.MaxSize - layer.currentSize)
+	neededHeap := 0
+	if layer.MaxHeapSize > 0 {
+		neededHeap = heapSize - (layer.MaxHeapSize - layer.currentHeap)
+	}
+
+	if neededSize > 0 || neededHeap > 0 {
+		err := layer.replaceCache(neededSize, neededHeap)
 		if err != nil {
 			return err
 		}
@@ -81,6 +119,7 @@ func (layer *InMemoryCacheLayer) Set(key string, entry io.ReadCloser, ttl time.D
 	return layer.set(key, inMemoryCacheEntity{
 		Data:       entryBytes,
 		Expiration: time.Now().Add(ttl),
+		heapSize:   heapSize,
 	})
 }
 
@@ -95,39 +134,120 @@ func (layer *InMemoryCacheLayer) Refresh(key string, ttl time.Duration) error {
 	layer.entityStoreMutex.Lock()
 	defer layer.entityStoreMutex.Unlock()
 
-	if entity, found := layer.entityStore[key]; found {
-		entity.Expiration = time.Now().Add(ttl)
-		layer.entityStore[key] = entity
+	entity, found := layer.entityStore[key]
+	if !found {
+		return ErrNotFound
+	}
+
+	entity.Expiration = time.Now().Add(ttl)
+	layer.entityStore[key] = entity
+
+	return nil
+}
+
+//SetEvictionHandler sets a function which is called for every entry which is evicted to make room for new entries
+func (layer *InMemoryCacheLayer) SetEvictionHandler(handler func(key string, size int)) {
+	layer.entityStoreMutex.Lock()
+	layer.evictionHandler = handler
+	layer.entityStoreMutex.Unlock()
+}
+
+//Size returns the amount of bytes stored and the maximum size of the layer
+func (layer *InMemoryCacheLayer) Size() (int64, int64) {
+	layer.entityStoreMutex.RLock()
+	defer layer.entityStoreMutex.RUnlock()
+
+	return int64(layer.currentSize), int64(layer.MaxSize)
+}
+
+//HeapSize returns the estimated amount of heap used by the entries, including the keys and the overhead of the index,
+// and the MaxHeapSize of the layer
+func (layer *InMemoryCacheLayer) HeapSize() (int64, int64) {
+	layer.entityStoreMutex.RLock()
+	defer layer.entityStoreMutex.RUnlock()
+
+	return int64(layer.currentHeap), int64(layer.MaxHeapSize)
+}
+
+//SetMaxHeapSize changes the MaxHeapSize of the layer, entries are evicted if the layer uses more than the new maximum
+func (layer *InMemoryCacheLayer) SetMaxHeapSize(maxHeapSize int) {
+	layer.entityStoreMutex.Lock()
+	defer layer.entityStoreMutex.Unlock()
+
+	layer.MaxHeapSize = maxHeapSize
+
+	if neededHeap := layer.currentHeap - maxHeapSize; maxHeapSize > 0 && neededHeap > 0 {
+		//The layer can always be emptied, so the error can be ignored
+		_ = layer.replaceCache(0, neededHeap)
+	}
+}
+
+//TryLock acquires a lock which is only shared by users of this layer, so it coordinates requests within a single instance
+func (layer *InMemoryCacheLayer) TryLock(key string, ttl time.Duration) (func() error, bool, error) {
+	layer.locksMutex.Lock()
+	defer layer.locksMutex.Unlock()
+
+	if layer.locks == nil {
+		layer.locks = make(map[string]inMemoryLock)
+	}
+
+	now := time.Now()
+	if lock, found := layer.locks[key]; found && lock.expiration.After(now) {
+		return nil, false, nil
+	}
+
+	layer.lockTokens++
+	token := layer.lockTokens
+
+	layer.locks[key] = inMemoryLock{
+		token:      token,
+		expiration: now.Add(ttl),
+	}
+
+	unlock := func() error {
+		layer.locksMutex.Lock()
+		defer layer.locksMutex.Unlock()
+
+		if lock, found := layer.locks[key]; found && lock.token == token {
+			delete(layer.locks, key)
+		}
+
 		return nil
 	}
 
-	return fmt.Errorf("Entity with key '%s' doesn't exist", key)
+	return unlock, true, nil
 }
 
+//replaceCache evicts entries until neededSize bytes of data and neededHeap bytes of heap are freed
 //WARNING call this function only when the layer is already write locked
-func (layer *InMemoryCacheLayer) replaceCache(neededSize int) error {
-
-	//Loop over all known stale keys and remove them until we have room or there are no more stale keys
-	layer.staleKeysMutex.Lock()
-	for key := range layer.staleKeys {
-		neededSize -= layer.delete(key)
+func (layer *InMemoryCacheLayer) replaceCache(neededSize, neededHeap int) error {
+
+	//Remove stale entries first until we have room or there are no more stale entries
+	// Staleness is determined here, under the write lock, so reads never have to modify the layer
+	now := time.Now()
+	for key, entity := range layer.entityStore {
+		if entity.Expiration.After(now) {
+			continue
+		}
 
-		delete(layer.staleKeys, key)
+		size, heapSize := layer.evict(key)
+		neededSize -= size
+		neededHeap -= heapSize
 
 		//If we have enough space we return
-		if neededSize <= 0 {
-			layer.staleKeysMutex.Unlock()
+		if neededSize <= 0 && neededHeap <= 0 {
 			return nil
 		}
 	}
-	layer.staleKeysMutex.Unlock()
 
 	//If we still need room and there are no stale keys start removing fresh entries
 	for key := range layer.entityStore {
-		neededSize -= layer.delete(key)
+		size, heapSize := layer.evict(key)
+		neededSize -= size
+		neededHeap -= heapSize
 
 		//If we have enough space we return
-		if neededSize <= 0 {
+		if neededSize <= 0 && neededHeap <= 0 {
 			return nil
 		}
 	}
@@ -135,18 +255,32 @@ func (layer *InMemoryCacheLayer) replaceCache(neededSize int) error {
 	return errors.New("Can't make enough room")
 }
 
-func (layer *InMemoryCacheLayer) delete(key string) int {
+//evict deletes a entry to make room and reports it to the eviction handler
+//WARNING call this function only when the layer is already write locked
+func (layer *InMemoryCacheLayer) evict(key string) (int, int) {
+	size, heapSize := layer.delete(key)
+
+	if layer.evictionHandler != nil && size > 0 {
+		layer.evictionHandler(key, size)
+	}
+
+	return size, heapSize
+}
+
+//delete removes a entry and returns the size of its data and its estimated heap usage
+func (layer *InMemoryCacheLayer) delete(key string) (int, int) {
 	if entry, found := layer.entityStore[key]; found {
 		size := len(entry.Data)
 
 		delete(layer.entityStore, key)
 
 		layer.currentSize -= size
+		layer.currentHeap -= entry.heapSize
 
-		return size
+		return size, entry.heapSize
 	}
 
-	return 0
+	return 0, 0
 }
 
 func (layer *InMemoryCacheLayer) set(key string, entry inMemoryCacheEntity) error {
@@ -154,6 +288,7 @@ func (layer *InMemoryCacheLayer) set(key string, entry inMemoryCacheEntity) erro
 	layer.delete(key)
 
 	layer.currentSize += len(entry.Data)
+	layer.currentHeap += entry.heapSize
 	layer.entityStore[key] = entry
 
 	return nil
@@ -1,9 +1,12 @@
 package layer
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -212,3 +215,234 @@ func TestInMemoryCacheLayer_Set(t *testing.T) {
 		return
 	}
 }
+
+func TestInMemoryCacheLayer_EvictionHandler(t *testing.T) {
+	layer := NewInMemoryCacheLayer(10)
+
+	evicted := map[string]int{}
+	layer.SetEvictionHandler(func(key string, size int) {
+		evicted[key] = size
+	})
+
+	if err := layer.Set("key1", ioutil.NopCloser(strings.NewReader("Content")), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := layer.Set("key2", ioutil.NopCloser(strings.NewReader("Content")), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(evicted, map[string]int{"key1": 7}) {
+		t.Errorf("Evicted entries not as expected, expected: %v, got %v", map[string]int{"key1": 7}, evicted)
+	}
+}
+
+func TestInMemoryCacheLayer_EntryTooLarge(t *testing.T) {
+	layer := NewInMemoryCacheLayer(10)
+
+	if err := layer.Set("key1", ioutil.NopCloser(strings.NewReader("Content")), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	err := layer.Set("key2", ioutil.NopCloser(strings.NewReader("Content which doesn't fit")), time.Minute)
+	if err != ErrEntryTooLarge {
+		t.Errorf("Expected ErrEntryTooLarge, got: %v", err)
+	}
+
+	//Rejecting a entry must not evict other entries
+	if reader, _, _ := layer.Get("key1"); reader == nil {
+		t.Error("Expected key1 to still be stored")
+	}
+
+	if used, _ := layer.Size(); used != 7 {
+		t.Errorf("Expected 7 bytes to be used, got %d", used)
+	}
+}
+
+func TestInMemoryCacheLayer_RefreshStale(t *testing.T) {
+	layer := NewInMemoryCacheLayer(14)
+
+	if err := layer.Refresh("missing", time.Minute); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+
+	if err := layer.Set("key1", ioutil.NopCloser(strings.NewReader("Content")), -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ttl, _ := layer.Get("key1"); ttl > 0 {
+		t.Fatal("Expected key1 to be stale")
+	}
+
+	if err := layer.Refresh("key1", time.Minute); err != nil {
+		t.Fatalf("Error while refreshing key: %s", err)
+	}
+
+	if err := layer.Set("key2", ioutil.NopCloser(strings.NewReader("Content")), -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ttl, _ := layer.Get("key2"); ttl > 0 {
+		t.Fatal("Expected key2 to be stale")
+	}
+
+	//The refreshed entry is fresh again, so the stale key2 has to be evicted to make room for key3
+	if err := layer.Set("key3", ioutil.NopCloser(strings.NewReader("Content")), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if reader, _, _ := layer.Get("key1"); reader == nil {
+		t.Error("Expected the refreshed key1 to be kept")
+	}
+
+	if reader, _, _ := layer.Get("key2"); reader != nil {
+		t.Error("Expected the stale key2 to be evicted")
+	}
+}
+
+//TestInMemoryCacheLayer_Concurrent uses the layer from multiple goroutines, run with -race to detect data races
+func TestInMemoryCacheLayer_Concurrent(t *testing.T) {
+	layer := NewInMemoryCacheLayer(100)
+
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key%d", i%10)
+
+				//Half of the entries are stale, so reads and evictions of stale entries happen concurrently
+				ttl := time.Minute
+				if i%2 == 0 {
+					ttl = -time.Minute
+				}
+
+				switch (worker + i) % 4 {
+				case 0:
+					_ = layer.Set(key, ioutil.NopCloser(strings.NewReader("Content")), ttl)
+				case 1:
+					if reader, _, _ := layer.Get(key); reader != nil {
+						_, _ = ioutil.ReadAll(reader)
+					}
+				case 2:
+					_ = layer.Refresh(key, ttl)
+				case 3:
+					_ = layer.Delete(key)
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+
+	if used, capacity := layer.Size(); used > capacity {
+		t.Errorf("Expected the used size %d to be within the capacity %d", used, capacity)
+	}
+}
+
+func TestInMemoryCacheLayer_TryLock(t *testing.T) {
+	layer := NewInMemoryCacheLayer(100)
+
+	unlock, acquired, err := layer.TryLock("key", time.Minute)
+	if err != nil || !acquired {
+		t.Fatalf("Expected lock to be acquired, err: %v", err)
+	}
+
+	if _, acquired, _ := layer.TryLock("key", time.Minute); acquired {
+		t.Error("Expected held lock not to be acquired again")
+	}
+
+	if err := unlock(); err != nil {
+		t.Error(err)
+	}
+
+	expiredUnlock, acquired, _ := layer.TryLock("key", -time.Second)
+	if !acquired {
+		t.Fatal("Expected released lock to be acquired")
+	}
+
+	//The lock expired, so it can be acquired by the next holder which can't be released by the previous holder
+	_, acquired, _ = layer.TryLock("key", time.Minute)
+	if !acquired {
+		t.Fatal("Expected expired lock to be acquired")
+	}
+
+	_ = expiredUnlock()
+
+	if _, acquired, _ := layer.TryLock("key", time.Minute); acquired {
+		t.Error("Expected the lock not to be released by the previous holder")
+	}
+}
+
+func TestInMemoryCacheLayer_HeapSize(t *testing.T) {
+	layer := NewInMemoryCacheLayer(1024)
+
+	if err := layer.Set("key1", ioutil.NopCloser(strings.NewReader("Content")), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	//The capacity of the data can be rounded up to the size class of the allocation
+	expected, _ := layer.HeapSize()
+	if minimum := int64(len("key1") + len("Content") + inMemoryEntryOverhead); expected < minimum || expected > minimum+8 {
+		t.Errorf("Expected a heap size of about %d, got %d", minimum, expected)
+	}
+
+	//The heap limit is reached before the size limit, since every entry has overhead
+	layer.SetMaxHeapSize(int(expected) * 2)
+
+	for i := 2; i <= 4; i++ {
+		if err := layer.Set(fmt.Sprintf("key%d", i), ioutil.NopCloser(strings.NewReader("Content")), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if used, capacity := layer.HeapSize(); used > capacity {
+		t.Errorf("Expected the heap size %d to be within the maximum %d", used, capacity)
+	}
+
+	if used, _ := layer.Size(); used != 2*int64(len("Content")) {
+		t.Errorf("Expected two entries to be stored, got %d bytes", used)
+	}
+
+	//Lowering the maximum evicts entries
+	layer.SetMaxHeapSize(int(expected))
+
+	if used, _ := layer.HeapSize(); used != expected {
+		t.Errorf("Expected a heap size of %d after shrinking, got %d", expected, used)
+	}
+
+	if err := layer.Set("large", ioutil.NopCloser(strings.NewReader("Content which doesn't fit")), time.Minute); err != ErrEntryTooLarge {
+		t.Errorf("Expected ErrEntryTooLarge, got: %v", err)
+	}
+
+	//Entries are evicted in no particular order, so all keys are deleted
+	for i := 1; i <= 4; i++ {
+		layer.Delete(fmt.Sprintf("key%d", i))
+	}
+
+	if used, _ := layer.HeapSize(); used != 0 {
+		t.Errorf("Expected no heap to be used after deleting the last entry, got %d", used)
+	}
+}
+
+func TestReadMemTotal(t *testing.T) {
+	file, err := ioutil.TempFile("", "meminfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, _ = file.WriteString("MemTotal:       16318412 kB\nMemFree:         1141232 kB\n")
+	file.Close()
+
+	total, err := readMemTotal(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != 16318412*1024 {
+		t.Errorf("Expected %d bytes, got %d", 16318412*1024, total)
+	}
+}
@@ -1,10 +1,19 @@
 package layer
 
 import (
+	"errors"
 	"io"
 	"time"
 )
 
+//ErrEntryTooLarge is returned by Set if a entry is larger than the capacity of the layer
+// The entry can then be stored in a other layer
+var ErrEntryTooLarge = errors.New("entry is larger than the capacity of the layer")
+
+//ErrNotFound is returned by Refresh if the layer doesn't contain a entry with the given key
+// This is expected since a entry doesn't have to be stored in every layer
+var ErrNotFound = errors.New("entry not found")
+
 //A CacheLayer stores and retrives cached responses.
 // The cache may delete a entry at any point which is required by some cache replacement policies
 // The TTL of a cached entry is a guide which can be used by the cache replacement policy
@@ -17,14 +26,46 @@ type CacheLayer interface {
 	// If there is no response with that key nil should be returned
 	// If there is a response the response and the TTL should be returned
 	// Error should only be returned in case of a error while getting the data like a connection error to a storage backend
+	//
+	// Layers which store entries in files should return the *os.File positioned at the start of the entry,
+	// response bodies are passed to the http server as is so it can serve them with sendfile
 	Get(key string) (io.ReadCloser, time.Duration, error)
 
 	//Set a new cache entry. if a key is already in use it should be overwritten.
+	// A error should be returned if the entry is not stored, for example ErrEntryTooLarge,
+	// the entry is then stored in the next layer instead
 	Set(key string, entry io.ReadCloser, ttl time.Duration) error
 
 	//Update the ttl of a existing cache entry
+	// ErrNotFound should be returned if there is no entry with the key, any other error means the refresh failed
 	Refresh(key string, ttl time.Duration) error
 
 	//Delete a cache entry with the given key
 	Delete(key string) error
 }
+
+//An EvictionReporter is a CacheLayer which can report entries it evicted to make room for new entries
+type EvictionReporter interface {
+
+	//SetEvictionHandler sets a function which is called with the key and size in bytes of every evicted entry
+	// The handler is called synchronously so it should return quickly
+	SetEvictionHandler(handler func(key string, size int))
+}
+
+//A Locker provides locks which are shared by all cache instances using the same storage backend
+// The cache uses them so only one instance fetches a missing or stale response from the origin while the others wait or serve it stale
+type Locker interface {
+
+	//TryLock attempts to acquire the lock with the given key without blocking.
+	// The lock is released automatically after the ttl, so a instance which crashed can't hold it forever.
+	// If the lock is acquired a function is returned which releases it, releasing a lock which already expired does nothing
+	// Error should only be returned if it is unknown if the lock is acquired, like a connection error to a storage backend
+	TryLock(key string, ttl time.Duration) (unlock func() error, acquired bool, err error)
+}
+
+//A SizeReporter is a CacheLayer which can report how much of its capacity is in use
+type SizeReporter interface {
+
+	//Size returns the amount of bytes in use and the capacity of the layer in bytes
+	Size() (used int64, capacity int64)
+}
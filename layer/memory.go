@@ -0,0 +1,167 @@
+package layer
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ErrMemoryUnknown is returned by ResizeToMemory if the amount of memory available to the process can't be determined
+var ErrMemoryUnknown = errors.New("Unable to determine the available memory")
+
+//memoryLimitFiles are the files which contain the memory limit of the cgroup of the process, for cgroup v2 and v1
+var memoryLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+//memInfoFile contains the total amount of memory of the system
+var memInfoFile = "/proc/meminfo"
+
+//availableMemory returns the amount of memory the process can use, the lowest of the cgroup limit and the system memory
+func availableMemory() (int64, error) {
+	var available int64
+
+	for _, file := range memoryLimitFiles {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		//cgroup v2 uses "max" if there is no limit, cgroup v1 a very large number which is larger than the system memory
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil || limit <= 0 {
+			continue
+		}
+
+		if available == 0 || limit < available {
+			available = limit
+		}
+	}
+
+	if total, err := readMemTotal(memInfoFile); err == nil && (available == 0 || total < available) {
+		available = total
+	}
+
+	if available == 0 {
+		return 0, ErrMemoryUnknown
+	}
+
+	return available, nil
+}
+
+//readMemTotal reads the total system memory in bytes from a file in the format of /proc/meminfo
+func readMemTotal(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+
+		kilobytes, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return kilobytes * 1024, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, ErrMemoryUnknown
+}
+
+//gcHeadroom returns the factor by which the heap grows before it is collected, as configured with GOGC
+func gcHeadroom() float64 {
+	value := os.Getenv("GOGC")
+	if value == "off" {
+		return 1
+	}
+
+	percent, err := strconv.Atoi(value)
+	if err != nil || percent < 0 {
+		percent = 100
+	}
+
+	return 1 + float64(percent)/100
+}
+
+//ResizeToMemory sets the MaxHeapSize of the layer to the given fraction of the memory available to the process,
+// like 0.5 for half. The memory is the lowest of the cgroup memory limit and the system memory.
+//
+// The size is lowered if the rest of the process needs the memory, since the garbage collector lets the heap grow
+// to twice the live heap with the default GOGC the heap of the layer and the rest of the process is kept below
+// the available memory divided by that factor
+func (layer *InMemoryCacheLayer) ResizeToMemory(fraction float64) error {
+	available, err := availableMemory()
+	if err != nil {
+		return err
+	}
+
+	maxHeapSize := int64(fraction * float64(available))
+
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+
+	layerHeap, _ := layer.HeapSize()
+	otherHeap := int64(stats.HeapAlloc) - layerHeap
+	if otherHeap < 0 {
+		otherHeap = 0
+	}
+
+	if limit := int64(float64(available)/gcHeadroom()) - otherHeap; limit < maxHeapSize {
+		maxHeapSize = limit
+	}
+
+	//A MaxHeapSize of zero is unlimited, so the layer is limited to a single byte if no memory is left
+	if maxHeapSize < 1 {
+		maxHeapSize = 1
+	}
+
+	layer.SetMaxHeapSize(int(maxHeapSize))
+
+	return nil
+}
+
+//AutoResize calls ResizeToMemory now and every interval after that until stop is called,
+// so the layer shrinks when the rest of the process needs more memory and grows again when it is released
+func (layer *InMemoryCacheLayer) AutoResize(fraction float64, interval time.Duration) (stop func(), err error) {
+	if err := layer.ResizeToMemory(fraction); err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				//The available memory was determined before, so it can only fail if the files disappear
+				_ = layer.ResizeToMemory(fraction)
+
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}, nil
+}
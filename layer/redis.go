@@ -0,0 +1,252 @@
+package layer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//DefaultRedisTimeout is the timeout of connecting to and executing a command on a Redis server if the Timeout of a RedisLocker is zero
+const DefaultRedisTimeout = time.Second
+
+//maxIdleRedisConns is the maximum amount of connections a RedisLocker keeps open for reuse
+const maxIdleRedisConns = 8
+
+//redisUnlockScript deletes the lock only if it is still held with the token, so a lock which expired
+// and was acquired by a other instance isn't released
+const redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+//The RedisLocker is a Locker which stores locks in a Redis server, so they are shared by all cache instances using the same server
+// Locks are acquired with SET NX PX and released with a script which checks the token of the holder
+type RedisLocker struct {
+	//Address of the Redis server, like "127.0.0.1:6379"
+	Address string
+
+	//Password is sent with the AUTH command if not empty
+	Password string
+
+	//DB is the database which is selected if not zero
+	DB int
+
+	//Timeout of connecting and of every command, if zero DefaultRedisTimeout is used
+	Timeout time.Duration
+
+	idle      []*redisConn
+	idleMutex sync.Mutex
+}
+
+//redisConn is a connection to a Redis server with a buffered reader for replies
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+//redisError is a error reply of a Redis server
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+var errUnexpectedRedisReply = errors.New("redis: unexpected reply")
+
+//NewRedisLocker creates a RedisLocker which stores locks in the Redis server at the address
+func NewRedisLocker(address string) *RedisLocker {
+	return &RedisLocker{
+		Address: address,
+	}
+}
+
+//TryLock acquires the lock if no other instance holds it
+func (locker *RedisLocker) TryLock(key string, ttl time.Duration) (func() error, bool, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	//Redis doesn't accept a expiration of zero
+	milliseconds := int64(ttl / time.Millisecond)
+	if milliseconds < 1 {
+		milliseconds = 1
+	}
+
+	reply, err := locker.do("SET", key, token, "NX", "PX", strconv.FormatInt(milliseconds, 10))
+	if err != nil {
+		return nil, false, err
+	}
+
+	//A nil reply means the key already exists, so the lock is held by a other instance
+	if reply == nil {
+		return nil, false, nil
+	}
+
+	unlock := func() error {
+		_, err := locker.do("EVAL", redisUnlockScript, "1", key, token)
+		return err
+	}
+
+	return unlock, true, nil
+}
+
+//Close closes all idle connections
+func (locker *RedisLocker) Close() error {
+	locker.idleMutex.Lock()
+	defer locker.idleMutex.Unlock()
+
+	for _, conn := range locker.idle {
+		conn.Close()
+	}
+	locker.idle = nil
+
+	return nil
+}
+
+func (locker *RedisLocker) timeout() time.Duration {
+	if locker.Timeout > 0 {
+		return locker.Timeout
+	}
+
+	return DefaultRedisTimeout
+}
+
+//do executes a command and returns the reply, nil is returned for a nil reply
+func (locker *RedisLocker) do(args ...string) (interface{}, error) {
+	conn, err := locker.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(locker.timeout(), args...)
+	if err != nil {
+		//The state of the connection is unknown unless Redis replied with a error, so it can't be reused
+		if _, isRedisError := err.(redisError); !isRedisError {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	locker.putConn(conn)
+
+	return reply, err
+}
+
+func (locker *RedisLocker) getConn() (*redisConn, error) {
+	locker.idleMutex.Lock()
+	if len(locker.idle) > 0 {
+		conn := locker.idle[len(locker.idle)-1]
+		locker.idle = locker.idle[:len(locker.idle)-1]
+		locker.idleMutex.Unlock()
+
+		return conn, nil
+	}
+	locker.idleMutex.Unlock()
+
+	netConn, err := net.DialTimeout("tcp", locker.Address, locker.timeout())
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &redisConn{
+		Conn:   netConn,
+		reader: bufio.NewReader(netConn),
+	}
+
+	if locker.Password != "" {
+		if _, err := conn.do(locker.timeout(), "AUTH", locker.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if locker.DB != 0 {
+		if _, err := conn.do(locker.timeout(), "SELECT", strconv.Itoa(locker.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (locker *RedisLocker) putConn(conn *redisConn) {
+	locker.idleMutex.Lock()
+	defer locker.idleMutex.Unlock()
+
+	if len(locker.idle) >= maxIdleRedisConns {
+		conn.Close()
+		return
+	}
+
+	locker.idle = append(locker.idle, conn)
+}
+
+//do sends a command as a array of bulk strings and reads the reply
+func (conn *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return conn.readReply()
+}
+
+//readReply reads a simple string, error, integer or bulk string reply
+func (conn *redisConn) readReply() (interface{}, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errUnexpectedRedisReply
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errUnexpectedRedisReply
+		}
+
+		if length < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(conn.reader, data); err != nil {
+			return nil, err
+		}
+
+		return string(data[:length]), nil
+	}
+
+	return nil, errUnexpectedRedisReply
+}
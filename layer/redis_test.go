@@ -0,0 +1,154 @@
+package layer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeRedisServer implements the commands used by the RedisLocker, expiration is ignored
+type fakeRedisServer struct {
+	listener net.Listener
+
+	keys  map[string]string
+	mutex sync.Mutex
+}
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeRedisServer{
+		listener: listener,
+		keys:     map[string]string{},
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (server *fakeRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readFakeRedisCommand(reader)
+		if err != nil {
+			return
+		}
+
+		server.mutex.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			if _, found := server.keys[args[1]]; found {
+				fmt.Fprint(conn, "$-1\r\n")
+			} else {
+				server.keys[args[1]] = args[2]
+				fmt.Fprint(conn, "+OK\r\n")
+			}
+
+		case "EVAL":
+			if server.keys[args[3]] == args[4] {
+				delete(server.keys, args[3])
+				fmt.Fprint(conn, ":1\r\n")
+			} else {
+				fmt.Fprint(conn, ":0\r\n")
+			}
+
+		default:
+			fmt.Fprint(conn, "-ERR unknown command\r\n")
+		}
+		server.mutex.Unlock()
+	}
+}
+
+func readFakeRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+
+		args[i] = string(data[:length])
+	}
+
+	return args, nil
+}
+
+func TestRedisLocker_TryLock(t *testing.T) {
+	server := newFakeRedisServer(t)
+	defer server.listener.Close()
+
+	locker := NewRedisLocker(server.listener.Addr().String())
+	defer locker.Close()
+
+	unlock, acquired, err := locker.TryLock("key", time.Minute)
+	if err != nil || !acquired {
+		t.Fatalf("Expected lock to be acquired, err: %v", err)
+	}
+
+	if _, acquired, err := locker.TryLock("key", time.Minute); err != nil || acquired {
+		t.Errorf("Expected held lock not to be acquired again, err: %v", err)
+	}
+
+	if err := unlock(); err != nil {
+		t.Error(err)
+	}
+
+	if _, acquired, err := locker.TryLock("key", time.Minute); err != nil || !acquired {
+		t.Errorf("Expected released lock to be acquired, err: %v", err)
+	}
+}
+
+func TestRedisLocker_Unreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	locker := NewRedisLocker(address)
+	if _, _, err := locker.TryLock("key", time.Minute); err == nil {
+		t.Error("Expected error when the server is unreachable")
+	}
+}
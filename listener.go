@@ -0,0 +1,107 @@
+package sharedhttpcache
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+//MetricListenerSaturated is counted every time a connection has to wait because the listener has MaxConnections open connections
+const MetricListenerSaturated = "listener.saturated"
+
+//errListenerClosed is returned by Accept when the listener is closed while waiting for a connection to close
+var errListenerClosed = errors.New("listener closed")
+
+//LimitListener returns a listener which accepts at most maxConnections connections at the same time, like netutil.LimitListener.
+// Connections above the limit wait in the backlog of the listener until a connection is closed,
+// so a flood of connections can't exhaust the memory of the server.
+// MetricListenerSaturated is counted for every connection which has to wait and a warning is logged when the limit is reached
+func (controller *CacheController) LimitListener(listener net.Listener, maxConnections int) net.Listener {
+	controller.initOnce.Do(controller.initialize)
+
+	return &limitListener{
+		Listener:   listener,
+		controller: controller,
+		slots:      make(chan struct{}, maxConnections),
+		done:       make(chan struct{}),
+	}
+}
+
+type limitListener struct {
+	net.Listener
+
+	controller *CacheController
+
+	//slots contains a value for every open connection
+	slots chan struct{}
+
+	//saturated is 1 while connections wait for a slot, so the warning is only logged once per saturation
+	saturated int32
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (listener *limitListener) Accept() (net.Conn, error) {
+	if !listener.acquire() {
+		return nil, errListenerClosed
+	}
+
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		listener.release()
+		return nil, err
+	}
+
+	return &limitConn{Conn: conn, release: listener.release}, nil
+}
+
+//acquire waits for a slot, false is returned if the listener was closed
+func (listener *limitListener) acquire() bool {
+	select {
+	case listener.slots <- struct{}{}:
+		atomic.StoreInt32(&listener.saturated, 0)
+		return true
+	default:
+	}
+
+	listener.controller.incrMetric(MetricListenerSaturated, 1, nil)
+
+	if atomic.CompareAndSwapInt32(&listener.saturated, 0, 1) {
+		listener.controller.Logger.WithField("max-connections", cap(listener.slots)).Warning("Connection limit reached, new connections wait until a connection is closed")
+	}
+
+	select {
+	case listener.slots <- struct{}{}:
+		return true
+	case <-listener.done:
+		return false
+	}
+}
+
+func (listener *limitListener) release() {
+	<-listener.slots
+}
+
+func (listener *limitListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.done)
+	})
+
+	return listener.Listener.Close()
+}
+
+//limitConn releases the slot of the connection when it is closed
+type limitConn struct {
+	net.Conn
+
+	release     func()
+	releaseOnce sync.Once
+}
+
+func (conn *limitConn) Close() error {
+	err := conn.Conn.Close()
+	conn.releaseOnce.Do(conn.release)
+	return err
+}
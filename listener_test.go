@@ -0,0 +1,87 @@
+package sharedhttpcache
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	controller, _, closeOrigin := newTestController(t, nil)
+	defer closeOrigin()
+
+	sink := newRecordingSink()
+	controller.Metrics = sink
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := controller.LimitListener(tcpListener, 1)
+	defer listener.Close()
+
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+
+	first, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	select {
+	case <-accepted:
+		t.Fatal("expected the second connection to wait until the first is closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sink.lock.Lock()
+	saturated := sink.counters[MetricListenerSaturated]
+	sink.lock.Unlock()
+
+	if saturated != 1 {
+		t.Errorf("expected the listener to be saturated once, got: %d", saturated)
+	}
+
+	first.Close()
+	//Closing twice must not release the slot twice
+	first.Close()
+
+	select {
+	case conn := <-accepted:
+		if conn == nil {
+			t.Fatal("expected the second connection to be accepted")
+		}
+		defer conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("expected the second connection to be accepted after the first is closed")
+	}
+
+	errChan := make(chan error)
+	go func() {
+		_, err := listener.Accept()
+		errChan <- err
+	}()
+
+	listener.Close()
+
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Error("expected a error after the listener is closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a waiting Accept to return when the listener is closed")
+	}
+}
@@ -0,0 +1,59 @@
+package sharedhttpcache
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//DefaultSessionTicketKeys is the amount of session ticket keys which are kept if keep is zero, see RotateSessionTicketKeys
+const DefaultSessionTicketKeys = 3
+
+//RotateSessionTicketKeys replaces the session ticket key of the TLS config of a listener every interval until the context is canceled.
+// New tickets are encrypted with the newest key, the previous keys are kept so clients can still resume sessions with tickets
+// issued before the rotation. A ticket is valid for at most keep times the interval. The first key is set before it returns
+func RotateSessionTicketKeys(ctx context.Context, tlsConfig *tls.Config, interval time.Duration, keep int) error {
+	if keep <= 0 {
+		keep = DefaultSessionTicketKeys
+	}
+
+	keys := [][32]byte{}
+
+	rotate := func() error {
+		key := [32]byte{}
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > keep {
+			keys = keys[:keep]
+		}
+
+		tlsConfig.SetSessionTicketKeys(keys)
+		return nil
+	}
+
+	if err := rotate(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				//A failed rotation keeps the current keys, the next rotation is attempted at the next tick
+				_ = rotate()
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package sharedhttpcache
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRotateSessionTicketKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{*newTestCertificate(t, "example.com")}}
+	if err := RotateSessionTicketKeys(ctx, serverConfig, 100*time.Millisecond, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			_, _ = conn.Write([]byte{1})
+			conn.Close()
+		}
+	}()
+
+	clientConfig := &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+
+	connect := func() bool {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		//The session ticket is received after the handshake, reading processes it
+		_, _ = conn.Read(make([]byte, 1))
+
+		return conn.ConnectionState().DidResume
+	}
+
+	connect()
+
+	//The key which encrypted the ticket is kept after it is rotated
+	time.Sleep(150 * time.Millisecond)
+
+	if !connect() {
+		t.Error("expected the session to be resumed with a ticket issued before the rotation")
+	}
+}
@@ -0,0 +1,191 @@
+package sharedhttpcache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const (
+	//DefaultLockTTL is the maximum time a lock is held if LockTTL is zero
+	DefaultLockTTL = 30 * time.Second
+
+	//DefaultLockWait is the maximum time a request waits for a other instance to store a response if LockWait is zero
+	DefaultLockWait = 5 * time.Second
+)
+
+//lockPollInterval is the interval at which a waiting request attempts to acquire the lock
+const lockPollInterval = 50 * time.Millisecond
+
+//MetricLockWait is observed every time a request waited for a other instance to fetch a response from the origin
+const MetricLockWait = "lock.wait"
+
+//lockKeyPrefix is prepended to the primary cache key to get the key of the lock
+const lockKeyPrefix = "lock"
+
+//originLock is the lock which must be held to fetch a response from the origin, see CacheController.Locker
+// and CacheController.CoalesceRequests. It is acquired lazily, only when the cache can't serve the request
+type originLock struct {
+	controller *CacheController
+	key        string
+
+	attempted bool
+	acquired  bool
+	unlock    func() error
+
+	//flight is the in-process flight of the key, it is led by this lock if leader is true
+	flight *flight
+	leader bool
+}
+
+func (controller *CacheController) newOriginLock(cacheKey string) *originLock {
+	return &originLock{
+		controller: controller,
+		key:        lockKeyPrefix + cacheKey,
+	}
+}
+
+//setCacheKey changes the key of the lock to the full cache key once the secondary key of the request is known,
+// so requests for different variants don't wait for each other. It has no effect once acquiring was attempted
+func (lock *originLock) setCacheKey(cacheKey string) {
+	if !lock.attempted {
+		lock.key = lockKeyPrefix + cacheKey
+	}
+}
+
+//acquire attempts to acquire the lock once, later calls return the result of the first attempt
+// true is returned if the lock is held or if there is no Locker and requests are not coalesced, the origin may then be contacted
+func (lock *originLock) acquire() bool {
+	if lock.controller.Locker == nil && !lock.controller.CoalesceRequests {
+		return true
+	}
+
+	if !lock.attempted {
+		lock.attempted = true
+
+		//Within this instance only the leader of the flight attempts to acquire the shared lock
+		if lock.controller.CoalesceRequests {
+			lock.flight, lock.leader = lock.controller.joinFlight(lock.key)
+			if !lock.leader {
+				return false
+			}
+		}
+
+		if lock.controller.Locker == nil {
+			lock.acquired = true
+			return true
+		}
+
+		lock.tryLock()
+	}
+
+	return lock.acquired
+}
+
+//tryLock attempts to acquire the lock. If the locker fails the lock is considered acquired,
+// a unreachable locker should never stop requests from being served
+func (lock *originLock) tryLock() {
+	unlock, acquired, err := lock.controller.Locker.TryLock(lock.key, lock.controller.lockTTL())
+	if err != nil {
+		lock.controller.Logger.WithError(err).WithField("lock", lock.key).Warning("Error while acquiring lock, fetching without lock")
+		lock.acquired = true
+		return
+	}
+
+	lock.unlock = unlock
+	lock.acquired = acquired
+}
+
+//wait waits until the other holder releases the lock and acquires it, or until LockWait has passed
+// true is returned if the lock was acquired, the response of the other holder should then be in the cache.
+// A request which joined the flight of a other request in this instance waits until that request is done, without acquiring the lock,
+// so responses which can't be stored don't make every request wait for the previous one
+func (lock *originLock) wait(ctx context.Context) bool {
+	if lock.controller.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			lock.controller.Metrics.ObserveDuration(MetricLockWait, time.Since(start), nil)
+		}()
+	}
+
+	deadline := time.NewTimer(lock.controller.lockWait())
+	defer deadline.Stop()
+
+	if lock.flight != nil && !lock.leader {
+		select {
+		case <-lock.flight.done:
+			return true
+
+		case <-ctx.Done():
+		case <-deadline.C:
+		}
+
+		return false
+	}
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+
+		case <-deadline.C:
+			return false
+
+		case <-ticker.C:
+			lock.tryLock()
+			if lock.acquired {
+				return true
+			}
+		}
+	}
+}
+
+//release releases the lock if it is held, it is safe to call multiple times
+func (lock *originLock) release() {
+	if lock.leader {
+		lock.controller.landFlight(lock.key, lock.flight)
+		lock.leader = false
+	}
+
+	if lock.unlock == nil {
+		return
+	}
+
+	err := lock.unlock()
+	if err != nil {
+		lock.controller.Logger.WithError(err).WithField("lock", lock.key).Warning("Error while releasing lock")
+	}
+
+	lock.unlock = nil
+}
+
+//mayServeStaleWhileLocked checks if a stale response may be served while a other request revalidates it
+// The response must allow to be served stale and the client must not require a fresh response, section 4.2.4 of RFC 7234
+func mayServeStaleWhileLocked(clientDirectives clientCacheControl, age int64, response *http.Response) bool {
+	if clientDirectives.noCache || clientDirectives.minFresh >= 0 || !clientDirectives.acceptsAge(age) {
+		return false
+	}
+
+	cc := parseResponseCacheControl(response.Header)
+
+	return !cc.mustRevalidate && !cc.proxyRevalidate && !cc.noCache && !cc.hasSMaxAge
+}
+
+func (controller *CacheController) lockTTL() time.Duration {
+	if controller.LockTTL > 0 {
+		return controller.LockTTL
+	}
+
+	return DefaultLockTTL
+}
+
+func (controller *CacheController) lockWait() time.Duration {
+	if controller.LockWait > 0 {
+		return controller.LockWait
+	}
+
+	return DefaultLockWait
+}
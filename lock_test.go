@@ -0,0 +1,107 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dylandreimerink/sharedhttpcache/layer"
+)
+
+//heldLocker is a layer.Locker of which every lock is held by a other instance
+type heldLocker struct{}
+
+func (heldLocker) TryLock(key string, ttl time.Duration) (func() error, bool, error) {
+	return nil, false, nil
+}
+
+func TestLockWaitsForMiss(t *testing.T) {
+	var originRequests int32
+	received := make(chan struct{})
+	release := make(chan struct{})
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&originRequests, 1) == 1 {
+			close(received)
+			<-release
+		}
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.Locker = layer.NewInMemoryCacheLayer(1024)
+
+	bodies := make([]string, 2)
+	wg := sync.WaitGroup{}
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			recorder := httptest.NewRecorder()
+			controller.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+			bodies[i] = recorder.Body.String()
+		}(i)
+
+		//The second request is sent while the first request holds the lock
+		if i == 0 {
+			<-received
+		}
+	}
+
+	//Give the second request time to start waiting
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if requests := atomic.LoadInt32(&originRequests); requests != 1 {
+		t.Errorf("expected 1 origin request, got %d", requests)
+	}
+
+	for i, body := range bodies {
+		if body != "content" {
+			t.Errorf("request %d: expected content, got: %s", i, body)
+		}
+	}
+}
+
+func TestLockServesStale(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		//The response is stored but immediately stale
+		rw.Header().Set(CacheControlHeader, "max-age=0")
+		rw.Header().Set("Etag", `"v1"`)
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+
+	//A other instance is revalidating the response
+	controller.Locker = heldLocker{}
+
+	response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if body != "content" || originRequests != 1 {
+		t.Errorf("expected stale response without origin request, got body: %s, origin requests: %d", body, originRequests)
+	}
+
+	if warning := response.Header.Get("Warning"); warning != `110 - "Response is Stale"` {
+		t.Errorf("expected stale warning, got: %s", warning)
+	}
+
+	//A client which requires a fresh response isn't served the stale response
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	req.Header.Set(CacheControlHeader, "min-fresh=10")
+	doTestRequest(t, controller, req)
+
+	if originRequests != 2 {
+		t.Errorf("expected response to be revalidated for min-fresh, got %d origin requests", originRequests)
+	}
+}
@@ -0,0 +1,86 @@
+package sharedhttpcache
+
+import (
+	"strings"
+)
+
+//stringSet is a set of strings which is built from a list in the CacheConfig
+// source is the list the set was built from so it can be rebuilt if the list is replaced
+type stringSet struct {
+	source []string
+	set    map[string]bool
+}
+
+func newStringSet(source []string) *stringSet {
+	set := &stringSet{
+		source: source,
+		set:    make(map[string]bool, len(source)),
+	}
+
+	for _, value := range source {
+		set.set[value] = true
+	}
+
+	return set
+}
+
+//builtFrom checks if the set was built from the given list
+// Lists are compared by identity, not by content, so the check is O(1)
+func (set *stringSet) builtFrom(source []string) bool {
+	if len(set.source) != len(source) {
+		return false
+	}
+
+	return len(source) == 0 || &set.source[0] == &source[0]
+}
+
+//cacheConfigLookups contains the lookup sets of a CacheConfig
+type cacheConfigLookups struct {
+	safeMethods       *stringSet
+	cacheableMethods  *stringSet
+	defaultExtensions *stringSet
+}
+
+//getLookups returns the lookup sets of the config. The sets are built on first use and
+// rebuilt if a list in the config is replaced, so configs which are changed after creation keep working.
+// Changing a element of a list in place after the config is used is not detected
+func (config *CacheConfig) getLookups() *cacheConfigLookups {
+	lookups, _ := config.lookups.Load().(*cacheConfigLookups)
+
+	if lookups != nil &&
+		lookups.safeMethods.builtFrom(config.SafeMethods) &&
+		lookups.cacheableMethods.builtFrom(config.CacheableMethods) &&
+		lookups.defaultExtensions.builtFrom(config.CacheableFileExtensions) {
+
+		return lookups
+	}
+
+	//Concurrent builds are harmless, they produce the same sets
+	lookups = &cacheConfigLookups{
+		safeMethods:       newStringSet(config.SafeMethods),
+		cacheableMethods:  newStringSet(config.CacheableMethods),
+		defaultExtensions: newStringSet(config.CacheableFileExtensions),
+	}
+	config.lookups.Store(lookups)
+
+	return lookups
+}
+
+//hasCacheableExtension checks if the last segment of the path ends with a extension from the set
+// Every part of the last segment after a dot is looked up so extensions which contain a dot, like "tar.gz", also match
+func (set *stringSet) hasCacheableExtension(path string) bool {
+	lastSegment := path[strings.LastIndexByte(path, '/')+1:]
+
+	for {
+		dot := strings.IndexByte(lastSegment, '.')
+		if dot == -1 {
+			return false
+		}
+
+		lastSegment = lastSegment[dot+1:]
+
+		if set.set[lastSegment] {
+			return true
+		}
+	}
+}
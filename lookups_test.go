@@ -0,0 +1,45 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCacheConfigLookups(t *testing.T) {
+	config := NewCacheConfig()
+
+	if !isMethodSafe(config, http.MethodHead) || isMethodSafe(config, http.MethodPost) {
+		t.Error("unexpected result for safe methods")
+	}
+
+	if !isMethodCacheable(config, http.MethodGet) || isMethodCacheable(config, http.MethodHead) {
+		t.Error("unexpected result for cacheable methods")
+	}
+
+	//Replacing a list after the config has been used must be picked up
+	config.CacheableMethods = []string{http.MethodGet, http.MethodHead}
+	if !isMethodCacheable(config, http.MethodHead) {
+		t.Error("expected replaced cacheable methods list to be used")
+	}
+}
+
+func TestHasCacheableExtension(t *testing.T) {
+	set := newStringSet([]string{"css", "tar.gz"})
+
+	tests := map[string]bool{
+		"/style.css":          true,
+		"/archive.tar.gz":     true,
+		"/archive.gz":         false,
+		"/dir.css/index":      false,
+		"/style.css.map":      false,
+		"/no-extension":       false,
+		"/min/style.min.css":  true,
+		"/releases/v1.tar.gz": true,
+	}
+
+	for path, expected := range tests {
+		if result := set.hasCacheableExtension(path); result != expected {
+			t.Errorf("path '%s': expected %v, got %v", path, expected, result)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+//Names of the metrics reported to the MetricsSink of the CacheController
+const (
+	//MetricCacheHit is counted every time a fresh stored response is served
+	MetricCacheHit = "cache.hit"
+
+	//MetricCacheMiss is counted every time no stored response was found
+	MetricCacheMiss = "cache.miss"
+
+	//MetricCacheRevalidated is counted every time a stored response was successfully revalidated with the origin server
+	MetricCacheRevalidated = "cache.revalidated"
+
+	//MetricCacheStale is counted every time a stale response is served
+	MetricCacheStale = "cache.stale"
+
+	//MetricCacheStoredBytes is incremented with the size of every response which is stored
+	MetricCacheStoredBytes = "cache.stored_bytes"
+
+	//MetricCacheEviction is counted every time a layer evicts a entry to make room, tagged with the layer index
+	MetricCacheEviction = "cache.eviction"
+
+	//MetricCacheTruncated is counted every time a response isn't stored because its body doesn't match the declared length
+	MetricCacheTruncated = "cache.truncated"
+
+	//MetricVariantEviction is counted every time a variant is deleted because the primary cache key has more than MaxVariants variants
+	MetricVariantEviction = "cache.variant_eviction"
+
+	//MetricOriginLatency is the round trip time of requests to the origin server, tagged with the origin host and status class
+	MetricOriginLatency = "origin.latency"
+)
+
+//A MetricsSink receives metrics from the CacheController.
+// Implementations must be safe for concurrent use by multiple goroutines
+type MetricsSink interface {
+
+	//IncrCounter increments a counter by the given value
+	IncrCounter(name string, value int64, tags map[string]string)
+
+	//ObserveDuration records a single duration, like the latency of a request
+	ObserveDuration(name string, duration time.Duration, tags map[string]string)
+}
+
+//MultiMetricsSink is a MetricsSink which sends every metric to all of its sinks, like StatsD and Prometheus
+type MultiMetricsSink []MetricsSink
+
+//IncrCounter increments the counter in every sink
+func (sinks MultiMetricsSink) IncrCounter(name string, value int64, tags map[string]string) {
+	for _, sink := range sinks {
+		sink.IncrCounter(name, value, tags)
+	}
+}
+
+//ObserveDuration records the duration in every sink
+func (sinks MultiMetricsSink) ObserveDuration(name string, duration time.Duration, tags map[string]string) {
+	for _, sink := range sinks {
+		sink.ObserveDuration(name, duration, tags)
+	}
+}
+
+//incrMetric increments a counter metric if a metrics sink is configured
+func (controller *CacheController) incrMetric(name string, value int64, tags map[string]string) {
+	if controller.Metrics != nil {
+		controller.Metrics.IncrCounter(name, value, tags)
+	}
+}
+
+//roundTripOrigin proxies a request to the origin server, the request is hedged if HedgeAfter of the forward config is set
+func (controller *CacheController) roundTripOrigin(forwardContext context.Context, transport http.RoundTripper, forwardConfig *ForwardConfig, req *http.Request) (*http.Response, error) {
+	if isHedgeable(forwardConfig, req) {
+		return controller.roundTripOriginHedged(forwardContext, transport, forwardConfig, req)
+	}
+
+	return controller.roundTripOriginOnce(forwardContext, transport, forwardConfig, req)
+}
+
+//roundTripOriginOnce proxies a request to the origin server and records the latency
+// If the origin has MaxConcurrentRequests in flight and no slot becomes available in time the request isn't send,
+// a 503 response is returned instead
+func (controller *CacheController) roundTripOriginOnce(forwardContext context.Context, transport http.RoundTripper, forwardConfig *ForwardConfig, req *http.Request) (*http.Response, error) {
+	release, acquired := controller.acquireOriginSlot(forwardContext, forwardConfig)
+	if !acquired {
+		controller.incrMetric(MetricOriginConcurrencyLimited, 1, map[string]string{
+			"origin": forwardConfig.Host,
+		})
+
+		return makeOriginBusyResponse(forwardConfig, req), nil
+	}
+
+	start := time.Now()
+
+	response, err := proxyToOrigin(forwardContext, transport, forwardConfig, req)
+	if err == nil {
+		correctAgeHeader(response, start, time.Now())
+
+		//The request is in flight until the body is read and closed
+		response.Body = &releasingReadCloser{ReadCloser: response.Body, release: release}
+	} else {
+		release()
+	}
+
+	if controller.Metrics != nil {
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(response.StatusCode/100) + "xx"
+		}
+
+		controller.Metrics.ObserveDuration(MetricOriginLatency, time.Since(start), map[string]string{
+			"origin": forwardConfig.Host,
+			"status": status,
+		})
+	}
+
+	return response, err
+}
@@ -0,0 +1,95 @@
+package sharedhttpcache
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//recordingSink is a MetricsSink which counts the metrics it receives
+type recordingSink struct {
+	lock     sync.Mutex
+	counters map[string]int64
+	timings  map[string]int
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{
+		counters: map[string]int64{},
+		timings:  map[string]int{},
+	}
+}
+
+func (sink *recordingSink) IncrCounter(name string, value int64, tags map[string]string) {
+	sink.lock.Lock()
+	sink.counters[name] += value
+	sink.lock.Unlock()
+}
+
+func (sink *recordingSink) ObserveDuration(name string, duration time.Duration, tags map[string]string) {
+	sink.lock.Lock()
+	sink.timings[name]++
+	sink.lock.Unlock()
+}
+
+func TestControllerMetrics(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	sink := newRecordingSink()
+	controller.Metrics = sink
+
+	for i := 0; i < 3; i++ {
+		doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	}
+
+	if sink.counters[MetricCacheMiss] != 1 {
+		t.Errorf("expected 1 miss, got: %d", sink.counters[MetricCacheMiss])
+	}
+
+	if sink.counters[MetricCacheHit] != 2 {
+		t.Errorf("expected 2 hits, got: %d", sink.counters[MetricCacheHit])
+	}
+
+	if sink.counters[MetricCacheStoredBytes] <= 0 {
+		t.Error("expected stored bytes to be counted")
+	}
+
+	if sink.timings[MetricOriginLatency] != 1 {
+		t.Errorf("expected 1 origin latency observation, got: %d", sink.timings[MetricOriginLatency])
+	}
+}
+
+func TestStatsDSink(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	sink, err := NewStatsDSink(listener.LocalAddr().String(), "shc.", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.IncrCounter(MetricCacheEviction, 1, map[string]string{"tier": "0", "layer": "1"})
+
+	buf := make([]byte, 512)
+	_ = listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "shc.cache.eviction:1|c|#layer:1,tier:0"
+	if string(buf[:n]) != expected {
+		t.Errorf("expected: '%s', got: '%s'", expected, string(buf[:n]))
+	}
+}
@@ -0,0 +1,242 @@
+package sharedhttpcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+//IP preferences of the OriginDialer
+const (
+	//DialPreferIPv6 dials the IPv6 addresses of the origin first, the IPv4 addresses are dialed if they don't connect within the FallbackDelay
+	DialPreferIPv6 = "prefer-ipv6"
+
+	//DialPreferIPv4 dials the IPv4 addresses of the origin first, the IPv6 addresses are dialed if they don't connect within the FallbackDelay
+	DialPreferIPv4 = "prefer-ipv4"
+
+	//DialIPv4Only only dials the IPv4 addresses of the origin
+	DialIPv4Only = "ipv4-only"
+
+	//DialIPv6Only only dials the IPv6 addresses of the origin
+	DialIPv6Only = "ipv6-only"
+)
+
+//DefaultOriginFallbackDelay is the time after which the addresses of the other IP version are dialed if FallbackDelay is zero,
+// the same as the default of RFC 6555
+const DefaultOriginFallbackDelay = 300 * time.Millisecond
+
+var errNoOriginAddresses = errors.New("No addresses of the origin match the IP preference")
+
+//OriginDialer dials origin servers with control over the IP version, for dual stack origins with a broken IPv6 or IPv4 path.
+// When the origin has addresses of both versions they are raced as described in RFC 6555 (Happy Eyeballs).
+// Its DialContext method can be used as DialContext of a http.Transport
+type OriginDialer struct {
+	//Dialer is used to dial the addresses, if nil a zero net.Dialer is used
+	Dialer *net.Dialer
+
+	//IPPreference is one of the Dial constants. If empty the version of the first resolved address is dialed first
+	IPPreference string
+
+	//FallbackDelay is the time after which the addresses of the other IP version are dialed while the preferred addresses are still connecting.
+	// If zero DefaultOriginFallbackDelay is used, if negative the other addresses are only dialed once the preferred addresses failed
+	FallbackDelay time.Duration
+
+	//OriginIPs are dialed instead of the addresses the hostname resolves to, in order, like "192.0.2.1" or "[2001:db8::1]:8443".
+	// Addresses without a port use the port of the dialed address
+	OriginIPs []string
+}
+
+//DialContext connects to the address, which is a host and port like "example.com:443"
+func (dialer *OriginDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	addresses, err := dialer.resolveAddresses(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	primaries, fallbacks := dialer.partitionAddresses(addresses)
+	if len(primaries) == 0 {
+		return nil, fmt.Errorf("Unable to dial '%s': %w", addr, errNoOriginAddresses)
+	}
+
+	if len(fallbacks) == 0 {
+		return dialer.dialSerial(ctx, network, primaries)
+	}
+
+	return dialer.dialParallel(ctx, network, primaries, fallbacks)
+}
+
+//resolveAddresses returns the IP and port of every address which can be dialed to reach the host
+func (dialer *OriginDialer) resolveAddresses(ctx context.Context, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dialer.OriginIPs) > 0 {
+		addresses := make([]string, 0, len(dialer.OriginIPs))
+		for _, originIP := range dialer.OriginIPs {
+			if _, _, err := net.SplitHostPort(originIP); err == nil {
+				addresses = append(addresses, originIP)
+			} else {
+				addresses = append(addresses, net.JoinHostPort(originIP, port))
+			}
+		}
+
+		return addresses, nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{addr}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+
+	return addresses, nil
+}
+
+//partitionAddresses splits the addresses in the preferred addresses and the addresses of the other IP version, in the original order.
+// Addresses of a excluded IP version are left out
+func (dialer *OriginDialer) partitionAddresses(addresses []string) (primaries, fallbacks []string) {
+	preferIPv4 := true
+	switch dialer.IPPreference {
+	case DialPreferIPv6, DialIPv6Only:
+		preferIPv4 = false
+	case DialPreferIPv4, DialIPv4Only:
+	default:
+		//Like the net package, the version of the first address is preferred
+		preferIPv4 = len(addresses) == 0 || isIPv4Address(addresses[0])
+	}
+
+	for _, address := range addresses {
+		if isIPv4Address(address) == preferIPv4 {
+			primaries = append(primaries, address)
+		} else {
+			fallbacks = append(fallbacks, address)
+		}
+	}
+
+	if dialer.IPPreference == DialIPv4Only || dialer.IPPreference == DialIPv6Only {
+		fallbacks = nil
+	}
+
+	return primaries, fallbacks
+}
+
+//isIPv4Address checks if the IP of a IP and port address is a IPv4 address
+func isIPv4Address(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() != nil
+}
+
+//dialSerial dials the addresses one by one until a connection is made, the error of the last address is returned if none connect
+func (dialer *OriginDialer) dialSerial(ctx context.Context, network string, addresses []string) (net.Conn, error) {
+	netDialer := dialer.Dialer
+	if netDialer == nil {
+		netDialer = &net.Dialer{}
+	}
+
+	var lastErr error
+	for _, address := range addresses {
+		conn, err := netDialer.DialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+//dialParallel dials the primary addresses and starts dialing the fallback addresses after the FallbackDelay
+// or once the primary addresses failed, the first connection which is made is returned
+func (dialer *OriginDialer) dialParallel(ctx context.Context, network string, primaries, fallbacks []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult)
+	dial := func(addresses []string) {
+		conn, err := dialer.dialSerial(ctx, network, addresses)
+
+		select {
+		case results <- dialResult{conn: conn, err: err}:
+		case <-ctx.Done():
+			//A other connection was returned
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go dial(primaries)
+	pending := 1
+
+	fallbackDelay := dialer.FallbackDelay
+	if fallbackDelay == 0 {
+		fallbackDelay = DefaultOriginFallbackDelay
+	}
+
+	var fallbackTimer <-chan time.Time
+	if fallbackDelay > 0 {
+		timer := time.NewTimer(fallbackDelay)
+		defer timer.Stop()
+		fallbackTimer = timer.C
+	}
+
+	fallbackStarted := false
+	startFallback := func() {
+		if !fallbackStarted {
+			fallbackStarted = true
+			pending++
+			go dial(fallbacks)
+		}
+	}
+
+	var firstErr error
+	for {
+		select {
+		case <-fallbackTimer:
+			startFallback()
+
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				return result.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = result.err
+			}
+
+			startFallback()
+
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
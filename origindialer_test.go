@@ -0,0 +1,88 @@
+package sharedhttpcache
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestOriginDialerPartition(t *testing.T) {
+	addresses := []string{"192.0.2.1:80", "[2001:db8::1]:80", "192.0.2.2:80", "[2001:db8::2]:80"}
+	ipv4 := []string{"192.0.2.1:80", "192.0.2.2:80"}
+	ipv6 := []string{"[2001:db8::1]:80", "[2001:db8::2]:80"}
+
+	tests := []struct {
+		preference string
+		primaries  []string
+		fallbacks  []string
+	}{
+		{preference: "", primaries: ipv4, fallbacks: ipv6},
+		{preference: DialPreferIPv6, primaries: ipv6, fallbacks: ipv4},
+		{preference: DialPreferIPv4, primaries: ipv4, fallbacks: ipv6},
+		{preference: DialIPv4Only, primaries: ipv4},
+		{preference: DialIPv6Only, primaries: ipv6},
+	}
+
+	for _, test := range tests {
+		dialer := &OriginDialer{IPPreference: test.preference}
+
+		primaries, fallbacks := dialer.partitionAddresses(addresses)
+		if !reflect.DeepEqual(primaries, test.primaries) || !reflect.DeepEqual(fallbacks, test.fallbacks) {
+			t.Errorf("'%s': expected %v and %v, got %v and %v", test.preference, test.primaries, test.fallbacks, primaries, fallbacks)
+		}
+	}
+}
+
+func TestOriginDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	//A address on which nothing listens, so connecting fails immediately
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := closedListener.Addr().String()
+	closedListener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	//The next origin IP is dialed if a address doesn't accept the connection, addresses without port use the dialed port
+	dialer := &OriginDialer{OriginIPs: []string{closedAddress, "127.0.0.1"}}
+	conn, err := dialer.DialContext(context.Background(), "tcp", "origin.example:"+port)
+	if err != nil {
+		t.Fatalf("expected the second origin IP to connect, got: %s", err)
+	}
+	conn.Close()
+
+	//The fallback addresses are dialed once the primary addresses fail, without waiting for the fallback delay
+	dialer = &OriginDialer{FallbackDelay: -1}
+	conn, err = dialer.dialParallel(context.Background(), "tcp", []string{closedAddress}, []string{listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("expected the fallback address to connect, got: %s", err)
+	}
+	conn.Close()
+
+	if _, err := dialer.dialParallel(context.Background(), "tcp", []string{closedAddress}, []string{closedAddress}); err == nil {
+		t.Error("expected error if no address connects")
+	}
+
+	dialer = &OriginDialer{IPPreference: DialIPv6Only, OriginIPs: []string{"127.0.0.1"}}
+	if _, err := dialer.DialContext(context.Background(), "tcp", "origin.example:"+port); err == nil {
+		t.Error("expected error if no address matches the IP preference")
+	}
+}
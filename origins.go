@@ -0,0 +1,376 @@
+package sharedhttpcache
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	errInvalidOriginHost   = errors.New("The host of a origin must not be empty")
+	errInvalidOriginTarget = errors.New("The origin_host of a origin must not be empty")
+)
+
+//A DynamicOrigin is a origin server which is registered at runtime, requests for Host are forwarded to OriginHost
+type DynamicOrigin struct {
+	//Host is the hostname, without port, requested by clients
+	Host string `json:"host"`
+
+	//OriginHost is the hostname or IP address and optionally the tcp port of the origin server, see ForwardConfig.Host
+	OriginHost string `json:"origin_host"`
+
+	//TLS if true https is used to connect to the origin
+	TLS bool `json:"tls"`
+
+	FollowRedirects       int         `json:"follow_redirects,omitempty"`
+	StripPathPrefix       string      `json:"strip_path_prefix,omitempty"`
+	AddPathPrefix         string      `json:"add_path_prefix,omitempty"`
+	SendOriginHost        bool        `json:"send_origin_host,omitempty"`
+	RequestHeaders        http.Header `json:"request_headers,omitempty"`
+	MaxConcurrentRequests int         `json:"max_concurrent_requests,omitempty"`
+	MaxQueuedRequests     int         `json:"max_queued_requests,omitempty"`
+}
+
+//forwardConfig converts the origin to the forward config which is used to forward requests to it
+func (origin DynamicOrigin) forwardConfig() *ForwardConfig {
+	return &ForwardConfig{
+		Host:                  origin.OriginHost,
+		TLS:                   origin.TLS,
+		FollowRedirects:       origin.FollowRedirects,
+		StripPathPrefix:       origin.StripPathPrefix,
+		AddPathPrefix:         origin.AddPathPrefix,
+		SendOriginHost:        origin.SendOriginHost,
+		RequestHeaders:        origin.RequestHeaders,
+		MaxConcurrentRequests: origin.MaxConcurrentRequests,
+		MaxQueuedRequests:     origin.MaxQueuedRequests,
+	}
+}
+
+//normalizeOriginHost returns the form in which hosts are compared, hostnames are case insensitive and
+// internationalized hostnames are compared in their ASCII form
+func normalizeOriginHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	return strings.ToLower(asciiHostname(host))
+}
+
+//A OriginStore persists the dynamic origins of a OriginRegistry, so they survive a restart
+type OriginStore interface {
+	//LoadOrigins returns the persisted origins
+	LoadOrigins() ([]DynamicOrigin, error)
+
+	//SaveOrigins replaces the persisted origins
+	SaveOrigins(origins []DynamicOrigin) error
+}
+
+//FileOriginStore is a OriginStore which persists the origins as a JSON file
+type FileOriginStore struct {
+	Path string
+}
+
+//LoadOrigins reads the origins from the file, no origins are returned if the file doesn't exist yet
+func (store *FileOriginStore) LoadOrigins() ([]DynamicOrigin, error) {
+	content, err := ioutil.ReadFile(store.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	origins := []DynamicOrigin{}
+	err = json.Unmarshal(content, &origins)
+
+	return origins, err
+}
+
+//SaveOrigins writes the origins to a temporary file which replaces the file, so a crash never leaves a partial file
+func (store *FileOriginStore) SaveOrigins(origins []DynamicOrigin) error {
+	content, err := json.MarshalIndent(origins, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(store.Path), filepath.Base(store.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), store.Path)
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+	}
+
+	return err
+}
+
+//OriginRegistry is a ForwardConfigResolver and TransportResolver of origins which are added and removed at runtime,
+// so new hosts can be served without a restart. Requests for hosts which are not registered are resolved by the fallbacks.
+// The origins can be managed with a OriginHandler
+type OriginRegistry struct {
+	//Fallback resolves the forward config of hosts which are not registered, if nil the default forward config is used
+	Fallback ForwardConfigResolver
+
+	//FallbackTransport resolves the transport of hosts which are not registered, if nil the default transport is used
+	FallbackTransport TransportResolver
+
+	//Transport is used to forward requests to registered origins, if nil the default transport of the controller is used
+	Transport http.RoundTripper
+
+	//Store can optionally be set to persist the origins, call Load to restore the persisted origins
+	Store OriginStore
+
+	mutex   sync.RWMutex
+	origins map[string]DynamicOrigin
+	configs map[string]*ForwardConfig
+}
+
+//Load replaces the registered origins with the origins of the store
+func (registry *OriginRegistry) Load() error {
+	if registry.Store == nil {
+		return nil
+	}
+
+	origins, err := registry.Store.LoadOrigins()
+	if err != nil {
+		return err
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.origins = make(map[string]DynamicOrigin, len(origins))
+	registry.configs = make(map[string]*ForwardConfig, len(origins))
+	for _, origin := range origins {
+		host := normalizeOriginHost(origin.Host)
+		registry.origins[host] = origin
+		registry.configs[host] = origin.forwardConfig()
+	}
+
+	return nil
+}
+
+//Register adds the origin or replaces the origin of the same host.
+// If the origins can't be persisted the registration is undone and the error of the store is returned
+func (registry *OriginRegistry) Register(origin DynamicOrigin) error {
+	if origin.Host == "" {
+		return errInvalidOriginHost
+	}
+
+	if origin.OriginHost == "" {
+		return errInvalidOriginTarget
+	}
+
+	host := normalizeOriginHost(origin.Host)
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if registry.origins == nil {
+		registry.origins = map[string]DynamicOrigin{}
+		registry.configs = map[string]*ForwardConfig{}
+	}
+
+	previous, existed := registry.origins[host]
+
+	registry.origins[host] = origin
+	registry.configs[host] = origin.forwardConfig()
+
+	if err := registry.save(); err != nil {
+		if existed {
+			registry.origins[host] = previous
+			registry.configs[host] = previous.forwardConfig()
+		} else {
+			delete(registry.origins, host)
+			delete(registry.configs, host)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+//Unregister removes the origin of the host, false is returned if the host was not registered.
+// Responses of the host which are already stored are not purged
+func (registry *OriginRegistry) Unregister(host string) (bool, error) {
+	host = normalizeOriginHost(host)
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	previous, existed := registry.origins[host]
+	if !existed {
+		return false, nil
+	}
+
+	delete(registry.origins, host)
+	delete(registry.configs, host)
+
+	if err := registry.save(); err != nil {
+		registry.origins[host] = previous
+		registry.configs[host] = previous.forwardConfig()
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+//Origins returns the registered origins sorted by host
+func (registry *OriginRegistry) Origins() []DynamicOrigin {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	return registry.list()
+}
+
+//list returns the origins sorted by host, the mutex must be held
+func (registry *OriginRegistry) list() []DynamicOrigin {
+	origins := make([]DynamicOrigin, 0, len(registry.origins))
+	for _, origin := range registry.origins {
+		origins = append(origins, origin)
+	}
+
+	sort.Slice(origins, func(i, j int) bool {
+		return normalizeOriginHost(origins[i].Host) < normalizeOriginHost(origins[j].Host)
+	})
+
+	return origins
+}
+
+//save persists the origins if a store is set, the mutex must be held
+func (registry *OriginRegistry) save() error {
+	if registry.Store == nil {
+		return nil
+	}
+
+	return registry.Store.SaveOrigins(registry.list())
+}
+
+//lookup returns the forward config of the registered origin of the host of the request
+func (registry *OriginRegistry) lookup(req *http.Request) *ForwardConfig {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	return registry.configs[normalizeOriginHost(req.Host)]
+}
+
+//GetForwardConfig returns the forward config of the registered origin, or resolves it with the fallback
+func (registry *OriginRegistry) GetForwardConfig(req *http.Request) *ForwardConfig {
+	if forwardConfig := registry.lookup(req); forwardConfig != nil {
+		return forwardConfig
+	}
+
+	if registry.Fallback != nil {
+		return registry.Fallback.GetForwardConfig(req)
+	}
+
+	return nil
+}
+
+//GetTransport returns the transport of registered origins, or resolves it with the fallback
+func (registry *OriginRegistry) GetTransport(req *http.Request) http.RoundTripper {
+	if registry.lookup(req) != nil {
+		return registry.Transport
+	}
+
+	if registry.FallbackTransport != nil {
+		return registry.FallbackTransport.GetTransport(req)
+	}
+
+	return nil
+}
+
+//OriginHandler is a http.Handler which manages the origins of a OriginRegistry.
+//
+// GET returns the registered origins as a JSON list, PUT registers the DynamicOrigin in the JSON body
+// and DELETE removes the origin of the host in the "host" query parameter, like "/origins?host=example.com".
+// It is meant to be served on a admin listener, not to the public
+type OriginHandler struct {
+	registry *OriginRegistry
+
+	//token is the bearer token which must be send, requests are accepted without authentication if empty
+	token string
+}
+
+//NewOriginHandler creates a OriginHandler which manages the origins of the registry
+func NewOriginHandler(registry *OriginRegistry, token string) *OriginHandler {
+	return &OriginHandler{
+		registry: registry,
+		token:    token,
+	}
+}
+
+func (handler *OriginHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if handler.token != "" {
+		authorization := req.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+handler.token)) != 1 {
+			http.Error(resp, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		resp.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(resp)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(handler.registry.Origins())
+
+	case http.MethodPut:
+		origin := DynamicOrigin{}
+		if err := json.NewDecoder(req.Body).Decode(&origin); err != nil {
+			http.Error(resp, "Invalid origin", http.StatusBadRequest)
+			return
+		}
+
+		err := handler.registry.Register(origin)
+		if errors.Is(err, errInvalidOriginHost) || errors.Is(err, errInvalidOriginTarget) {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(resp, "Error while saving origins", http.StatusInternalServerError)
+			return
+		}
+
+		resp.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		removed, err := handler.registry.Unregister(req.URL.Query().Get("host"))
+		if err != nil {
+			http.Error(resp, "Error while saving origins", http.StatusInternalServerError)
+			return
+		}
+
+		if !removed {
+			http.Error(resp, "Origin not found", http.StatusNotFound)
+			return
+		}
+
+		resp.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
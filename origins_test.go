@@ -0,0 +1,118 @@
+package sharedhttpcache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOriginRegistry(t *testing.T) {
+	fallback := &ForwardConfig{Host: "fallback.internal"}
+
+	registry := &OriginRegistry{
+		Fallback: ForwardConfigResolverFunc(func(req *http.Request) *ForwardConfig {
+			return fallback
+		}),
+	}
+
+	err := registry.Register(DynamicOrigin{Host: "Tenant.example.com", OriginHost: "10.0.0.1:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://tenant.example.com:80/page", nil)
+	if forwardConfig := registry.GetForwardConfig(req); forwardConfig == nil || forwardConfig.Host != "10.0.0.1:8080" {
+		t.Errorf("expected the registered origin, got %+v", forwardConfig)
+	}
+
+	other := httptest.NewRequest(http.MethodGet, "http://other.example.com/page", nil)
+	if forwardConfig := registry.GetForwardConfig(other); forwardConfig != fallback {
+		t.Errorf("expected the fallback for a unregistered host, got %+v", forwardConfig)
+	}
+
+	if err := registry.Register(DynamicOrigin{Host: "missing.example.com"}); err != errInvalidOriginTarget {
+		t.Errorf("expected a origin without origin host to be rejected, got %v", err)
+	}
+
+	removed, err := registry.Unregister("tenant.example.com")
+	if err != nil || !removed {
+		t.Fatalf("expected the origin to be removed, got %v %v", removed, err)
+	}
+
+	if forwardConfig := registry.GetForwardConfig(req); forwardConfig != fallback {
+		t.Errorf("expected the fallback after unregistering, got %+v", forwardConfig)
+	}
+}
+
+func TestOriginHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "origins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &FileOriginStore{Path: filepath.Join(dir, "origins.json")}
+	handler := NewOriginHandler(&OriginRegistry{Store: store}, "secret")
+
+	serve := func(method, target, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	origin := `{"host": "tenant.example.com", "origin_host": "10.0.0.1", "tls": true}`
+
+	if code := serve(http.MethodPut, "/origins", origin, "wrong").Code; code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong token, got %d", code)
+	}
+
+	if code := serve(http.MethodPut, "/origins", origin, "secret").Code; code != http.StatusNoContent {
+		t.Errorf("expected 204 after registering, got %d", code)
+	}
+
+	if code := serve(http.MethodPut, "/origins", `{"host": ""}`, "secret").Code; code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a invalid origin, got %d", code)
+	}
+
+	listed := []DynamicOrigin{}
+	if err := json.NewDecoder(serve(http.MethodGet, "/origins", "", "secret").Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listed) != 1 || listed[0].OriginHost != "10.0.0.1" || !listed[0].TLS {
+		t.Errorf("expected the registered origin to be listed, got %+v", listed)
+	}
+
+	//A new registry restores the persisted origins
+	restored := &OriginRegistry{Store: store}
+	if err := restored.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://tenant.example.com/", nil)
+	if forwardConfig := restored.GetForwardConfig(req); forwardConfig == nil || forwardConfig.Host != "10.0.0.1" {
+		t.Errorf("expected the persisted origin to be restored, got %+v", forwardConfig)
+	}
+
+	if code := serve(http.MethodDelete, "/origins?host=tenant.example.com", "", "secret").Code; code != http.StatusNoContent {
+		t.Errorf("expected 204 after removing, got %d", code)
+	}
+
+	if code := serve(http.MethodDelete, "/origins?host=tenant.example.com", "", "secret").Code; code != http.StatusNotFound {
+		t.Errorf("expected 404 for a unregistered host, got %d", code)
+	}
+
+	if origins, err := store.LoadOrigins(); err != nil || len(origins) != 0 {
+		t.Errorf("expected the removal to be persisted, got %+v %v", origins, err)
+	}
+}
@@ -0,0 +1,95 @@
+package sharedhttpcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+var errNoCACertificates = errors.New("No certificates found in CA file")
+
+//tlsVersions maps the names of TLS versions as they are configured to their crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//OriginTLSOptions configures the TLS connections to a origin server, see NewOriginTLSConfig
+type OriginTLSOptions struct {
+	//MinVersion is the minimum TLS version, like "1.2". If empty the default of the crypto/tls package is used
+	MinVersion string
+
+	//CipherSuites are the names of the cipher suites which may be used with TLS 1.2 and lower, like "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+	// The cipher suites of TLS 1.3 are not configurable. If empty the defaults of the crypto/tls package are used
+	CipherSuites []string
+
+	//CAFile is the path of a PEM file with the certificates of the certificate authorities which are trusted instead of the system pool,
+	// for origins with certificates of a private certificate authority
+	CAFile string
+
+	//ServerName is the name which is used to verify the certificate of the origin, if empty the hostname of the origin is used
+	ServerName string
+
+	//InsecureSkipVerify if true the certificate of the origin is not verified.
+	// DANGEROUS: anyone between the cache and the origin can read and change the responses, only use this for test origins
+	InsecureSkipVerify bool
+}
+
+//NewOriginTLSConfig creates the TLS config for connections to a origin server from the options.
+// The rootCAs are trusted if the options don't contain a CAFile, the system pool is used if they are nil
+func NewOriginTLSConfig(options OriginTLSOptions, rootCAs *x509.CertPool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		RootCAs:            rootCAs,
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+
+	if options.MinVersion != "" {
+		version, found := tlsVersions[options.MinVersion]
+		if !found {
+			return nil, fmt.Errorf("Invalid TLS version '%s'", options.MinVersion)
+		}
+
+		tlsConfig.MinVersion = version
+	}
+
+	for _, name := range options.CipherSuites {
+		id, err := cipherSuiteID(name)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	if options.CAFile != "" {
+		pem, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA file '%s': %w", options.CAFile, err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Invalid CA file '%s': %w", options.CAFile, errNoCACertificates)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+//cipherSuiteID returns the ID of the cipher suite with the name, insecure cipher suites are accepted since they have to be chosen explicitly
+func cipherSuiteID(name string) (uint16, error) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.Name == name {
+				return suite.ID, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("Unknown cipher suite '%s'", name)
+}
@@ -0,0 +1,80 @@
+package sharedhttpcache
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestNewOriginTLSConfig(t *testing.T) {
+	tlsConfig, err := NewOriginTLSConfig(OriginTLSOptions{
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected min version TLS 1.2, got %x", tlsConfig.MinVersion)
+	}
+	if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("expected the configured cipher suite, got %v", tlsConfig.CipherSuites)
+	}
+
+	if _, err := NewOriginTLSConfig(OriginTLSOptions{MinVersion: "2.0"}, nil); err == nil {
+		t.Error("expected error for invalid TLS version")
+	}
+
+	if _, err := NewOriginTLSConfig(OriginTLSOptions{CipherSuites: []string{"TLS_UNKNOWN"}}, nil); err == nil {
+		t.Error("expected error for unknown cipher suite")
+	}
+}
+
+func TestOriginTLSCAFile(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	caFile, err := ioutil.TempFile("", "origin-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+
+	err = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: origin.Certificate().Raw})
+	caFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Without the CA file the certificate of the test server is not trusted
+	tlsConfig, err := NewOriginTLSConfig(OriginTLSOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&http.Client{Transport: NewOriginTransport(tlsConfig)}).Get(origin.URL); err == nil {
+		t.Error("expected the certificate of the origin to be rejected")
+	}
+
+	tlsConfig, err = NewOriginTLSConfig(OriginTLSOptions{CAFile: caFile.Name()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := (&http.Client{Transport: NewOriginTransport(tlsConfig)}).Get(origin.URL)
+	if err != nil {
+		t.Fatalf("expected the certificate of the origin to be trusted, got: %s", err)
+	}
+	response.Body.Close()
+
+	if _, err := NewOriginTLSConfig(OriginTLSOptions{CAFile: os.DevNull}, nil); err == nil {
+		t.Error("expected error for a CA file without certificates")
+	}
+}
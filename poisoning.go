@@ -0,0 +1,177 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+//Modes of protection against web cache poisoning through unkeyed request headers, see CacheConfig.PoisoningProtection
+const (
+	//PoisoningProtectionWarn logs a warning when a response echoes the value of a unkeyed header, the response is still stored
+	PoisoningProtectionWarn = "warn"
+
+	//PoisoningProtectionStrip removes the unkeyed headers from cacheable requests before they are forwarded,
+	// so the origin can't use them to generate a response which is served to other clients
+	PoisoningProtectionStrip = "strip"
+
+	//PoisoningProtectionRefuse doesn't store responses which echo the value of a unkeyed header, a warning is logged
+	PoisoningProtectionRefuse = "refuse"
+)
+
+//MetricCachePoisoningSuspected is counted every time a response echoes the value of a unkeyed request header
+const MetricCachePoisoningSuspected = "cache.poisoning_suspected"
+
+//DefaultUnkeyedHeaders are the request headers which are not part of the cache key but are commonly used by origins
+// to generate URLs or route requests, so a attacker can use them to poison the cache for all clients
+var DefaultUnkeyedHeaders = []string{
+	"X-Forwarded-Host",
+	"X-Forwarded-Server",
+	"X-Forwarded-Scheme",
+	"X-Forwarded-Port",
+	"X-Forwarded-Prefix",
+	"X-Host",
+	"X-Original-Host",
+	"X-Original-URL",
+	"X-Rewrite-URL",
+	"X-HTTP-Method-Override",
+	"Forwarded",
+}
+
+//minEchoLength is the minimum length of a header value before it is searched for in the response,
+// shorter values like "on" or "1" occur in most responses by accident
+const minEchoLength = 4
+
+//unkeyedHeaders returns the unkeyed headers of the config, DefaultUnkeyedHeaders if none are configured
+func unkeyedHeaders(cacheConfig *CacheConfig) []string {
+	if cacheConfig.UnkeyedHeaders != nil {
+		return cacheConfig.UnkeyedHeaders
+	}
+
+	return DefaultUnkeyedHeaders
+}
+
+//stripUnkeyedHeaders removes the unkeyed headers from a cacheable request if the PoisoningProtection is PoisoningProtectionStrip
+// The request is cloned if it is modified
+func stripUnkeyedHeaders(cacheConfig *CacheConfig, req *http.Request) *http.Request {
+	if cacheConfig.PoisoningProtection != PoisoningProtectionStrip || !isRequestCacheable(cacheConfig, req) {
+		return req
+	}
+
+	var strippedReq *http.Request
+	for _, name := range unkeyedHeaders(cacheConfig) {
+		if _, found := req.Header[http.CanonicalHeaderKey(name)]; !found {
+			continue
+		}
+
+		if strippedReq == nil {
+			strippedReq = req.Clone(req.Context())
+		}
+
+		strippedReq.Header.Del(name)
+	}
+
+	if strippedReq == nil {
+		return req
+	}
+
+	return strippedReq
+}
+
+//findEchoedUnkeyedHeaders returns the names of the unkeyed request headers of which the value occurs in the header or body of the response
+// Headers listed in the Vary header of the response are part of the secondary key, so they are not unkeyed
+func findEchoedUnkeyedHeaders(cacheConfig *CacheConfig, req *http.Request, response *http.Response) []string {
+	varyFields := getSecondaryKeyFields(cacheConfig, response.Header)
+
+	candidates := map[string]string{}
+	for _, name := range unkeyedHeaders(cacheConfig) {
+		name = http.CanonicalHeaderKey(name)
+
+		value := strings.TrimSpace(req.Header.Get(name))
+		if len(value) < minEchoLength || containsString(varyFields, name) {
+			continue
+		}
+
+		candidates[name] = value
+	}
+
+	//Most clients don't send unkeyed headers, the body doesn't have to be read for them
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	echoed := []string{}
+	for name, value := range candidates {
+		if headerContainsValue(response.Header, value) {
+			echoed = append(echoed, name)
+			delete(candidates, name)
+		}
+	}
+
+	body := readBodyForInspection(cacheConfig, response)
+	for name, value := range candidates {
+		if bytes.Contains(body, []byte(value)) {
+			echoed = append(echoed, name)
+		}
+	}
+
+	return echoed
+}
+
+//headerContainsValue checks if any value of the header contains the value
+func headerContainsValue(header http.Header, value string) bool {
+	for _, values := range header {
+		for _, headerValue := range values {
+			if strings.Contains(headerValue, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//readBodyForInspection returns the decoded body of the response and replaces the body so it can still be served
+// nil is returned if the body can't be decoded
+func readBodyForInspection(cacheConfig *CacheConfig, response *http.Response) []byte {
+	if response.Body == nil {
+		return nil
+	}
+
+	coding, supported := contentCodingOf(cacheConfig, response.Header)
+	if !supported {
+		return nil
+	}
+
+	body, encoded, err := readDecodedBody(coding, response)
+	response.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+	if err != nil {
+		return nil
+	}
+
+	return body
+}
+
+//allowedByPoisoningProtection checks if the response may be stored according to the PoisoningProtection of the config.
+// A warning is logged if the response echoes the value of a unkeyed header
+func (controller *CacheController) allowedByPoisoningProtection(cacheConfig *CacheConfig, req *http.Request, response *http.Response, cacheKey string) bool {
+	if cacheConfig.PoisoningProtection == "" {
+		return true
+	}
+
+	echoed := findEchoedUnkeyedHeaders(cacheConfig, req, response)
+	if len(echoed) == 0 {
+		return true
+	}
+
+	controller.incrMetric(MetricCachePoisoningSuspected, 1, nil)
+	controller.requestLogger(req).WithFields(logrus.Fields{
+		"cache-key": cacheKey,
+		"headers":   echoed,
+	}).Warning("Response echoes unkeyed request headers, it can be used to poison the cache")
+
+	return cacheConfig.PoisoningProtection != PoisoningProtectionRefuse
+}
@@ -0,0 +1,78 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPoisoningProtection(t *testing.T) {
+	tests := []struct {
+		mode         string
+		expectStored bool
+		expectEcho   bool
+	}{
+		{mode: "", expectStored: true, expectEcho: true},
+		{mode: PoisoningProtectionWarn, expectStored: true, expectEcho: true},
+		{mode: PoisoningProtectionRefuse, expectStored: false, expectEcho: true},
+		{mode: PoisoningProtectionStrip, expectStored: true, expectEcho: false},
+	}
+
+	for _, test := range tests {
+		originRequests := 0
+		controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			originRequests++
+
+			//The origin generates a absolute URL from the forwarded host
+			forwardedHost := req.Header.Get("X-Forwarded-Host")
+			if forwardedHost == "" {
+				forwardedHost = req.Host
+			}
+
+			rw.Header().Set(CacheControlHeader, "max-age=60")
+			_, _ = rw.Write([]byte(`<script src="https://` + forwardedHost + `/app.js"></script>`))
+		}))
+
+		controller.DefaultCacheConfig.PoisoningProtection = test.mode
+
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.Header.Set("X-Forwarded-Host", "evil.example")
+
+		_, body := doTestRequest(t, controller, req)
+		if echoed := body == `<script src="https://evil.example/app.js"></script>`; echoed != test.expectEcho {
+			t.Errorf("%s: expected echo %v, got body '%s'", test.mode, test.expectEcho, body)
+		}
+
+		doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if stored := originRequests == 1; stored != test.expectStored {
+			t.Errorf("%s: expected stored %v, got %d origin requests", test.mode, test.expectStored, originRequests)
+		}
+
+		closeOrigin()
+	}
+}
+
+func TestFindEchoedUnkeyedHeaders(t *testing.T) {
+	cacheConfig := NewCacheConfig()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-Forwarded-Host", "evil.example")
+	req.Header.Set("X-Original-URL", "/admin")
+
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Location": {"https://evil.example/login"}},
+		Body:       http.NoBody,
+	}
+
+	echoed := findEchoedUnkeyedHeaders(cacheConfig, req, response)
+	if len(echoed) != 1 || echoed[0] != "X-Forwarded-Host" {
+		t.Errorf("expected X-Forwarded-Host to be echoed, got %v", echoed)
+	}
+
+	//A header in the Vary header is part of the cache key
+	response.Header.Set(VaryHeader, "X-Forwarded-Host")
+	if echoed := findEchoedUnkeyedHeaders(cacheConfig, req, response); len(echoed) != 0 {
+		t.Errorf("expected no echoed headers when the header is keyed, got %v", echoed)
+	}
+}
@@ -0,0 +1,109 @@
+package sharedhttpcache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+//maxPooledBufferSize is the maximum capacity of a buffer which is returned to the pool
+// bigger buffers are left to the garbage collector so a single large response doesn't pin memory
+const maxPooledBufferSize = 64 * 1024
+
+//copyBufferSize is the size of the buffers used to copy bodies, the same size io.Copy uses
+const copyBufferSize = 32 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+//getBuffer gets a empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+//putBuffer returns a buffer to the pool, the buffer may not be used after it is returned
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+var bufioReaderPool sync.Pool
+
+//getBufioReader gets a buffered reader for the given reader from the pool
+func getBufioReader(reader io.Reader) *bufio.Reader {
+	if pooled := bufioReaderPool.Get(); pooled != nil {
+		bufioReader := pooled.(*bufio.Reader)
+		bufioReader.Reset(reader)
+		return bufioReader
+	}
+
+	return bufio.NewReader(reader)
+}
+
+//putBufioReader returns a buffered reader to the pool, the reader may not be used after it is returned
+func putBufioReader(bufioReader *bufio.Reader) {
+	//Drop the reference to the underlying reader so it can be garbage collected
+	bufioReader.Reset(nil)
+	bufioReaderPool.Put(bufioReader)
+}
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+//copyWithPooledBuffer copies from src to dst like io.Copy but uses a buffer from the pool
+func copyWithPooledBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	return copyWithBufferPool(&copyBufferPool, dst, src)
+}
+
+//copyWithBufferPool copies from src to dst like io.Copy but uses a buffer from the given pool
+func copyWithBufferPool(pool *sync.Pool, dst io.Writer, src io.Reader) (int64, error) {
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+//getCopyBufferPool returns the pool of buffers used to copy bodies to the client, sized according to CopyBufferSize
+func (controller *CacheController) getCopyBufferPool() *sync.Pool {
+	controller.copyBufferPoolOnce.Do(func() {
+		size := controller.CopyBufferSize
+		if size <= 0 || size == copyBufferSize {
+			controller.copyBufferPool = &copyBufferPool
+			return
+		}
+
+		controller.copyBufferPool = &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		}
+	})
+
+	return controller.copyBufferPool
+}
+
+//releasingReadCloser calls release once when it is closed
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (readCloser *releasingReadCloser) Close() error {
+	err := readCloser.ReadCloser.Close()
+	readCloser.once.Do(readCloser.release)
+	return err
+}
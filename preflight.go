@@ -0,0 +1,85 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//preflightKeyFields are the request headers a preflight response depends on, they are always part of its secondary key
+// even if the origin doesn't list them in the Vary header, so a preflight response is never served to a other origin
+var preflightKeyFields = []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}
+
+//isRequestCacheable checks if the response to the request can be served from and stored in the cache,
+// which is the case if the method is safe and cacheable or if the request is a cacheable CORS preflight
+func isRequestCacheable(config *CacheConfig, req *http.Request) bool {
+	return (isMethodSafe(config, req.Method) && isMethodCacheable(config, req.Method)) || isCacheablePreflight(config, req)
+}
+
+//isCacheablePreflight checks if the request is a CORS preflight request and CachePreflight is enabled
+// A preflight is a OPTIONS request with a Origin and Access-Control-Request-Method header
+func isCacheablePreflight(config *CacheConfig, req *http.Request) bool {
+	return config.CachePreflight &&
+		req.Method == http.MethodOptions &&
+		firstHeaderValue(req.Header, "Origin") != "" &&
+		firstHeaderValue(req.Header, "Access-Control-Request-Method") != ""
+}
+
+//addPreflightKeyFields adds the preflightKeyFields to the secondary key fields of a preflight response which doesn't vary on them
+func addPreflightKeyFields(config *CacheConfig, req *http.Request, secondaryKeyFields []string) []string {
+	if !isCacheablePreflight(config, req) {
+		return secondaryKeyFields
+	}
+
+	for _, field := range preflightKeyFields {
+		found := false
+		for _, existing := range secondaryKeyFields {
+			if strings.EqualFold(existing, field) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			secondaryKeyFields = append(secondaryKeyFields, field)
+		}
+	}
+
+	return secondaryKeyFields
+}
+
+//preflightTTL returns the ttl of a preflight response, which is the PreflightTTL of the config or the Access-Control-Max-Age of the response
+// Zero is returned if neither is set, the response is then not stored
+func preflightTTL(config *CacheConfig, resp *http.Response) time.Duration {
+	if config.PreflightTTL > 0 {
+		return config.PreflightTTL
+	}
+
+	maxAge, err := strconv.ParseInt(strings.TrimSpace(resp.Header.Get("Access-Control-Max-Age")), 10, 64)
+	if err != nil || maxAge <= 0 {
+		return 0
+	}
+
+	return time.Duration(maxAge) * time.Second
+}
+
+//evaluatePreflightRules decides if a response to a cacheable preflight request is stored, every evaluated rule is recorded in the decision.
+// Preflight responses rarely contain explicit freshness information, so they are stored for the preflight ttl instead
+func evaluatePreflightRules(config *CacheConfig, resp *http.Response, decision *Decision) bool {
+	successful := resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent
+	if !decision.record(RulePreflight, successful, "only successful preflight responses are stored") {
+		return false
+	}
+
+	cc := parseResponseCacheControl(resp.Header)
+	if !decision.record(RuleResponseNoStore, !cc.noStore, "the response contains the no-store directive") {
+		return false
+	}
+
+	if !decision.record(RulePrivate, !cc.private, "the response contains the private directive") {
+		return false
+	}
+
+	return decision.record(RulePreflight, preflightTTL(config, resp) > 0, "the preflight response has no Access-Control-Max-Age and no PreflightTTL is configured")
+}
@@ -0,0 +1,79 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPreflightCaching(t *testing.T) {
+	requests := 0
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+
+		rw.Header().Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		rw.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.CachePreflight = true
+	controller.DefaultCacheConfig.PreflightTTL = time.Minute
+
+	preflight := func(origin string) *http.Response {
+		req := httptest.NewRequest(http.MethodOptions, "http://"+host+"/api", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+
+		response, _ := doTestRequest(t, controller, req)
+		return response
+	}
+
+	preflight("https://a.example.com")
+	response := preflight("https://a.example.com")
+	if requests != 1 {
+		t.Errorf("expected the second preflight to be served from the cache, origin got %d requests", requests)
+	}
+	if allowed := response.Header.Get("Access-Control-Allow-Origin"); allowed != "https://a.example.com" {
+		t.Errorf("expected the cached allowed origin, got '%s'", allowed)
+	}
+
+	//The origin didn't vary on Origin, but a preflight of a other origin must never get the stored response
+	response = preflight("https://b.example.com")
+	if requests != 2 {
+		t.Errorf("expected a preflight of a other origin to be forwarded, origin got %d requests", requests)
+	}
+	if allowed := response.Header.Get("Access-Control-Allow-Origin"); allowed != "https://b.example.com" {
+		t.Errorf("expected the allowed origin of the new response, got '%s'", allowed)
+	}
+
+	//A OPTIONS request which isn't a preflight is never stored
+	for i := 0; i < 2; i++ {
+		doTestRequest(t, controller, httptest.NewRequest(http.MethodOptions, "http://"+host+"/api", nil))
+	}
+	if requests != 4 {
+		t.Errorf("expected OPTIONS requests without Origin to be forwarded, origin got %d requests", requests)
+	}
+}
+
+func TestPreflightTTL(t *testing.T) {
+	config := NewCacheConfig()
+	config.CachePreflight = true
+
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	if ttl := preflightTTL(config, resp); ttl != 0 {
+		t.Errorf("expected no ttl without Access-Control-Max-Age, got %s", ttl)
+	}
+
+	resp.Header.Set("Access-Control-Max-Age", "600")
+	if ttl := preflightTTL(config, resp); ttl != 10*time.Minute {
+		t.Errorf("expected the Access-Control-Max-Age as ttl, got %s", ttl)
+	}
+
+	config.PreflightTTL = time.Minute
+	if ttl := preflightTTL(config, resp); ttl != time.Minute {
+		t.Errorf("expected the PreflightTTL to take precedence, got %s", ttl)
+	}
+}
@@ -0,0 +1,238 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DefaultPrometheusBuckets are the upper bounds in seconds of the buckets of duration histograms if Buckets of a PrometheusSink is empty
+var DefaultPrometheusBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+//PrometheusContentType is the content type of the Prometheus text exposition format
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+//PrometheusSink is a MetricsSink which keeps the metrics in memory and serves them in the Prometheus text format.
+// Counters are exposed with the "_total" suffix and durations as histograms in seconds with the "_seconds" suffix,
+// dots in metric names are replaced with underscores, so "cache.hit" becomes "sharedhttpcache_cache_hit_total".
+// The sink is a http.Handler which is meant to be served on a separate listener, not to the public
+type PrometheusSink struct {
+	//Namespace is prepended to the name of every metric, like "sharedhttpcache"
+	Namespace string
+
+	//Buckets are the upper bounds in seconds of the buckets of duration histograms, if empty DefaultPrometheusBuckets is used.
+	// They must be sorted and must not be changed after the first duration is observed
+	Buckets []float64
+
+	mutex   sync.Mutex
+	metrics map[string]*prometheusMetric
+}
+
+//prometheusMetric holds the series of a counter or histogram, keyed by their formatted labels
+type prometheusMetric struct {
+	histogram bool
+	series    map[string]*prometheusSeries
+}
+
+//prometheusSeries is the value of a counter or the observations of a histogram with one set of labels
+type prometheusSeries struct {
+	value float64
+
+	//buckets are the non cumulative counts of every bucket of a histogram, the last bucket is +Inf
+	buckets []uint64
+	count   uint64
+}
+
+//NewPrometheusSink creates a PrometheusSink which prepends the namespace to all metric names
+func NewPrometheusSink(namespace string) *PrometheusSink {
+	return &PrometheusSink{
+		Namespace: namespace,
+	}
+}
+
+//IncrCounter increments the counter with the tags as labels
+func (sink *PrometheusSink) IncrCounter(name string, value int64, tags map[string]string) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	series := sink.series(sink.metricName(name)+"_total", false, prometheusLabels(tags))
+	series.value += float64(value)
+}
+
+//ObserveDuration adds the duration in seconds to the histogram with the tags as labels
+func (sink *PrometheusSink) ObserveDuration(name string, duration time.Duration, tags map[string]string) {
+	buckets := sink.buckets()
+	seconds := duration.Seconds()
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	series := sink.series(sink.metricName(name)+"_seconds", true, prometheusLabels(tags))
+	if series.buckets == nil {
+		series.buckets = make([]uint64, len(buckets)+1)
+	}
+
+	series.buckets[sort.SearchFloat64s(buckets, seconds)]++
+	series.value += seconds
+	series.count++
+}
+
+//series returns the series of the metric with the labels, it is created if it doesn't exist. The mutex must be held
+func (sink *PrometheusSink) series(name string, histogram bool, labels string) *prometheusSeries {
+	if sink.metrics == nil {
+		sink.metrics = map[string]*prometheusMetric{}
+	}
+
+	metric := sink.metrics[name]
+	if metric == nil {
+		metric = &prometheusMetric{histogram: histogram, series: map[string]*prometheusSeries{}}
+		sink.metrics[name] = metric
+	}
+
+	series := metric.series[labels]
+	if series == nil {
+		series = &prometheusSeries{}
+		metric.series[labels] = series
+	}
+
+	return series
+}
+
+func (sink *PrometheusSink) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	sink.writeMetrics(buf)
+
+	resp.Header().Set("Content-Type", PrometheusContentType)
+	resp.Write(buf.Bytes())
+}
+
+//writeMetrics writes all metrics in the text format, sorted by name and labels so the output is stable
+func (sink *PrometheusSink) writeMetrics(buf *bytes.Buffer) {
+	buckets := sink.buckets()
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	names := make([]string, 0, len(sink.metrics))
+	for name := range sink.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		metric := sink.metrics[name]
+
+		labelSets := make([]string, 0, len(metric.series))
+		for labels := range metric.series {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+
+		if !metric.histogram {
+			buf.WriteString("# TYPE " + name + " counter\n")
+
+			for _, labels := range labelSets {
+				writePrometheusSample(buf, name, labels, "", metric.series[labels].value)
+			}
+
+			continue
+		}
+
+		buf.WriteString("# TYPE " + name + " histogram\n")
+
+		for _, labels := range labelSets {
+			series := metric.series[labels]
+
+			cumulative := uint64(0)
+			for index, count := range series.buckets {
+				cumulative += count
+
+				le := "+Inf"
+				if index < len(buckets) {
+					le = strconv.FormatFloat(buckets[index], 'g', -1, 64)
+				}
+
+				writePrometheusSample(buf, name+"_bucket", labels, `le="`+le+`"`, float64(cumulative))
+			}
+
+			writePrometheusSample(buf, name+"_sum", labels, "", series.value)
+			writePrometheusSample(buf, name+"_count", labels, "", float64(series.count))
+		}
+	}
+}
+
+func (sink *PrometheusSink) buckets() []float64 {
+	if len(sink.Buckets) > 0 {
+		return sink.Buckets
+	}
+
+	return DefaultPrometheusBuckets
+}
+
+//metricName converts the name of a metric to a valid Prometheus metric name with the namespace
+func (sink *PrometheusSink) metricName(name string) string {
+	if sink.Namespace != "" {
+		name = sink.Namespace + "_" + name
+	}
+
+	return sanitizePrometheusName(name)
+}
+
+//sanitizePrometheusName replaces all characters which are not allowed in metric and label names with underscores
+func sanitizePrometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return '_'
+	}, name)
+}
+
+//prometheusLabelEscaper escapes label values as required by the text format
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//prometheusLabels formats the tags as the labels of a sample sorted by name, like `layer="0",origin="example.com"`
+func prometheusLabels(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	labels := make([]string, 0, len(tags))
+	for key, value := range tags {
+		labels = append(labels, sanitizePrometheusName(key)+`="`+prometheusLabelEscaper.Replace(value)+`"`)
+	}
+	sort.Strings(labels)
+
+	return strings.Join(labels, ",")
+}
+
+//writePrometheusSample writes a single line of the text format, extra is a label which is added after the other labels
+func writePrometheusSample(buf *bytes.Buffer, name, labels, extra string, value float64) {
+	buf.WriteString(name)
+
+	if labels != "" || extra != "" {
+		buf.WriteByte('{')
+		buf.WriteString(labels)
+		if labels != "" && extra != "" {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(extra)
+		buf.WriteByte('}')
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	buf.WriteByte('\n')
+}
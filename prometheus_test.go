@@ -0,0 +1,54 @@
+package sharedhttpcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusSink(t *testing.T) {
+	sink := NewPrometheusSink("sharedhttpcache")
+	sink.Buckets = []float64{0.1, 1}
+
+	sink.IncrCounter(MetricCacheHit, 1, nil)
+	sink.IncrCounter(MetricCacheHit, 2, nil)
+	sink.IncrCounter(MetricCacheEviction, 1, map[string]string{"layer": "0"})
+	sink.ObserveDuration(MetricOriginLatency, 50*time.Millisecond, map[string]string{"origin": "example.com", "status": "2xx"})
+	sink.ObserveDuration(MetricOriginLatency, 2*time.Second, map[string]string{"origin": "example.com", "status": "2xx"})
+
+	recorder := httptest.NewRecorder()
+	sink.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != PrometheusContentType {
+		t.Errorf("expected the prometheus content type, got '%s'", contentType)
+	}
+
+	body, _ := ioutil.ReadAll(recorder.Body)
+
+	expected := []string{
+		"# TYPE sharedhttpcache_cache_hit_total counter\nsharedhttpcache_cache_hit_total 3\n",
+		`sharedhttpcache_cache_eviction_total{layer="0"} 1`,
+		"# TYPE sharedhttpcache_origin_latency_seconds histogram\n",
+		`sharedhttpcache_origin_latency_seconds_bucket{origin="example.com",status="2xx",le="0.1"} 1`,
+		`sharedhttpcache_origin_latency_seconds_bucket{origin="example.com",status="2xx",le="1"} 1`,
+		`sharedhttpcache_origin_latency_seconds_bucket{origin="example.com",status="2xx",le="+Inf"} 2`,
+		`sharedhttpcache_origin_latency_seconds_sum{origin="example.com",status="2xx"} 2.05`,
+		`sharedhttpcache_origin_latency_seconds_count{origin="example.com",status="2xx"} 2`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("expected the output to contain '%s', got:\n%s", line, body)
+		}
+	}
+}
+
+func TestPrometheusLabelEscaping(t *testing.T) {
+	labels := prometheusLabels(map[string]string{"path": "a\"b\\c\nd", "content-type": "x"})
+	if labels != `content_type="x",path="a\"b\\c\nd"` {
+		t.Errorf("unexpected labels: %s", labels)
+	}
+}
@@ -2,8 +2,11 @@ package sharedhttpcache
 
 import (
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -103,6 +106,11 @@ func proxyToOrigin(forwardContext context.Context, transport http.RoundTripper,
 		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
 
+	//Configured headers are set last so a client can't override them
+	for name, values := range forwardConfig.RequestHeaders {
+		outreq.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+
 	//Change the protocol of the url to the protocol specified in the forward config
 	if forwardConfig.TLS {
 		outreq.URL.Scheme = "https"
@@ -110,9 +118,12 @@ func proxyToOrigin(forwardContext context.Context, transport http.RoundTripper,
 		outreq.URL.Scheme = "http"
 	}
 
-	//Forward the original hostname for which the request was intended
-	outreq.URL.Host = req.Host
-	outreq.Host = req.Host
+	//The origin can use a different URL layout than the one used by clients
+	rewriteOriginPath(forwardConfig, outreq.URL)
+
+	//Forward the original hostname for which the request was intended, unless the origin expects its own hostname
+	outreq.URL.Host = originHost(forwardConfig, req)
+	outreq.Host = outreq.URL.Host
 
 	//Forward request to origin server
 	response, err := transport.RoundTrip(outreq)
@@ -120,6 +131,12 @@ func proxyToOrigin(forwardContext context.Context, transport http.RoundTripper,
 		return nil, err
 	}
 
+	//Interim responses are handled by the transport, the only 1xx which can be returned is the final 101
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		response.Body.Close()
+		return nil, errSwitchingProtocols
+	}
+
 	removeConnectionHeaders(response.Header)
 
 	for _, h := range hopHeaders {
@@ -129,13 +146,149 @@ func proxyToOrigin(forwardContext context.Context, transport http.RoundTripper,
 	return response, nil
 }
 
-//writeHTTPResponse writes a response the response writer
-func writeHTTPResponse(rw http.ResponseWriter, response *http.Response) error {
+//originHost returns the host to which a request is forwarded
+func originHost(forwardConfig *ForwardConfig, req *http.Request) string {
+	//The configured host can be a internationalized hostname, the Host header must contain its ASCII form
+	if forwardConfig.SendOriginHost && forwardConfig.Host != "" {
+		return asciiHost(forwardConfig.Host)
+	}
+
+	return req.Host
+}
+
+//rewriteOriginPath rewrites the path of a URL from the layout of the client to the layout of the origin
+// using the StripPathPrefix and AddPathPrefix of the forward config
+func rewriteOriginPath(forwardConfig *ForwardConfig, u *url.URL) {
+	if forwardConfig.StripPathPrefix == "" && forwardConfig.AddPathPrefix == "" {
+		return
+	}
+
+	rawPath := u.EscapedPath()
+
+	u.Path = replacePathPrefix(u.Path, forwardConfig.StripPathPrefix, forwardConfig.AddPathPrefix)
+
+	//The escaped path is only kept if it still encodes the rewritten path, otherwise it is generated from the path
+	u.RawPath = replacePathPrefix(rawPath, forwardConfig.StripPathPrefix, forwardConfig.AddPathPrefix)
+	if u.EscapedPath() != u.RawPath {
+		u.RawPath = ""
+	}
+}
+
+//clientPath rewrites a path from the layout of the origin back to the layout of the client, it is the inverse of rewriteOriginPath
+func clientPath(forwardConfig *ForwardConfig, path string) string {
+	if forwardConfig.StripPathPrefix == "" && forwardConfig.AddPathPrefix == "" {
+		return path
+	}
+
+	return replacePathPrefix(path, forwardConfig.AddPathPrefix, forwardConfig.StripPathPrefix)
+}
+
+//replacePathPrefix replaces the old prefix of the path with the new prefix, the path is returned unchanged if it doesn't have the old prefix
+// The old prefix only matches whole path segments, so "/app" matches "/app" and "/app/x" but not "/application"
+func replacePathPrefix(path, oldPrefix, newPrefix string) string {
+	oldPrefix = strings.TrimSuffix(oldPrefix, "/")
+
+	if oldPrefix != "" {
+		rest := strings.TrimPrefix(path, oldPrefix)
+		if len(rest) == len(path) || (rest != "" && rest[0] != '/') {
+			return path
+		}
+
+		path = rest
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	if newPrefix != "" {
+		path = strings.TrimSuffix(newPrefix, "/") + path
+	}
+
+	return path
+}
+
+//followRedirects follows 301 and 302 redirects returned by the origin server as configured in the forward config
+// Only redirects to the same host are followed so the cache can't be used to proxy requests to arbitrary hosts.
+// If a redirect can't be followed the last redirect response is returned
+func followRedirects(forwardContext context.Context, transport http.RoundTripper, forwardConfig *ForwardConfig, req *http.Request, response *http.Response) (*http.Response, error) {
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return response, nil
+	}
+
+	currentURL := &url.URL{
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	}
+
+	//Relative locations are relative to the URL requested from the origin
+	rewriteOriginPath(forwardConfig, currentURL)
+
+	for hop := 0; hop < forwardConfig.FollowRedirects; hop++ {
+		if response.StatusCode != http.StatusMovedPermanently && response.StatusCode != http.StatusFound {
+			return response, nil
+		}
+
+		location, err := currentURL.Parse(response.Header.Get("Location"))
+		if err != nil || response.Header.Get("Location") == "" {
+			return response, nil
+		}
+
+		//Only follow redirects to the same host, absolute locations contain the host the origin received
+		if location.Host != "" && !strings.EqualFold(location.Host, originHost(forwardConfig, req)) {
+			return response, nil
+		}
+
+		//The location uses the layout of the origin, proxyToOrigin expects the layout of the client
+		redirectReq := req.Clone(forwardContext)
+		redirectReq.URL.Path = clientPath(forwardConfig, location.Path)
+		redirectReq.URL.RawPath = ""
+		redirectReq.URL.RawQuery = location.RawQuery
+
+		redirectResponse, err := proxyToOrigin(forwardContext, transport, forwardConfig, redirectReq)
+		if err != nil {
+			//The previous response is not returned, so its connection must be released here
+			response.Body.Close()
+			return nil, err
+		}
+
+		//Discard the body of the redirect so the connection can be reused
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+
+		response = redirectResponse
+		currentURL = location
+	}
+
+	return response, nil
+}
+
+//writeHTTPResponse writes a response the response writer, without the headers listed in StripResponseHeaders
+// The body is flushed to the client according to the FlushInterval of the controller
+func (controller *CacheController) writeHTTPResponse(cacheConfig *CacheConfig, rw http.ResponseWriter, response *http.Response) error {
 
 	//TODO add support for Trailers https://golang.org/src/net/http/httputil/reverseproxy.go?s=3318:3379#L276
 
+	//Strip the headers here so they are removed from every response, including responses which are never stored
+	// and stored responses which were stored before the header was added to the config
+	stripResponseHeaders(cacheConfig, response.Header)
+
+	//The client should get the Cache-Control header the origin meant for it, not the targeted field meant for the cache
+	restoreOriginCacheControl(response.Header)
+
+	//The ID of the current request is already set, a stored response can contain the ID of the request which fetched it
+	requestIDHeader := ""
+	if controller.RequestIDHeader != "" {
+		requestIDHeader = http.CanonicalHeaderKey(controller.RequestIDHeader)
+	}
+
 	//Set all response headers in the response writer
 	for key, values := range response.Header {
+		if key == requestIDHeader {
+			continue
+		}
+
 		rw.Header()[key] = values
 	}
 
@@ -143,53 +296,137 @@ func writeHTTPResponse(rw http.ResponseWriter, response *http.Response) error {
 
 	//Close the body before returning
 	defer response.Body.Close()
-	_, err := io.Copy(rw, response.Body)
+
+	bufferPool := controller.getCopyBufferPool()
+
+	if flusher, ok := rw.(http.Flusher); ok {
+		//Streams are send to the client as they arrive instead of being buffered
+		flushInterval := controller.FlushInterval
+		if isStreamingResponse(response) {
+			flushInterval = -1
+		}
+
+		if flushInterval < 0 {
+			return copyStream(rw, flusher, bufferPool, response.Body)
+		}
+
+		if flushInterval > 0 {
+			return copyWithFlushInterval(rw, flusher, flushInterval, bufferPool, response.Body)
+		}
+	}
+
+	//Hand the body directly to the response writer if it can read from it.
+	// When the body is a file from a disk layer the http server will use sendfile instead of copying through userspace buffers.
+	// Other bodies are only handed over if no buffer size is configured, since the response writer uses its own buffers
+	if readerFrom, ok := rw.(io.ReaderFrom); ok {
+		if _, isFile := response.Body.(*os.File); isFile || controller.CopyBufferSize <= 0 {
+			_, err := readerFrom.ReadFrom(response.Body)
+			return err
+		}
+	}
+
+	_, err := copyWithBufferPool(bufferPool, rw, response.Body)
 
 	return err
 }
 
+//getResponseAge calculates the current age of a response in seconds, section 4.2.3 of RFC 7234
+// The response is assumed to be received just now, its Age header must be corrected or current
 func getResponseAge(response *http.Response) int64 {
+	freshness := &entryFreshness{ageValue: -1, responseTime: time.Now().Unix()}
+
+	if date, err := http.ParseTime(response.Header.Get(DateHeader)); err == nil {
+		freshness.date = date.Unix()
+	}
 
-	apparentAge := int64(0)
+	if ageValue, valid := parseAgeHeader(response.Header); valid {
+		freshness.ageValue = ageValue
+	}
 
-	dateString := response.Header.Get(DateHeader)
-	if dateString != "" {
-		date, err := http.ParseTime(dateString)
-		if err == nil {
+	return freshness.age()
+}
 
-			//Get the second difference between date and now
-			// this is the apparent_age method described in section 4.2.3 of RFC 7234
-			apparentAge = int64(time.Since(date).Seconds())
-			if apparentAge < 0 {
-				apparentAge = 0
-			}
+//correctAgeHeader replaces the Age header of a response received from the origin with the corrected_initial_age,
+// so the time the response spent in upstream caches and in transit is accounted for in the stored entry and passed on to the client.
+// Section 4.2.3 of RFC 7234. Responses without a Age header were not served by a upstream cache and are left unchanged
+func correctAgeHeader(response *http.Response, requestTime, responseTime time.Time) {
+	ageValue, valid := parseAgeHeader(response.Header)
+	if !valid {
+		return
+	}
 
-		}
+	//The response delay is rounded up since the age must never be underestimated
+	responseDelay := int64((responseTime.Sub(requestTime) + time.Second - 1) / time.Second)
+	if responseDelay < 0 {
+		responseDelay = 0
 	}
 
-	if ageHeader := response.Header.Get(AgeHeader); ageHeader != "" {
-		ageValue, err := strconv.ParseInt(ageHeader, 10, 0)
-		if err == nil {
+	freshness := &entryFreshness{
+		ageValue:     capDeltaSeconds(ageValue + responseDelay),
+		responseTime: responseTime.Unix(),
+	}
+
+	if date, err := http.ParseTime(response.Header.Get(DateHeader)); err == nil {
+		freshness.date = date.Unix()
+	}
 
-			//TODO correct age by adding response_delay
+	//The resident time is zero since the response was just received
+	response.Header.Set(AgeHeader, strconv.FormatInt(freshness.age(), 10))
+}
+
+//parseAgeHeader parses the Age header of a response
+// If the header contains multiple values only the first is used, the header is ignored if the value is not a non-negative integer.
+// Section 5.1 of RFC 9111
+func parseAgeHeader(header http.Header) (int64, bool) {
+	values := header[AgeHeader]
+	if len(values) == 0 {
+		return 0, false
+	}
 
-			return ageValue + apparentAge
+	//Both multiple header lines and a comma separated list are treated the same
+	first := strings.TrimSpace(strings.SplitN(values[0], ",", 2)[0])
+	if first == "" {
+		return 0, false
+	}
+
+	//Only digits are allowed, this rejects signs, decimals and parameters
+	for _, char := range first {
+		if char < '0' || char > '9' {
+			return 0, false
 		}
 	}
 
-	return apparentAge
+	age, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		//The only possible error at this point is a overflow
+		return maxDeltaSeconds, true
+	}
+
+	return capDeltaSeconds(age), true
 }
 
-//writeCachedResponse writes a cached response to a response writer
-// this function should be used to write cached responses because it modifies the response to comply with the RFC's
-func writeCachedResponse(rw http.ResponseWriter, cachedResponse *http.Response, ttl time.Duration) error {
+//maxDeltaSeconds is the greatest delta-seconds value a cache should transmit or use
+// Section 1.2.1 of RFC 7234
+const maxDeltaSeconds = int64(2147483648)
 
-	age := getResponseAge(cachedResponse)
+//capDeltaSeconds caps a amount of seconds at maxDeltaSeconds
+// A negative amount can only be the result of a integer overflow so it is also capped
+func capDeltaSeconds(seconds int64) int64 {
+	if seconds > maxDeltaSeconds || seconds < 0 {
+		return maxDeltaSeconds
+	}
+
+	return seconds
+}
+
+//writeCachedResponse writes a cached response with the given age to a response writer
+// this function should be used to write cached responses because it modifies the response to comply with the RFC's
+func (controller *CacheController) writeCachedResponse(cacheConfig *CacheConfig, rw http.ResponseWriter, cachedResponse *http.Response, age int64) error {
 
 	//If the age is positive we add the header. Negative ages are not allowed
 	if age >= 0 {
 		cachedResponse.Header.Set(AgeHeader, strconv.FormatInt(age, 10))
 	}
 
-	return writeHTTPResponse(rw, cachedResponse)
+	return controller.writeHTTPResponse(cacheConfig, rw, cachedResponse)
 }
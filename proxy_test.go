@@ -0,0 +1,359 @@
+package sharedhttpcache
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAgeHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		age    int64
+		valid  bool
+	}{
+		{name: "missing", values: nil, valid: false},
+		{name: "empty", values: []string{""}, valid: false},
+		{name: "valid", values: []string{"7200"}, age: 7200, valid: true},
+		{name: "whitespace", values: []string{" 7200 "}, age: 7200, valid: true},
+		{name: "duplicate zero first", values: []string{"0, 7200"}, age: 0, valid: true},
+		{name: "duplicate old first", values: []string{"7200, 0"}, age: 7200, valid: true},
+		{name: "duplicate zero first two lines", values: []string{"0", "7200"}, age: 0, valid: true},
+		{name: "duplicate old first two lines", values: []string{"7200", "0"}, age: 7200, valid: true},
+		{name: "float", values: []string{"7200.0"}, valid: false},
+		{name: "negative", values: []string{"-7200"}, valid: false},
+		{name: "plus sign", values: []string{"+7200"}, valid: false},
+		{name: "non numeric", values: []string{"abc"}, valid: false},
+		{name: "parameter", values: []string{"7200;foo=bar"}, valid: false},
+		{name: "numeric parameter", values: []string{"7200;foo=111"}, valid: false},
+		{name: "prefix", values: []string{"a7200"}, valid: false},
+		{name: "suffix", values: []string{"7200a"}, valid: false},
+		{name: "overflow", values: []string{"99999999999999999999999"}, age: maxDeltaSeconds, valid: true},
+		{name: "above maximum", values: []string{"4294967296"}, age: maxDeltaSeconds, valid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.values != nil {
+				header[AgeHeader] = test.values
+			}
+
+			age, valid := parseAgeHeader(header)
+			if valid != test.valid {
+				t.Errorf("expected valid: %v, got: %v", test.valid, valid)
+			}
+
+			if valid && age != test.age {
+				t.Errorf("expected age: %d, got: %d", test.age, age)
+			}
+		})
+	}
+}
+
+func TestGetResponseAgeCapped(t *testing.T) {
+	response := &http.Response{
+		Header: http.Header{
+			AgeHeader:  []string{"2147483648"},
+			DateHeader: []string{"Mon, 01 Jan 2001 00:00:00 GMT"},
+		},
+	}
+
+	if age := getResponseAge(response); age != maxDeltaSeconds {
+		t.Errorf("expected age to be capped at %d, got: %d", maxDeltaSeconds, age)
+	}
+}
+
+func TestCorrectAgeHeader(t *testing.T) {
+	requestTime := time.Now()
+	responseTime := requestTime.Add(1500 * time.Millisecond)
+
+	response := &http.Response{
+		Header: http.Header{
+			AgeHeader:  []string{"100"},
+			DateHeader: []string{responseTime.UTC().Format(http.TimeFormat)},
+		},
+	}
+
+	//The response delay is rounded up and added to the age value
+	correctAgeHeader(response, requestTime, responseTime)
+	if age := response.Header.Get(AgeHeader); age != "102" {
+		t.Errorf("expected corrected age 102, got: %s", age)
+	}
+
+	//Responses generated by the origin don't get a Age header
+	response.Header.Del(AgeHeader)
+	correctAgeHeader(response, requestTime, responseTime)
+	if _, found := response.Header[AgeHeader]; found {
+		t.Error("expected no Age header on a response without one")
+	}
+}
+
+func TestAgeOfForwardedMiss(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		//The response was served by a upstream cache which held it for 100 seconds
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		rw.Header().Set(AgeHeader, "100")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	for i := 0; i < 2; i++ {
+		response, _ := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+
+		age, _ := strconv.Atoi(response.Header.Get(AgeHeader))
+		if age < 100 {
+			t.Errorf("request %d: expected the age of the upstream cache to be kept, got: %d", i, age)
+		}
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/a":
+			http.Redirect(rw, req, "/b", http.StatusMovedPermanently)
+		case "/b":
+			http.Redirect(rw, req, "/c", http.StatusFound)
+		case "/c":
+			_, _ = rw.Write([]byte("final"))
+		case "/external":
+			http.Redirect(rw, req, "http://example.com/", http.StatusFound)
+		}
+	}))
+	defer origin.Close()
+
+	originURL, _ := url.Parse(origin.URL)
+
+	tests := []struct {
+		name       string
+		path       string
+		hops       int
+		statusCode int
+	}{
+		{name: "disabled", path: "/a", hops: 0, statusCode: http.StatusMovedPermanently},
+		{name: "not enough hops", path: "/a", hops: 1, statusCode: http.StatusFound},
+		{name: "followed", path: "/a", hops: 2, statusCode: http.StatusOK},
+		{name: "other host", path: "/external", hops: 2, statusCode: http.StatusFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forwardConfig := &ForwardConfig{
+				Host:            originURL.Host,
+				FollowRedirects: test.hops,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://"+originURL.Host+test.path, nil)
+
+			response, err := proxyToOrigin(req.Context(), http.DefaultTransport, forwardConfig, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err = followRedirects(req.Context(), http.DefaultTransport, forwardConfig, req, response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != test.statusCode {
+				t.Errorf("expected status code: %d, got: %d", test.statusCode, response.StatusCode)
+			}
+		})
+	}
+}
+
+//roundTripperFunc is a http.RoundTripper which calls the function
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+//closeTrackingBody records if it was closed
+type closeTrackingBody struct {
+	io.Reader
+	closed bool
+}
+
+func (body *closeTrackingBody) Close() error {
+	body.closed = true
+	return nil
+}
+
+func TestFollowRedirectsClosesBodyOnError(t *testing.T) {
+	body := &closeTrackingBody{Reader: strings.NewReader("moved")}
+
+	//The redirect can't be fetched, the origin went away
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/a", nil)
+	response := &http.Response{
+		StatusCode: http.StatusMovedPermanently,
+		Header:     http.Header{"Location": []string{"/b"}},
+		Body:       body,
+	}
+
+	_, err := followRedirects(req.Context(), transport, &ForwardConfig{Host: "example.com", FollowRedirects: 1}, req, response)
+	if err == nil {
+		t.Fatal("expected the error of the transport")
+	}
+
+	if !body.closed {
+		t.Error("expected the body of the redirect to be closed")
+	}
+}
+
+func TestRewriteOriginPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		strip    string
+		add      string
+		path     string
+		expected string
+	}{
+		{name: "no rewrite", path: "/app/page", expected: "/app/page"},
+		{name: "strip", strip: "/app", path: "/app/page", expected: "/page"},
+		{name: "strip with slash", strip: "/app/", path: "/app/page", expected: "/page"},
+		{name: "strip whole path", strip: "/app", path: "/app", expected: "/"},
+		{name: "strip partial segment", strip: "/app", path: "/application", expected: "/application"},
+		{name: "strip not matching", strip: "/app", add: "/v2", path: "/other", expected: "/other"},
+		{name: "add", add: "/v2", path: "/page", expected: "/v2/page"},
+		{name: "strip and add", strip: "/app", add: "/v2/", path: "/app/page", expected: "/v2/page"},
+		{name: "escaped", strip: "/app", path: "/app/a%2Fb", expected: "/a%2Fb"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forwardConfig := &ForwardConfig{StripPathPrefix: test.strip, AddPathPrefix: test.add}
+
+			u, err := url.Parse(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rewriteOriginPath(forwardConfig, u)
+			if u.EscapedPath() != test.expected {
+				t.Errorf("expected path: %s, got: %s", test.expected, u.EscapedPath())
+			}
+		})
+	}
+}
+
+func TestPathRewriteCacheKey(t *testing.T) {
+	originPaths := []string{}
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originPaths = append(originPaths, req.URL.Path)
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte(req.URL.Path))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultForwardConfig.StripPathPrefix = "/app"
+	controller.DefaultForwardConfig.AddPathPrefix = "/v2"
+
+	for i := 0; i < 2; i++ {
+		_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/app/page", nil))
+		if body != "/v2/page" {
+			t.Errorf("expected the origin to receive the rewritten path, got: %s", body)
+		}
+	}
+
+	if len(originPaths) != 1 {
+		t.Errorf("expected the second request to be served from cache, got %d origin requests", len(originPaths))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/app/page", nil)
+	cachedResponse, _, err := controller.findResponseInCache(getPrimaryCacheKey(controller.DefaultCacheConfig, controller.DefaultForwardConfig, req))
+	if err != nil || cachedResponse == nil {
+		t.Fatalf("expected the response to be stored under the path of the client: %v", err)
+	}
+	cachedResponse.Body.Close()
+}
+
+func TestSendOriginHost(t *testing.T) {
+	controller, originHost, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.Host))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultForwardConfig.SendOriginHost = true
+
+	_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://public.example.com/", nil))
+	if body != originHost {
+		t.Errorf("expected the origin to receive Host: %s, got: %s", originHost, body)
+	}
+}
+
+func TestForwardRequestHeaders(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.Header.Get("X-Origin-Secret")))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultForwardConfig.RequestHeaders = http.Header{"x-origin-secret": []string{"secret"}}
+
+	//The client can't override a configured header
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	req.Header.Set("X-Origin-Secret", "spoofed")
+
+	_, body := doTestRequest(t, controller, req)
+	if body != "secret" {
+		t.Errorf("expected the origin to receive the configured header, got: %s", body)
+	}
+}
+
+//readerFromRecorder is a response recorder which records the type of the reader passed to ReadFrom
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	source io.Reader
+}
+
+func (recorder *readerFromRecorder) ReadFrom(source io.Reader) (int64, error) {
+	recorder.source = source
+	return io.Copy(recorder.ResponseRecorder, source)
+}
+
+func TestWriteHTTPResponseFromFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "sharedhttpcache-body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, _ = file.WriteString("content")
+	_, _ = file.Seek(0, io.SeekStart)
+
+	recorder := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+	controller := &CacheController{}
+	err = controller.writeHTTPResponse(NewCacheConfig(), recorder, &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := recorder.source.(*os.File); !ok {
+		t.Errorf("expected the file to be passed to ReadFrom as is, got: %T", recorder.source)
+	}
+
+	if recorder.Body.String() != "content" {
+		t.Errorf("expected body 'content', got: %s", recorder.Body.String())
+	}
+}
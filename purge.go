@@ -0,0 +1,606 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//DefaultPurgeRetries is the amount of times a purge is retried per peer if Retries of a HTTPPurgePropagator is zero
+	DefaultPurgeRetries = 3
+
+	//DefaultPurgeRetryDelay is the delay before the first retry if RetryDelay of a HTTPPurgePropagator is zero,
+	// the delay is doubled after every retry
+	DefaultPurgeRetryDelay = 500 * time.Millisecond
+
+	//DefaultPurgeTimeout is the timeout of a purge request to a peer if Client of a HTTPPurgePropagator is nil
+	DefaultPurgeTimeout = 5 * time.Second
+)
+
+//PurgeMethod is the request method with which trusted clients purge a resource, see PurgeMethodResolver
+const PurgeMethod = "PURGE"
+
+//DefaultInvalidationRuleLifetime is the time prefix and tag purges are remembered if InvalidationRuleLifetime is zero
+const DefaultInvalidationRuleLifetime = 24 * time.Hour
+
+//CacheTagHeaders are the response headers which contain the tags of a response, separated by spaces or commas
+// A purge of a tag removes all responses with the tag
+var CacheTagHeaders = []string{"Cache-Tag", "Surrogate-Key"}
+
+var (
+	errInvalidPurgeURL = errors.New("Purge URL must be absolute")
+	errInvalidPurge    = errors.New("Purge must have exactly one of a URL, prefix or tag")
+)
+
+//A Purge removes stored responses from the cache, exactly one of URL, Prefix and Tag must be set
+type Purge struct {
+	//Tenant is the tenant to which the stored responses belong, empty if tenants are not used
+	Tenant string `json:"tenant,omitempty"`
+
+	//URL is the absolute URL of the resource as requested by clients, like "https://example.com/page"
+	URL string `json:"url,omitempty"`
+
+	//Prefix purges all resources of which the absolute URL starts with it, like "https://example.com/blog/"
+	Prefix string `json:"prefix,omitempty"`
+
+	//Tag purges all responses which have the tag in one of the CacheTagHeaders
+	Tag string `json:"tag,omitempty"`
+}
+
+//target returns the URL, prefix or tag which is purged
+func (purge Purge) target() string {
+	switch {
+	case purge.URL != "":
+		return purge.URL
+	case purge.Prefix != "":
+		return purge.Prefix
+	}
+
+	return purge.Tag
+}
+
+//invalidationRule is a purge of a prefix or tag. Layers can't list the entries they contain,
+// so instead of deleting the matching entries every stored response is matched against the rules when it is looked up
+type invalidationRule struct {
+	Purge
+
+	//created is the unix time at which the rule was created, only responses stored before it match
+	created int64
+}
+
+//A PurgePropagator sends purges to the other instances of a cluster, so a purge issued on one instance reaches all instances
+type PurgePropagator interface {
+
+	//PropagatePurge is called after a purge is applied to the local cache
+	// A error should be returned if the purge didn't reach all instances
+	PropagatePurge(purge Purge) error
+}
+
+//The PurgePropagatorFunc type is an adapter to allow the use of ordinary functions as PurgePropagator
+type PurgePropagatorFunc func(purge Purge) error
+
+//PropagatePurge calls the underlying function to propagate the purge
+func (propagator PurgePropagatorFunc) PropagatePurge(purge Purge) error {
+	return propagator(purge)
+}
+
+//Purge removes all stored variants of the resource, for all safe methods, from the cache
+// and propagates the purge to the other instances of the cluster if a PurgePropagator is set.
+// Slices of sliced resources are not removed, they are fetched again once the stored head no longer matches them
+func (controller *CacheController) Purge(purge Purge) error {
+	err := controller.purgeLocal(purge)
+	if err != nil {
+		return err
+	}
+
+	if controller.PurgePropagator != nil {
+		return controller.PurgePropagator.PropagatePurge(purge)
+	}
+
+	return nil
+}
+
+//purgeLocal removes the stored responses of the purge from the layers of this instance
+func (controller *CacheController) purgeLocal(purge Purge) error {
+	controller.initOnce.Do(controller.initialize)
+
+	kinds := 0
+	for _, value := range []string{purge.URL, purge.Prefix, purge.Tag} {
+		if value != "" {
+			kinds++
+		}
+	}
+
+	if kinds != 1 {
+		return errInvalidPurge
+	}
+
+	//Responses with the tag are deleted right away, the rule still matches responses which are missing from the tag index
+	if purge.Tag != "" {
+		if err := controller.purgeTagIndex(purge.Tenant, purge.Tag); err != nil {
+			controller.Logger.WithError(err).WithField("tag", purge.Tag).Error("Error while purging responses in tag index")
+		}
+	}
+
+	if purge.URL == "" {
+		return controller.addInvalidationRule(purge)
+	}
+
+	effectiveURI, err := purgeEffectiveURI(controller.DefaultCacheConfig, purge.URL)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, method := range controller.DefaultCacheConfig.SafeMethods {
+		primaryKey := tenantCacheKeyPrefix(purge.Tenant) + method + effectiveURI
+
+		if err := controller.purgePrimaryKey(primaryKey); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	controller.Logger.WithFields(logrus.Fields{
+		"tenant": purge.Tenant,
+		"url":    purge.URL,
+	}).Info("Purged URL")
+
+	return firstErr
+}
+
+//PurgeRequest removes all stored variants of the requested resource, for all safe methods, from the cache.
+// The cache key is resolved like it is for a request received by the server, so the tenant, the cache config and the forward config
+// of the request are used. The purge is propagated to the other instances of the cluster if a PurgePropagator is set
+func (controller *CacheController) PurgeRequest(req *http.Request) error {
+	controller.initOnce.Do(controller.initialize)
+
+	//The tenant and the cache config are resolved with the canonical hostname, like they are for requests
+	canonicalReq := withCanonicalHost(req)
+
+	if controller.TenantResolver != nil && TenantFromRequest(req) == "" {
+		tenant := controller.TenantResolver.GetTenant(canonicalReq)
+		req = withTenant(req, tenant)
+		canonicalReq = withTenant(canonicalReq, tenant)
+	}
+
+	cacheConfig := controller.resolveCacheConfig(canonicalReq)
+	if cacheConfig == BypassConfig {
+		return nil
+	}
+
+	req = controller.resolveForwardedProto(cacheConfig, req)
+	req = normalizeRequestHost(cacheConfig, req)
+	forwardConfig := controller.resolveForwardConfig(req)
+
+	var firstErr error
+	for _, method := range cacheConfig.SafeMethods {
+		methodReq := req.WithContext(req.Context())
+		methodReq.Method = method
+
+		if err := controller.purgePrimaryKey(getPrimaryCacheKey(cacheConfig, forwardConfig, methodReq)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	purge := Purge{
+		Tenant: TenantFromRequest(req),
+		URL:    scheme + "://" + req.Host + req.URL.RequestURI(),
+	}
+
+	controller.requestLogger(req).WithFields(logrus.Fields{
+		"tenant": purge.Tenant,
+		"url":    purge.URL,
+	}).Info("Purged URL")
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if controller.PurgePropagator != nil {
+		return controller.PurgePropagator.PropagatePurge(purge)
+	}
+
+	return nil
+}
+
+//PurgeKey removes all stored variants of the primary cache key from the cache of this instance, like "GEThttp://example.com/page".
+// The purge is not propagated to the other instances of the cluster
+func (controller *CacheController) PurgeKey(primaryCacheKey string) error {
+	controller.initOnce.Do(controller.initialize)
+
+	err := controller.purgePrimaryKey(primaryCacheKey)
+
+	controller.Logger.WithField("cache-key", primaryCacheKey).Info("Purged cache key")
+
+	return err
+}
+
+//servePurgeMethod purges the resource of a PURGE request if the client is trusted by the PurgeMethodResolver
+func (controller *CacheController) servePurgeMethod(resp http.ResponseWriter, req *http.Request) {
+	if !controller.PurgeMethodResolver.IsTrusted(req) {
+		http.Error(resp, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := controller.PurgeRequest(req); err != nil {
+		controller.requestLogger(req).WithError(err).Error("Error while purging requested resource")
+		http.Error(resp, "Error while purging", http.StatusInternalServerError)
+		return
+	}
+
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+//purgePrimaryKey deletes all variants stored under the primary cache key and the entries which list them
+func (controller *CacheController) purgePrimaryKey(primaryKey string) error {
+	//The variant index lists the secondary cache keys of all stored variants
+	variants, err := controller.findVariantsInCache(primaryKey)
+	if err != nil {
+		return err
+	}
+
+	secondaryCacheKeys := []string{""}
+
+	for _, variant := range variants {
+		if !containsString(secondaryCacheKeys, variant.secondaryKey) {
+			secondaryCacheKeys = append(secondaryCacheKeys, variant.secondaryKey)
+		}
+	}
+
+	var firstErr error
+	for _, secondaryKey := range secondaryCacheKeys {
+		cachedResponse, _, err := controller.findResponseInCache(primaryKey + secondaryKey)
+		if err != nil || cachedResponse == nil {
+			continue
+		}
+		cachedResponse.Body.Close()
+
+		if err := controller.deleteCacheEntry(primaryKey + secondaryKey); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		controller.emitEvent(CacheEventPurge, primaryKey+secondaryKey, -1, false)
+	}
+
+	for _, key := range []string{"secondary-keys" + primaryKey, variantIndexPrefix + primaryKey} {
+		if err := controller.deleteCacheEntry(key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+//addInvalidationRule remembers a prefix or tag purge for InvalidationRuleLifetime
+func (controller *CacheController) addInvalidationRule(purge Purge) error {
+	if purge.Prefix != "" {
+		if _, err := purgeEffectiveURI(controller.DefaultCacheConfig, purge.Prefix); err != nil {
+			return err
+		}
+	}
+
+	controller.invalidationRulesMutex.Lock()
+	defer controller.invalidationRulesMutex.Unlock()
+
+	//Rules are added in order, so expired rules are at the start
+	expired := time.Now().Add(-controller.invalidationRuleLifetime()).Unix()
+	for len(controller.invalidationRules) > 0 && controller.invalidationRules[0].created < expired {
+		controller.invalidationRules = controller.invalidationRules[1:]
+	}
+
+	controller.invalidationRules = append(controller.invalidationRules, invalidationRule{
+		Purge:   purge,
+		created: time.Now().Unix(),
+	})
+
+	controller.Logger.WithFields(logrus.Fields{
+		"tenant": purge.Tenant,
+		"prefix": purge.Prefix,
+		"tag":    purge.Tag,
+	}).Info("Purged prefix or tag")
+
+	return nil
+}
+
+//isInvalidated checks if a stored response matches a prefix or tag purge which was issued after it was stored
+func (controller *CacheController) isInvalidated(cacheConfig *CacheConfig, req *http.Request, forwardConfig *ForwardConfig, response *http.Response, freshness *entryFreshness) bool {
+	controller.invalidationRulesMutex.RLock()
+	defer controller.invalidationRulesMutex.RUnlock()
+
+	if len(controller.invalidationRules) == 0 {
+		return false
+	}
+
+	storedAt := freshness.responseTime
+	if storedAt == 0 {
+		storedAt = freshness.date
+	}
+
+	tenant := TenantFromRequest(req)
+	effectiveURI := ""
+	expired := time.Now().Add(-controller.invalidationRuleLifetime()).Unix()
+
+	//Rules are matched newest first, since only rules created after the response was stored match.
+	// Times are in seconds, so a response stored in the same second as the rule is considered to be stored before it
+	for i := len(controller.invalidationRules) - 1; i >= 0; i-- {
+		rule := controller.invalidationRules[i]
+		if rule.created < expired || rule.created < storedAt {
+			break
+		}
+
+		if rule.Tenant != tenant {
+			continue
+		}
+
+		if rule.Prefix != "" {
+			if effectiveURI == "" {
+				effectiveURI = getEffectiveURI(req, cacheConfig, forwardConfig)
+			}
+
+			prefix := rule.Prefix
+			if cacheConfig.IgnoreSchemeInCacheKey {
+				prefix = stripScheme(prefix)
+			}
+
+			if strings.HasPrefix(effectiveURI, prefix) {
+				return true
+			}
+		}
+
+		if rule.Tag != "" && hasCacheTag(response.Header, rule.Tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//hasCacheTag checks if one of the CacheTagHeaders contains the tag
+func hasCacheTag(header http.Header, tag string) bool {
+	return containsString(cacheTagsOf(header), tag)
+}
+
+func (controller *CacheController) invalidationRuleLifetime() time.Duration {
+	if controller.InvalidationRuleLifetime > 0 {
+		return controller.InvalidationRuleLifetime
+	}
+
+	return DefaultInvalidationRuleLifetime
+}
+
+//purgeEffectiveURI returns the effective URI of a purged URL as it is used in the primary cache key
+func purgeEffectiveURI(cacheConfig *CacheConfig, rawURL string) (string, error) {
+	purgeURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	if purgeURL.Scheme == "" || purgeURL.Host == "" {
+		return "", errInvalidPurgeURL
+	}
+
+	//The effective URI is built the same way as for a request received by the server
+	pseudoRequest := &http.Request{
+		URL: &url.URL{
+			Path:     purgeURL.Path,
+			RawPath:  purgeURL.RawPath,
+			RawQuery: purgeURL.RawQuery,
+		},
+		Host: purgeURL.Host,
+	}
+
+	if strings.EqualFold(purgeURL.Scheme, "https") {
+		pseudoRequest.TLS = &tls.ConnectionState{}
+	}
+
+	return getEffectiveURI(pseudoRequest, cacheConfig, &ForwardConfig{}), nil
+}
+
+//HTTPPurgePropagator propagates purges by sending them to the PurgeHandler of every peer.
+// Failed requests are retried with a exponential backoff, every attempt is logged so the propagation can be audited
+type HTTPPurgePropagator struct {
+	//Peers are the URLs of the purge handlers of the other instances, like "http://10.0.0.2:8081/purge"
+	Peers []string
+
+	//Token is sent as bearer token, it must match the token of the PurgeHandler of the peers
+	Token string
+
+	//Client is used to send the purges, if nil a client with DefaultPurgeTimeout is used
+	Client *http.Client
+
+	//Retries is the amount of times a failed purge is retried per peer, if zero DefaultPurgeRetries is used
+	Retries int
+
+	//RetryDelay is the delay before the first retry, it is doubled after every retry. If zero DefaultPurgeRetryDelay is used
+	RetryDelay time.Duration
+
+	//Logger is used for the audit log of the propagation, if nil the standard logger is used
+	Logger *logrus.Logger
+}
+
+//PropagatePurge sends the purge to all peers concurrently and waits until every peer received it or all retries failed
+func (propagator *HTTPPurgePropagator) PropagatePurge(purge Purge) error {
+	body, err := json.Marshal(purge)
+	if err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	failedPeers := make([]string, 0)
+	failedPeersMutex := sync.Mutex{}
+
+	for _, peer := range propagator.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+
+			if !propagator.sendWithRetries(peer, purge, body) {
+				failedPeersMutex.Lock()
+				failedPeers = append(failedPeers, peer)
+				failedPeersMutex.Unlock()
+			}
+		}(peer)
+	}
+
+	wg.Wait()
+
+	if len(failedPeers) > 0 {
+		return fmt.Errorf("Purge of '%s' didn't reach peers: %s", purge.target(), strings.Join(failedPeers, ", "))
+	}
+
+	return nil
+}
+
+//sendWithRetries sends the purge to a peer until it succeeds or the retries run out, it returns true on success
+func (propagator *HTTPPurgePropagator) sendWithRetries(peer string, purge Purge, body []byte) bool {
+	retries := propagator.Retries
+	if retries == 0 {
+		retries = DefaultPurgeRetries
+	}
+
+	delay := propagator.RetryDelay
+	if delay == 0 {
+		delay = DefaultPurgeRetryDelay
+	}
+
+	for attempt := 1; ; attempt++ {
+		log := propagator.logger().WithFields(logrus.Fields{
+			"peer":    peer,
+			"tenant":  purge.Tenant,
+			"url":     purge.URL,
+			"attempt": attempt,
+		})
+
+		err := propagator.send(peer, body)
+		if err == nil {
+			log.Info("Propagated purge to peer")
+			return true
+		}
+
+		if attempt > retries {
+			log.WithError(err).Error("Giving up propagating purge to peer")
+			return false
+		}
+
+		log.WithError(err).Warning("Error while propagating purge to peer, retrying")
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (propagator *HTTPPurgePropagator) send(peer string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, peer, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if propagator.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+propagator.Token)
+	}
+
+	client := propagator.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultPurgeTimeout}
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Peer responded with status %s", response.Status)
+	}
+
+	return nil
+}
+
+func (propagator *HTTPPurgePropagator) logger() *logrus.Logger {
+	if propagator.Logger != nil {
+		return propagator.Logger
+	}
+
+	return logrus.StandardLogger()
+}
+
+//PurgeHandler is a http.Handler which receives purges propagated by a HTTPPurgePropagator of a peer.
+// The purges are applied to the local cache only, so they are not propagated again.
+// It is meant to be served on a admin listener, not to the public
+type PurgeHandler struct {
+	controller *CacheController
+
+	//token is the bearer token peers must send, purges are accepted without authentication if empty
+	token string
+}
+
+//NewPurgeHandler creates a PurgeHandler which applies purges to the controller
+func NewPurgeHandler(controller *CacheController, token string) *PurgeHandler {
+	return &PurgeHandler{
+		controller: controller,
+		token:      token,
+	}
+}
+
+func (handler *PurgeHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if handler.token != "" {
+		authorization := req.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+handler.token)) != 1 {
+			http.Error(resp, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	purge := Purge{}
+	if err := json.NewDecoder(req.Body).Decode(&purge); err != nil {
+		http.Error(resp, "Invalid purge", http.StatusBadRequest)
+		return
+	}
+
+	handler.controller.initOnce.Do(handler.controller.initialize)
+	handler.controller.Logger.WithFields(logrus.Fields{
+		"peer":   req.RemoteAddr,
+		"tenant": purge.Tenant,
+		"url":    purge.URL,
+	}).Info("Received purge from peer")
+
+	err := handler.controller.purgeLocal(purge)
+	if errors.Is(err, errInvalidPurgeURL) || errors.Is(err, errInvalidPurge) {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		handler.controller.Logger.WithError(err).WithField("url", purge.URL).Error("Error while applying purge from peer")
+		http.Error(resp, "Error while purging", http.StatusInternalServerError)
+		return
+	}
+
+	resp.WriteHeader(http.StatusNoContent)
+}
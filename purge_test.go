@@ -0,0 +1,211 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurge(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		rw.Header().Set(VaryHeader, "Accept-Language")
+		_, _ = rw.Write([]byte(req.Header.Get("Accept-Language")))
+	}))
+	defer closeOrigin()
+
+	request := func(language string) {
+		//The request is in origin-form like requests received by a server, so the query is normalized in the cache key
+		req := httptest.NewRequest(http.MethodGet, "/page?b=2&a=1", nil)
+		req.Host = host
+		req.Header.Set("Accept-Language", language)
+		doTestRequest(t, controller, req)
+	}
+
+	request("en")
+	request("nl")
+	request("en")
+	if originRequests != 2 {
+		t.Fatalf("expected both variants to be stored, got %d origin requests", originRequests)
+	}
+
+	if err := controller.Purge(Purge{URL: "http://" + host + "/page?a=1&b=2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	request("en")
+	request("nl")
+	if originRequests != 4 {
+		t.Errorf("expected all variants to be purged, got %d origin requests", originRequests)
+	}
+
+	if err := controller.Purge(Purge{URL: "/page"}); err != errInvalidPurgeURL {
+		t.Errorf("expected error for relative URL, got: %v", err)
+	}
+}
+
+func TestPurgePropagation(t *testing.T) {
+	originRequests := 0
+	origin := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write([]byte("content"))
+	})
+
+	controller, host, closeOrigin := newTestController(t, origin)
+	defer closeOrigin()
+
+	peer, _, closePeerOrigin := newTestController(t, origin)
+	defer closePeerOrigin()
+	peer.DefaultForwardConfig = controller.DefaultForwardConfig
+
+	peerServer := httptest.NewServer(NewPurgeHandler(peer, "secret"))
+	defer peerServer.Close()
+
+	controller.PurgePropagator = &HTTPPurgePropagator{
+		Peers:      []string{peerServer.URL},
+		Token:      "secret",
+		RetryDelay: time.Millisecond,
+	}
+
+	for _, instance := range []*CacheController{controller, peer, controller, peer} {
+		doTestRequest(t, instance, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	}
+
+	if originRequests != 2 {
+		t.Fatalf("expected the response to be stored on both instances, got %d origin requests", originRequests)
+	}
+
+	if err := controller.Purge(Purge{URL: "http://" + host + "/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, instance := range []*CacheController{controller, peer} {
+		doTestRequest(t, instance, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	}
+
+	if originRequests != 4 {
+		t.Errorf("expected the purge to reach the peer, got %d origin requests", originRequests)
+	}
+
+	//A peer which rejects the purge is retried and reported
+	controller.PurgePropagator = &HTTPPurgePropagator{
+		Peers:      []string{peerServer.URL},
+		Token:      "wrong",
+		Retries:    1,
+		RetryDelay: time.Millisecond,
+	}
+
+	err := controller.Purge(Purge{URL: "http://" + host + "/"})
+	if err == nil || !strings.Contains(err.Error(), peerServer.URL) {
+		t.Errorf("expected error naming the peer, got: %v", err)
+	}
+}
+
+func TestPurgeMethod(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.PurgeMethodResolver = TrustAny(
+		TrustedHeaderToken("Authorization", "Bearer secret"),
+		TrustResolverFunc(func(req *http.Request) bool { return false }),
+	)
+
+	request := func(method, token string) int {
+		req := httptest.NewRequest(method, "/page", nil)
+		req.Host = host
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, _ := doTestRequest(t, controller, req)
+		return resp.StatusCode
+	}
+
+	request(http.MethodGet, "")
+	request(http.MethodGet, "")
+	if originRequests != 1 {
+		t.Fatalf("expected the response to be stored, got %d origin requests", originRequests)
+	}
+
+	if status := request(PurgeMethod, "wrong"); status != http.StatusForbidden {
+		t.Errorf("expected 403 for a untrusted client, got %d", status)
+	}
+
+	if originRequests != 1 {
+		t.Errorf("expected a PURGE request to never reach the origin, got %d origin requests", originRequests)
+	}
+
+	if status := request(PurgeMethod, "secret"); status != http.StatusNoContent {
+		t.Errorf("expected 204 for a trusted client, got %d", status)
+	}
+
+	request(http.MethodGet, "")
+	if originRequests != 2 {
+		t.Errorf("expected the response to be purged, got %d origin requests", originRequests)
+	}
+
+	if err := controller.PurgeKey("GEThttp://" + host + "/page"); err != nil {
+		t.Fatal(err)
+	}
+
+	request(http.MethodGet, "")
+	if originRequests != 3 {
+		t.Errorf("expected the cache key to be purged, got %d origin requests", originRequests)
+	}
+}
+
+func TestPurgeByTag(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		if req.URL.Path != "/other" {
+			rw.Header().Set("Surrogate-Key", "product-42 category-1")
+		}
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	for _, path := range []string{"/product", "/product/reviews", "/other"} {
+		doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+path, nil))
+	}
+
+	cacheKeys, _, err := controller.findTagIndex("", "product-42")
+	if err != nil || len(cacheKeys) != 2 {
+		t.Fatalf("expected 2 responses in the tag index, got %v %v", cacheKeys, err)
+	}
+
+	if err := controller.PurgeByTag("product-42"); err != nil {
+		t.Fatal(err)
+	}
+
+	//The tagged responses are deleted from the layers, not only hidden by the invalidation rule
+	for _, cacheKey := range cacheKeys {
+		if entry, _, _ := controller.Layers[0].Get(cacheKey); entry != nil {
+			entry.Close()
+			t.Errorf("expected %s to be deleted", cacheKey)
+		}
+	}
+
+	if entry, _, _ := controller.Layers[0].Get(tagIndexKey("", "product-42")); entry != nil {
+		entry.Close()
+		t.Error("expected the tag index to be deleted")
+	}
+
+	stored, _, err := controller.findResponseInCache("GEThttp://" + host + "/other")
+	if err != nil || stored == nil {
+		t.Fatalf("expected the untagged response to remain stored, got %v", err)
+	}
+	stored.Body.Close()
+}
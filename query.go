@@ -0,0 +1,53 @@
+package sharedhttpcache
+
+import (
+	"net/url"
+)
+
+//Modes of CacheConfig.QueryCanonicalization
+const (
+	//QuerySort sorts the query parameters by key, so the order in which clients send them doesn't matter.
+	// The order of parameters with the same key is preserved
+	QuerySort = "sort"
+
+	//QueryPreserve uses the query as send by the client, for origins which are sensitive to the order of parameters
+	QueryPreserve = "preserve"
+)
+
+//A QueryCanonicalizer rewrites the query of a request before it is used in the cache key, for example to remove tracking parameters
+type QueryCanonicalizer interface {
+
+	//CanonicalizeQuery returns the query which is used in the cache key, requests with the same canonical query share a stored response
+	CanonicalizeQuery(rawQuery string) string
+}
+
+//The QueryCanonicalizerFunc type is an adapter to allow the use of ordinary functions as QueryCanonicalizer
+type QueryCanonicalizerFunc func(rawQuery string) string
+
+//CanonicalizeQuery calls the underlying function to canonicalize the query
+func (canonicalizer QueryCanonicalizerFunc) CanonicalizeQuery(rawQuery string) string {
+	return canonicalizer(rawQuery)
+}
+
+//canonicalizeQuery returns the query as it is used in the effective URI, according to the QueryCanonicalizer
+// or QueryCanonicalization of the config. The query is sorted if the config is nil
+func canonicalizeQuery(cacheConfig *CacheConfig, rawQuery string) string {
+	if cacheConfig != nil {
+		if cacheConfig.QueryCanonicalizer != nil {
+			return cacheConfig.QueryCanonicalizer.CanonicalizeQuery(rawQuery)
+		}
+
+		if cacheConfig.QueryCanonicalization == QueryPreserve {
+			return rawQuery
+		}
+	}
+
+	//Parse and re-encode the query, this causes the query to be sorted by key
+	// sort order is important when the effective uri is used in a cache key
+	queryValues, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return ""
+	}
+
+	return queryValues.Encode()
+}
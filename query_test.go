@@ -0,0 +1,45 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQueryCanonicalization(t *testing.T) {
+	dropTracking := QueryCanonicalizerFunc(func(rawQuery string) string {
+		kept := []string{}
+		for _, parameter := range strings.Split(rawQuery, "&") {
+			if !strings.HasPrefix(parameter, "utm_") {
+				kept = append(kept, parameter)
+			}
+		}
+		return strings.Join(kept, "&")
+	})
+
+	tests := []struct {
+		name          string
+		mode          string
+		canonicalizer QueryCanonicalizer
+		expect        string
+	}{
+		{name: "default", expect: "http://example.com/page?a=2&b=1&b=0&utm_source=x"},
+		{name: "sort", mode: QuerySort, expect: "http://example.com/page?a=2&b=1&b=0&utm_source=x"},
+		{name: "preserve", mode: QueryPreserve, expect: "http://example.com/page?b=1&utm_source=x&a=2&b=0"},
+		{name: "custom", mode: QueryPreserve, canonicalizer: dropTracking, expect: "http://example.com/page?b=1&a=2&b=0"},
+	}
+
+	for _, test := range tests {
+		config := NewCacheConfig()
+		config.QueryCanonicalization = test.mode
+		config.QueryCanonicalizer = test.canonicalizer
+
+		req := httptest.NewRequest(http.MethodGet, "/page?b=1&utm_source=x&a=2&b=0", nil)
+
+		effectiveURI := getEffectiveURI(req, config, &ForwardConfig{})
+		if effectiveURI != test.expect {
+			t.Errorf("%s: expected '%s', got '%s'", test.name, test.expect, effectiveURI)
+		}
+	}
+}
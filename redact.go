@@ -0,0 +1,127 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+//AlwaysRedactedHeaders are headers which are always redacted before requests and responses are logged
+// since they contain credentials or sessions
+var AlwaysRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+//redactedValue replaces the value of redacted headers
+const redactedValue = "[REDACTED]"
+
+//loggedRequest is the representation of a request in log fields
+type loggedRequest struct {
+	Method string
+	URL    string
+	Host   string
+	Header http.Header
+}
+
+//loggedResponse is the representation of a response in log fields
+type loggedResponse struct {
+	Status string
+	Header http.Header
+}
+
+//redactLogFields replaces requests, responses and headers in the log fields with copies from which
+// sensitive headers are redacted. It must be used for all fields which can contain data of clients or origins
+func (controller *CacheController) redactLogFields(fields logrus.Fields) logrus.Fields {
+	redacted := make(logrus.Fields, len(fields))
+
+	for key, value := range fields {
+		switch value := value.(type) {
+		case *http.Request:
+			if value != nil {
+				redacted[key] = controller.redactRequest(value)
+				continue
+			}
+
+		case *http.Response:
+			if value != nil {
+				redacted[key] = loggedResponse{
+					Status: value.Status,
+					Header: controller.redactHeader(value.Header),
+				}
+				continue
+			}
+
+		case http.Header:
+			redacted[key] = controller.redactHeader(value)
+			continue
+
+		case *ForwardConfig:
+			if value != nil {
+				redacted[key] = redactForwardConfig(value)
+				continue
+			}
+		}
+
+		redacted[key] = value
+	}
+
+	return redacted
+}
+
+func (controller *CacheController) redactRequest(req *http.Request) loggedRequest {
+	logged := loggedRequest{
+		Method: req.Method,
+		Host:   req.Host,
+		Header: controller.redactHeader(req.Header),
+	}
+
+	if req.URL != nil {
+		//Credentials in the URL are removed, the URL is copied since it is shared with the request
+		url := *req.URL
+		url.User = nil
+
+		logged.URL = url.String()
+	}
+
+	return logged
+}
+
+//redactAuthorizationParams removes the authorization parameters of the RequestAuthorizer and EdgeAuthenticator from the query,
+// so the signatures of signed URLs, which grant access to anyone who has them, are not logged
+func redactAuthorizationParams(cacheConfig *CacheConfig, req *http.Request) *http.Request {
+	req = stripAuthorizationParams(cacheConfig.RequestAuthorizer, req)
+	return stripAuthorizationParams(cacheConfig.EdgeAuthenticator, req)
+}
+
+//redactForwardConfig returns a copy of the forward config in which the values of all RequestHeaders are replaced
+// since they are configured to prove the request came through the cache
+func redactForwardConfig(forwardConfig *ForwardConfig) *ForwardConfig {
+	if len(forwardConfig.RequestHeaders) == 0 {
+		return forwardConfig
+	}
+
+	redacted := *forwardConfig
+	redacted.RequestHeaders = make(http.Header, len(forwardConfig.RequestHeaders))
+	for name := range forwardConfig.RequestHeaders {
+		redacted.RequestHeaders[name] = []string{redactedValue}
+	}
+
+	return &redacted
+}
+
+//redactHeader returns a copy of the header in which the values of AlwaysRedactedHeaders and RedactedLogHeaders are replaced
+func (controller *CacheController) redactHeader(header http.Header) http.Header {
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		redacted[name] = values
+	}
+
+	for _, names := range [][]string{AlwaysRedactedHeaders, controller.RedactedLogHeaders} {
+		for _, name := range names {
+			name = http.CanonicalHeaderKey(name)
+			if _, found := redacted[name]; found {
+				redacted[name] = []string{redactedValue}
+			}
+		}
+	}
+
+	return redacted
+}
@@ -0,0 +1,72 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+//DefaultLayerReplaySize is the LayerReplaySize used if it is zero
+const DefaultLayerReplaySize = 256 * 1024
+
+//replayableReader records the bytes read from a entry so the entry can be read again from the start
+type replayableReader struct {
+	source    io.ReadCloser
+	recorded  *bytes.Buffer
+	limit     int64
+	truncated bool
+
+	closeOnce sync.Once
+}
+
+//newReplayableReader records at most limit bytes of the source, if more is read the entry can't be replayed
+func newReplayableReader(source io.ReadCloser, limit int64) *replayableReader {
+	return &replayableReader{
+		source:   source,
+		recorded: getBuffer(),
+		limit:    limit,
+	}
+}
+
+//Read reads from the source and records the bytes which are read
+func (reader *replayableReader) Read(p []byte) (int, error) {
+	n, err := reader.source.Read(p)
+
+	if !reader.truncated && n > 0 {
+		if int64(reader.recorded.Len()+n) > reader.limit {
+			reader.truncated = true
+			reader.recorded.Reset()
+		} else {
+			reader.recorded.Write(p[:n])
+		}
+	}
+
+	return n, err
+}
+
+//stopRecording stops recording the bytes which are read after the current recording,
+// used when the entry will never be replayed again. The current recording can still be replayed
+func (reader *replayableReader) stopRecording() {
+	reader.limit = int64(reader.recorded.Len())
+}
+
+//replay returns a reader which reads the entry from the start, false is returned if the recording was truncated
+// The reader is only valid until replay is called again
+func (reader *replayableReader) replay() (io.Reader, bool) {
+	if reader.truncated {
+		return nil, false
+	}
+
+	return io.MultiReader(bytes.NewReader(reader.recorded.Bytes()), reader), true
+}
+
+//Close closes the source and releases the recording
+func (reader *replayableReader) Close() error {
+	err := reader.source.Close()
+
+	reader.closeOnce.Do(func() {
+		putBuffer(reader.recorded)
+	})
+
+	return err
+}
@@ -0,0 +1,82 @@
+package sharedhttpcache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+//DefaultRequestIDHeader is the header which is commonly used to correlate a request across proxies and servers
+const DefaultRequestIDHeader = "X-Request-ID"
+
+//maxRequestIDLength is the maximum length of a request ID send by a trusted client, longer IDs are replaced
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+//RequestIDFromRequest returns the ID of the request, empty if the RequestIDHeader of the controller is not set
+func RequestIDFromRequest(req *http.Request) string {
+	requestID, _ := req.Context().Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+//resolveRequestID assigns a ID to the request if the RequestIDHeader is set. The ID send by a trusted client, like a load balancer,
+// is kept so the request can be followed across tiers, other clients get a new ID. The ID is set in the header of the request
+// so it is forwarded to the origin, and in the header of the response so it is returned to the client
+func (controller *CacheController) resolveRequestID(resp http.ResponseWriter, req *http.Request) *http.Request {
+	if controller.RequestIDHeader == "" {
+		return req
+	}
+
+	requestID := req.Header.Get(controller.RequestIDHeader)
+	if !isValidRequestID(requestID) || !controller.isTrustedClient(req) {
+		requestID = newRequestID()
+	}
+
+	identifiedReq := req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, requestID))
+	identifiedReq.Header = req.Header.Clone()
+	identifiedReq.Header.Set(controller.RequestIDHeader, requestID)
+
+	resp.Header().Set(controller.RequestIDHeader, requestID)
+
+	return identifiedReq
+}
+
+//isValidRequestID checks if a request ID is not empty and only contains visible ASCII characters, so it is safe to log and forward
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] <= ' ' || requestID[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+//newRequestID generates a random request ID of 32 hexadecimal characters
+func newRequestID() string {
+	id := make([]byte, 16)
+
+	//The ID is only used for correlation, a failure of the random source is not worth failing the request over
+	_, _ = rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+//requestLogger returns a log entry which contains the ID of the request, if it has one
+func (controller *CacheController) requestLogger(req *http.Request) *logrus.Entry {
+	entry := logrus.NewEntry(controller.Logger)
+
+	if requestID := RequestIDFromRequest(req); requestID != "" {
+		return entry.WithField("request-id", requestID)
+	}
+
+	return entry
+}
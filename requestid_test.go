@@ -0,0 +1,48 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	originIDs := []string{}
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originIDs = append(originIDs, req.Header.Get(DefaultRequestIDHeader))
+
+		//The origin echoes the ID, it must not be served to the next client from the cache
+		rw.Header().Set(DefaultRequestIDHeader, req.Header.Get(DefaultRequestIDHeader))
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.RequestIDHeader = DefaultRequestIDHeader
+	controller.TrustResolver = TrustedHeaderToken("X-Trusted", "secret")
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil)
+	req.Header.Set(DefaultRequestIDHeader, "client-id")
+	response, _ := doTestRequest(t, controller, req)
+
+	generatedID := response.Header.Get(DefaultRequestIDHeader)
+	if generatedID == "" || generatedID == "client-id" {
+		t.Errorf("expected a generated ID for a untrusted client, got '%s'", generatedID)
+	}
+	if len(originIDs) != 1 || originIDs[0] != generatedID {
+		t.Errorf("expected the generated ID to be forwarded to the origin, got %v", originIDs)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil)
+	req.Header.Set(DefaultRequestIDHeader, "trusted-id")
+	req.Header.Set("X-Trusted", "secret")
+	response, _ = doTestRequest(t, controller, req)
+
+	if requestID := response.Header.Get(DefaultRequestIDHeader); requestID != "trusted-id" {
+		t.Errorf("expected the ID of the trusted client instead of the stored ID, got '%s'", requestID)
+	}
+	if len(originIDs) != 1 {
+		t.Errorf("expected the second request to be served from the cache, origin got %d requests", len(originIDs))
+	}
+}
@@ -0,0 +1,74 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//logRequest logs the completed request if it is sampled, see LogRequests.
+// Slow requests are logged as a warning with a trace of the request.
+// The request is logged as received, without the credentials of signed URLs since the request can be logged before they are removed
+func (controller *CacheController) logRequest(cacheConfig *CacheConfig, req *http.Request, resp http.ResponseWriter, start time.Time) {
+	writer, ok := resp.(*cacheStatusWriter)
+	if !ok {
+		return
+	}
+
+	duration := time.Since(start)
+	slow := controller.SlowRequestThreshold > 0 && duration >= controller.SlowRequestThreshold
+
+	if !slow && !controller.sampleRequestLog(writer) {
+		return
+	}
+
+	statusCode := writer.statusCode
+	if !writer.wroteHeader {
+		//The handler panicked or the client went away before anything was sent
+		statusCode = 0
+	}
+
+	req = redactAuthorizationParams(cacheConfig, req)
+
+	log := controller.requestLogger(req).WithFields(logrus.Fields{
+		"method":       req.Method,
+		"url":          controller.redactRequest(req).URL,
+		"status":       statusCode,
+		"cache-status": writer.status,
+		"bytes":        writer.written,
+		"duration":     duration,
+	})
+
+	if !slow {
+		log.Info("Request served")
+		return
+	}
+
+	fields := logrus.Fields{
+		"request":         req,
+		"response-header": resp.Header(),
+	}
+
+	if writer.wroteHeader {
+		fields["time-to-first-byte"] = writer.headerWritten.Sub(start)
+	}
+
+	log.WithFields(controller.redactLogFields(fields)).Warning("Slow request served")
+}
+
+//sampleRequestLog decides if a request which isn't slow is logged. Requests served from the cache are sampled with LogHitSampleRate,
+// misses and other requests which reached the origin and errors are always logged
+func (controller *CacheController) sampleRequestLog(writer *cacheStatusWriter) bool {
+	if controller.LogHitSampleRate <= 1 || writer.statusCode >= http.StatusInternalServerError || !writer.wroteHeader {
+		return true
+	}
+
+	if writer.status != CacheStatusHit && writer.status != CacheStatusStale {
+		return true
+	}
+
+	//The first hit is logged, then every LogHitSampleRate-th hit
+	return (atomic.AddUint32(&controller.loggedHits, 1)-1)%uint32(controller.LogHitSampleRate) == 0
+}
@@ -0,0 +1,96 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRequestLogSampling(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	output := &bytes.Buffer{}
+	controller.Logger = logrus.New()
+	controller.Logger.Out = output
+
+	controller.LogRequests = true
+	controller.LogHitSampleRate = 3
+	controller.SlowRequestThreshold = 10 * time.Millisecond
+
+	//One miss and six hits, of which the first and the fourth are logged
+	for i := 0; i < 7; i++ {
+		doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	}
+
+	if lines := strings.Count(output.String(), "Request served"); lines != 3 {
+		t.Errorf("expected 3 logged requests, got %d: %s", lines, output.String())
+	}
+
+	if lines := strings.Count(output.String(), "cache-status=HIT"); lines != 2 {
+		t.Errorf("expected 2 logged hits, got %d", lines)
+	}
+
+	output.Reset()
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/slow", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	doTestRequest(t, controller, req)
+
+	logged := output.String()
+	if !strings.Contains(logged, "Slow request served") || !strings.Contains(logged, "time-to-first-byte") {
+		t.Errorf("expected the slow request to be logged with a trace, got: %s", logged)
+	}
+
+	if strings.Contains(logged, "secret-token") {
+		t.Errorf("expected the trace to be redacted, got: %s", logged)
+	}
+}
+
+func TestRequestLogRedactsSignedURLs(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	output := &bytes.Buffer{}
+	controller.Logger = logrus.New()
+	controller.Logger.Out = output
+	controller.LogRequests = true
+
+	signer := &URLSigner{Secret: []byte("secret")}
+	controller.DefaultCacheConfig.RequestAuthorizer = signer
+
+	signedURL := signer.Sign(&url.URL{Scheme: "http", Host: host, Path: "/file", RawQuery: "v=1"}, time.Now().Add(time.Hour))
+	signature := signedURL.Query().Get(DefaultSignedURLSignatureParam)
+
+	//The signature is not logged, whether the request was authorized or refused
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, signedURL.String(), nil))
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, strings.Replace(signedURL.String(), "v=1", "v=2", 1), nil))
+
+	logged := output.String()
+	if strings.Count(logged, "Request served") != 2 {
+		t.Fatalf("expected 2 logged requests, got: %s", logged)
+	}
+
+	if strings.Contains(logged, signature) {
+		t.Errorf("expected the signature to be removed from the logged URL, got: %s", logged)
+	}
+
+	if !strings.Contains(logged, "/file?v=1") || !strings.Contains(logged, "/file?v=2") {
+		t.Errorf("expected the other query parameters to be logged, got: %s", logged)
+	}
+}
@@ -3,10 +3,9 @@ package sharedhttpcache
 import (
 	"context"
 	"net/http"
+	"strings"
 )
 
-//TODO implement bulk revalidation with If-None-Match precondition
-
 //makeRevalidationRequest makes a revalidation request based on the current request and the stored response to revalidate
 // If a conditional request can't be created the response will be nil in which case the cached response should be considered invalidated
 func makeRevalidationRequest(request *http.Request, response *http.Response) *http.Request {
@@ -40,3 +39,56 @@ func makeRevalidationRequest(request *http.Request, response *http.Response) *ht
 
 	return nil
 }
+
+//addVariantETags adds the entity tags of all stored variants to the If-None-Match precondition of a validation request
+// so the origin can select which stored response is still valid with a single request, section 4.3.2 of RFC 7234
+func addVariantETags(validationRequest *http.Request, variants []variant) {
+	etags := []string{}
+	if current := validationRequest.Header.Get("If-None-Match"); current != "" {
+		etags = append(etags, current)
+	}
+
+	for _, storedVariant := range variants {
+		if storedVariant.etag == "" || containsString(etags, storedVariant.etag) {
+			continue
+		}
+
+		etags = append(etags, storedVariant.etag)
+	}
+
+	if len(etags) > 0 {
+		validationRequest.Header.Set("If-None-Match", strings.Join(etags, ", "))
+	}
+}
+
+//selectVariant returns the variant of which the etag matches the etag of a 304 response using the weak comparison function
+// Section 4.3.4 of RFC 7234 and section 2.3.2 of RFC 7232
+func selectVariant(variants []variant, etag string) (variant, bool) {
+	for _, storedVariant := range variants {
+		if storedVariant.etag != "" && weakETagEqual(storedVariant.etag, etag) {
+			return storedVariant, true
+		}
+	}
+
+	return variant{}, false
+}
+
+//completePartialResponse turns a 206 response into a 200 response if its Content-Range covers the complete representation
+// Section 3.3 of RFC 7234. False is returned if the response is incomplete
+func completePartialResponse(response *http.Response) bool {
+	contentRange, err := parseContentRange(response.Header.Get("Content-Range"))
+	if err != nil || contentRange.start != 0 || contentRange.end != contentRange.complete-1 {
+		return false
+	}
+
+	response.StatusCode = http.StatusOK
+	response.Status = "200 " + http.StatusText(http.StatusOK)
+	response.Header.Del("Content-Range")
+
+	return true
+}
+
+//weakETagEqual compares two entity tags using the weak comparison function, section 2.3.2 of RFC 7232
+func weakETagEqual(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
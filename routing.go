@@ -0,0 +1,92 @@
+package sharedhttpcache
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+//A ForwardRoute routes requests for a host and path prefix to a origin server
+type ForwardRoute struct {
+	//Host is the hostname, without port, for which the route applies. A empty host matches any host
+	Host string
+
+	//PathPrefix is the prefix the path of the request must start with, like "/api/". It only matches whole path segments,
+	// so "/api" doesn't match "/apiary". A empty prefix matches any path
+	PathPrefix string
+
+	//ForwardConfig is used to forward requests which match the route
+	ForwardConfig *ForwardConfig
+
+	//Transport can optionally be set, if nil the default transport of the controller is used
+	Transport http.RoundTripper
+}
+
+//ForwardRouter is a ForwardConfigResolver and TransportResolver which routes requests to origin servers by host and path prefix.
+// If multiple routes match a request the route with the longest path prefix wins,
+// if the prefixes are equal a route with a host wins over a route which matches any host.
+type ForwardRouter struct {
+	Routes []ForwardRoute
+}
+
+//MatchRoute returns the route which matches the request best, nil is returned if no route matches
+func (router *ForwardRouter) MatchRoute(req *http.Request) *ForwardRoute {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+
+	//Internationalized hostnames are compared in their ASCII form, so a route can use either form.
+	// The trailing dot of a fully qualified name is ignored
+	host = asciiHostname(strings.TrimSuffix(host, "."))
+
+	var bestRoute *ForwardRoute
+	for i := range router.Routes {
+		route := &router.Routes[i]
+
+		if route.Host != "" && !strings.EqualFold(asciiHostname(strings.TrimSuffix(route.Host, ".")), host) {
+			continue
+		}
+
+		if !hasPathPrefix(req.URL.Path, route.PathPrefix) {
+			continue
+		}
+
+		if bestRoute == nil ||
+			len(route.PathPrefix) > len(bestRoute.PathPrefix) ||
+			(len(route.PathPrefix) == len(bestRoute.PathPrefix) && bestRoute.Host == "" && route.Host != "") {
+
+			bestRoute = route
+		}
+	}
+
+	return bestRoute
+}
+
+//hasPathPrefix checks if the path starts with the prefix. The prefix only matches whole path segments,
+// so "/api" and "/api/" match "/api/users" but not "/apiary". A empty prefix matches any path
+func hasPathPrefix(path, prefix string) bool {
+	if prefix == "" || path == prefix {
+		return true
+	}
+
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+//GetForwardConfig returns the forward config of the best matching route
+func (router *ForwardRouter) GetForwardConfig(req *http.Request) *ForwardConfig {
+	if route := router.MatchRoute(req); route != nil {
+		return route.ForwardConfig
+	}
+
+	return nil
+}
+
+//GetTransport returns the transport of the best matching route
+func (router *ForwardRouter) GetTransport(req *http.Request) http.RoundTripper {
+	if route := router.MatchRoute(req); route != nil && route.Transport != nil {
+		return route.Transport
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardRouter(t *testing.T) {
+	router := &ForwardRouter{
+		Routes: []ForwardRoute{
+			{PathPrefix: "", ForwardConfig: &ForwardConfig{Host: "default"}},
+			{PathPrefix: "/api/", ForwardConfig: &ForwardConfig{Host: "api-any-host"}},
+			{Host: "example.com", PathPrefix: "/api/", ForwardConfig: &ForwardConfig{Host: "api"}},
+			{Host: "example.com", PathPrefix: "/api/v2/", ForwardConfig: &ForwardConfig{Host: "api-v2"}},
+			{Host: "example.com", PathPrefix: "/static/", ForwardConfig: &ForwardConfig{Host: "static"}},
+			{Host: "example.com", PathPrefix: "/shop", ForwardConfig: &ForwardConfig{Host: "shop"}},
+			{Host: "bücher.example", PathPrefix: "", ForwardConfig: &ForwardConfig{Host: "idn"}},
+			{Host: "München.example.", PathPrefix: "", ForwardConfig: &ForwardConfig{Host: "idn-fqdn"}},
+		},
+	}
+
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{url: "http://example.com/", expected: "default"},
+		{url: "http://example.com/api/users", expected: "api"},
+		{url: "http://example.com:8080/api/v2/users", expected: "api-v2"},
+		{url: "http://example.com/static/style.css", expected: "static"},
+		{url: "http://example.org/api/users", expected: "api-any-host"},
+		{url: "http://example.org/static/style.css", expected: "default"},
+		{url: "http://example.com/shop", expected: "shop"},
+		{url: "http://example.com/shop/cart", expected: "shop"},
+		{url: "http://example.com/shopping", expected: "default"},
+		{url: "http://example.com/apiary", expected: "default"},
+		{url: "http://example.org/api-docs", expected: "default"},
+		{url: "http://xn--bcher-kva.example/", expected: "idn"},
+		{url: "http://XN--BCHER-KVA.example/", expected: "idn"},
+		{url: "http://BÜCHER.Example/", expected: "idn"},
+		{url: "http://bücher.example./", expected: "idn"},
+		{url: "http://xn--bcher-kva.example.:8080/", expected: "idn"},
+		{url: "http://bü_cher.example/", expected: "default"},
+		{url: "http://xn--mnchen-3ya.example/", expected: "idn-fqdn"},
+		{url: "http://xn--bcher-kva.example.org/", expected: "default"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			forwardConfig := router.GetForwardConfig(httptest.NewRequest(http.MethodGet, test.url, nil))
+			if forwardConfig == nil || forwardConfig.Host != test.expected {
+				t.Errorf("expected: %s, got: %v", test.expected, forwardConfig)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package sharedhttpcache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//MetricRequestUnauthorized is counted every time a request is refused because the RequestAuthorizer of the cache config rejected it
+const MetricRequestUnauthorized = "request.unauthorized"
+
+//Default names of the query parameters of a URLSigner
+const (
+	DefaultSignedURLExpiresParam   = "expires"
+	DefaultSignedURLSignatureParam = "signature"
+)
+
+var (
+	errSignatureMissing = errors.New("The URL is not signed")
+	errSignatureExpired = errors.New("The signed URL has expired")
+	errSignatureInvalid = errors.New("The signature of the URL is invalid")
+)
+
+//A RequestAuthorizer decides if a client may access a resource, it is consulted before a request is served from the cache
+// or forwarded, so protected content can be stored once and still be access controlled at the edge
+type RequestAuthorizer interface {
+
+	//AuthorizeRequest returns a error if the client may not access the requested resource
+	AuthorizeRequest(req *http.Request) error
+}
+
+//The RequestAuthorizerFunc type is an adapter to allow the use of ordinary functions as RequestAuthorizer
+type RequestAuthorizerFunc func(req *http.Request) error
+
+//AuthorizeRequest calls the underlying function to authorize the request
+func (authorizer RequestAuthorizerFunc) AuthorizeRequest(req *http.Request) error {
+	return authorizer(req)
+}
+
+//A QueryParamAuthorizer is a RequestAuthorizer which authorizes requests with parameters in the query, like a signature or token.
+// The parameters are removed from the request once it is authorized, so clients with different tokens share the stored response
+// and the origin never sees them
+type QueryParamAuthorizer interface {
+	RequestAuthorizer
+
+	//AuthorizationParams returns the names of the query parameters which are used to authorize requests
+	AuthorizationParams() []string
+}
+
+//A URLSigner signs URLs with a expiry time and authorizes requests for signed URLs which have not expired.
+// The signature is the hex encoded HMAC-SHA256 of the path and the expiry time in unix seconds, so the same signature
+// is valid for every host and query. It implements QueryParamAuthorizer
+type URLSigner struct {
+	//Secret is the key of the HMAC, it must be shared with the application which generates the URLs
+	Secret []byte
+
+	//ExpiresParam is the name of the query parameter with the expiry time, if empty DefaultSignedURLExpiresParam is used
+	ExpiresParam string
+
+	//SignatureParam is the name of the query parameter with the signature, if empty DefaultSignedURLSignatureParam is used
+	SignatureParam string
+}
+
+func (signer *URLSigner) expiresParam() string {
+	if signer.ExpiresParam == "" {
+		return DefaultSignedURLExpiresParam
+	}
+
+	return signer.ExpiresParam
+}
+
+func (signer *URLSigner) signatureParam() string {
+	if signer.SignatureParam == "" {
+		return DefaultSignedURLSignatureParam
+	}
+
+	return signer.SignatureParam
+}
+
+//signature returns the hex encoded HMAC of the path and expiry time
+func (signer *URLSigner) signature(path string, expires string) string {
+	mac := hmac.New(sha256.New, signer.Secret)
+	_, _ = mac.Write([]byte(path))
+	_, _ = mac.Write([]byte{'\n'})
+	_, _ = mac.Write([]byte(expires))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Sign returns a copy of the URL with the expiry time and signature added to the query
+func (signer *URLSigner) Sign(u *url.URL, expires time.Time) *url.URL {
+	unixExpires := strconv.FormatInt(expires.Unix(), 10)
+
+	query := u.Query()
+	query.Set(signer.expiresParam(), unixExpires)
+	query.Set(signer.signatureParam(), signer.signature(u.EscapedPath(), unixExpires))
+
+	signed := *u
+	signed.RawQuery = query.Encode()
+
+	return &signed
+}
+
+//AuthorizeRequest returns a error if the URL of the request is not signed, the signature is invalid or the URL has expired
+func (signer *URLSigner) AuthorizeRequest(req *http.Request) error {
+	query := req.URL.Query()
+
+	expires := query.Get(signer.expiresParam())
+	signature := query.Get(signer.signatureParam())
+	if expires == "" || signature == "" {
+		return errSignatureMissing
+	}
+
+	//The signature is checked first, so the expiry time can be trusted
+	if !hmac.Equal([]byte(signature), []byte(signer.signature(req.URL.EscapedPath(), expires))) {
+		return errSignatureInvalid
+	}
+
+	unixExpires, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+
+	if time.Now().Unix() > unixExpires {
+		return errSignatureExpired
+	}
+
+	return nil
+}
+
+//AuthorizationParams returns the names of the expiry and signature parameters
+func (signer *URLSigner) AuthorizationParams() []string {
+	return []string{signer.expiresParam(), signer.signatureParam()}
+}
+
+//authorizeRequest checks the request with the RequestAuthorizer of the config, a 403 is sent if it is rejected and false is returned.
+// The authorization parameters of a QueryParamAuthorizer are removed from the returned request
+func (controller *CacheController) authorizeRequest(cacheConfig *CacheConfig, resp http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	if cacheConfig.RequestAuthorizer == nil {
+		return req, true
+	}
+
+	if err := cacheConfig.RequestAuthorizer.AuthorizeRequest(req); err != nil {
+		controller.incrMetric(MetricRequestUnauthorized, 1, nil)
+
+		controller.requestLogger(req).WithError(err).WithFields(logrus.Fields{
+			"url": req.URL.Path,
+		}).Debug("Request refused by the request authorizer")
+
+		http.Error(resp, "Forbidden", http.StatusForbidden)
+		return req, false
+	}
+
+	return stripAuthorizationParams(cacheConfig.RequestAuthorizer, req), true
+}
+
+//stripAuthorizationParams removes the query parameters from the request if the authorizer is a QueryParamAuthorizer, the order of the other
+// parameters is preserved since it can matter to the origin. The request is cloned if it is modified
+func stripAuthorizationParams(requestAuthorizer RequestAuthorizer, req *http.Request) *http.Request {
+	authorizer, ok := requestAuthorizer.(QueryParamAuthorizer)
+	if !ok || req.URL.RawQuery == "" {
+		return req
+	}
+
+	names := authorizer.AuthorizationParams()
+
+	kept := make([]string, 0)
+	for _, param := range strings.Split(req.URL.RawQuery, "&") {
+		name := param
+		if equals := strings.Index(param, "="); equals >= 0 {
+			name = param[:equals]
+		}
+
+		if unescaped, err := url.QueryUnescape(name); err == nil && containsString(names, unescaped) {
+			continue
+		}
+
+		kept = append(kept, param)
+	}
+
+	rawQuery := strings.Join(kept, "&")
+	if rawQuery == req.URL.RawQuery {
+		return req
+	}
+
+	strippedReq := req.Clone(req.Context())
+	strippedReq.URL.RawQuery = rawQuery
+	strippedReq.RequestURI = strippedReq.URL.RequestURI()
+
+	return strippedReq
+}
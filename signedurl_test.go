@@ -0,0 +1,81 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	signer := &URLSigner{Secret: []byte("secret")}
+
+	page, _ := url.Parse("http://example.com/protected/file.mp4?quality=high")
+
+	tests := []struct {
+		name   string
+		url    string
+		expect error
+	}{
+		{name: "valid", url: signer.Sign(page, time.Now().Add(time.Hour)).String(), expect: nil},
+		{name: "expired", url: signer.Sign(page, time.Now().Add(-time.Hour)).String(), expect: errSignatureExpired},
+		{name: "unsigned", url: page.String(), expect: errSignatureMissing},
+		{name: "other secret", url: (&URLSigner{Secret: []byte("other")}).Sign(page, time.Now().Add(time.Hour)).String(), expect: errSignatureInvalid},
+	}
+
+	for _, test := range tests {
+		err := signer.AuthorizeRequest(httptest.NewRequest(http.MethodGet, test.url, nil))
+		if err != test.expect {
+			t.Errorf("%s: expected error '%v', got '%v'", test.name, test.expect, err)
+		}
+	}
+
+	//The signature covers the path, so it can't be used for a other resource
+	signed := signer.Sign(page, time.Now().Add(time.Hour))
+	signed.Path = "/protected/other.mp4"
+	if err := signer.AuthorizeRequest(httptest.NewRequest(http.MethodGet, signed.String(), nil)); err != errSignatureInvalid {
+		t.Errorf("expected a invalid signature for a other path, got '%v'", err)
+	}
+}
+
+func TestSignedURLsShareStoredResponse(t *testing.T) {
+	var originRequests int32
+	var originQuery atomic.Value
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&originRequests, 1)
+		originQuery.Store(req.URL.RawQuery)
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	signer := &URLSigner{Secret: []byte("secret")}
+	controller.DefaultCacheConfig.RequestAuthorizer = signer
+
+	page, _ := url.Parse("http://" + host + "/file.mp4?quality=high")
+
+	for _, expires := range []time.Time{time.Now().Add(time.Hour), time.Now().Add(2 * time.Hour)} {
+		response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, signer.Sign(page, expires).String(), nil))
+		if response.StatusCode != http.StatusOK || body != "content" {
+			t.Errorf("expected the signed URL to be served, got status %d", response.StatusCode)
+		}
+	}
+
+	if requests := atomic.LoadInt32(&originRequests); requests != 1 {
+		t.Errorf("expected differently signed URLs to share the stored response, got %d origin requests", requests)
+	}
+
+	if query := originQuery.Load().(string); query != "quality=high" {
+		t.Errorf("expected the signature to be removed before forwarding, got query '%s'", query)
+	}
+
+	//A stored response isn't served to clients without a valid signature
+	response, _ := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, page.String(), nil))
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403 for a unsigned URL, got %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,569 @@
+package sharedhttpcache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//errSliceMismatch is returned when a slice doesn't belong to the same representation as the other slices of a response
+// This happens when the resource changes on the origin while it is being sliced
+var errSliceMismatch = errors.New("slice doesn't match the representation of the other slices")
+
+//sliceCacheKeySuffix is appended to the primary cache key, followed by the byte range of the slice
+const sliceCacheKeySuffix = "|slice:"
+
+//byteRange is a inclusive range of bytes
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+//contentRange is a parsed Content-Range header, section 4.2 of RFC 7233
+type contentRange struct {
+	byteRange
+
+	//complete is the length of the complete representation
+	complete int64
+}
+
+//slice is a part of a resource which is stored as a separate cache entry
+type slice struct {
+	response     *http.Response
+	contentRange contentRange
+
+	//cached is true if the slice was served from the cache
+	cached bool
+}
+
+//serveSliced serves a GET request by fetching and storing the resource in slices of cacheConfig.SliceSize bytes.
+// Only the slices needed for the requested range are fetched, so very large resources can be cached partially.
+//
+// Slices are only stored under the primary cache key, a Vary header of the origin response is not taken into account
+func (controller *CacheController) serveSliced(
+	cacheConfig *CacheConfig,
+	forwardConfig *ForwardConfig,
+	transport http.RoundTripper,
+	resp http.ResponseWriter,
+	req *http.Request,
+	primaryCacheKey string,
+) {
+	sliceSize := cacheConfig.SliceSize
+
+	requestedRange, hasRange := parseRangeHeader(req.Header.Get("Range"))
+
+	//Fetch the slice which contains the start of the requested range, the headers and complete length are taken from it
+	headIndex := int64(0)
+	if hasRange && requestedRange.start >= 0 {
+		headIndex = requestedRange.start / sliceSize
+	}
+
+	head, err := controller.getSlice(cacheConfig, forwardConfig, transport, req, primaryCacheKey, headIndex, nil)
+
+	//The requested range starts after the end of the resource, use the first slice to get the complete length
+	if err == nil && headIndex > 0 && head.response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		head.response.Body.Close()
+
+		headIndex = 0
+		head, err = controller.getSlice(cacheConfig, forwardConfig, transport, req, primaryCacheKey, headIndex, nil)
+	}
+
+	if err != nil {
+		controller.requestLogger(req).WithError(err).WithFields(controller.redactLogFields(logrus.Fields{
+			"forward-config": forwardConfig,
+			"request":        req,
+		})).Warning("Error while fetching slice from origin server")
+
+		http.Error(resp, "Unable to contact origin server", http.StatusBadGateway)
+		return
+	}
+
+	//The header is sent with the first slice, so the status of the response is the status of the first slice
+	if head.cached {
+		setCacheStatus(resp, CacheStatusHit)
+	} else {
+		setCacheStatus(resp, CacheStatusMiss)
+	}
+
+	//The origin doesn't support range requests or returned a error, in both cases the response is not sliced
+	if head.response.StatusCode != http.StatusPartialContent {
+		controller.serveUnsliced(cacheConfig, forwardConfig, transport, resp, req, primaryCacheKey, head.response)
+		return
+	}
+
+	complete := head.contentRange.complete
+
+	//A range is ignored if the representation changed since the client received the validator, section 3.2 of RFC 7233
+	if hasRange && !ifRangeMatches(req.Header.Get("If-Range"), head.response) {
+		hasRange = false
+	}
+
+	statusCode := http.StatusOK
+	servedRange := byteRange{start: 0, end: complete - 1}
+
+	if hasRange {
+		var satisfiable bool
+		servedRange, satisfiable = requestedRange.resolve(complete)
+		if !satisfiable {
+			head.response.Body.Close()
+
+			resp.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(complete, 10))
+			http.Error(resp, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		statusCode = http.StatusPartialContent
+	}
+
+	header := resp.Header()
+	for key, values := range head.response.Header {
+		header[key] = values
+	}
+
+	restoreOriginCacheControl(header)
+
+	header.Del("Content-Range")
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Length", strconv.FormatInt(servedRange.length(), 10))
+	header.Set(AgeHeader, strconv.FormatInt(getResponseAge(head.response), 10))
+
+	if statusCode == http.StatusPartialContent {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", servedRange.start, servedRange.end, complete))
+	}
+
+	resp.WriteHeader(statusCode)
+
+	//An empty representation has no slices to write
+	if servedRange.length() <= 0 {
+		head.response.Body.Close()
+		return
+	}
+
+	firstIndex := servedRange.start / sliceSize
+	lastIndex := servedRange.end / sliceSize
+
+	//The head is not part of the served range if the start of a suffix range was unknown
+	if headIndex < firstIndex || headIndex > lastIndex {
+		head.response.Body.Close()
+	}
+
+	for index := firstIndex; index <= lastIndex; index++ {
+		current := head
+		if index != headIndex {
+			current, err = controller.getSlice(cacheConfig, forwardConfig, transport, req, primaryCacheKey, index, head)
+		}
+
+		if err == nil {
+			err = writeSlice(resp, current, servedRange)
+		}
+
+		if err != nil {
+			//Close the head if it has not been written yet
+			if headIndex > index && headIndex <= lastIndex {
+				head.response.Body.Close()
+			}
+
+			controller.requestLogger(req).WithError(err).WithField("cache-key", primaryCacheKey).Error("Error while writing sliced response to http client")
+
+			//The status and headers are already sent, the only way to signal the error to the client is aborting the response
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+//serveUnsliced serves a response of the origin to a slice request which is not a partial response
+func (controller *CacheController) serveUnsliced(
+	cacheConfig *CacheConfig,
+	forwardConfig *ForwardConfig,
+	transport http.RoundTripper,
+	resp http.ResponseWriter,
+	req *http.Request,
+	primaryCacheKey string,
+	response *http.Response,
+) {
+	//The range of the slice was not satisfiable, most likely because the resource is empty.
+	// Retry with the request of the client which doesn't have the range of the slice
+	if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		response.Body.Close()
+
+		var stop bool
+		response, stop = controller.proxyRequestToOrigin(cacheConfig, forwardConfig, transport, resp, req)
+		if stop {
+			return
+		}
+	}
+
+	if response.Header.Get(DateHeader) == "" {
+		response.Header.Set(DateHeader, time.Now().Format(http.TimeFormat))
+	}
+
+	response = controller.storeResponse(cacheConfig, req, response, primaryCacheKey)
+
+	controller.prepareResponseForClient(cacheConfig, req, response)
+
+	err := controller.writeHTTPResponse(cacheConfig, resp, response)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).Error("Error while writing response to http client")
+	}
+}
+
+//getSlice gets the slice with the given index from the cache or the origin.
+// If head is not nil the slice must be part of the same representation as head
+//
+// If the origin doesn't return a partial response the response is returned as is, without a content range
+func (controller *CacheController) getSlice(
+	cacheConfig *CacheConfig,
+	forwardConfig *ForwardConfig,
+	transport http.RoundTripper,
+	req *http.Request,
+	primaryCacheKey string,
+	index int64,
+	head *slice,
+) (*slice, error) {
+	sliceRange := byteRange{
+		start: index * cacheConfig.SliceSize,
+		end:   (index+1)*cacheConfig.SliceSize - 1,
+	}
+
+	cacheKey := primaryCacheKey + sliceCacheKeySuffix + strconv.FormatInt(sliceRange.start, 10) + "-" + strconv.FormatInt(sliceRange.end, 10)
+
+	cachedResponse, freshness, ttl, err := controller.findEntryInCache(cacheKey)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).WithField("cache-key", cacheKey).Error("Error while attempting to find slice in cache")
+	}
+
+	if cachedResponse != nil && cacheConfig.EpochResolver != nil {
+		ttl = boundTTLByEpoch(cacheConfig.EpochResolver.GetEpoch(req), freshness, ttl)
+	}
+
+	if cachedResponse != nil && controller.isInvalidated(cacheConfig, req, forwardConfig, cachedResponse, freshness) {
+		cachedResponse.Body.Close()
+		cachedResponse = nil
+	}
+
+	if cachedResponse != nil {
+		cachedSlice, parseErr := newSlice(cachedResponse, sliceRange)
+
+		//Slices have their own TTL, a slice which belongs to a older representation than the head is fetched again
+		if parseErr == nil && ttl > 0 && !freshness.noCache && sliceMatches(head, cachedSlice) {
+			controller.incrMetric(MetricCacheHit, 1, nil)
+			controller.emitEvent(CacheEventHit, cacheKey, cachedResponse.ContentLength, false)
+
+			cachedResponse.Request = req
+			cachedSlice.cached = true
+
+			//The Age of the served response is based on the head, which may come from the cache
+			cachedResponse.Header.Set(AgeHeader, strconv.FormatInt(freshness.age(), 10))
+
+			return cachedSlice, nil
+		}
+
+		cachedResponse.Body.Close()
+	}
+
+	controller.incrMetric(MetricCacheMiss, 1, nil)
+	controller.emitEvent(CacheEventMiss, cacheKey, -1, false)
+
+	sliceRequest := req.Clone(req.Context())
+	sliceRequest.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", sliceRange.start, sliceRange.end))
+
+	//Preconditions of the client apply to the complete response, not to the slice
+	for _, name := range []string{"If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		sliceRequest.Header.Del(name)
+	}
+
+	//The body of the slice is read after this function returns, so the context of the client request is used
+	response, err := controller.roundTripOrigin(req.Context(), transport, forwardConfig, sliceRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	controller.prepareOriginResponse(cacheConfig, sliceRequest, response)
+
+	if response.StatusCode != http.StatusPartialContent {
+		if head != nil {
+			response.Body.Close()
+			return nil, fmt.Errorf("%w: origin returned status %d", errSliceMismatch, response.StatusCode)
+		}
+
+		return &slice{response: response}, nil
+	}
+
+	originSlice, err := newSlice(response, sliceRange)
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+
+	if !sliceMatches(head, originSlice) {
+		response.Body.Close()
+		return nil, errSliceMismatch
+	}
+
+	storedSlice := controller.storeSlice(cacheConfig, req, cacheKey, originSlice)
+	if storedSlice == nil {
+		return nil, errors.New("slice was evicted before it could be served")
+	}
+
+	return storedSlice, nil
+}
+
+//storeSlice stores a slice from the origin if the complete response would be stored
+// The stored slice is returned, or the given slice if it was not stored
+func (controller *CacheController) storeSlice(cacheConfig *CacheConfig, req *http.Request, cacheKey string, originSlice *slice) *slice {
+	response := originSlice.response
+
+	if response.Header.Get(DateHeader) == "" {
+		response.Header.Set(DateHeader, time.Now().Format(http.TimeFormat))
+	}
+
+	stripResponseHeaders(cacheConfig, response.Header)
+
+	//A slice is as cacheable as the complete response, which would have status 200
+	complete := *response
+	complete.StatusCode = http.StatusOK
+	complete.Request = req
+
+	if !shouldStoreResponse(cacheConfig, &complete) {
+		return originSlice
+	}
+
+	ttl := getResponseTTL(cacheConfig, &complete)
+	if ttl <= 0 {
+		return originSlice
+	}
+
+	tenant := TenantFromRequest(req)
+	if !controller.tenantQuotaAllows(tenant, cacheKey, response.ContentLength) {
+		return originSlice
+	}
+
+	size, err := controller.storeResponseInCache(cacheKey, response, ttl)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).WithField("cache-key", cacheKey).Error("Error while attempting to store slice in cache")
+
+		if errors.Is(err, errResponseBodyLost) {
+			return nil
+		}
+
+		return originSlice
+	}
+
+	controller.incrMetric(MetricCacheStoredBytes, size, nil)
+	controller.emitEvent(CacheEventStore, cacheKey, size, false)
+
+	if tenant != "" {
+		controller.getTenantUsageTracker().record(tenant, cacheKey, size, ttl)
+	}
+
+	storedResponse, _, err := controller.findResponseInCache(cacheKey)
+	if err != nil || storedResponse == nil {
+		//The body of the origin response has been consumed by storing it, so the slice can't be served if it was evicted right away
+		return nil
+	}
+
+	storedResponse.Request = req
+	originSlice.response = storedResponse
+
+	return originSlice
+}
+
+//newSlice checks if the partial response contains the expected range
+func newSlice(response *http.Response, expected byteRange) (*slice, error) {
+	parsed, err := parseContentRange(response.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+
+	//The last slice is shorter if the complete length is not a multiple of the slice size
+	if parsed.start != expected.start || (parsed.end != expected.end && parsed.end != parsed.complete-1) {
+		return nil, fmt.Errorf("unexpected content range %d-%d for slice %d-%d", parsed.start, parsed.end, expected.start, expected.end)
+	}
+
+	return &slice{
+		response:     response,
+		contentRange: parsed,
+	}, nil
+}
+
+//sliceMatches checks if the slice is part of the same representation as the head
+func sliceMatches(head, other *slice) bool {
+	if head == nil {
+		return true
+	}
+
+	if head.contentRange.complete != other.contentRange.complete {
+		return false
+	}
+
+	if etag := head.response.Header.Get("Etag"); etag != "" {
+		return etag == other.response.Header.Get("Etag")
+	}
+
+	return head.response.Header.Get("Last-Modified") == other.response.Header.Get("Last-Modified")
+}
+
+//writeSlice writes the part of the slice which overlaps with the served range
+func writeSlice(w io.Writer, current *slice, servedRange byteRange) error {
+	body := current.response.Body
+	defer body.Close()
+
+	start := servedRange.start
+	if current.contentRange.start > start {
+		start = current.contentRange.start
+	}
+
+	end := servedRange.end
+	if current.contentRange.end < end {
+		end = current.contentRange.end
+	}
+
+	skip := start - current.contentRange.start
+
+	//Files from a disk layer can seek to the start, other bodies have to be read
+	if seeker, ok := body.(io.Seeker); ok {
+		if _, err := seeker.Seek(skip, io.SeekCurrent); err != nil {
+			return err
+		}
+	} else if _, err := io.CopyN(ioutil.Discard, body, skip); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(w, body, end-start+1)
+	return err
+}
+
+//requestedRange is a single range of a Range header, section 2.1 of RFC 7233
+// start is -1 for a suffix range, in which case end is the length of the suffix
+// end is -1 if the range has no last byte position
+type requestedRange byteRange
+
+//parseRangeHeader parses a Range header with a single byte range
+// Headers with multiple ranges or a invalid syntax are reported as not having a range, since a server may ignore the Range header
+func parseRangeHeader(value string) (requestedRange, bool) {
+	if !strings.HasPrefix(value, "bytes=") {
+		return requestedRange{}, false
+	}
+
+	spec := strings.TrimSpace(value[len("bytes="):])
+	if strings.Contains(spec, ",") {
+		return requestedRange{}, false
+	}
+
+	dash := strings.IndexByte(spec, '-')
+	if dash == -1 {
+		return requestedRange{}, false
+	}
+
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return requestedRange{}, false
+		}
+
+		return requestedRange{start: -1, end: suffix}, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return requestedRange{}, false
+	}
+
+	if last == "" {
+		return requestedRange{start: start, end: -1}, true
+	}
+
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return requestedRange{}, false
+	}
+
+	return requestedRange{start: start, end: end}, true
+}
+
+//resolve returns the range of bytes of a representation with the given length which is requested
+// false is returned if the range is not satisfiable, section 4.4 of RFC 7233
+func (r requestedRange) resolve(complete int64) (byteRange, bool) {
+	if r.start == -1 {
+		if r.end == 0 || complete == 0 {
+			return byteRange{}, false
+		}
+
+		start := complete - r.end
+		if start < 0 {
+			start = 0
+		}
+
+		return byteRange{start: start, end: complete - 1}, true
+	}
+
+	if r.start >= complete {
+		return byteRange{}, false
+	}
+
+	end := r.end
+	if end == -1 || end >= complete {
+		end = complete - 1
+	}
+
+	return byteRange{start: r.start, end: end}, true
+}
+
+//parseContentRange parses a Content-Range header of a partial response, section 4.2 of RFC 7233
+func parseContentRange(value string) (contentRange, error) {
+	invalid := fmt.Errorf("invalid Content-Range '%s'", value)
+
+	if !strings.HasPrefix(value, "bytes ") {
+		return contentRange{}, invalid
+	}
+
+	spec := value[len("bytes "):]
+
+	slash := strings.IndexByte(spec, '/')
+	dash := strings.IndexByte(spec, '-')
+	if slash == -1 || dash == -1 || dash > slash {
+		return contentRange{}, invalid
+	}
+
+	start, startErr := strconv.ParseInt(spec[:dash], 10, 64)
+	end, endErr := strconv.ParseInt(spec[dash+1:slash], 10, 64)
+	complete, completeErr := strconv.ParseInt(spec[slash+1:], 10, 64)
+
+	//The complete length must be known to know how many slices there are
+	if startErr != nil || endErr != nil || completeErr != nil || start > end || end >= complete {
+		return contentRange{}, invalid
+	}
+
+	return contentRange{
+		byteRange: byteRange{start: start, end: end},
+		complete:  complete,
+	}, nil
+}
+
+//ifRangeMatches checks the If-Range precondition against the response, section 3.2 of RFC 7233
+// The precondition matches if the header is empty
+func ifRangeMatches(ifRange string, response *http.Response) bool {
+	if ifRange == "" {
+		return true
+	}
+
+	//A entity tag must match strongly
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == response.Header.Get("Etag")
+	}
+
+	return ifRange == response.Header.Get("Last-Modified")
+}
@@ -0,0 +1,100 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlicedResponses(t *testing.T) {
+	content := "0123456789"
+
+	lock := sync.Mutex{}
+	requestedRanges := []string{}
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		requestedRanges = append(requestedRanges, req.Header.Get("Range"))
+		lock.Unlock()
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		rw.Header().Set("Etag", `"v1"`)
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.SliceSize = 4
+
+	tests := []struct {
+		rangeHeader  string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{rangeHeader: "bytes=5-6", status: http.StatusPartialContent, body: "56", contentRange: "bytes 5-6/10"},
+		{rangeHeader: "", status: http.StatusOK, body: content},
+		{rangeHeader: "bytes=-3", status: http.StatusPartialContent, body: "789", contentRange: "bytes 7-9/10"},
+		{rangeHeader: "bytes=2-", status: http.StatusPartialContent, body: "23456789", contentRange: "bytes 2-9/10"},
+		{rangeHeader: "bytes=0-1,4-5", status: http.StatusOK, body: content},
+		{rangeHeader: "bytes=20-30", status: http.StatusRequestedRangeNotSatisfiable, contentRange: "bytes */10"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/file.bin", nil)
+		if test.rangeHeader != "" {
+			req.Header.Set("Range", test.rangeHeader)
+		}
+
+		response, body := doTestRequest(t, controller, req)
+
+		if response.StatusCode != test.status {
+			t.Errorf("range '%s': expected status %d, got %d", test.rangeHeader, test.status, response.StatusCode)
+			continue
+		}
+
+		if test.status != http.StatusRequestedRangeNotSatisfiable && body != test.body {
+			t.Errorf("range '%s': expected body '%s', got '%s'", test.rangeHeader, test.body, body)
+		}
+
+		if response.Header.Get("Content-Range") != test.contentRange {
+			t.Errorf("range '%s': expected Content-Range '%s', got '%s'", test.rangeHeader, test.contentRange, response.Header.Get("Content-Range"))
+		}
+	}
+
+	//Every slice is only fetched once, all other requests are served from the cache
+	expectedRanges := []string{"bytes=4-7", "bytes=0-3", "bytes=8-11", "bytes=20-23"}
+	if strings.Join(requestedRanges, " ") != strings.Join(expectedRanges, " ") {
+		t.Errorf("expected the origin to receive ranges %v, got %v", expectedRanges, requestedRanges)
+	}
+}
+
+func TestSlicedResponseWithoutRangeSupport(t *testing.T) {
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("0123456789"))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.SliceSize = 4
+
+	response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/file.bin", nil))
+	if response.StatusCode != http.StatusOK || body != "0123456789" {
+		t.Errorf("expected the complete response, got status %d and body '%s'", response.StatusCode, body)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	parsed, err := parseContentRange("bytes 4-7/10")
+	if err != nil || parsed.start != 4 || parsed.end != 7 || parsed.complete != 10 {
+		t.Errorf("unexpected result %+v, err: %v", parsed, err)
+	}
+
+	for _, invalid := range []string{"", "bytes */10", "bytes 4-7/*", "bytes 7-4/10", "bytes 4-10/10", "items 4-7/10"} {
+		if _, err := parseContentRange(invalid); err == nil {
+			t.Errorf("expected '%s' to be invalid", invalid)
+		}
+	}
+}
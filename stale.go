@@ -0,0 +1,79 @@
+package sharedhttpcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+//MetricCacheStaleWhileRevalidate is counted every time a stale response is served within the stale-while-revalidate window of the response
+const MetricCacheStaleWhileRevalidate = "cache.stale_while_revalidate"
+
+//Classes of origin failures for which a stale response can be served, see CacheConfig.ServeStaleOnFailures
+const (
+	//OriginFailureUnreachable means no response was received from the origin server, for example because the connection was refused
+	OriginFailureUnreachable = "unreachable"
+
+	//OriginFailureTimeout means the origin server didn't respond in time
+	OriginFailureTimeout = "timeout"
+
+	//OriginFailureServerError means the origin server responded with a 5xx status code
+	OriginFailureServerError = "server-error"
+)
+
+//classifyOriginFailure returns the class of a failed origin request, the error or the response should be set
+func classifyOriginFailure(err error, response *http.Response) string {
+	if err == nil && response != nil {
+		return OriginFailureServerError
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return OriginFailureTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return OriginFailureTimeout
+	}
+
+	return OriginFailureUnreachable
+}
+
+//staleAllowedByPolicy checks if the configuration allows a stale response to be served for the origin failure
+// An empty list in the configuration allows all failures or status codes
+func staleAllowedByPolicy(cacheConfig *CacheConfig, response *http.Response, failure string) bool {
+	if len(cacheConfig.ServeStaleOnFailures) > 0 && !containsString(cacheConfig.ServeStaleOnFailures, failure) {
+		return false
+	}
+
+	if len(cacheConfig.ServeStaleStatusCodes) == 0 {
+		return true
+	}
+
+	for _, statusCode := range cacheConfig.ServeStaleStatusCodes {
+		if statusCode == response.StatusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+//mayServeWhileRevalidating checks if a stale response may be served immediately while it is revalidated in the background,
+// because its staleness is within the stale-while-revalidate window of the response. Section 3 of RFC 5861.
+// The directive overrides the proxy-revalidate implied by s-maxage, but not a explicit must-revalidate, proxy-revalidate or no-cache.
+// Clients which send no-cache or min-fresh, or don't accept the age of the response, are not served while revalidating
+func mayServeWhileRevalidating(clientDirectives clientCacheControl, age int64, ttl time.Duration, response *http.Response) bool {
+	if ttl > 0 || clientDirectives.noCache || clientDirectives.minFresh >= 0 || !clientDirectives.acceptsAge(age) {
+		return false
+	}
+
+	cc := parseResponseCacheControl(response.Header)
+	if !cc.staleWhileRevalidateValid || cc.mustRevalidate || cc.proxyRevalidate || cc.noCache {
+		return false
+	}
+
+	return -ttl <= time.Duration(cc.staleWhileRevalidate)*time.Second
+}
@@ -0,0 +1,199 @@
+package sharedhttpcache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyOriginFailure(t *testing.T) {
+	if failure := classifyOriginFailure(nil, &http.Response{StatusCode: http.StatusBadGateway}); failure != OriginFailureServerError {
+		t.Errorf("expected server error, got %s", failure)
+	}
+
+	if failure := classifyOriginFailure(timeoutError{}, nil); failure != OriginFailureTimeout {
+		t.Errorf("expected timeout, got %s", failure)
+	}
+
+	if failure := classifyOriginFailure(errors.New("connection refused"), nil); failure != OriginFailureUnreachable {
+		t.Errorf("expected unreachable, got %s", failure)
+	}
+}
+
+func TestServeStalePolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    []string
+		statusCodes []int
+		expectStale bool
+	}{
+		{name: "no restrictions", expectStale: true},
+		{name: "allowed status code", statusCodes: []int{http.StatusOK}, expectStale: true},
+		{name: "disallowed status code", statusCodes: []int{http.StatusMovedPermanently}, expectStale: false},
+		{name: "allowed failure", failures: []string{OriginFailureServerError}, expectStale: true},
+		{name: "disallowed failure", failures: []string{OriginFailureTimeout}, expectStale: false},
+	}
+
+	for _, test := range tests {
+		originRequests := 0
+		controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			originRequests++
+
+			//The first response is stored but immediately stale, after that the origin fails
+			if originRequests > 1 {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			rw.Header().Set(CacheControlHeader, "max-age=0")
+			rw.Header().Set("Etag", `"v1"`)
+			_, _ = rw.Write([]byte("content"))
+		}))
+
+		controller.DefaultCacheConfig.ServeStaleOnFailures = test.failures
+		controller.DefaultCacheConfig.ServeStaleStatusCodes = test.statusCodes
+
+		doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+
+		servedStale := response.StatusCode == http.StatusOK && body == "content"
+		if servedStale != test.expectStale {
+			t.Errorf("%s: expected stale response %v, got status %d", test.name, test.expectStale, response.StatusCode)
+		}
+
+		closeOrigin()
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var fullResponses, notModified int32
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		//The response is stored but immediately stale, it may be served stale for a minute while it is revalidated
+		rw.Header().Set(CacheControlHeader, "max-age=0, stale-while-revalidate=60")
+		rw.Header().Set("Etag", `"v1"`)
+
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		atomic.AddInt32(&fullResponses, 1)
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+
+	response, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+	if response.StatusCode != http.StatusOK || body != "content" {
+		t.Fatalf("expected the stale response to be served, got status %d", response.StatusCode)
+	}
+
+	//The stale response is revalidated in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&notModified) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if atomic.LoadInt32(&notModified) == 0 {
+		t.Errorf("expected the stale response to be revalidated in the background")
+	}
+
+	if requests := atomic.LoadInt32(&fullResponses); requests != 1 {
+		t.Errorf("expected 1 full response from the origin, got %d", requests)
+	}
+
+	//A client which needs a fresh response isn't served while revalidating
+	if mayServeWhileRevalidating(parseClientCacheControl(http.Header{CacheControlHeader: {"min-fresh=1"}}), 1, -time.Second, response) {
+		t.Errorf("expected a client with min-fresh not to be served while revalidating")
+	}
+}
+
+func TestMayServeWhileRevalidating(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		ttl          time.Duration
+		expectServe  bool
+	}{
+		{name: "within window", cacheControl: "max-age=60, stale-while-revalidate=30", ttl: -time.Second, expectServe: true},
+		{name: "past window", cacheControl: "max-age=60, stale-while-revalidate=30", ttl: -time.Minute, expectServe: false},
+		{name: "fresh", cacheControl: "max-age=60, stale-while-revalidate=30", ttl: time.Second, expectServe: false},
+		{name: "no directive", cacheControl: "max-age=60", ttl: -time.Second, expectServe: false},
+		{name: "s-maxage", cacheControl: "s-maxage=60, stale-while-revalidate=30", ttl: -time.Second, expectServe: true},
+		{name: "must-revalidate", cacheControl: "max-age=60, must-revalidate, stale-while-revalidate=30", ttl: -time.Second, expectServe: false},
+	}
+
+	for _, test := range tests {
+		response := &http.Response{Header: http.Header{CacheControlHeader: {test.cacheControl}}}
+
+		if served := mayServeWhileRevalidating(parseClientCacheControl(http.Header{}), 0, test.ttl, response); served != test.expectServe {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expectServe, served)
+		}
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	tests := []struct {
+		name          string
+		cacheControl  string
+		clientControl string
+		wait          time.Duration
+		expectStale   bool
+	}{
+		{name: "response directive", cacheControl: "max-age=0, stale-if-error=60", expectStale: true},
+		{name: "response overrides must-revalidate", cacheControl: "max-age=0, must-revalidate, stale-if-error=60", expectStale: true},
+		{name: "past window", cacheControl: "max-age=0, stale-if-error=0", wait: 1100 * time.Millisecond, expectStale: false},
+		{name: "client directive", cacheControl: "max-age=0", clientControl: "stale-if-error=60", expectStale: true},
+		{name: "client directive with must-revalidate", cacheControl: "max-age=0, must-revalidate", clientControl: "stale-if-error=60", expectStale: false},
+		{name: "no directive", cacheControl: "max-age=0", expectStale: false},
+	}
+
+	for _, test := range tests {
+		var originRequests int32
+		controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			//The first response is stored but immediately stale, after that the origin fails
+			if atomic.AddInt32(&originRequests, 1) > 1 {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			rw.Header().Set(CacheControlHeader, test.cacheControl)
+			rw.Header().Set("Etag", `"v1"`)
+			_, _ = rw.Write([]byte("content"))
+		}))
+
+		//Only the directives allow stale responses to be served
+		controller.DefaultCacheConfig.ServeStaleOnError = false
+
+		doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+
+		//Ages are in whole seconds, so the response has to be stale for over a second to exceed a window
+		time.Sleep(test.wait)
+
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		if test.clientControl != "" {
+			req.Header.Set(CacheControlHeader, test.clientControl)
+		}
+
+		response, body := doTestRequest(t, controller, req)
+
+		servedStale := response.StatusCode == http.StatusOK && body == "content"
+		if servedStale != test.expectStale {
+			t.Errorf("%s: expected stale response %v, got status %d", test.name, test.expectStale, response.StatusCode)
+		}
+
+		closeOrigin()
+	}
+}
@@ -0,0 +1,81 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//StatsDSink is a MetricsSink which sends metrics to a StatsD server over UDP
+// If DatadogTags is true tags are sent in the DogStatsD format, otherwise tags are dropped since plain StatsD doesn't support them
+type StatsDSink struct {
+	//Prefix is prepended to the name of every metric, like "sharedhttpcache."
+	Prefix string
+
+	//DatadogTags enables the DogStatsD tag extension
+	DatadogTags bool
+
+	conn net.Conn
+}
+
+//NewStatsDSink creates a StatsDSink which sends metrics to the given address, like "127.0.0.1:8125"
+func NewStatsDSink(address, prefix string, datadogTags bool) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsDSink{
+		Prefix:      prefix,
+		DatadogTags: datadogTags,
+		conn:        conn,
+	}, nil
+}
+
+//IncrCounter sends a counter metric
+func (sink *StatsDSink) IncrCounter(name string, value int64, tags map[string]string) {
+	sink.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+//ObserveDuration sends a timing metric in milliseconds
+func (sink *StatsDSink) ObserveDuration(name string, duration time.Duration, tags map[string]string) {
+	sink.send(name, strconv.FormatFloat(duration.Seconds()*1000, 'f', 3, 64), "ms", tags)
+}
+
+//Close closes the connection to the StatsD server
+func (sink *StatsDSink) Close() error {
+	return sink.conn.Close()
+}
+
+func (sink *StatsDSink) send(name, value, metricType string, tags map[string]string) {
+	buf := &bytes.Buffer{}
+	buf.WriteString(sink.Prefix)
+	buf.WriteString(name)
+	buf.WriteByte(':')
+	buf.WriteString(value)
+	buf.WriteByte('|')
+	buf.WriteString(metricType)
+
+	if sink.DatadogTags && len(tags) > 0 {
+		keys := make([]string, 0, len(tags))
+		for key := range tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteString("|#")
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(key)
+			buf.WriteByte(':')
+			buf.WriteString(tags[key])
+		}
+	}
+
+	//Metrics are best effort, a unreachable StatsD server should never affect requests
+	_, _ = sink.conn.Write(buf.Bytes())
+}
@@ -0,0 +1,206 @@
+package sharedhttpcache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//maxStoreDrainSize is the maximum amount of bytes read from the origin for the cache after the client stopped reading.
+// A larger rest of the body is not worth the bandwidth of a client which went away, so the response is not stored
+const maxStoreDrainSize = 1024 * 1024
+
+var errStoreAborted = errors.New("the client closed the response before it was stored")
+
+//storingBody is the body of a response which is stored while it is served to the client.
+// Every byte read from the origin is also written to a pipe from which the cache layers read, like a io.TeeReader.
+// The client and the cache read at the same pace, so the body is never buffered completely
+type storingBody struct {
+	origin io.ReadCloser
+
+	//pipe is nil once the cache stopped reading, the rest of the body is then only served to the client
+	pipe *io.PipeWriter
+
+	//finished is true once the origin body returned EOF or a error
+	finished bool
+
+	//aborted is true if the client closed the body and the rest was too large to read for the cache
+	aborted bool
+
+	//stored is closed once the response is stored or storing failed
+	stored chan struct{}
+
+	closeOnce sync.Once
+}
+
+func (body *storingBody) Read(p []byte) (int, error) {
+	n, err := body.origin.Read(p)
+
+	if n > 0 && body.pipe != nil {
+		//The cache can stop reading if the response can't be stored, the client is still served
+		if _, writeErr := body.pipe.Write(p[:n]); writeErr != nil {
+			body.pipe = nil
+		}
+	}
+
+	if err != nil {
+		body.finish(err)
+	}
+
+	return n, err
+}
+
+//finish ends the body of the cache, a incomplete body is never stored since the layers receive the error
+func (body *storingBody) finish(err error) {
+	if body.finished {
+		return
+	}
+	body.finished = true
+
+	if body.pipe == nil {
+		return
+	}
+
+	if err == io.EOF {
+		body.pipe.Close()
+	} else {
+		body.pipe.CloseWithError(err)
+	}
+}
+
+//Close reads the rest of the body for the cache if the client stopped reading, and waits until the response is stored.
+// This way requests which wait for the response can find it in the cache once the body is closed.
+// At most maxStoreDrainSize bytes are read, storing is aborted if the rest of the body is larger
+func (body *storingBody) Close() error {
+	var err error
+
+	body.closeOnce.Do(func() {
+		if !body.finished && body.pipe != nil {
+			//One byte more than the limit is read, to tell a body which ends at the limit from a larger body
+			_, copyErr := io.CopyN(body.pipe, body.origin, maxStoreDrainSize+1)
+			if copyErr == nil {
+				body.aborted = true
+				copyErr = errStoreAborted
+			}
+
+			body.finish(copyErr)
+		}
+
+		body.finish(io.ErrUnexpectedEOF)
+
+		err = body.origin.Close()
+
+		<-body.stored
+	})
+
+	return err
+}
+
+//storeWhileServing starts storing the response under the cache key while it is served. The returned response must be served
+// to the client instead of the given one, the body of the returned response must always be closed.
+// The response is stored from a copy, so the client response can be modified while it is being stored
+func (controller *CacheController) storeWhileServing(
+	req *http.Request,
+	response *http.Response,
+	primaryCacheKey string,
+	secondaryCacheKey string,
+	ttl time.Duration,
+	maxVariants int,
+) *http.Response {
+	cacheKey := primaryCacheKey + secondaryCacheKey
+
+	body := response.Body
+	if body == nil {
+		body = http.NoBody
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	storing := &storingBody{
+		origin: body,
+		pipe:   pipeWriter,
+		stored: make(chan struct{}),
+	}
+
+	storedResponse := *response
+	storedResponse.Header = response.Header.Clone()
+	storedResponse.Body = pipeReader
+
+	//The length of the body can be unknown, so the quota of the tenant is also enforced on the stored bytes
+	var quotaBody *quotaLimitedBody
+	if remaining, limited := controller.tenantQuotaRemaining(TenantFromRequest(req), cacheKey); limited {
+		quotaBody = &quotaLimitedBody{ReadCloser: pipeReader, remaining: remaining}
+		storedResponse.Body = quotaBody
+	}
+
+	go func() {
+		defer close(storing.stored)
+
+		//The client is served from the origin body, the cache stops reading if storing fails
+		defer pipeReader.Close()
+
+		size, err := controller.storeResponseInCache(cacheKey, &storedResponse, ttl)
+		if err != nil {
+			//If no layer stored the response the rest of the body is not needed
+			if storedResponse.Body != pipeReader {
+				storedResponse.Body.Close()
+			}
+
+			if storing.aborted {
+				controller.requestLogger(req).WithField("cache-key", cacheKey).Debug("Not storing response because the client closed it early")
+
+				return
+			}
+
+			if quotaBody != nil && quotaBody.exceeded {
+				controller.requestLogger(req).WithFields(logrus.Fields{
+					"cache-key": cacheKey,
+					"tenant":    TenantFromRequest(req),
+				}).Warning("Not storing response because the tenant quota is exceeded")
+
+				return
+			}
+
+			controller.requestLogger(req).WithError(err).WithFields(controller.redactLogFields(logrus.Fields{
+				"cache-key": cacheKey,
+				"response":  &storedResponse,
+			})).Error("Error while attempting to store response in cache")
+
+			return
+		}
+
+		controller.incrMetric(MetricCacheStoredBytes, size, nil)
+		controller.emitEvent(CacheEventStore, cacheKey, size, false)
+
+		if tenant := TenantFromRequest(req); tenant != "" {
+			controller.getTenantUsageTracker().record(tenant, cacheKey, size, ttl)
+		}
+
+		err = controller.storeVariantInIndex(primaryCacheKey, variant{
+			secondaryKey: secondaryCacheKey,
+			etag:         storedResponse.Header.Get("Etag"),
+		}, ttl, maxVariants)
+		if err != nil {
+			controller.requestLogger(req).WithError(err).WithField("cache-key", primaryCacheKey).Error("Error while attempting to store variant index in cache")
+		}
+
+		err = controller.storeTagsInIndex(TenantFromRequest(req), cacheKey, storedResponse.Header, ttl)
+		if err != nil {
+			controller.requestLogger(req).WithError(err).WithField("cache-key", cacheKey).Error("Error while attempting to store tag index in cache")
+		}
+	}()
+
+	response.Body = storing
+
+	return response
+}
+
+//isStoringWhileServing checks if the body of the response is stored while it is served
+func isStoringWhileServing(response *http.Response) bool {
+	_, storing := response.Body.(*storingBody)
+	return storing
+}
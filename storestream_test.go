@@ -0,0 +1,163 @@
+package sharedhttpcache
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStoreWhileServing(t *testing.T) {
+	release := make(chan struct{})
+	var originRequests int32
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&originRequests, 1)
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		rw.Write([]byte("first\n"))
+		rw.(http.Flusher).Flush()
+
+		//The rest of the body is only send after the client received the first part
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+
+		rw.Write([]byte("second\n"))
+	}))
+	defer closeOrigin()
+
+	server := httptest.NewServer(controller)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatalf("expected the first part before the origin finished, got '%s', %v", line, err)
+	}
+
+	close(release)
+
+	rest, err := ioutil.ReadAll(reader)
+	if err != nil || string(rest) != "second\n" {
+		t.Fatalf("expected the second part, got '%s', %v", rest, err)
+	}
+
+	//Waiting requests are released once the response is stored, so the next request is served from the cache
+	cachedReq := httptest.NewRequest(http.MethodGet, "http://"+host+"/stream", nil)
+	_, body := doTestRequest(t, controller, cachedReq)
+	if body != "first\nsecond\n" {
+		t.Errorf("expected the complete body from the cache, got '%s'", body)
+	}
+
+	if requests := atomic.LoadInt32(&originRequests); requests != 1 {
+		t.Errorf("expected 1 origin request, got %d", requests)
+	}
+}
+
+func TestStoreWhileServingClosedEarly(t *testing.T) {
+	controller, _, closeOrigin := newTestController(t, http.NotFoundHandler())
+	defer closeOrigin()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	response := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{CacheControlHeader: {"max-age=60"}},
+		ContentLength: -1,
+		Body:          ioutil.NopCloser(strings.NewReader("content")),
+		Request:       req,
+	}
+
+	response = controller.storeWhileServing(req, response, "page", "", time.Minute, 0)
+
+	//The client stops reading after the first bytes, the rest is still read for the cache
+	buffer := make([]byte, 3)
+	if _, err := response.Body.Read(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := response.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _, err := controller.findResponseInCache("page")
+	if err != nil || stored == nil {
+		t.Fatalf("expected the response to be stored once the body is closed, got %v", err)
+	}
+	defer stored.Body.Close()
+
+	body, err := ioutil.ReadAll(stored.Body)
+	if err != nil || string(body) != "content" {
+		t.Errorf("expected the complete body to be stored, got '%s', %v", body, err)
+	}
+}
+
+//countingReader is a endless body which counts the bytes read from it
+type countingReader struct {
+	read int64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	atomic.AddInt64(&reader.read, int64(len(p)))
+	return len(p), nil
+}
+
+func (reader *countingReader) Close() error {
+	return nil
+}
+
+func TestStoreWhileServingAbortsLargeRest(t *testing.T) {
+	controller, _, closeOrigin := newTestController(t, http.NotFoundHandler())
+	defer closeOrigin()
+
+	controller.initialize()
+
+	origin := &countingReader{}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/large", nil)
+	response := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{CacheControlHeader: {"max-age=60"}},
+		ContentLength: -1,
+		Body:          origin,
+		Request:       req,
+	}
+
+	response = controller.storeWhileServing(req, response, "large", "", time.Minute, 0)
+
+	buffer := make([]byte, 3)
+	if _, err := response.Body.Read(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	//The client goes away, the endless rest of the body must not be read for the cache
+	if err := response.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if read := atomic.LoadInt64(&origin.read); read > maxStoreDrainSize+64*1024 {
+		t.Errorf("expected at most %d bytes to be read after the client closed the body, got %d", maxStoreDrainSize, read)
+	}
+
+	stored, _, err := controller.findResponseInCache("large")
+	if err != nil || stored != nil {
+		t.Errorf("expected the aborted response not to be stored, got %v", err)
+	}
+}
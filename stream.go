@@ -0,0 +1,117 @@
+package sharedhttpcache
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//eventStreamMediaType is the media type of Server-Sent Events
+const eventStreamMediaType = "text/event-stream"
+
+//isEventStream checks if the response contains Server-Sent Events
+func isEventStream(header http.Header) bool {
+	contentType := firstHeaderValue(header, "Content-Type")
+	if contentType == "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == eventStreamMediaType
+}
+
+//isStreamingResponse checks if the response is streamed by the origin, like Server-Sent Events, long-polling or chunked progress output.
+// A response without a known length is considered a stream since stored responses always have a Content-Length
+func isStreamingResponse(response *http.Response) bool {
+	return response.ContentLength == -1 || isEventStream(response.Header)
+}
+
+//flushingWriter flushes the response writer after every write so a stream reaches the client without being buffered
+type flushingWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+}
+
+func (writer *flushingWriter) Write(p []byte) (int, error) {
+	n, err := writer.writer.Write(p)
+	if n > 0 {
+		writer.flusher.Flush()
+	}
+
+	return n, err
+}
+
+//copyStream copies a streaming response body to the response writer, flushing after every write
+// The headers are flushed first so the client knows the stream started before the first data arrives
+func copyStream(rw http.ResponseWriter, flusher http.Flusher, bufferPool *sync.Pool, body io.Reader) error {
+	flusher.Flush()
+
+	_, err := copyWithBufferPool(bufferPool, &flushingWriter{writer: rw, flusher: flusher}, body)
+	return err
+}
+
+//intervalFlushingWriter flushes the response writer at most once per interval, only if data was written since the last flush
+// Like the flush interval of httputil.ReverseProxy, it bounds the latency of buffered data without flushing every write
+type intervalFlushingWriter struct {
+	writer   io.Writer
+	flusher  http.Flusher
+	interval time.Duration
+
+	lock         sync.Mutex
+	timer        *time.Timer
+	flushPending bool
+}
+
+func (writer *intervalFlushingWriter) Write(p []byte) (int, error) {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+
+	n, err := writer.writer.Write(p)
+	if err != nil || writer.flushPending {
+		return n, err
+	}
+
+	writer.flushPending = true
+	if writer.timer == nil {
+		writer.timer = time.AfterFunc(writer.interval, writer.delayedFlush)
+	} else {
+		writer.timer.Reset(writer.interval)
+	}
+
+	return n, nil
+}
+
+func (writer *intervalFlushingWriter) delayedFlush() {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+
+	//The copy was stopped before the timer fired
+	if !writer.flushPending {
+		return
+	}
+
+	writer.flusher.Flush()
+	writer.flushPending = false
+}
+
+//stop stops the timer, it must be called before the handler returns since the response writer may not be used afterwards
+func (writer *intervalFlushingWriter) stop() {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+
+	writer.flushPending = false
+	if writer.timer != nil {
+		writer.timer.Stop()
+	}
+}
+
+//copyWithFlushInterval copies the body to the response writer and flushes the written data at least once per interval
+func copyWithFlushInterval(rw http.ResponseWriter, flusher http.Flusher, interval time.Duration, bufferPool *sync.Pool, body io.Reader) error {
+	writer := &intervalFlushingWriter{writer: rw, flusher: flusher, interval: interval}
+	defer writer.stop()
+
+	_, err := copyWithBufferPool(bufferPool, writer, body)
+	return err
+}
@@ -0,0 +1,138 @@
+package sharedhttpcache
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamingResponseIsFlushed(t *testing.T) {
+	release := make(chan struct{})
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+
+		_, _ = rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+
+		//The stream doesn't end until the test is done
+		<-release
+	}))
+	defer closeOrigin()
+
+	proxy := httptest.NewServer(controller)
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	//The servers wait for the stream to end when they are closed, so it has to end first
+	var releaseOnce sync.Once
+	endStream := func() {
+		releaseOnce.Do(func() { close(release) })
+	}
+	defer endStream()
+
+	lines := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(response.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		if line != "data: first\n" {
+			t.Errorf("expected the first event, got: %q", line)
+		}
+
+		//Let the stream end normally so the response is completed
+		endStream()
+		_, _ = ioutil.ReadAll(response.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the first event to be flushed before the stream ends")
+	}
+}
+
+func TestEventStreamIsNotStored(t *testing.T) {
+	response := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":     []string{"text/event-stream; charset=utf-8"},
+			CacheControlHeader: []string{"max-age=60"},
+		},
+		Request: httptest.NewRequest(http.MethodGet, "http://example.com/events", nil),
+	}
+
+	if shouldStoreResponse(NewCacheConfig(), response) {
+		t.Error("expected a event stream not to be stored")
+	}
+}
+
+//flushRecorder is a response recorder which signals every flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes chan struct{}
+}
+
+func (recorder *flushRecorder) Flush() {
+	recorder.flushes <- struct{}{}
+}
+
+func TestFlushInterval(t *testing.T) {
+	controller := &CacheController{FlushInterval: 10 * time.Millisecond}
+
+	recorder := &flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushes: make(chan struct{}, 16)}
+	body, bodyWriter := io.Pipe()
+
+	done := make(chan error)
+	go func() {
+		done <- controller.writeHTTPResponse(NewCacheConfig(), recorder, &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{},
+			ContentLength: 7,
+			Body:          body,
+		})
+	}()
+
+	_, _ = bodyWriter.Write([]byte("content"))
+
+	//The data must be flushed while the body is still being copied
+	select {
+	case <-recorder.flushes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the written data to be flushed within the flush interval")
+	}
+
+	bodyWriter.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyBufferSize(t *testing.T) {
+	controller := &CacheController{CopyBufferSize: 1024}
+
+	buf := controller.getCopyBufferPool().Get().(*[]byte)
+	if len(*buf) != 1024 {
+		t.Errorf("expected a buffer of 1024 bytes, got %d", len(*buf))
+	}
+
+	if (&CacheController{}).getCopyBufferPool() != &copyBufferPool {
+		t.Error("expected the shared pool to be used without a configured buffer size")
+	}
+}
@@ -0,0 +1,70 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//SurrogateControlHeader is the header with which origins control surrogates like the cache, as defined in the
+// Edge Architecture Specification of the W3C. Directives can be targeted at a surrogate with a device token like "max-age=60;edge"
+const SurrogateControlHeader = "Surrogate-Control"
+
+//surrogateCacheControl translates the directives of the Surrogate-Control header which apply to the cache to Cache-Control directives.
+// Untargeted directives apply to all surrogates, targeted directives only if the target is the SurrogateTarget of the cache config.
+// nil is returned if no directive applies, so the Cache-Control header of the origin is used
+//
+// Only max-age and no-store control caching, other directives like content are ignored. The stale part of a max-age like
+// "max-age=60+30" is translated to stale-if-error, since the spec allows serving it when the origin is unavailable.
+// Unlike Cache-Control, a directive with whitespace around the equals sign is invalid and ignored
+func surrogateCacheControl(cacheConfig *CacheConfig, header http.Header) []string {
+	directives := []string{}
+
+	for _, headerValue := range header[SurrogateControlHeader] {
+		for _, directive := range strings.Split(headerValue, ",") {
+			directive = strings.TrimSpace(directive)
+
+			target := ""
+			if semicolon := strings.IndexByte(directive, ';'); semicolon != -1 {
+				directive, target = directive[:semicolon], strings.TrimSpace(directive[semicolon+1:])
+			}
+
+			if target != "" && !strings.EqualFold(target, cacheConfig.SurrogateTarget) {
+				continue
+			}
+
+			name, value := strings.ToLower(directive), ""
+			if equals := strings.IndexByte(directive, '='); equals != -1 {
+				name, value = strings.ToLower(directive[:equals]), directive[equals+1:]
+			}
+
+			switch name {
+			case "no-store":
+				directives = append(directives, "no-store")
+
+			case "max-age":
+				fresh, stale := value, ""
+				if plus := strings.IndexByte(value, '+'); plus != -1 {
+					fresh, stale = value[:plus], value[plus+1:]
+				}
+
+				//ParseUint rejects whitespace, so "max-age = 60" is ignored
+				if _, err := strconv.ParseUint(fresh, 10, 63); err != nil {
+					continue
+				}
+
+				directives = append(directives, "max-age="+fresh)
+
+				if _, err := strconv.ParseUint(stale, 10, 63); err == nil {
+					directives = append(directives, StaleIfErrorDirective+"="+stale)
+				}
+			}
+		}
+	}
+
+	if len(directives) == 0 {
+		return nil
+	}
+
+	return []string{strings.Join(directives, ", ")}
+}
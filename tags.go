@@ -0,0 +1,140 @@
+package sharedhttpcache
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//tagIndexPrefix is prepended to the tenant and tag to get the key of the tag index
+const tagIndexPrefix = "tags"
+
+//cacheTagsOf returns the tags in the CacheTagHeaders of a response, each tag is returned once
+func cacheTagsOf(header http.Header) []string {
+	tags := []string{}
+
+	for _, name := range CacheTagHeaders {
+		for _, value := range header[http.CanonicalHeaderKey(name)] {
+			for _, tag := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' }) {
+				if !containsString(tags, tag) {
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+
+	return tags
+}
+
+//PurgeByTag removes all responses which have the tag in one of the CacheTagHeaders and propagates the purge like Purge.
+// Stored responses are found with the tag index, responses which are missing from the index are still matched when they are looked up
+func (controller *CacheController) PurgeByTag(tag string) error {
+	return controller.Purge(Purge{Tag: tag})
+}
+
+//tagIndexKey returns the key of the tag index of the tag of the tenant
+func tagIndexKey(tenant, tag string) string {
+	return tagIndexPrefix + tenantCacheKeyPrefix(tenant) + tag
+}
+
+//findTagIndex returns the cache keys of the responses with the tag and the ttl of the index
+//
+// The tag index is a special purpose cache entry with one cache key per line, like the variant index
+func (controller *CacheController) findTagIndex(tenant, tag string) ([]string, time.Duration, error) {
+	for _, cacheLayer := range controller.Layers {
+		reader, ttl, err := cacheLayer.Get(tagIndexKey(tenant, tag))
+		if err != nil {
+			return nil, -1, err
+		}
+
+		if reader == nil {
+			continue
+		}
+
+		defer reader.Close()
+
+		cacheKeys := []string{}
+
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				cacheKeys = append(cacheKeys, line)
+			}
+		}
+
+		return cacheKeys, ttl, scanner.Err()
+	}
+
+	return []string{}, -1, nil
+}
+
+//storeTagsInIndex adds the cache key to the tag index of every tag of the response.
+// A index is kept as long as the longest living response in it
+func (controller *CacheController) storeTagsInIndex(tenant, cacheKey string, header http.Header, ttl time.Duration) error {
+	tags := cacheTagsOf(header)
+	if len(tags) == 0 {
+		return nil
+	}
+
+	controller.tagIndexMutex.Lock()
+	defer controller.tagIndexMutex.Unlock()
+
+	for _, tag := range tags {
+		cacheKeys, indexTTL, err := controller.findTagIndex(tenant, tag)
+		if err != nil {
+			return err
+		}
+
+		if containsString(cacheKeys, cacheKey) && indexTTL >= ttl {
+			continue
+		}
+
+		if !containsString(cacheKeys, cacheKey) {
+			cacheKeys = append(cacheKeys, cacheKey)
+		}
+
+		if indexTTL > ttl {
+			ttl = indexTTL
+		}
+
+		index := strings.Join(cacheKeys, "\n") + "\n"
+		if err := controller.storeInCache(tagIndexKey(tenant, tag), ioutil.NopCloser(strings.NewReader(index)), ttl); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//purgeTagIndex deletes all responses in the tag index of the tag and the index itself
+func (controller *CacheController) purgeTagIndex(tenant, tag string) error {
+	controller.tagIndexMutex.Lock()
+	defer controller.tagIndexMutex.Unlock()
+
+	cacheKeys, _, err := controller.findTagIndex(tenant, tag)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, cacheKey := range cacheKeys {
+		if err := controller.deleteCacheEntry(cacheKey); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		controller.emitEvent(CacheEventPurge, cacheKey, -1, false)
+	}
+
+	for _, cacheLayer := range controller.Layers {
+		if err := cacheLayer.Delete(tagIndexKey(tenant, tag)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,85 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/textproto"
+)
+
+const (
+	//CDNCacheControlHeader is the targeted cache control field for CDN's and other shared caches as defined in RFC 9213
+	CDNCacheControlHeader = "CDN-Cache-Control"
+
+	//originCacheControlHeader is a internal header in which the Cache-Control header of the origin is kept
+	// while the Cache-Control header is replaced by a targeted cache control field
+	originCacheControlHeader = "X-Sharedhttpcache-Origin-Cache-Control"
+)
+
+//applyTargetedCacheControl replaces the Cache-Control header of a origin response with the first targeted cache control field
+// from the cache config which is present in the response, as described in section 2.2 of RFC 9213.
+// This way the rest of the caching logic only has to look at the Cache-Control header.
+//
+// If no targeted field is present the Surrogate-Control header is used if enabled, see surrogateCacheControl.
+//
+// The original Cache-Control header is kept in a internal header so it can be restored before the response is sent to the client
+// by restoreOriginCacheControl. All targeted fields are stripped since they are only meant for the cache.
+func applyTargetedCacheControl(cacheConfig *CacheConfig, response *http.Response) {
+
+	//Never trust the internal header if the origin sends it
+	response.Header.Del(originCacheControlHeader)
+
+	var targetedValues []string
+	for _, headerName := range cacheConfig.TargetedCacheControlHeaders {
+		values := response.Header[textproto.CanonicalMIMEHeaderKey(headerName)]
+		if len(values) > 0 && targetedValues == nil {
+			targetedValues = values
+		}
+
+		response.Header.Del(headerName)
+	}
+
+	//Surrogate-Control predates the targeted fields, so a targeted field takes precedence
+	if cacheConfig.SurrogateControl {
+		if targetedValues == nil {
+			targetedValues = surrogateCacheControl(cacheConfig, response.Header)
+		}
+
+		response.Header.Del(SurrogateControlHeader)
+	}
+
+	if targetedValues == nil {
+		return
+	}
+
+	//The header is always set, even if empty, so the restore knows there was a targeted field
+	response.Header.Set(originCacheControlHeader, response.Header.Get(CacheControlHeader))
+	response.Header[CacheControlHeader] = targetedValues
+}
+
+//mergeValidationHeaders overwrites the headers of the cached response with the headers of the validation response
+// Section 4.3.4 of RFC 7234
+func mergeValidationHeaders(cachedResponse, validationResponse *http.Response) {
+
+	//If the validation response has its own Cache-Control, the internal header of the cached response is outdated
+	if _, found := validationResponse.Header[CacheControlHeader]; found {
+		cachedResponse.Header.Del(originCacheControlHeader)
+	}
+
+	for header, value := range validationResponse.Header {
+		cachedResponse.Header[header] = value
+	}
+}
+
+//restoreOriginCacheControl restores the Cache-Control header of the origin if it was replaced by a targeted cache control field
+func restoreOriginCacheControl(header http.Header) {
+	if _, found := header[originCacheControlHeader]; !found {
+		return
+	}
+
+	if originValue := header.Get(originCacheControlHeader); originValue != "" {
+		header.Set(CacheControlHeader, originValue)
+	} else {
+		header.Del(CacheControlHeader)
+	}
+
+	header.Del(originCacheControlHeader)
+}
@@ -0,0 +1,134 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTargetedCacheControl(t *testing.T) {
+	config := NewCacheConfig()
+	config.TargetedCacheControlHeaders = []string{"SharedHTTPCache-Cache-Control", CDNCacheControlHeader}
+
+	response := &http.Response{
+		Header: http.Header{
+			CacheControlHeader:              []string{"max-age=10"},
+			"Cdn-Cache-Control":             []string{"max-age=600"},
+			"Sharedhttpcache-Cache-Control": []string{"max-age=3600"},
+		},
+	}
+
+	applyTargetedCacheControl(config, response)
+
+	if cc := response.Header.Get(CacheControlHeader); cc != "max-age=3600" {
+		t.Errorf("expected the most specific targeted field to be used, got: %s", cc)
+	}
+
+	if response.Header.Get(CDNCacheControlHeader) != "" || response.Header.Get("SharedHTTPCache-Cache-Control") != "" {
+		t.Errorf("targeted fields have not been stripped")
+	}
+
+	restoreOriginCacheControl(response.Header)
+
+	if cc := response.Header.Get(CacheControlHeader); cc != "max-age=10" {
+		t.Errorf("expected the origin Cache-Control to be restored, got: %s", cc)
+	}
+
+	if _, found := response.Header[originCacheControlHeader]; found {
+		t.Errorf("internal header has not been removed")
+	}
+}
+
+func TestTargetedCacheControlWithoutOriginCacheControl(t *testing.T) {
+	config := NewCacheConfig()
+
+	response := &http.Response{
+		Header: http.Header{
+			"Cdn-Cache-Control": []string{"max-age=600"},
+		},
+	}
+
+	applyTargetedCacheControl(config, response)
+	restoreOriginCacheControl(response.Header)
+
+	if _, found := response.Header[CacheControlHeader]; found {
+		t.Errorf("Cache-Control header should not be present after restoring")
+	}
+}
+
+func TestSurrogateControl(t *testing.T) {
+	config := NewCacheConfig()
+	config.SurrogateControl = true
+	config.SurrogateTarget = "edge"
+
+	tests := []struct {
+		surrogate string
+		expected  string
+	}{
+		{surrogate: "max-age=60", expected: "max-age=60"},
+		{surrogate: "max-age=60+30", expected: "max-age=60, stale-if-error=30"},
+		{surrogate: "no-store", expected: "no-store"},
+		{surrogate: "max-age=60;other", expected: "max-age=10"},
+		{surrogate: "max-age=60;edge, no-store;other", expected: "max-age=60"},
+		{surrogate: "max-age =60", expected: "max-age=10"},
+		{surrogate: "max-age= 60", expected: "max-age=10"},
+		{surrogate: `content="ESI/1.0"`, expected: "max-age=10"},
+	}
+
+	for _, test := range tests {
+		response := &http.Response{
+			Header: http.Header{
+				CacheControlHeader:     []string{"max-age=10"},
+				SurrogateControlHeader: []string{test.surrogate},
+			},
+		}
+
+		applyTargetedCacheControl(config, response)
+
+		if cc := response.Header.Get(CacheControlHeader); cc != test.expected {
+			t.Errorf("%s: expected Cache-Control '%s', got '%s'", test.surrogate, test.expected, cc)
+		}
+
+		if response.Header.Get(SurrogateControlHeader) != "" {
+			t.Errorf("%s: the Surrogate-Control header has not been stripped", test.surrogate)
+		}
+
+		restoreOriginCacheControl(response.Header)
+
+		if cc := response.Header.Get(CacheControlHeader); cc != "max-age=10" {
+			t.Errorf("%s: expected the origin Cache-Control to be restored, got: %s", test.surrogate, cc)
+		}
+	}
+
+	//A targeted cache control field takes precedence
+	response := &http.Response{
+		Header: http.Header{
+			"Cdn-Cache-Control":    []string{"max-age=600"},
+			SurrogateControlHeader: []string{"max-age=60"},
+		},
+	}
+
+	applyTargetedCacheControl(config, response)
+
+	if cc := response.Header.Get(CacheControlHeader); cc != "max-age=600" {
+		t.Errorf("expected the targeted field to take precedence, got: %s", cc)
+	}
+}
+
+func TestSurrogateControlDisabledByDefault(t *testing.T) {
+	response := &http.Response{
+		Header: http.Header{
+			CacheControlHeader:     []string{"max-age=10"},
+			SurrogateControlHeader: []string{"max-age=60"},
+		},
+	}
+
+	applyTargetedCacheControl(NewCacheConfig(), response)
+
+	if cc := response.Header.Get(CacheControlHeader); cc != "max-age=10" {
+		t.Errorf("expected the Surrogate-Control header to be ignored by default, got Cache-Control: %s", cc)
+	}
+
+	if response.Header.Get(SurrogateControlHeader) != "max-age=60" {
+		t.Errorf("expected the Surrogate-Control header to be passed on by default")
+	}
+}
@@ -0,0 +1,232 @@
+package sharedhttpcache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A TenantResolver resolves the tenant a request belongs to.
+// The tenant ID is used to namespace cache keys, enforce per tenant quotas and scope purges,
+// so one cache can safely serve many customers
+type TenantResolver interface {
+
+	//GetTenant is called to resolve the tenant ID of a request
+	// A empty string means the request doesn't belong to a tenant
+	GetTenant(req *http.Request) string
+}
+
+//The TenantResolverFunc type is an adapter to allow the use of ordinary functions as TenantResolver
+type TenantResolverFunc func(req *http.Request) string
+
+//GetTenant calls the underlying function to resolve the tenant of a request
+func (resolver TenantResolverFunc) GetTenant(req *http.Request) string {
+	return resolver(req)
+}
+
+//TenantFromHeader returns a TenantResolver which uses the value of the given request header as tenant ID
+// Only use this if the header is set by a trusted party like a load balancer, otherwise clients can pick their own tenant
+func TenantFromHeader(headerName string) TenantResolver {
+	return TenantResolverFunc(func(req *http.Request) string {
+		return req.Header.Get(headerName)
+	})
+}
+
+//TenantFromHost returns a TenantResolver which uses the hostname of the request, without port, as tenant ID
+func TenantFromHost() TenantResolver {
+	return TenantResolverFunc(func(req *http.Request) string {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+
+		return strings.ToLower(host)
+	})
+}
+
+//TenantFromPathPrefix returns a TenantResolver which maps path prefixes to tenant IDs
+// If multiple prefixes match the longest prefix wins
+func TenantFromPathPrefix(prefixes map[string]string) TenantResolver {
+	return TenantResolverFunc(func(req *http.Request) string {
+		tenant := ""
+		longest := -1
+
+		for prefix, prefixTenant := range prefixes {
+			if len(prefix) > longest && strings.HasPrefix(req.URL.Path, prefix) {
+				tenant = prefixTenant
+				longest = len(prefix)
+			}
+		}
+
+		return tenant
+	})
+}
+
+type tenantContextKey struct{}
+
+//TenantFromRequest returns the tenant ID which was resolved by the TenantResolver of the CacheController
+// A empty string is returned if the request doesn't belong to a tenant
+func TenantFromRequest(req *http.Request) string {
+	tenant, _ := req.Context().Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+//withTenant returns a shallow copy of the request with the tenant ID in its context
+func withTenant(req *http.Request, tenant string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, tenant))
+}
+
+//tenantCacheKeyPrefix returns the prefix which namespaces the cache keys of a tenant
+func tenantCacheKeyPrefix(tenant string) string {
+	if tenant == "" {
+		return ""
+	}
+
+	//Curly braces are not allowed in a method so the prefix can't collide with a un-namespaced key
+	return "{" + tenant + "}"
+}
+
+//tenantUsageTracker keeps track of the amount of bytes stored per tenant so quotas can be enforced
+//
+// Entries are tracked until they expire, entries which are evicted early by a cache layer
+// are counted until their expiration, so the usage is a upper bound of the actual usage
+type tenantUsageTracker struct {
+	mutex   sync.Mutex
+	entries map[string]map[string]tenantEntry
+}
+
+type tenantEntry struct {
+	size       int64
+	expiration time.Time
+}
+
+func newTenantUsageTracker() *tenantUsageTracker {
+	return &tenantUsageTracker{
+		entries: make(map[string]map[string]tenantEntry),
+	}
+}
+
+//record records the size of a stored cache entry
+func (tracker *tenantUsageTracker) record(tenant, cacheKey string, size int64, ttl time.Duration) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tenantEntries, found := tracker.entries[tenant]
+	if !found {
+		tenantEntries = make(map[string]tenantEntry)
+		tracker.entries[tenant] = tenantEntries
+	}
+
+	tenantEntries[cacheKey] = tenantEntry{
+		size:       size,
+		expiration: time.Now().Add(ttl),
+	}
+}
+
+//remove removes a cache entry from the usage of a tenant
+func (tracker *tenantUsageTracker) remove(tenant, cacheKey string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	delete(tracker.entries[tenant], cacheKey)
+}
+
+//usage returns the amount of bytes stored for a tenant, excluding the given cache key since it will be overwritten
+func (tracker *tenantUsageTracker) usage(tenant, excludeCacheKey string) int64 {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	now := time.Now()
+	total := int64(0)
+
+	for cacheKey, entry := range tracker.entries[tenant] {
+		//Expired entries can be replaced by the layers at any time so they no longer count
+		if entry.expiration.Before(now) {
+			delete(tracker.entries[tenant], cacheKey)
+			continue
+		}
+
+		if cacheKey != excludeCacheKey {
+			total += entry.size
+		}
+	}
+
+	return total
+}
+
+//getTenantQuota returns the quota in bytes of a tenant, zero means unlimited
+func (controller *CacheController) getTenantQuota(tenant string) int64 {
+	if quota, found := controller.TenantQuotas[tenant]; found {
+		return quota
+	}
+
+	return controller.DefaultTenantQuota
+}
+
+//tenantQuotaAllows checks if a new entry of the given size may be stored for a tenant
+// if the size is unknown(negative) the entry is allowed as long as the tenant hasn't exceeded its quota yet,
+// its body is then limited to the remaining quota while it is stored, see tenantQuotaRemaining
+func (controller *CacheController) tenantQuotaAllows(tenant, cacheKey string, size int64) bool {
+	remaining, limited := controller.tenantQuotaRemaining(tenant, cacheKey)
+	if !limited {
+		return true
+	}
+
+	if size < 0 {
+		size = 0
+	}
+
+	return size <= remaining
+}
+
+//tenantQuotaRemaining returns the amount of bytes which may still be stored for a tenant under the cache key,
+// false is returned if the tenant has no quota
+func (controller *CacheController) tenantQuotaRemaining(tenant, cacheKey string) (int64, bool) {
+	if tenant == "" {
+		return 0, false
+	}
+
+	quota := controller.getTenantQuota(tenant)
+	if quota <= 0 {
+		return 0, false
+	}
+
+	return quota - controller.getTenantUsageTracker().usage(tenant, cacheKey), true
+}
+
+//errTenantQuotaExceeded is returned while storing a body which is larger than the remaining quota of the tenant
+var errTenantQuotaExceeded = errors.New("tenant quota exceeded")
+
+//quotaLimitedBody fails once more than the remaining quota of a tenant is read from it,
+// so a response of unknown length which doesn't fit the quota is never stored completely
+type quotaLimitedBody struct {
+	io.ReadCloser
+
+	remaining int64
+	exceeded  bool
+}
+
+func (body *quotaLimitedBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+
+	body.remaining -= int64(n)
+	if body.remaining < 0 {
+		body.exceeded = true
+		return n, errTenantQuotaExceeded
+	}
+
+	return n, err
+}
+
+func (controller *CacheController) getTenantUsageTracker() *tenantUsageTracker {
+	controller.tenantUsageOnce.Do(func() {
+		controller.tenantUsage = newTenantUsageTracker()
+	})
+
+	return controller.tenantUsage
+}
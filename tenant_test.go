@@ -0,0 +1,136 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTenantResolvers(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://Shop.Example.com:8080/customers/acme/index.html", nil)
+	req.Header.Set("X-Tenant", "acme")
+
+	if tenant := TenantFromHeader("X-Tenant").GetTenant(req); tenant != "acme" {
+		t.Errorf("expected the tenant from the header, got '%s'", tenant)
+	}
+
+	if tenant := TenantFromHost().GetTenant(req); tenant != "shop.example.com" {
+		t.Errorf("expected the lowercase host without port, got '%s'", tenant)
+	}
+
+	prefixes := TenantFromPathPrefix(map[string]string{
+		"/customers/":      "customers",
+		"/customers/acme/": "acme",
+		"/other/":          "other",
+	})
+
+	if tenant := prefixes.GetTenant(req); tenant != "acme" {
+		t.Errorf("expected the longest prefix to win, got '%s'", tenant)
+	}
+
+	if tenant := prefixes.GetTenant(httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); tenant != "" {
+		t.Errorf("expected no tenant without a matching prefix, got '%s'", tenant)
+	}
+}
+
+func TestTenantCacheKeyNamespacing(t *testing.T) {
+	originRequests := 0
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.TenantResolver = TenantFromHeader("X-Tenant")
+
+	for _, tenant := range []string{"acme", "globex", "acme", ""} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.Header.Set("X-Tenant", tenant)
+
+		doTestRequest(t, controller, req)
+	}
+
+	//Every tenant, and the requests without tenant, get their own stored response
+	if originRequests != 3 {
+		t.Errorf("expected one origin request per tenant, got %d", originRequests)
+	}
+
+	req := withTenant(httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil), "acme")
+	if key := getPrimaryCacheKey(controller.DefaultCacheConfig, controller.DefaultForwardConfig, req); !strings.HasPrefix(key, "{acme}") {
+		t.Errorf("expected the primary key to be namespaced, got '%s'", key)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	originRequests := map[string]int{}
+
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests[req.URL.Path]++
+
+		rw.Header().Set(CacheControlHeader, "max-age=60")
+
+		switch req.URL.Path {
+		case "/small":
+			_, _ = rw.Write([]byte("small"))
+
+		case "/large":
+			_, _ = rw.Write([]byte(strings.Repeat("a", 300)))
+
+		case "/chunked":
+			//Flushing before the body is complete sends it chunked, without Content-Length
+			_, _ = rw.Write([]byte(strings.Repeat("a", 150)))
+			rw.(http.Flusher).Flush()
+			_, _ = rw.Write([]byte(strings.Repeat("a", 150)))
+		}
+	}))
+	defer closeOrigin()
+
+	controller.TenantResolver = TenantFromHeader("X-Tenant")
+	controller.TenantQuotas = map[string]int64{"acme": 256}
+
+	newRequest := func(path string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		req.Header.Set("X-Tenant", "acme")
+		return req
+	}
+
+	for _, path := range []string{"/small", "/large", "/chunked"} {
+		for i := 0; i < 2; i++ {
+			response, body := doTestRequest(t, controller, newRequest(path))
+			if response.StatusCode != http.StatusOK || (path != "/small" && len(body) != 300) {
+				t.Errorf("%s: expected the complete response to be served, got status %d and %d bytes", path, response.StatusCode, len(body))
+			}
+		}
+	}
+
+	if originRequests["/small"] != 1 {
+		t.Errorf("expected the small response to be stored, the origin got %d requests", originRequests["/small"])
+	}
+
+	for _, path := range []string{"/large", "/chunked"} {
+		if originRequests[path] != 2 {
+			t.Errorf("%s: expected the response not to be stored, the origin got %d requests", path, originRequests[path])
+		}
+
+		//A refused response must not leave index entries behind
+		req := withTenant(newRequest(path), "acme")
+		primaryKey := getPrimaryCacheKey(controller.DefaultCacheConfig, controller.DefaultForwardConfig, req)
+
+		_, ttl, err := controller.findSecondaryKeysInCache(primaryKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if path == "/large" && ttl >= 0 {
+			t.Errorf("%s: expected no secondary keys to be stored", path)
+		}
+	}
+
+	if usage := controller.getTenantUsageTracker().usage("acme", ""); usage > 256 {
+		t.Errorf("expected the usage to stay within the quota, got %d", usage)
+	}
+}
@@ -0,0 +1,169 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//A BodyTransformer transforms the body of a response, for example to minify it
+type BodyTransformer interface {
+
+	//TransformBody is called with the complete body of a response and returns the transformed body
+	// If the transformer doesn't apply to the response the body should be returned unchanged
+	TransformBody(response *http.Response, body []byte) ([]byte, error)
+}
+
+//The BodyTransformerFunc type is an adapter to allow the use of ordinary functions as BodyTransformer
+type BodyTransformerFunc func(response *http.Response, body []byte) ([]byte, error)
+
+//TransformBody calls the underlying function to transform a body
+func (transformer BodyTransformerFunc) TransformBody(response *http.Response, body []byte) ([]byte, error) {
+	return transformer(response, body)
+}
+
+//responseMediaType returns the lowercase media type of the response without parameters
+func responseMediaType(response *http.Response) string {
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+var (
+	preformattedRegexp = regexp.MustCompile(`(?is)<(pre|textarea|script|style)[\s>].*?</(pre|textarea|script|style)>`)
+	cssCommentRegexp   = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssSpaceRegexp     = regexp.MustCompile(`\s*([{};:,>])\s*`)
+	whitespaceRegexp   = regexp.MustCompile(`\s+`)
+)
+
+//HTMLWhitespaceStripper is a BodyTransformer which removes leading and trailing whitespace from every line of a HTML document
+// and removes empty lines. The content of pre, textarea, script and style elements is left untouched
+var HTMLWhitespaceStripper = BodyTransformerFunc(func(response *http.Response, body []byte) ([]byte, error) {
+	if responseMediaType(response) != "text/html" {
+		return body, nil
+	}
+
+	result := &bytes.Buffer{}
+	last := 0
+	for _, preformatted := range preformattedRegexp.FindAllIndex(body, -1) {
+		stripLines(result, body[last:preformatted[0]])
+		result.Write(body[preformatted[0]:preformatted[1]])
+		last = preformatted[1]
+	}
+	stripLines(result, body[last:])
+
+	return result.Bytes(), nil
+})
+
+//stripLines writes the non empty lines of the text to the buffer without leading and trailing whitespace
+// Whitespace at the start or end of the text is replaced by a single newline since it can be significant between inline elements
+func stripLines(buf *bytes.Buffer, text []byte) {
+	lines := [][]byte{}
+	for _, line := range bytes.Split(text, []byte("\n")) {
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			lines = append(lines, trimmed)
+		}
+	}
+
+	if len(lines) == 0 {
+		if len(text) > 0 {
+			buf.WriteByte('\n')
+		}
+		return
+	}
+
+	if text[0] != lines[0][0] {
+		buf.WriteByte('\n')
+	}
+
+	buf.Write(bytes.Join(lines, []byte("\n")))
+
+	lastLine := lines[len(lines)-1]
+	if text[len(text)-1] != lastLine[len(lastLine)-1] {
+		buf.WriteByte('\n')
+	}
+}
+
+//CSSMinifier is a BodyTransformer which removes comments and unnecessary whitespace from stylesheets
+var CSSMinifier = BodyTransformerFunc(func(response *http.Response, body []byte) ([]byte, error) {
+	if responseMediaType(response) != "text/css" {
+		return body, nil
+	}
+
+	body = cssCommentRegexp.ReplaceAll(body, nil)
+	body = whitespaceRegexp.ReplaceAll(body, []byte(" "))
+	body = cssSpaceRegexp.ReplaceAll(body, []byte("$1"))
+
+	return bytes.TrimSpace(body), nil
+})
+
+//hasNoTransform checks if the Cache-Control header contains the no-transform directive
+// Section 5.2.1.6 and 5.2.2.4 of RFC 7234
+func hasNoTransform(header http.Header) bool {
+	return parseResponseCacheControl(header).noTransform
+}
+
+//applyBodyTransformers transforms the body of the response with the given transformers.
+// Responses with the no-transform directive and responses with a unsupported content coding are not transformed,
+// encoded responses are decoded before and encoded again after transforming them.
+// If the body is changed the Content-Length is updated and strong validators are weakened
+func applyBodyTransformers(cacheConfig *CacheConfig, transformers []BodyTransformer, response *http.Response) error {
+	if len(transformers) == 0 || response.Body == nil || hasNoTransform(response.Header) {
+		return nil
+	}
+
+	coding, supported := contentCodingOf(cacheConfig, response.Header)
+	if !supported {
+		return nil
+	}
+
+	body, encoded, err := readDecodedBody(coding, response)
+
+	//Serve the original body if it can't be decoded or a transformation fails
+	response.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+
+	transformed := body
+	for _, transformer := range transformers {
+		transformed, err = transformer.TransformBody(response, transformed)
+		if err != nil {
+			return err
+		}
+	}
+
+	if bytes.Equal(body, transformed) {
+		return nil
+	}
+
+	transformed, err = encodeBody(coding, transformed)
+	if err != nil {
+		return err
+	}
+
+	response.Body = ioutil.NopCloser(bytes.NewReader(transformed))
+
+	response.ContentLength = int64(len(transformed))
+	response.Header.Set("Content-Length", strconv.Itoa(len(transformed)))
+
+	//The representation is no longer byte for byte identical, so a strong validator is no longer valid
+	// Section 2.1 of RFC 7232
+	if etag := response.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		response.Header.Set("Etag", "W/"+etag)
+	}
+
+	//Section 5.5.6 of RFC 7234
+	if cacheConfig.HTTPWarnings {
+		response.Header.Add("Warning", `214 - "Transformation Applied"`)
+	}
+
+	return nil
+}
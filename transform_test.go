@@ -0,0 +1,146 @@
+package sharedhttpcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHTMLWhitespaceStripper(t *testing.T) {
+	response := &http.Response{
+		Header: http.Header{"Content-Type": []string{"text/html"}},
+	}
+
+	body := "<html>\n    <body>\n\n        <p>Hello</p>\n<pre>\n  keep\n    this\n</pre>  \n    </body>\n</html>\n"
+
+	transformed, err := HTMLWhitespaceStripper.TransformBody(response, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "<html>\n<body>\n<p>Hello</p>\n<pre>\n  keep\n    this\n</pre>\n</body>\n</html>\n"
+	if string(transformed) != expected {
+		t.Errorf("expected: %q, got: %q", expected, transformed)
+	}
+}
+
+func TestCSSMinifier(t *testing.T) {
+	response := &http.Response{
+		Header: http.Header{"Content-Type": []string{"text/css; charset=utf-8"}},
+	}
+
+	body := "/* comment */\nbody {\n    color : red;\n    margin: 0 auto;\n}\n"
+
+	transformed, err := CSSMinifier.TransformBody(response, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "body{color:red;margin:0 auto;}"
+	if string(transformed) != expected {
+		t.Errorf("expected: %q, got: %q", expected, transformed)
+	}
+}
+
+func TestApplyBodyTransformers(t *testing.T) {
+	config := NewCacheConfig()
+
+	newResponse := func(cacheControl string) *http.Response {
+		return &http.Response{
+			Header: http.Header{
+				"Content-Type":     []string{"text/css"},
+				"Etag":             []string{`"abc"`},
+				CacheControlHeader: []string{cacheControl},
+			},
+			Body: ioutil.NopCloser(strings.NewReader("body {  color: red; }")),
+		}
+	}
+
+	response := newResponse("max-age=10")
+	err := applyBodyTransformers(config, []BodyTransformer{CSSMinifier}, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if string(body) != "body{color:red;}" {
+		t.Errorf("unexpected body: %s", body)
+	}
+
+	if response.Header.Get("Content-Length") != "16" || response.ContentLength != 16 {
+		t.Errorf("content length has not been updated")
+	}
+
+	if response.Header.Get("Etag") != `W/"abc"` {
+		t.Errorf("expected weak etag, got: %s", response.Header.Get("Etag"))
+	}
+
+	response = newResponse("max-age=10, no-transform")
+	err = applyBodyTransformers(config, []BodyTransformer{CSSMinifier}, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ = ioutil.ReadAll(response.Body)
+	if string(body) != "body {  color: red; }" {
+		t.Errorf("response with no-transform has been transformed: %s", body)
+	}
+}
+
+func TestApplyBodyTransformersEncoded(t *testing.T) {
+	config := NewCacheConfig()
+
+	for _, coding := range []string{"gzip", "deflate"} {
+		encoded, err := DefaultContentCodings[coding].Encode([]byte("p  {  color : red ; }"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response := &http.Response{
+			Header: http.Header{
+				"Content-Type":     []string{"text/css"},
+				"Content-Encoding": []string{coding},
+			},
+			Body: ioutil.NopCloser(strings.NewReader(string(encoded))),
+		}
+
+		err = applyBodyTransformers(config, []BodyTransformer{CSSMinifier}, response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		transformed, _ := ioutil.ReadAll(response.Body)
+		decoded, err := DefaultContentCodings[coding].Decode(transformed)
+		if err != nil {
+			t.Fatalf("%s: expected the transformed body to be encoded again: %s", coding, err)
+		}
+
+		if string(decoded) != "p{color:red;}" {
+			t.Errorf("%s: expected the decoded body to be transformed, got: %s", coding, decoded)
+		}
+
+		if response.Header.Get("Content-Length") != strconv.Itoa(len(transformed)) {
+			t.Errorf("%s: expected the Content-Length of the encoded body", coding)
+		}
+	}
+
+	//Bodies with a unknown coding are left untouched
+	response := &http.Response{
+		Header: http.Header{
+			"Content-Type":     []string{"text/css"},
+			"Content-Encoding": []string{"br"},
+		},
+		Body: ioutil.NopCloser(strings.NewReader("p  {  color : red ; }")),
+	}
+
+	err := applyBodyTransformers(config, []BodyTransformer{CSSMinifier}, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body, _ := ioutil.ReadAll(response.Body); string(body) != "p  {  color : red ; }" {
+		t.Errorf("expected a body with a unknown coding to be untouched, got: %s", body)
+	}
+}
@@ -0,0 +1,136 @@
+package sharedhttpcache
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//ForwardedProtoHeader is the request header in which a TLS terminating load balancer sends the scheme used by the client
+const ForwardedProtoHeader = "X-Forwarded-Proto"
+
+//A TrustResolver decides if a client is trusted.
+// Trusted clients, like a deploy pipeline or an administrator, can for example force a stored response to be refreshed
+type TrustResolver interface {
+
+	//IsTrusted is called to check if the client which sent the request is trusted
+	IsTrusted(req *http.Request) bool
+}
+
+//The TrustResolverFunc type is an adapter to allow the use of ordinary functions as TrustResolver
+type TrustResolverFunc func(req *http.Request) bool
+
+//IsTrusted calls the underlying function to check if the client is trusted
+func (resolver TrustResolverFunc) IsTrusted(req *http.Request) bool {
+	return resolver(req)
+}
+
+//TrustedNetworks returns a TrustResolver which trusts clients of which the remote address is in one of the networks
+// The networks are given in CIDR notation like "10.0.0.0/8"
+func TrustedNetworks(cidrs ...string) (TrustResolver, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted network '%s': %w", cidr, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return TrustResolverFunc(func(req *http.Request) bool {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	}), nil
+}
+
+//TrustedHeaderToken returns a TrustResolver which trusts clients which send the token in the given request header
+func TrustedHeaderToken(headerName, token string) TrustResolver {
+	return TrustResolverFunc(func(req *http.Request) bool {
+		value := req.Header.Get(headerName)
+		return token != "" && subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1
+	})
+}
+
+//isTrustedClient checks if the client which sent the request is trusted, no client is trusted if there is no TrustResolver
+func (controller *CacheController) isTrustedClient(req *http.Request) bool {
+	return controller.TrustResolver != nil && controller.TrustResolver.IsTrusted(req)
+}
+
+//resolveRefresh checks if a trusted client requested the stored response to be refreshed with the RefreshHeader of the cache config
+// The header is removed from the request so it isn't forwarded to the origin server. The header of untrusted clients is ignored
+func (controller *CacheController) resolveRefresh(cacheConfig *CacheConfig, req *http.Request) (*http.Request, bool) {
+	if cacheConfig.RefreshHeader == "" {
+		return req, false
+	}
+
+	if _, found := req.Header[http.CanonicalHeaderKey(cacheConfig.RefreshHeader)]; !found {
+		return req, false
+	}
+
+	refresh := controller.isTrustedClient(req)
+
+	strippedReq := req.Clone(req.Context())
+	strippedReq.Header.Del(cacheConfig.RefreshHeader)
+
+	return strippedReq, refresh
+}
+
+//resolveForwardedProto uses the scheme in the ForwardedProtoHeader of trusted clients as scheme of the request if TrustForwardedProto is true,
+// so a resource requested through a TLS terminating load balancer has the same cache key as when it is requested over TLS directly.
+// Like for the effective URI, the scheme is set by the TLS field of the returned request
+func (controller *CacheController) resolveForwardedProto(cacheConfig *CacheConfig, req *http.Request) *http.Request {
+	if !cacheConfig.TrustForwardedProto {
+		return req
+	}
+
+	//Only the first value is used, which was set by the proxy closest to the client
+	proto := strings.ToLower(strings.TrimSpace(strings.Split(req.Header.Get(ForwardedProtoHeader), ",")[0]))
+	if proto != "http" && proto != "https" {
+		return req
+	}
+
+	if (proto == "https") == (req.TLS != nil) || !controller.isTrustedClient(req) {
+		return req
+	}
+
+	forwardedReq := req.WithContext(req.Context())
+	if proto == "https" {
+		forwardedReq.TLS = &tls.ConnectionState{}
+	} else {
+		forwardedReq.TLS = nil
+	}
+
+	return forwardedReq
+}
+
+//TrustAny returns a TrustResolver which trusts clients trusted by any of the resolvers, like a network or a token
+func TrustAny(resolvers ...TrustResolver) TrustResolver {
+	return TrustResolverFunc(func(req *http.Request) bool {
+		for _, resolver := range resolvers {
+			if resolver.IsTrusted(req) {
+				return true
+			}
+		}
+
+		return false
+	})
+}
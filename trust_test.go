@@ -0,0 +1,143 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestTrustedNetworks(t *testing.T) {
+	if _, err := TrustedNetworks("invalid"); err == nil {
+		t.Error("expected error for invalid network")
+	}
+
+	resolver, err := TrustedNetworks("10.0.0.0/8", "2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for remoteAddr, expected := range map[string]bool{
+		"10.1.2.3:1234":     true,
+		"[2001:db8::1]:443": true,
+		"192.0.2.1:1234":    false,
+		"invalid":           false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+
+		if trusted := resolver.IsTrusted(req); trusted != expected {
+			t.Errorf("%s: expected trusted %v, got %v", remoteAddr, expected, trusted)
+		}
+	}
+}
+
+func TestTrustedHeaderToken(t *testing.T) {
+	resolver := TrustedHeaderToken("X-Admin-Token", "secret")
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if resolver.IsTrusted(req) {
+		t.Error("expected client without token not to be trusted")
+	}
+
+	req.Header.Set("X-Admin-Token", "wrong")
+	if resolver.IsTrusted(req) {
+		t.Error("expected client with wrong token not to be trusted")
+	}
+
+	req.Header.Set("X-Admin-Token", "secret")
+	if !resolver.IsTrusted(req) {
+		t.Error("expected client with token to be trusted")
+	}
+}
+
+func TestRefreshFromTrustedClient(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		if req.Header.Get("X-Cache-Refresh") != "" {
+			t.Error("expected refresh header not to be forwarded")
+		}
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write([]byte(strconv.Itoa(originRequests)))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.RefreshHeader = "X-Cache-Refresh"
+	controller.TrustResolver = TrustResolverFunc(func(req *http.Request) bool {
+		return req.Header.Get("X-Trusted") == "yes"
+	})
+
+	request := func(refresh, trusted bool) string {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		if refresh {
+			req.Header.Set("X-Cache-Refresh", "1")
+		}
+		if trusted {
+			req.Header.Set("X-Trusted", "yes")
+		}
+
+		_, body := doTestRequest(t, controller, req)
+		return body
+	}
+
+	if body := request(false, false); body != "1" {
+		t.Errorf("expected first response from origin, got: %s", body)
+	}
+
+	if body := request(true, false); body != "1" {
+		t.Errorf("expected refresh of untrusted client to be ignored, got: %s", body)
+	}
+
+	if body := request(true, true); body != "2" {
+		t.Errorf("expected refresh of trusted client to fetch a new response, got: %s", body)
+	}
+
+	if body := request(false, false); body != "2" {
+		t.Errorf("expected refreshed response to be stored, got: %s", body)
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	controller := &CacheController{
+		TrustResolver: TrustResolverFunc(func(req *http.Request) bool {
+			return req.RemoteAddr == "10.0.0.1:1234"
+		}),
+	}
+
+	config := NewCacheConfig()
+	config.TrustForwardedProto = true
+
+	for _, test := range []struct {
+		remoteAddr string
+		proto      string
+		expect     string
+	}{
+		{remoteAddr: "10.0.0.1:1234", proto: "https", expect: "https://example.com/page"},
+		{remoteAddr: "10.0.0.1:1234", proto: "HTTPS, http", expect: "https://example.com/page"},
+		{remoteAddr: "10.0.0.1:1234", proto: "ftp", expect: "http://example.com/page"},
+		{remoteAddr: "192.0.2.1:1234", proto: "https", expect: "http://example.com/page"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set(ForwardedProtoHeader, test.proto)
+
+		effectiveURI := getEffectiveURI(controller.resolveForwardedProto(config, req), config, &ForwardConfig{})
+		if effectiveURI != test.expect {
+			t.Errorf("%s with '%s': expected '%s', got '%s'", test.remoteAddr, test.proto, test.expect, effectiveURI)
+		}
+	}
+
+	config.IgnoreSchemeInCacheKey = true
+
+	httpReq := httptest.NewRequest(http.MethodGet, "/page", nil)
+	httpsReq := httptest.NewRequest(http.MethodGet, "https://example.com/page", nil)
+	httpsReq.URL.Scheme = ""
+	httpsReq.URL.Host = ""
+
+	if getEffectiveURI(httpReq, config, &ForwardConfig{}) != getEffectiveURI(httpsReq, config, &ForwardConfig{}) {
+		t.Error("expected http and https requests to share the effective URI when the scheme is ignored")
+	}
+}
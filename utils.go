@@ -2,66 +2,93 @@ package sharedhttpcache
 
 import (
 	"bytes"
+	"fmt"
+	"hash"
+	"io"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	"sort"
 	"strings"
+	"time"
 )
 
-//splitCacheControlHeader splits the directives from the Cache-Control header value
-func splitCacheControlHeader(headerValues []string) []string {
-	directives := []string{}
-	for _, headerValue := range headerValues {
-		inQuote := false
-		curDir := ""
-		for _, char := range strings.ToLower(headerValue) {
-			if char == '"' {
-				inQuote = !inQuote
-			}
+//getPrimaryCacheKey generates the primary cache key for the request according to the requirement in section 4 of RFC7234
+//The primary keys is the method, host and effective URI concatenated together
+//If the request belongs to a tenant the key is prefixed with the tenant ID
+func getPrimaryCacheKey(cacheConfig *CacheConfig, forwardConfig *ForwardConfig, req *http.Request) string {
 
-			if char == ',' && !inQuote {
-				trimmed := strings.TrimSpace(curDir)
-				if len(trimmed) != 0 {
-					directives = append(directives, trimmed)
-				}
-				curDir = ""
-				continue
-			}
+	//TODO custom cache keys
 
-			curDir += string(char)
-		}
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	buf.WriteString(tenantCacheKeyPrefix(TenantFromRequest(req)))
+	buf.WriteString(req.Method)
+	buf.WriteString(getEffectiveURI(req, cacheConfig, forwardConfig))
 
-		trimmed := strings.TrimSpace(curDir)
-		if len(trimmed) != 0 {
-			directives = append(directives, trimmed)
+	return buf.String()
+}
+
+//getSecondaryKeyFields returns the header fields listed in the Vary header, which select the stored response
+// Fields which are not in AllowedVaryHeaders are left out
+func getSecondaryKeyFields(cacheConfig *CacheConfig, header http.Header) []string {
+	secondaryKeyFields := []string{}
+
+	vary := header.Get(VaryHeader)
+	if vary != "" {
+		for _, key := range strings.Split(vary, ",") {
+			key = strings.TrimSpace(key)
+			if isVaryHeaderAllowed(cacheConfig, key) {
+				secondaryKeyFields = append(secondaryKeyFields, key)
+			}
 		}
 	}
 
-	return directives
+	return secondaryKeyFields
 }
 
-//getPrimaryCacheKey generates the primary cache key for the request according to the requirement in section 4 of RFC7234
-//The primary keys is the method, host and effective URI concatenated together
-func getPrimaryCacheKey(cacheConfig *CacheConfig, forwardConfig *ForwardConfig, req *http.Request) string {
+//isVaryHeaderAllowed checks if the cache honors the header name in a Vary header, see AllowedVaryHeaders
+func isVaryHeaderAllowed(cacheConfig *CacheConfig, name string) bool {
+	if len(cacheConfig.AllowedVaryHeaders) == 0 {
+		return true
+	}
 
-	//TODO custom cache keys
+	for _, allowed := range cacheConfig.AllowedVaryHeaders {
+		if strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
 
-	buf := &bytes.Buffer{}
+	return false
+}
 
-	buf.WriteString(req.Method)
-	buf.WriteString(getEffectiveURI(req, forwardConfig))
+//variesOnDisallowedHeader checks if the Vary header contains a header name which is not in AllowedVaryHeaders
+func variesOnDisallowedHeader(cacheConfig *CacheConfig, header http.Header) bool {
+	if len(cacheConfig.AllowedVaryHeaders) == 0 {
+		return false
+	}
 
-	return buf.String()
+	for _, vary := range header[VaryHeader] {
+		for _, key := range strings.Split(vary, ",") {
+			if key = strings.TrimSpace(key); key != "" && !isVaryHeaderAllowed(cacheConfig, key) {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 //getSecondaryCacheKey generates the secondary cache key based on the secondary key fields specified in the cached responses and the current request
-func getSecondaryCacheKey(secondaryKeyFields []string, req *http.Request) string {
+// Values of the cookies listed in CacheKeyCookies, the class and the geographical variant of the request are also part of the secondary key
+func getSecondaryCacheKey(cacheConfig *CacheConfig, secondaryKeyFields []string, req *http.Request) string {
 
 	//Sort the fields so the order in the resulting key is always the same
 	sort.Strings(secondaryKeyFields)
 
-	buf := &bytes.Buffer{}
+	buf := getBuffer()
+	defer putBuffer(buf)
 
 	for _, key := range secondaryKeyFields {
 		//Separate pieces of the key by the pipe. It is not a allowed value in the Method, hostname, URI or header names so it is a good separator
@@ -84,16 +111,58 @@ func getSecondaryCacheKey(secondaryKeyFields []string, req *http.Request) string
 		}
 	}
 
+	writeCookieCacheKey(buf, cacheConfig.CacheKeyCookies, req)
+
+	if cacheConfig.RequestClassifier != nil {
+		buf.WriteString("|class:")
+		buf.WriteString(cacheConfig.RequestClassifier.ClassifyRequest(req))
+	}
+
+	buf.WriteString(geoCacheKey(cacheConfig, req))
+
 	return buf.String()
 }
 
+//writeCookieCacheKey writes the values of the given cookie names from the request to the cache key buffer
+func writeCookieCacheKey(buf *bytes.Buffer, cookieNames []string, req *http.Request) {
+	if len(cookieNames) == 0 {
+		return
+	}
+
+	//Copy before sorting so the order of the config isn't changed
+	names := make([]string, len(cookieNames))
+	copy(names, cookieNames)
+	sort.Strings(names)
+
+	for _, name := range names {
+		buf.WriteString("|cookie:")
+		buf.WriteString(name)
+		buf.WriteRune('=')
+
+		//A missing cookie results in a empty value so requests without the cookie share one variant
+		if cookie, err := req.Cookie(name); err == nil {
+			buf.WriteString(cookie.Value)
+		}
+	}
+}
+
 //getEffectiveURI returns the effective URI as string generated from a request object
 // https://tools.ietf.org/html/rfc7230#section-5.5
-func getEffectiveURI(req *http.Request, forwardConfig *ForwardConfig) string {
+// The query is canonicalized according to the cache config, so the URI can be used in a cache key
+func getEffectiveURI(req *http.Request, cacheConfig *CacheConfig, forwardConfig *ForwardConfig) string {
+
+	ignoreScheme := cacheConfig != nil && cacheConfig.IgnoreSchemeInCacheKey
 
 	//If the request URI is in the absolute-form, just return it
 	if req.URL.Host != "" && req.URL.Scheme != "" {
-		return req.URL.String()
+		absoluteURI := *req.URL
+		absoluteURI.Host = normalizeHost(cacheConfig, absoluteURI.Scheme, absoluteURI.Host)
+
+		if ignoreScheme {
+			return stripScheme(absoluteURI.String())
+		}
+
+		return absoluteURI.String()
 	}
 
 	//Otherwise build the absolute URI ourselfs
@@ -112,18 +181,110 @@ func getEffectiveURI(req *http.Request, forwardConfig *ForwardConfig) string {
 		effectiveURI.Host = forwardConfig.Host
 	}
 
+	effectiveURI.Host = normalizeHost(cacheConfig, effectiveURI.Scheme, effectiveURI.Host)
+
+	//Without a scheme the URI starts with "//", so http and https requests share the cache key
+	if ignoreScheme {
+		effectiveURI.Scheme = ""
+	}
+
 	//If request is in asterisk form we leave the path and query empty
 	if req.URL.Path != "*" {
 		effectiveURI.Path = req.URL.Path
 		effectiveURI.RawPath = req.URL.RawPath
 
-		//Parse and re-encode the query, this causes the query to be sorted by key
-		// sort order is important when the effective uri is used in a cache key
-		queryValues, err := url.ParseQuery(req.URL.RawQuery)
-		if err == nil {
-			effectiveURI.RawQuery = queryValues.Encode()
-		}
+		effectiveURI.RawQuery = canonicalizeQuery(cacheConfig, req.URL.RawQuery)
 	}
 
 	return effectiveURI.String()
 }
+
+//stripScheme removes the scheme from a absolute URI, leaving a URI which starts with "//"
+func stripScheme(uri string) string {
+	if colon := strings.Index(uri, "://"); colon != -1 {
+		return uri[colon+1:]
+	}
+
+	return uri
+}
+
+//countingReadCloser counts the amount of bytes read from the underlying ReadCloser
+// If checksum is not nil the read bytes are also written to it
+type countingReadCloser struct {
+	io.ReadCloser
+	count    int64
+	checksum hash.Hash32
+}
+
+func (reader *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	reader.count += int64(n)
+	if reader.checksum != nil {
+		_, _ = reader.checksum.Write(p[:n])
+	}
+	return n, err
+}
+
+//httpDateLayouts are the date formats a recipient must accept, section 7.1.1.1 of RFC 7231
+var httpDateLayouts = []string{
+	http.TimeFormat,
+	time.RFC850,
+	time.ANSIC,
+}
+
+//parseHTTPDate parses a HTTP-date as defined in section 7.1.1.1 of RFC 7231
+//
+// If lenient is false the value must exactly match one of the allowed formats,
+// so things like a lowercase weekday, a single digit hour or extra spaces cause an error.
+// If lenient is true a best effort is made to parse the value
+func parseHTTPDate(value string, lenient bool) (time.Time, error) {
+	if lenient {
+		//Collapse all whitespace into single spaces
+		value = strings.Join(strings.Fields(value), " ")
+
+		return http.ParseTime(value)
+	}
+
+	for _, layout := range httpDateLayouts {
+		date, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+
+		//time.Parse is case insensitive and accepts single digit hours, so check if the value is in the exact format
+		// by formatting the date again. This also checks if the weekday matches the date
+		if date.Format(layout) == value {
+			return date, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid HTTP-date '%s'", value)
+}
+
+//stripResponseHeaders removes the headers listed in StripResponseHeaders of the cache config from the header
+// A name ending with a asterisk strips all headers starting with that prefix
+func stripResponseHeaders(cacheConfig *CacheConfig, header http.Header) {
+	for _, name := range cacheConfig.StripResponseHeaders {
+		if !strings.HasSuffix(name, "*") {
+			header.Del(name)
+			continue
+		}
+
+		prefix := strings.ToLower(strings.TrimSuffix(name, "*"))
+		for key := range header {
+			if strings.HasPrefix(strings.ToLower(key), prefix) {
+				delete(header, key)
+			}
+		}
+	}
+}
+
+//firstHeaderValue returns the first value of a header, or a empty string if the header is not set
+// Unlike http.Header.Get the name is not canonicalized, so it must already be in canonical form
+func firstHeaderValue(header http.Header, canonicalName string) string {
+	if values := header[canonicalName]; len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
@@ -0,0 +1,108 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetSecondaryCacheKeyCookies(t *testing.T) {
+	config := NewCacheConfig()
+	config.CacheKeyCookies = []string{"lang", "currency"}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	req.AddCookie(&http.Cookie{Name: "lang", Value: "nl"})
+
+	key := getSecondaryCacheKey(config, []string{"Accept-Encoding"}, req)
+
+	expected := "|Accept-Encoding:gzip|cookie:currency=|cookie:lang=nl"
+	if key != expected {
+		t.Errorf("expected: %s, got: %s", expected, key)
+	}
+
+	//The order of the cookie names in the config must not be changed
+	if config.CacheKeyCookies[0] != "lang" {
+		t.Errorf("the cookie names of the config have been modified")
+	}
+}
+
+func TestParseHTTPDate(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		strictValid bool
+		lenientOK   bool
+	}{
+		{name: "IMF-fixdate", value: "Sun, 06 Nov 1994 08:49:37 GMT", strictValid: true, lenientOK: true},
+		{name: "RFC850", value: "Sunday, 06-Nov-94 08:49:37 GMT", strictValid: true, lenientOK: true},
+		{name: "asctime", value: "Sun Nov  6 08:49:37 1994", strictValid: true, lenientOK: true},
+		{name: "lowercase weekday", value: "sun, 06 Nov 1994 08:49:37 GMT", strictValid: false, lenientOK: true},
+		{name: "1 digit hour", value: "Sun, 06 Nov 1994 8:49:37 GMT", strictValid: false, lenientOK: true},
+		{name: "multiple spaces", value: "Sun, 06  Nov 1994 08:49:37 GMT", strictValid: false, lenientOK: true},
+		{name: "wrong weekday", value: "Mon, 06 Nov 1994 08:49:37 GMT", strictValid: false, lenientOK: true},
+		{name: "garbage", value: "0", strictValid: false, lenientOK: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseHTTPDate(test.value, false)
+			if (err == nil) != test.strictValid {
+				t.Errorf("strict: expected valid: %v, got error: %v", test.strictValid, err)
+			}
+
+			_, err = parseHTTPDate(test.value, true)
+			if (err == nil) != test.lenientOK {
+				t.Errorf("lenient: expected valid: %v, got error: %v", test.lenientOK, err)
+			}
+		})
+	}
+}
+
+func TestStripResponseHeaders(t *testing.T) {
+	config := NewCacheConfig()
+	config.StripResponseHeaders = []string{"set-cookie", "X-Backend-*"}
+
+	header := http.Header{
+		"Set-Cookie":        []string{"session=abc"},
+		"X-Backend-Server":  []string{"app-1"},
+		"X-Backend-Version": []string{"1.2"},
+		"X-Frame-Options":   []string{"DENY"},
+	}
+
+	stripResponseHeaders(config, header)
+
+	if len(header) != 1 || header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("expected only X-Frame-Options to remain, got: %v", header)
+	}
+}
+
+func TestFilterRequestCookies(t *testing.T) {
+	config := NewCacheConfig()
+	config.StripRequestCookies = true
+	config.RequestCookieAllowlist = []string{"consent"}
+	config.CacheKeyCookies = []string{"lang"}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	req.AddCookie(&http.Cookie{Name: "consent", Value: "yes"})
+	req.AddCookie(&http.Cookie{Name: "lang", Value: "nl"})
+
+	filtered := filterRequestCookies(config, req)
+
+	if cookie := filtered.Header.Get("Cookie"); cookie != "consent=yes; lang=nl" {
+		t.Errorf("unexpected cookie header: %s", cookie)
+	}
+
+	if len(req.Cookies()) != 3 {
+		t.Errorf("the original request has been modified")
+	}
+
+	postReq := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	postReq.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+
+	if filterRequestCookies(config, postReq) != postReq {
+		t.Errorf("cookies of uncacheable requests should not be filtered")
+	}
+}
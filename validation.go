@@ -0,0 +1,134 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//OriginFailureInvalidResponse means the origin server responded, but a ResponseValidator rejected the response,
+// see CacheConfig.ServeStaleOnFailures
+const OriginFailureInvalidResponse = "invalid-response"
+
+//MetricCacheRejected is counted every time a response isn't stored because a ResponseValidator rejected it
+const MetricCacheRejected = "cache.rejected"
+
+//A ResponseValidator checks a response of the origin before it is stored, so responses broken by transient origin bugs
+// don't poison the cache. A rejected response is still served to the client, unless a stale response can be served instead
+type ResponseValidator interface {
+
+	//ValidateResponse is called with the complete decoded body of a 200 response, a error rejects the response
+	ValidateResponse(response *http.Response, body []byte) error
+}
+
+//The ResponseValidatorFunc type is an adapter to allow the use of ordinary functions as ResponseValidator
+type ResponseValidatorFunc func(response *http.Response, body []byte) error
+
+//ValidateResponse calls the underlying function to validate a response
+func (validator ResponseValidatorFunc) ValidateResponse(response *http.Response, body []byte) error {
+	return validator(response, body)
+}
+
+var (
+	errTruncatedHTML = errors.New("HTML document has no closing html tag")
+	errEmptyBody     = errors.New("Body is empty")
+)
+
+//TruncatedHTMLValidator is a ResponseValidator which rejects HTML documents without a closing html tag,
+// which are most likely cut off by a origin which crashed while rendering
+var TruncatedHTMLValidator = ResponseValidatorFunc(func(response *http.Response, body []byte) error {
+	if responseMediaType(response) != "text/html" {
+		return nil
+	}
+
+	if !bytes.Contains(bytes.ToLower(body), []byte("</html>")) {
+		return errTruncatedHTML
+	}
+
+	return nil
+})
+
+//EmptyBodyValidator is a ResponseValidator which rejects 200 responses without a body
+var EmptyBodyValidator = ResponseValidatorFunc(func(response *http.Response, body []byte) error {
+	if len(body) == 0 {
+		return errEmptyBody
+	}
+
+	return nil
+})
+
+//ErrorMarkerValidator returns a ResponseValidator which rejects bodies containing one of the markers,
+// like a error message the origin renders with a 200 status code
+func ErrorMarkerValidator(markers ...string) ResponseValidator {
+	return ResponseValidatorFunc(func(response *http.Response, body []byte) error {
+		for _, marker := range markers {
+			if bytes.Contains(body, []byte(marker)) {
+				return fmt.Errorf("Body contains error marker '%s'", marker)
+			}
+		}
+
+		return nil
+	})
+}
+
+//ContentTypeValidator returns a ResponseValidator which rejects responses of which the media type doesn't match the file extension
+// of the requested path. The key of the map is the extension without dot, like "css", the value the media type, like "text/css".
+// Paths with a extension which is not in the map are not validated
+func ContentTypeValidator(mediaTypes map[string]string) ResponseValidator {
+	return ResponseValidatorFunc(func(response *http.Response, body []byte) error {
+		if response.Request == nil {
+			return nil
+		}
+
+		extension := strings.ToLower(strings.TrimPrefix(path.Ext(response.Request.URL.Path), "."))
+
+		expected, found := mediaTypes[extension]
+		if !found {
+			return nil
+		}
+
+		if mediaType := responseMediaType(response); !strings.EqualFold(mediaType, expected) {
+			return fmt.Errorf("Media type '%s' doesn't match the expected '%s' of the extension '%s'", mediaType, expected, extension)
+		}
+
+		return nil
+	})
+}
+
+//validateResponse checks the response with the ResponseValidators of the config, the first error is returned.
+// Only 200 responses are validated, since other responses don't contain the complete body.
+// Responses with a unsupported content coding can't be decoded and are not validated
+func validateResponse(cacheConfig *CacheConfig, response *http.Response) error {
+	if len(cacheConfig.ResponseValidators) == 0 || response.StatusCode != http.StatusOK || response.Body == nil {
+		return nil
+	}
+
+	if response.Request != nil && response.Request.Method == http.MethodHead {
+		return nil
+	}
+
+	coding, supported := contentCodingOf(cacheConfig, response.Header)
+	if !supported {
+		return nil
+	}
+
+	body, encoded, err := readDecodedBody(coding, response)
+
+	//The body has been read, the client still needs it
+	response.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+
+	for _, validator := range cacheConfig.ResponseValidators {
+		if err := validator.ValidateResponse(response, body); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package sharedhttpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseValidators(t *testing.T) {
+	tests := []struct {
+		name        string
+		validator   ResponseValidator
+		path        string
+		contentType string
+		body        string
+		expectValid bool
+	}{
+		{name: "complete html", validator: TruncatedHTMLValidator, contentType: "text/html", body: "<html><body></body></HTML>", expectValid: true},
+		{name: "truncated html", validator: TruncatedHTMLValidator, contentType: "text/html", body: "<html><body>", expectValid: false},
+		{name: "truncated other", validator: TruncatedHTMLValidator, contentType: "text/plain", body: "<html>", expectValid: true},
+		{name: "empty body", validator: EmptyBodyValidator, contentType: "text/plain", body: "", expectValid: false},
+		{name: "error marker", validator: ErrorMarkerValidator("Fatal error"), contentType: "text/html", body: "<b>Fatal error</b>", expectValid: false},
+		{name: "no error marker", validator: ErrorMarkerValidator("Fatal error"), contentType: "text/html", body: "<b>Hello</b>", expectValid: true},
+		{name: "matching type", validator: ContentTypeValidator(map[string]string{"css": "text/css"}), path: "/style.CSS", contentType: "text/css; charset=utf-8", expectValid: true},
+		{name: "wrong type", validator: ContentTypeValidator(map[string]string{"css": "text/css"}), path: "/style.css", contentType: "text/html", expectValid: false},
+		{name: "unknown extension", validator: ContentTypeValidator(map[string]string{"css": "text/css"}), path: "/page", contentType: "text/html", expectValid: true},
+	}
+
+	for _, test := range tests {
+		response := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {test.contentType}},
+			Request:    httptest.NewRequest(http.MethodGet, "http://example.com"+test.path, nil),
+		}
+
+		err := test.validator.ValidateResponse(response, []byte(test.body))
+		if (err == nil) != test.expectValid {
+			t.Errorf("%s: expected valid %v, got error %v", test.name, test.expectValid, err)
+		}
+	}
+}
+
+func TestRejectedResponseNotStored(t *testing.T) {
+	originRequests := 0
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests++
+
+		rw.Header().Set("Content-Type", "text/html")
+
+		if req.URL.Path == "/broken" {
+			rw.Header().Set(CacheControlHeader, "max-age=60")
+			_, _ = rw.Write([]byte("<html><body>"))
+			return
+		}
+
+		//The first response is stored but immediately stale, after that the origin sends a truncated document
+		rw.Header().Set(CacheControlHeader, "max-age=0")
+		if originRequests > 1 {
+			rw.Header().Set("Etag", `"v2"`)
+			_, _ = rw.Write([]byte("<html><body>"))
+			return
+		}
+
+		rw.Header().Set("Etag", `"v1"`)
+		_, _ = rw.Write([]byte("<html><body></body></html>"))
+	}))
+	defer closeOrigin()
+
+	controller.DefaultCacheConfig.ResponseValidators = []ResponseValidator{TruncatedHTMLValidator}
+
+	doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil))
+
+	_, body := doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil))
+	if body != "<html><body></body></html>" {
+		t.Errorf("expected the stale response instead of the rejected response, got '%s'", body)
+	}
+
+	//A rejected response is served but not stored
+	originRequests = 0
+	for i := 0; i < 2; i++ {
+		_, body = doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+"/broken", nil))
+		if body != "<html><body>" {
+			t.Errorf("expected the rejected response to be served, got '%s'", body)
+		}
+	}
+
+	if originRequests != 2 {
+		t.Errorf("expected the rejected response not to be stored, got %d origin requests", originRequests)
+	}
+}
@@ -0,0 +1,233 @@
+package sharedhttpcache
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//variantIndexPrefix is prepended to the primary cache key to get the key of the variant index
+const variantIndexPrefix = "variants"
+
+//A variant is a stored response for a primary cache key, which is selected by its secondary cache key
+type variant struct {
+	//secondaryKey is the secondary cache key of the stored response
+	secondaryKey string
+
+	//etag is the entity tag of the stored response, empty if the response has none
+	etag string
+}
+
+//findVariantsInCache returns the variants which are known to be stored for the primary cache key
+//
+// The variant index is a special purpose cache entry with one line per variant.
+// Each line contains the etag, a tab and the secondary key. Neither a etag nor a header value can contain a tab or newline
+func (controller *CacheController) findVariantsInCache(primaryCacheKey string) ([]variant, error) {
+	variants, _, err := controller.findVariantIndex(primaryCacheKey)
+	return variants, err
+}
+
+//findVariantIndex returns the variants in the variant index and the ttl of the index
+func (controller *CacheController) findVariantIndex(primaryCacheKey string) ([]variant, time.Duration, error) {
+	for _, cacheLayer := range controller.Layers {
+		reader, ttl, err := cacheLayer.Get(variantIndexPrefix + primaryCacheKey)
+		if err != nil {
+			return nil, -1, err
+		}
+
+		//If the entry was not found
+		if reader == nil {
+			continue
+		}
+
+		//Close the cache reader when we are done
+		defer reader.Close()
+
+		variants := []variant{}
+
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), "\t", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			variants = append(variants, variant{etag: parts[0], secondaryKey: parts[1]})
+		}
+
+		return variants, ttl, scanner.Err()
+	}
+
+	//If entry wasn't found in any layer
+	return []variant{}, -1, nil
+}
+
+//storeVariantInIndex adds or updates a variant in the variant index of the primary cache key
+// The index is ordered from least to most recently used, the new variant is the most recently used.
+// If more than maxVariants variants are stored the least recently used are deleted, zero means no limit
+func (controller *CacheController) storeVariantInIndex(primaryCacheKey string, newVariant variant, ttl time.Duration, maxVariants int) error {
+	controller.variantIndexMutex.Lock()
+	defer controller.variantIndexMutex.Unlock()
+
+	variants, err := controller.findVariantsInCache(primaryCacheKey)
+	if err != nil {
+		return err
+	}
+
+	variants = append(withoutVariant(variants, newVariant.secondaryKey), newVariant)
+
+	if maxVariants > 0 && len(variants) > maxVariants {
+		evicted := variants[:len(variants)-maxVariants]
+		variants = variants[len(variants)-maxVariants:]
+
+		for _, evictedVariant := range evicted {
+			cacheKey := primaryCacheKey + evictedVariant.secondaryKey
+			if err := controller.deleteCacheEntry(cacheKey); err != nil {
+				return err
+			}
+
+			controller.incrMetric(MetricVariantEviction, 1, nil)
+			controller.emitEvent(CacheEventEvict, cacheKey, -1, false)
+		}
+	}
+
+	return controller.storeVariantIndex(primaryCacheKey, variants, ttl)
+}
+
+//touchVariantInIndex marks the variant as the most recently used variant of the primary cache key
+// It is only needed if the amount of variants is limited, since the order of the index is only used to select variants to evict
+func (controller *CacheController) touchVariantInIndex(primaryCacheKey string, secondaryKey string) error {
+	controller.variantIndexMutex.Lock()
+	defer controller.variantIndexMutex.Unlock()
+
+	variants, ttl, err := controller.findVariantIndex(primaryCacheKey)
+	if err != nil {
+		return err
+	}
+
+	//The index isn't written if the variant is already the most recently used one, which is the common case
+	if len(variants) < 2 || variants[len(variants)-1].secondaryKey == secondaryKey {
+		return nil
+	}
+
+	touched := variant{}
+	found := false
+	for _, existing := range variants {
+		if existing.secondaryKey == secondaryKey {
+			touched = existing
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	//Stale entries are kept as long as they can be revalidated, the ttl is clamped like it is when storing them
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return controller.storeVariantIndex(primaryCacheKey, append(withoutVariant(variants, secondaryKey), touched), ttl)
+}
+
+//removeVariantFromIndex removes the variant with the secondary key from the variant index of the primary cache key
+// The ttl of the index is kept, if no variants remain the index is deleted
+func (controller *CacheController) removeVariantFromIndex(primaryCacheKey string, secondaryKey string) error {
+	controller.variantIndexMutex.Lock()
+	defer controller.variantIndexMutex.Unlock()
+
+	variants, ttl, err := controller.findVariantIndex(primaryCacheKey)
+	if err != nil {
+		return err
+	}
+
+	remaining := withoutVariant(variants, secondaryKey)
+	if len(remaining) == len(variants) {
+		return nil
+	}
+
+	if len(remaining) == 0 {
+		for _, cacheLayer := range controller.Layers {
+			if err := cacheLayer.Delete(variantIndexPrefix + primaryCacheKey); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	//Stale entries are kept as long as they can be revalidated, the ttl is clamped like it is when storing them
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return controller.storeVariantIndex(primaryCacheKey, remaining, ttl)
+}
+
+//storeVariantIndex stores the variants as the variant index of the primary cache key
+// WARNING the variantIndexMutex must be locked by the caller
+func (controller *CacheController) storeVariantIndex(primaryCacheKey string, variants []variant, ttl time.Duration) error {
+	builder := &strings.Builder{}
+	for _, variant := range variants {
+		builder.WriteString(variant.etag + "\t" + variant.secondaryKey + "\n")
+	}
+
+	return controller.storeInCache(variantIndexPrefix+primaryCacheKey, ioutil.NopCloser(strings.NewReader(builder.String())), ttl)
+}
+
+//withoutVariant returns the variants except the one with the given secondary key
+func withoutVariant(variants []variant, secondaryKey string) []variant {
+	remaining := make([]variant, 0, len(variants))
+	for _, existing := range variants {
+		if existing.secondaryKey != secondaryKey {
+			remaining = append(remaining, existing)
+		}
+	}
+
+	return remaining
+}
+
+//updateVaryOfStoredResponse is called when a 304 response contains a Vary header. If the secondary key of the revalidated
+// response changed, the secondary keys of the primary cache key are replaced and the response is removed from its old key,
+// so the old key can't be selected anymore. The response is stored under its new key when the revalidated response is stored
+func (controller *CacheController) updateVaryOfStoredResponse(cacheConfig *CacheConfig, req *http.Request, primaryCacheKey string, oldSecondaryKey string, response *http.Response) {
+	secondaryKeyFields := getSecondaryKeyFields(cacheConfig, response.Header)
+
+	if getSecondaryCacheKey(cacheConfig, secondaryKeyFields, req) == oldSecondaryKey {
+		return
+	}
+
+	//The secondary keys are replaced even if the revalidated response is not stored again, so lookups don't keep using the old keys
+	_, ttl, err := controller.findSecondaryKeysInCache(primaryCacheKey)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).WithField("cache-key", primaryCacheKey).Error("Error while attempting to find secondary cache keys in cache")
+	} else {
+		//The ttl is clamped like it is for stored responses which are stale on arrival
+		if ttl < 0 {
+			ttl = 0
+		}
+
+		err = controller.storeSecondaryKeysInCache(primaryCacheKey, secondaryKeyFields, ttl)
+		if err != nil {
+			controller.requestLogger(req).WithError(err).WithField("cache-key", primaryCacheKey).Error("Error while attempting to store secondary cache keys in cache")
+		}
+	}
+
+	err = controller.removeVariantFromIndex(primaryCacheKey, oldSecondaryKey)
+	if err != nil {
+		controller.requestLogger(req).WithError(err).WithField("cache-key", primaryCacheKey).Error("Error while attempting to remove variant from index")
+	}
+
+	//Only the metadata is deleted, the body is still being read from the cache. Without metadata the body is never looked up
+	// and it expires with its ttl
+	oldCacheKey := primaryCacheKey + oldSecondaryKey
+	for _, cacheLayer := range controller.Layers {
+		if err := cacheLayer.Delete(oldCacheKey); err != nil {
+			controller.requestLogger(req).WithError(err).WithField("cache-key", oldCacheKey).Error("Error while attempting to delete stored response with outdated secondary key")
+		}
+	}
+}
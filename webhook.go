@@ -0,0 +1,180 @@
+package sharedhttpcache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//InvalidationSignatureHeader is the request header which contains the signature of a invalidation message,
+	// "sha256=" followed by the hex encoded HMAC-SHA256 of the body with the shared secret
+	InvalidationSignatureHeader = "X-Signature"
+
+	//maxInvalidationMessageSize is the maximum size of the body of a invalidation message in bytes
+	maxInvalidationMessageSize = 1024 * 1024
+
+	//maxInvalidationMessageAge is the maximum difference between the timestamp of a invalidation message and the current time,
+	// so a captured message can't be replayed later
+	maxInvalidationMessageAge = 5 * time.Minute
+)
+
+//InvalidationMessage is sent by a origin to the InvalidationWebhook after content changed
+type InvalidationMessage struct {
+	//Tenant is the tenant to which the purged responses belong, empty if tenants are not used.
+	// The message must be signed with the secret of the tenant
+	Tenant string `json:"tenant,omitempty"`
+
+	//URLs are absolute URLs of resources which are purged
+	URLs []string `json:"urls,omitempty"`
+
+	//Prefixes are absolute URL prefixes of which all resources are purged
+	Prefixes []string `json:"prefixes,omitempty"`
+
+	//Tags are tags of which all responses are purged, see CacheTagHeaders
+	Tags []string `json:"tags,omitempty"`
+
+	//Timestamp is the unix time at which the message was sent
+	Timestamp int64 `json:"timestamp"`
+}
+
+//purges returns the purges requested by the message
+func (message *InvalidationMessage) purges() []Purge {
+	purges := make([]Purge, 0, len(message.URLs)+len(message.Prefixes)+len(message.Tags))
+
+	for _, url := range message.URLs {
+		purges = append(purges, Purge{Tenant: message.Tenant, URL: url})
+	}
+
+	for _, prefix := range message.Prefixes {
+		purges = append(purges, Purge{Tenant: message.Tenant, Prefix: prefix})
+	}
+
+	for _, tag := range message.Tags {
+		purges = append(purges, Purge{Tenant: message.Tenant, Tag: tag})
+	}
+
+	return purges
+}
+
+//InvalidationWebhook is a http.Handler which accepts signed invalidation messages from origins,
+// so applications can purge content right after it changed instead of waiting for it to expire.
+// The purges are propagated to the other instances of the cluster like purges issued with CacheController.Purge
+type InvalidationWebhook struct {
+	controller *CacheController
+
+	//secrets are the secrets of the tenants, a message is only accepted if it is signed with the secret of its tenant
+	secrets map[string][]byte
+}
+
+//NewInvalidationWebhook creates a InvalidationWebhook which accepts messages signed with the secret.
+// The messages can't contain a tenant, use NewTenantInvalidationWebhook if tenants are used
+func NewInvalidationWebhook(controller *CacheController, secret string) *InvalidationWebhook {
+	return NewTenantInvalidationWebhook(controller, map[string]string{"": secret})
+}
+
+//NewTenantInvalidationWebhook creates a InvalidationWebhook with a secret per tenant ID.
+// A message is only accepted if it is signed with the secret of its tenant, so a tenant can't purge the responses of other tenants.
+// The secret of the empty tenant is used for messages without tenant
+func NewTenantInvalidationWebhook(controller *CacheController, secrets map[string]string) *InvalidationWebhook {
+	webhook := &InvalidationWebhook{
+		controller: controller,
+		secrets:    make(map[string][]byte, len(secrets)),
+	}
+
+	for tenant, secret := range secrets {
+		//A empty secret accepts nothing, unsigned messages would allow anyone to empty the cache
+		if secret != "" {
+			webhook.secrets[tenant] = []byte(secret)
+		}
+	}
+
+	return webhook
+}
+
+//SignInvalidationMessage returns the value of the InvalidationSignatureHeader for the body of a message
+func SignInvalidationMessage(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (webhook *InvalidationWebhook) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, maxInvalidationMessageSize))
+	if err != nil {
+		http.Error(resp, "Unable to read message", http.StatusBadRequest)
+		return
+	}
+
+	message := InvalidationMessage{}
+	if err := json.Unmarshal(body, &message); err != nil {
+		http.Error(resp, "Invalid message", http.StatusBadRequest)
+		return
+	}
+
+	//The message is verified with the secret of its tenant, so a message signed by one tenant can't name another tenant.
+	// A tenant without secret accepts nothing
+	secret, found := webhook.secrets[message.Tenant]
+	signature := req.Header.Get(InvalidationSignatureHeader)
+	if !found || !hmac.Equal([]byte(signature), []byte(SignInvalidationMessage(body, string(secret)))) {
+		http.Error(resp, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	age := time.Since(time.Unix(message.Timestamp, 0))
+	if age > maxInvalidationMessageAge || age < -maxInvalidationMessageAge {
+		http.Error(resp, "Message expired", http.StatusBadRequest)
+		return
+	}
+
+	purges := message.purges()
+
+	//The whole message is rejected if one of the URLs is invalid, so it is never applied partially
+	for _, purge := range purges {
+		if purge.Tag != "" {
+			continue
+		}
+
+		if _, err := purgeEffectiveURI(webhook.controller.DefaultCacheConfig, purge.target()); err != nil {
+			http.Error(resp, "Invalid URL '"+purge.target()+"'", http.StatusBadRequest)
+			return
+		}
+	}
+
+	webhook.controller.initOnce.Do(webhook.controller.initialize)
+
+	failed := []string{}
+	for _, purge := range purges {
+		err := webhook.controller.Purge(purge)
+		if err == nil {
+			continue
+		}
+
+		webhook.controller.Logger.WithError(err).WithFields(logrus.Fields{
+			"origin": req.RemoteAddr,
+			"purge":  purge,
+		}).Error("Error while applying invalidation from origin")
+
+		failed = append(failed, purge.target())
+	}
+
+	if len(failed) > 0 {
+		http.Error(resp, "Unable to purge: "+strings.Join(failed, ", "), http.StatusInternalServerError)
+		return
+	}
+
+	resp.WriteHeader(http.StatusNoContent)
+}
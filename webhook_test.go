@@ -0,0 +1,186 @@
+package sharedhttpcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInvalidationWebhook(t *testing.T) {
+	originRequests := map[string]int{}
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests[req.URL.Path]++
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		if req.URL.Path == "/tagged" {
+			rw.Header().Set("Cache-Tag", "product-1, product-2")
+		}
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	paths := []string{"/page", "/blog/post", "/tagged", "/other"}
+	requestAll := func() {
+		for _, path := range paths {
+			doTestRequest(t, controller, httptest.NewRequest(http.MethodGet, "http://"+host+path, nil))
+		}
+	}
+
+	requestAll()
+
+	webhook := NewInvalidationWebhook(controller, "secret")
+	send := func(message InvalidationMessage, secret string) int {
+		body, err := json.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/invalidate", bytes.NewReader(body))
+		req.Header.Set(InvalidationSignatureHeader, SignInvalidationMessage(body, secret))
+
+		recorder := httptest.NewRecorder()
+		webhook.ServeHTTP(recorder, req)
+
+		return recorder.Code
+	}
+
+	message := InvalidationMessage{
+		URLs:      []string{"http://" + host + "/page"},
+		Prefixes:  []string{"http://" + host + "/blog/"},
+		Tags:      []string{"product-2"},
+		Timestamp: time.Now().Unix(),
+	}
+
+	if status := send(message, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("expected message with wrong signature to be rejected, got status %d", status)
+	}
+
+	expired := message
+	expired.Timestamp = time.Now().Add(-time.Hour).Unix()
+	if status := send(expired, "secret"); status != http.StatusBadRequest {
+		t.Errorf("expected expired message to be rejected, got status %d", status)
+	}
+
+	invalid := message
+	invalid.URLs = []string{"/relative"}
+	if status := send(invalid, "secret"); status != http.StatusBadRequest {
+		t.Errorf("expected message with relative URL to be rejected, got status %d", status)
+	}
+
+	requestAll()
+	for _, path := range paths {
+		if originRequests[path] != 1 {
+			t.Fatalf("expected rejected messages not to purge %s, got %d origin requests", path, originRequests[path])
+		}
+	}
+
+	if status := send(message, "secret"); status != http.StatusNoContent {
+		t.Fatalf("expected message to be accepted, got status %d", status)
+	}
+
+	//Responses stored in the same second as the purge are considered stored before it, so the next second is awaited
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	requestAll()
+	requestAll()
+
+	for path, expected := range map[string]int{"/page": 2, "/blog/post": 2, "/tagged": 2, "/other": 1} {
+		if originRequests[path] != expected {
+			t.Errorf("%s: expected %d origin requests, got %d", path, expected, originRequests[path])
+		}
+	}
+}
+
+func TestTenantInvalidationWebhook(t *testing.T) {
+	originRequests := map[string]int{}
+	controller, host, closeOrigin := newTestController(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originRequests[req.Header.Get("X-Tenant")]++
+
+		rw.Header().Set(CacheControlHeader, "max-age=3600")
+		_, _ = rw.Write([]byte("content"))
+	}))
+	defer closeOrigin()
+
+	controller.TenantResolver = TenantFromHeader("X-Tenant")
+
+	tenants := []string{"acme", "globex"}
+	requestAll := func() {
+		for _, tenant := range tenants {
+			req := httptest.NewRequest(http.MethodGet, "http://"+host+"/page", nil)
+			req.Header.Set("X-Tenant", tenant)
+
+			doTestRequest(t, controller, req)
+		}
+	}
+
+	requestAll()
+
+	webhook := NewTenantInvalidationWebhook(controller, map[string]string{
+		"acme":   "acme-secret",
+		"globex": "globex-secret",
+	})
+	send := func(message InvalidationMessage, secret string) int {
+		body, err := json.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/invalidate", bytes.NewReader(body))
+		req.Header.Set(InvalidationSignatureHeader, SignInvalidationMessage(body, secret))
+
+		recorder := httptest.NewRecorder()
+		webhook.ServeHTTP(recorder, req)
+
+		return recorder.Code
+	}
+
+	//A message signed by acme which names globex is refused
+	crossTenant := InvalidationMessage{
+		Tenant:    "globex",
+		URLs:      []string{"http://" + host + "/page"},
+		Timestamp: time.Now().Unix(),
+	}
+	if status := send(crossTenant, "acme-secret"); status != http.StatusUnauthorized {
+		t.Errorf("expected a cross tenant purge to be refused, got status %d", status)
+	}
+
+	//There is no secret for messages without tenant
+	noTenant := crossTenant
+	noTenant.Tenant = ""
+	if status := send(noTenant, "acme-secret"); status != http.StatusUnauthorized {
+		t.Errorf("expected a message without tenant to be refused, got status %d", status)
+	}
+
+	ownTenant := crossTenant
+	ownTenant.Tenant = "acme"
+	if status := send(ownTenant, "acme-secret"); status != http.StatusNoContent {
+		t.Fatalf("expected a purge of the own tenant to be accepted, got status %d", status)
+	}
+
+	//Responses stored in the same second as the purge are considered stored before it, so the next second is awaited
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	requestAll()
+
+	for tenant, expected := range map[string]int{"acme": 2, "globex": 1} {
+		if originRequests[tenant] != expected {
+			t.Errorf("%s: expected %d origin requests, got %d", tenant, expected, originRequests[tenant])
+		}
+	}
+}
+
+func TestHasCacheTag(t *testing.T) {
+	header := http.Header{}
+	header.Set("Surrogate-Key", "a b")
+	header.Set("Cache-Tag", "c,d")
+
+	for tag, expected := range map[string]bool{"a": true, "b": true, "c": true, "d": true, "e": false, "a b": false} {
+		if found := hasCacheTag(header, tag); found != expected {
+			t.Errorf("tag %s: expected %s, got %s", tag, strconv.FormatBool(expected), strconv.FormatBool(found))
+		}
+	}
+}